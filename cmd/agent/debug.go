@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"go-musthave-devops-trainer/internal/agent"
+	"go-musthave-devops-trainer/internal/logger"
+)
+
+// newDebugHandler отладочные ручки агента:
+//
+//	POST /debug/pause  - приостановить сбор и отправку метрик;
+//	POST /debug/resume - возобновить их;
+//	GET  /debug/status - текущее состояние.
+//
+// Авторизации нет, поэтому слушать стоит только локальный адрес.
+func newDebugHandler(scope agent.ReportableScope) http.Handler {
+	mux := http.NewServeMux()
+	status := func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Paused         bool   `json:"paused"`
+			ReportInterval string `json:"report_interval"`
+			ReportPanics   int64  `json:"report_panics"`
+		}{
+			Paused:         scope.Paused(),
+			ReportInterval: scope.ReportInterval().String(),
+			ReportPanics:   scope.ReportPanics(),
+		})
+	}
+	control := func(f func(), action string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			f()
+			logger.Infof("client: collection %s via debug endpoint", action)
+			status(w)
+		}
+	}
+	mux.HandleFunc("/debug/pause", control(scope.Pause, "paused"))
+	mux.HandleFunc("/debug/resume", control(scope.Resume, "resumed"))
+	mux.HandleFunc("/debug/status", func(w http.ResponseWriter, r *http.Request) {
+		status(w)
+	})
+	return mux
+}
+
+// runDebugServer запускает отладочный сервер, возвращает функцию его остановки.
+func runDebugServer(address string, scope agent.ReportableScope) (func(), error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen debug address %s: %w", address, err)
+	}
+	srv := &http.Server{Handler: newDebugHandler(scope)}
+	go func() {
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Errorf("client: debug server: %v", err)
+		}
+	}()
+	logger.Infof("client: debug endpoint listens on %s", listener.Addr())
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}, nil
+}
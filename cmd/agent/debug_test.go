@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"go-musthave-devops-trainer/internal/agent"
+)
+
+type countReporter struct {
+	sync.Mutex
+	counters map[string]int64
+}
+
+func (r *countReporter) ReportCounter(name string, tags map[string]string, delta int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.counters[name] += delta
+}
+
+func (r *countReporter) ReportGauge(name string, tags map[string]string, value float64) {}
+
+func (r *countReporter) ReportIntGauge(name string, tags map[string]string, value int64) {}
+
+func (r *countReporter) Flush() {}
+
+func (r *countReporter) counter(name string) int64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.counters[name]
+}
+
+func TestDebugPauseResume(t *testing.T) {
+	r := &countReporter{counters: make(map[string]int64)}
+	s, closer := agent.NewRootScope(agent.ScopeOptions{Reporter: r}, 0)
+	defer closer.Close()
+	scope := s.(agent.ReportableScope)
+
+	srv := httptest.NewServer(newDebugHandler(scope))
+	defer srv.Close()
+	post := func(path string) bool {
+		t.Helper()
+		resp, err := srv.Client().Post(srv.URL+path, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var status struct {
+			Paused bool `json:"paused"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return status.Paused
+	}
+
+	if !post("/debug/pause") || !scope.Paused() {
+		t.Fatal("agent must be paused")
+	}
+	resp, err := srv.Client().Get(srv.URL + "/debug/pause")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET must not change state, got %d", resp.StatusCode)
+	}
+
+	// Во время паузы монитор не обновляет метрики.
+	defer runMemMonitor(context.Background(), scope, time.Millisecond)()
+	time.Sleep(20 * time.Millisecond)
+	scope.Report()
+	if got := r.counter("PollCount"); got != 0 {
+		t.Errorf("no polls expected while paused, got %d", got)
+	}
+
+	if post("/debug/resume") || scope.Paused() {
+		t.Fatal("agent must be resumed")
+	}
+	time.Sleep(20 * time.Millisecond)
+	scope.Report()
+	if got := r.counter("PollCount"); got == 0 {
+		t.Error("polls expected after resume")
+	}
+}
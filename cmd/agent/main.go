@@ -1,171 +1,351 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"math"
 	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"syscall"
 	"time"
 
 	"go-musthave-devops-trainer/internal/agent"
+	"go-musthave-devops-trainer/internal/h3"
+	"go-musthave-devops-trainer/internal/logger"
 	"go-musthave-devops-trainer/internal/misc"
-	"go-musthave-devops-trainer/models"
+	"go-musthave-devops-trainer/internal/sign"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/mem"
 )
 
 const (
 	defaultAddress        = "localhost:8080"
 	defaultReportInterval = 10 * time.Second
 	defaultPollInterval   = 2 * time.Second
+	// defaultShutdownTimeout сколько ждать текущую отправку при завершении.
+	defaultShutdownTimeout = 5 * time.Second
 )
 
 type config struct {
 	address        string
 	reportInterval time.Duration
 	pollInterval   time.Duration
+	shutdown       time.Duration
 	key            string
+	hashExempt     string
+	dualWrite      bool
+	binary         bool
+	http3          bool
+	compress       bool
+	sequence       bool
+	batchSize      int
+	retry          string
+	updatesMethod  string
+	updatesPath    string
+	instance       string
+	debugAddress   string
+	sources        string
+	logLevel       string
+	logFormat      string
+	printConfig    bool
+	stdin          bool
 }
 
 func main() {
 	c := config{}
 
-	flag.StringVar(&c.address, "a", defaultAddress, "address <<HOST:PORT>>")
+	flag.StringVar(&c.address, "a", defaultAddress, "address <<HOST:PORT>> or <<unix:/path/to.sock>>")
 	flag.DurationVar(&c.reportInterval, "r", defaultReportInterval, "report interval")
 	flag.DurationVar(&c.pollInterval, "p", defaultPollInterval, "poll interval")
+	flag.DurationVar(&c.shutdown, "s", defaultShutdownTimeout, "timeout for the last report on shutdown, in-flight report is cancelled after it (0 - no limit)")
 	flag.StringVar(&c.key, "k", "", "key for sha256")
+	flag.StringVar(&c.hashExempt, "hash-exempt", "", "comma-separated prefixes of metrics sent without hash (their values can be forged)")
+	flag.BoolVar(&c.dualWrite, "dual-write", false, "send metrics by legacy API in addition to /updates/")
+	flag.BoolVar(&c.binary, "binary", false, "send batches in compact binary format instead of JSON")
+	flag.BoolVar(&c.http3, "http3", false, "experimental: send metrics over HTTP/3 (QUIC) with TLS, the agent must be built with -tags http3")
+	flag.BoolVar(&c.compress, "compress", true, "compress batches with gzip (false - send uncompressed)")
+	flag.BoolVar(&c.sequence, "sequence", false, "number batches, so the server can detect lost ones")
+	flag.IntVar(&c.batchSize, "b", 0, "max number of metrics in one request, larger batches are split (0 - unlimited)")
+	flag.StringVar(&c.retry, "retry", defaultRetry, "comma-separated intervals between retries of a batch on connection errors and 503 responses, a longer Retry-After of the server is respected (empty - no retries)")
+	flag.StringVar(&c.updatesMethod, "updates-method", http.MethodPost, "HTTP method for sending batches")
+	flag.StringVar(&c.updatesPath, "updates-path", defaultUpdatesPath, "server path for sending batches")
+	flag.StringVar(&c.instance, "instance", "", "tag reported metrics with this instance and the hostname, tagged metrics are stored apart from plain ones (empty - no tags)")
+	flag.StringVar(&c.debugAddress, "debug-address", "", "address of debug endpoint to pause/resume collection, without auth, keep it local (disabled by default)")
+	flag.StringVar(&c.sources, "sources", "", "comma-separated additional metric sources <<kind:arg>>, e.g. file:/path/to/gauges (kinds: "+strings.Join(agent.SourceKinds(), ", ")+")")
+	flag.StringVar(&c.logLevel, "log-level", "info", "log level: debug, info, warn, error")
+	flag.StringVar(&c.logFormat, "log-format", logger.FormatText, "log format: text, json")
+	flag.BoolVar(&c.printConfig, "print-config", false, "print effective config and exit")
+	flag.BoolVar(&c.stdin, "stdin", false, "send metrics read from stdin as <<name:type:value>> lines and exit")
 
 	flag.Parse()
 
 	c = config{
 		address:        misc.GetEnvStr("ADDRESS", c.address),
-		reportInterval: misc.GetEnvSeconds("REPORT_INTERVAL", c.reportInterval),
-		pollInterval:   misc.GetEnvSeconds("POLL_INTERVAL", c.pollInterval),
+		reportInterval: misc.GetEnvDuration("REPORT_INTERVAL", c.reportInterval),
+		pollInterval:   misc.GetEnvDuration("POLL_INTERVAL", c.pollInterval),
+		shutdown:       misc.GetEnvDuration("SHUTDOWN_TIMEOUT", c.shutdown),
 		key:            misc.GetEnvStr("KEY", c.key),
+		hashExempt:     misc.GetEnvStr("HASH_EXEMPT", c.hashExempt),
+		dualWrite:      misc.GetEnvBool("DUAL_WRITE", c.dualWrite),
+		binary:         misc.GetEnvBool("BINARY", c.binary),
+		http3:          misc.GetEnvBool("HTTP3", c.http3),
+		compress:       misc.GetEnvBool("COMPRESS", c.compress),
+		sequence:       misc.GetEnvBool("SEQUENCE", c.sequence),
+		batchSize:      misc.GetEnvInt("BATCH_SIZE", c.batchSize),
+		retry:          misc.GetEnvStr("RETRY", c.retry),
+		updatesMethod:  misc.GetEnvStr("UPDATES_METHOD", c.updatesMethod),
+		updatesPath:    misc.GetEnvStr("UPDATES_PATH", c.updatesPath),
+		instance:       misc.GetEnvStr("INSTANCE", c.instance),
+		debugAddress:   misc.GetEnvStr("DEBUG_ADDRESS", c.debugAddress),
+		sources:        misc.GetEnvStr("SOURCES", c.sources),
+		logLevel:       misc.GetEnvStr("LOG_LEVEL", c.logLevel),
+		logFormat:      misc.GetEnvStr("LOG_FORMAT", c.logFormat),
+		printConfig:    c.printConfig,
+		stdin:          c.stdin,
 	}
-	if err := c.Run(); err != nil {
-		log.Fatalln("client:", err)
+
+	if c.printConfig {
+		if err := c.Print(os.Stdout); err != nil {
+			logger.Fatalf("client: %v", err)
+		}
+		return
 	}
-	log.Println("client: done")
+
+	if err := logger.Setup(c.logLevel, c.logFormat); err != nil {
+		logger.Fatalf("client: %v", err)
+	}
+	if c.stdin {
+		if err := c.RunStdin(os.Stdin); err != nil {
+			logger.Fatalf("client: %v", err)
+		}
+		return
+	}
+	if err := c.Run(context.Background()); err != nil {
+		logger.Fatalf("client: %v", err)
+	}
+	logger.Infof("client: done")
+}
+
+// Print выводит итоговую конфигурацию в формате JSON, ключ скрывается.
+func (c *config) Print(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Address        string `json:"address"`
+		ReportInterval string `json:"report_interval"`
+		PollInterval   string `json:"poll_interval"`
+		Shutdown       string `json:"shutdown_timeout"`
+		Key            string `json:"key"`
+		HashExempt     string `json:"hash_exempt"`
+		DualWrite      bool   `json:"dual_write"`
+		Binary         bool   `json:"binary"`
+		HTTP3          bool   `json:"http3"`
+		Compress       bool   `json:"compress"`
+		Sequence       bool   `json:"sequence"`
+		BatchSize      int    `json:"batch_size"`
+		Retry          string `json:"retry"`
+		UpdatesMethod  string `json:"updates_method"`
+		UpdatesPath    string `json:"updates_path"`
+		Instance       string `json:"instance"`
+		DebugAddress   string `json:"debug_address"`
+		Sources        string `json:"sources"`
+		LogLevel       string `json:"log_level"`
+		LogFormat      string `json:"log_format"`
+	}{
+		Address:        c.address,
+		ReportInterval: c.reportInterval.String(),
+		PollInterval:   c.pollInterval.String(),
+		Shutdown:       c.shutdown.String(),
+		Key:            misc.Redact(c.key),
+		HashExempt:     c.hashExempt,
+		DualWrite:      c.dualWrite,
+		Binary:         c.binary,
+		HTTP3:          c.http3,
+		Compress:       c.compress,
+		Sequence:       c.sequence,
+		BatchSize:      c.batchSize,
+		Retry:          c.retry,
+		UpdatesMethod:  c.updatesMethod,
+		UpdatesPath:    c.updatesPath,
+		Instance:       c.instance,
+		DebugAddress:   c.debugAddress,
+		Sources:        c.sources,
+		LogLevel:       c.logLevel,
+		LogFormat:      c.logFormat,
+	})
 }
 
-func (c *config) Run() error {
-	log.Println("client: starting...")
-	ctx, cancel := context.WithCancel(context.Background())
+func (c *config) Run(ctx context.Context) error {
+	logger.Infof("client: starting...")
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	// Обрабатывем сигналы от системы.
 	termSignal := make(chan os.Signal, 1)
 	signal.Notify(termSignal, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
 
+	retry, err := parseRetry(c.retry)
+	if err != nil {
+		return err
+	}
+	sources, err := parseSources(c.sources)
+	if err != nil {
+		return err
+	}
+	var transport http.RoundTripper
+	if c.http3 {
+		if network, _ := misc.SplitAddress(c.address); network == "unix" {
+			return errors.New("HTTP/3 is not supported over unix socket")
+		}
+		if transport, err = h3.NewRoundTripper(nil); err != nil {
+			return err
+		}
+	}
+
 	// Регистируем простейший обработчик для выгрузки репортов.
-	scopeOpt := agent.ScopeOptions{Reporter: NewReporter(c.address, c.key)}
+	// Отправка идет через очередь, что бы медленный сервер не задерживал сбор.
+	reporter := newQueuedReporter(NewReporter(c.address, c.key,
+		WithDualWrite(c.dualWrite),
+		WithBinary(c.binary),
+		WithHTTP3(transport),
+		WithCompress(c.compress),
+		WithSequence(c.sequence),
+		WithBatchSize(c.batchSize),
+		WithRetry(retry...),
+		WithEndpoint(c.updatesMethod, c.updatesPath),
+		WithHashExempt(sign.ParseExempt(c.hashExempt))), defaultQueueSize)
+	scopeOpt := agent.ScopeOptions{
+		Tags:         c.scopeTags(),
+		Reporter:     reporter,
+		CloseTimeout: c.shutdown,
+	}
 	scope, closer := agent.NewRootScope(scopeOpt, c.reportInterval)
 	defer closer.Close()
 
 	// Запускаем процесс мониторинга с заданным интервалом.
-	cancel = runMemMonitor(ctx, scope, c.pollInterval)
-	defer cancel()
+	stopMonitor := runMemMonitor(ctx, scope, c.pollInterval)
+	defer stopMonitor()
+	stopSystemMonitor := runSystemMonitor(ctx, scope, c.pollInterval)
+	defer stopSystemMonitor()
+	if len(sources) > 0 {
+		stopSources := runSources(ctx, scope, sources, c.pollInterval)
+		defer stopSources()
+	}
+
+	if c.debugAddress != "" {
+		stop, err := runDebugServer(c.debugAddress, scope.(agent.ReportableScope))
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
 
 	// Ожидаем формирование условий, для завершения приложения.
-	sig := <-termSignal
-	log.Println("client: finished, reason:", sig.String())
+	select {
+	case sig := <-termSignal:
+		logger.Infof("client: finished, reason: %s", sig.String())
+	case <-ctx.Done():
+		logger.Infof("client: finished, reason: %s", ctx.Err().Error())
+	}
+	// Финальная отправка выполняется в closer.Close после остановки сбора,
+	// что бы попали и значения последнего опроса. Пачки этой отправки
+	// не должны отбрасываться из-за очереди, занятой предыдущими.
+	reporter.Drain()
 	return nil
 }
 
-type simpleReporter struct {
-	address      string
-	client       *http.Client
-	counterFlush int
-	key          []byte
-	metrics      []models.Metrics
-}
-
-func NewReporter(address, key string) agent.StatsReporter {
-	return &simpleReporter{
-		address: "http://" + address + "/updates/",
-		client:  &http.Client{},
-		key:     []byte(key),
+// parseRetry разбирает список интервалов повторов вида "1s,3s,5s",
+// пустая строка отключает повторы.
+func parseRetry(s string) ([]time.Duration, error) {
+	var intervals []time.Duration
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		d, err := time.ParseDuration(part)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("wrong retry interval: %q", part)
+		}
+		intervals = append(intervals, d)
 	}
+	return intervals, nil
 }
 
-// simpleReporter реализация тривиального варианта репортера.
-func (r *simpleReporter) ReportCounter(name string, tags map[string]string, delta int64) {
-	data := fmt.Sprintf("%s:%s:%d", name, models.Counter, delta)
-	// Накапливаем данные для последующей отправки пачкой
-	r.metrics = append(r.metrics, models.Metrics{
-		ID:    name,
-		MType: models.Counter,
-		Delta: &delta,
-		Hash:  r.hash(data),
-	})
-}
-
-func (r *simpleReporter) ReportGauge(name string, tags map[string]string, value float64) {
-	data := fmt.Sprintf("%s:%s:%f", name, models.Gauge, value)
-	// Накапливаем данные для последующей отправки пачкой
-	r.metrics = append(r.metrics, models.Metrics{
-		ID:    name,
-		MType: models.Gauge,
-		Value: &value,
-		Hash:  r.hash(data),
-	})
+// parseSources создает дополнительные источники метрик по списку
+// описаний вида "file:/path/a,file:/path/b".
+func parseSources(s string) ([]agent.MetricSource, error) {
+	var sources []agent.MetricSource
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		src, err := agent.NewSource(spec)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
 }
 
-func (r *simpleReporter) Flush() {
-	r.counterFlush++
-	log.Printf("reporter: flush, count: %d\n", r.counterFlush)
-	// Отправляем ранее накопление данные
-	metrics := r.metrics
-	r.metrics = r.metrics[:0] // в случае проблем, буфер все равно отчищаем.
-	jsonBody, err := json.Marshal(metrics)
-	if err != nil {
-		panic(err)
+// scopeTags теги, которыми помечаются все метрики агента. Без -instance
+// метрики не помечаются: сервер хранит помеченные отдельно от обычных,
+// и они не были бы доступны по своим именам в /value/.
+func (c *config) scopeTags() map[string]string {
+	if c.instance == "" {
+		return nil
 	}
-	resp, err := r.client.Post(r.address, "application/json", bytes.NewReader(jsonBody))
+	host, err := os.Hostname()
 	if err != nil {
-		log.Println("reporter: ", err)
-		return
+		logger.Warnf("client: cannot get hostname: %v", err)
+		host = "unknown"
 	}
-	defer resp.Body.Close()
-	log.Printf("reporter: got response, status: %d, proto: %s, value: %s\n", resp.StatusCode, resp.Proto, jsonBody)
-}
-
-func (r *simpleReporter) hash(data string) string {
-	if len(r.key) == 0 {
-		return ""
+	return map[string]string{
+		"host":     host,
+		"instance": c.instance,
 	}
-
-	h := hmac.New(sha256.New, r.key)
-	h.Write([]byte(data))
-	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
 // runMemMonitor запускаем горутину по сбору метрик экспартируемых пакетом runtime.
-func runMemMonitor(ctx context.Context, scope agent.Scope, pollInterval time.Duration) context.CancelFunc {
+// Возвращаемая функция останавливает сбор и дожидается завершения горутины.
+func runMemMonitor(ctx context.Context, scope agent.Scope, pollInterval time.Duration) func() {
 	ctx, cancel := context.WithCancel(ctx)
-	go newMemMonitor(ctx, scope, pollInterval)
-	return cancel
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newMemMonitor(ctx, scope, pollInterval)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
 }
 
 func newMemMonitor(ctx context.Context, scope agent.Scope, pollInterval time.Duration) {
 	rPollCount := scope.Counter("PollCount")
 	rRandomValue := scope.Gauge("RandomValue") // Немного энтропии в данных (для примера дробного значения)
 
+	// Накопительные значения и время в наносекундах могут превышать 2^53
+	// (LastGC превышает всегда), поэтому отправляются как целочисленные
+	// датчики без потери точности: TotalAlloc, Lookups, Mallocs, Frees,
+	// LastGC, PauseTotalNs.
 	rAlloc := scope.Gauge("Alloc")
-	rTotalAlloc := scope.Gauge("TotalAlloc")
+	rTotalAlloc := scope.IntGauge("TotalAlloc")
 	rSys := scope.Gauge("Sys")
-	rLookups := scope.Gauge("Lookups")
-	rMallocs := scope.Gauge("Mallocs")
-	rFrees := scope.Gauge("Frees")
+	rLookups := scope.IntGauge("Lookups")
+	rMallocs := scope.IntGauge("Mallocs")
+	rFrees := scope.IntGauge("Frees")
 	rHeapAlloc := scope.Gauge("HeapAlloc")
 	rHeapSys := scope.Gauge("HeapSys")
 	rHeapIdle := scope.Gauge("HeapIdle")
@@ -182,8 +362,8 @@ func newMemMonitor(ctx context.Context, scope agent.Scope, pollInterval time.Dur
 	rGCSys := scope.Gauge("GCSys")
 	rOtherSys := scope.Gauge("OtherSys")
 	rNextGC := scope.Gauge("NextGC")
-	rLastGC := scope.Gauge("LastGC")
-	rPauseTotalNs := scope.Gauge("PauseTotalNs")
+	rLastGC := scope.IntGauge("LastGC")
+	rPauseTotalNs := scope.IntGauge("PauseTotalNs")
 	rNumGC := scope.Gauge("NumGC")
 	rNumForcedGC := scope.Gauge("NumForcedGC")
 	rGCCPUFraction := scope.Gauge("GCCPUFraction")
@@ -199,11 +379,15 @@ func newMemMonitor(ctx context.Context, scope agent.Scope, pollInterval time.Dur
 		select {
 		case <-ticker.C:
 		case <-ctx.Done():
-			log.Printf("monitor: teminate goroutine, reason: %s\n", ctx.Err())
+			logger.Infof("monitor: teminate goroutine, reason: %s\n", ctx.Err())
 			return
 		}
 
-		log.Printf("monitor: update metrics with interval: %s\n", pollInterval)
+		if rs, ok := scope.(agent.ReportableScope); ok && rs.Paused() {
+			logger.Debugf("monitor: paused, skip update\n")
+			continue
+		}
+		logger.Debugf("monitor: update metrics with interval: %s\n", pollInterval)
 		rPollCount.Inc(1)
 		rRandomValue.Update(rand.Float64() * 100)
 
@@ -214,16 +398,16 @@ func newMemMonitor(ctx context.Context, scope agent.Scope, pollInterval time.Dur
 		// Alloc is bytes of allocated heap objects.
 		rAlloc.Update(float64(rtm.Alloc))
 		// TotalAlloc is cumulative bytes allocated for heap objects.
-		rTotalAlloc.Update(float64(rtm.TotalAlloc))
+		rTotalAlloc.Update(rtm.TotalAlloc)
 		// Sys is the total bytes of memory obtained from the OS.
 		rSys.Update(float64(rtm.Sys))
 		// Lookups is the number of pointer lookups performed by the runtime.
-		rLookups.Update(float64(rtm.Lookups))
+		rLookups.Update(rtm.Lookups)
 		// Mallocs is the cumulative count of heap objects allocated.
 		// The number of live objects is Mallocs - Frees.
-		rMallocs.Update(float64(rtm.Mallocs))
+		rMallocs.Update(rtm.Mallocs)
 		// Frees is the cumulative count of heap objects freed.
-		rFrees.Update(float64(rtm.Frees))
+		rFrees.Update(rtm.Frees)
 
 		// Heap memory statistics.
 		// HeapAlloc is bytes of allocated heap objects.
@@ -267,10 +451,10 @@ func newMemMonitor(ctx context.Context, scope agent.Scope, pollInterval time.Dur
 		rNextGC.Update(float64(rtm.NextGC))
 		// LastGC is the time the last garbage collection finished, as
 		// nanoseconds since 1970 (the UNIX epoch).
-		rLastGC.Update(float64(rtm.LastGC))
+		rLastGC.Update(rtm.LastGC)
 		// PauseTotalNs is the cumulative nanoseconds in GC
 		// stop-the-world pauses since the program started.
-		rPauseTotalNs.Update(float64(rtm.PauseTotalNs))
+		rPauseTotalNs.Update(rtm.PauseTotalNs)
 		// NumGC is the number of completed GC cycles.
 		rNumGC.Update(float64(rtm.NumGC))
 		// NumForcedGC is the number of GC cycles that were forced by
@@ -281,3 +465,148 @@ func newMemMonitor(ctx context.Context, scope agent.Scope, pollInterval time.Dur
 		rGCCPUFraction.Update(float64(rtm.GCCPUFraction))
 	}
 }
+
+// runSystemMonitor запускает горутину по сбору метрик системы: памяти
+// и загрузки каждого ядра процессора (gopsutil). Остановка аналогична runMemMonitor.
+func runSystemMonitor(ctx context.Context, scope agent.Scope, pollInterval time.Duration) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newSystemMonitor(ctx, scope, pollInterval)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func newSystemMonitor(ctx context.Context, scope agent.Scope, pollInterval time.Duration) {
+	rTotalMemory := scope.Gauge("TotalMemory")
+	rFreeMemory := scope.Gauge("FreeMemory")
+
+	// Количество ядер определяется один раз, датчики CPUutilization1..N
+	// соответствуют ядрам, найденным при запуске.
+	prev, err := cpu.TimesWithContext(ctx, true)
+	if err != nil {
+		logger.Errorf("monitor: cannot read cpu times: %v", err)
+	}
+	rCPU := make([]agent.Gauge, len(prev))
+	for i := range rCPU {
+		rCPU[i] = scope.Gauge(fmt.Sprintf("CPUutilization%d", i+1))
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			logger.Infof("monitor: teminate system goroutine, reason: %s\n", ctx.Err())
+			return
+		}
+
+		if rs, ok := scope.(agent.ReportableScope); ok && rs.Paused() {
+			continue
+		}
+
+		if vm, err := mem.VirtualMemoryWithContext(ctx); err == nil {
+			rTotalMemory.Update(float64(vm.Total))
+			rFreeMemory.Update(float64(vm.Free))
+		} else {
+			logger.Errorf("monitor: cannot read memory stats: %v", err)
+		}
+
+		cur, err := cpu.TimesWithContext(ctx, true)
+		if err != nil {
+			logger.Errorf("monitor: cannot read cpu times: %v", err)
+			continue
+		}
+		for i, v := range cpuUtilization(prev, cur) {
+			if i < len(rCPU) {
+				rCPU[i].Update(v)
+			}
+		}
+		prev = cur
+	}
+}
+
+// cpuUtilization загрузка каждого ядра в процентах за время между
+// двумя чтениями счетчиков, а не с момента запуска системы.
+func cpuUtilization(prev, cur []cpu.TimesStat) []float64 {
+	n := len(cur)
+	if len(prev) < n {
+		n = len(prev)
+	}
+	util := make([]float64, n)
+	for i := 0; i < n; i++ {
+		total := cpuTotal(cur[i]) - cpuTotal(prev[i])
+		idle := (cur[i].Idle + cur[i].Iowait) - (prev[i].Idle + prev[i].Iowait)
+		if total <= 0 {
+			continue
+		}
+		util[i] = math.Max(0, math.Min(100, (total-idle)/total*100))
+	}
+	return util
+}
+
+// cpuTotal время ядра во всех состояниях, guest уже учтено в user.
+func cpuTotal(t cpu.TimesStat) float64 {
+	return t.User + t.System + t.Idle + t.Nice + t.Iowait + t.Irq + t.Softirq + t.Steal
+}
+
+// runSources запускает горутину опроса дополнительных источников метрик,
+// значения отправляются датчиками. Остановка аналогична runMemMonitor.
+func runSources(ctx context.Context, scope agent.Scope, sources []agent.MetricSource, pollInterval time.Duration) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newSourcesMonitor(ctx, scope, sources, pollInterval)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func newSourcesMonitor(ctx context.Context, scope agent.Scope, sources []agent.MetricSource, pollInterval time.Duration) {
+	// Набор датчиков источника может меняться, датчики создаются
+	// при первом появлении значения.
+	gauges := make(map[string]agent.Gauge)
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			logger.Infof("monitor: teminate sources goroutine, reason: %s\n", ctx.Err())
+			return
+		}
+
+		if rs, ok := scope.(agent.ReportableScope); ok && rs.Paused() {
+			continue
+		}
+		collectSources(ctx, scope, sources, gauges)
+	}
+}
+
+// collectSources опрашивает источники один раз. Значения, прочитанные
+// источником вместе с ошибкой, тоже отправляются.
+func collectSources(ctx context.Context, scope agent.Scope, sources []agent.MetricSource, gauges map[string]agent.Gauge) {
+	for _, src := range sources {
+		values, err := src.Collect(ctx)
+		if err != nil {
+			logger.Errorf("monitor: cannot collect metric source: %v", err)
+		}
+		for name, v := range values {
+			g, ok := gauges[name]
+			if !ok {
+				g = scope.Gauge(name)
+				gauges[name] = g
+			}
+			g.Update(v)
+		}
+	}
+}
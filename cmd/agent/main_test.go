@@ -1 +1,274 @@
 package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"go-musthave-devops-trainer/internal/agent"
+	"go-musthave-devops-trainer/models"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+)
+
+func TestPrintConfig(t *testing.T) {
+	c := config{
+		address:        "localhost:9090",
+		reportInterval: 10 * time.Second,
+		pollInterval:   2 * time.Second,
+		key:            "secret",
+		logLevel:       "info",
+		logFormat:      "text",
+	}
+
+	var buf bytes.Buffer
+	if err := c.Print(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"address":          "localhost:9090",
+		"report_interval":  "10s",
+		"poll_interval":    "2s",
+		"shutdown_timeout": "0s",
+		"key":              "[REDACTED]",
+		"hash_exempt":      "",
+		"dual_write":       false,
+		"binary":           false,
+		"http3":            false,
+		"compress":         false,
+		"sequence":         false,
+		"batch_size":       float64(0),
+		"retry":            "",
+		"updates_method":   "",
+		"updates_path":     "",
+		"instance":         "",
+		"debug_address":    "",
+		"sources":          "",
+		"log_level":        "info",
+		"log_format":       "text",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: want %v, got %v", k, v, got[k])
+		}
+	}
+
+	c.key = ""
+	buf.Reset()
+	if err := c.Print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(`"key": ""`)) {
+		t.Errorf("empty key must stay empty:\n%s", buf.String())
+	}
+}
+
+type tagsReporter struct {
+	tags map[string]map[string]string
+}
+
+func (r *tagsReporter) ReportCounter(name string, tags map[string]string, delta int64) {
+	r.tags[name] = tags
+}
+
+func (r *tagsReporter) ReportGauge(name string, tags map[string]string, value float64) {
+	r.tags[name] = tags
+}
+
+func (r *tagsReporter) ReportIntGauge(name string, tags map[string]string, value int64) {
+	r.tags[name] = tags
+}
+
+func (r *tagsReporter) Flush() {}
+
+func TestScopeTags(t *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		t.Skip(err)
+	}
+
+	for _, tt := range []struct {
+		instance string
+		want     map[string]string
+	}{
+		// По умолчанию метрики не помечаются.
+		{"", nil},
+		{"agent-1", map[string]string{"host": host, "instance": "agent-1"}},
+	} {
+		c := config{instance: tt.instance}
+		r := &tagsReporter{tags: make(map[string]map[string]string)}
+		scope, closer := agent.NewRootScope(agent.ScopeOptions{Tags: c.scopeTags(), Reporter: r}, 0)
+		scope.Counter("PollCount").Inc(1)
+		scope.Gauge("Alloc").Update(1)
+		closer.Close()
+
+		for _, name := range []string{"PollCount", "Alloc"} {
+			tags := r.tags[name]
+			if len(tags) == 0 && len(tt.want) == 0 {
+				continue
+			}
+			if !reflect.DeepEqual(tags, tt.want) {
+				t.Errorf("%s: want tags %v, got %v", name, tt.want, tags)
+			}
+		}
+	}
+}
+
+// TestRunDefaultServer запускает агент с настройками по умолчанию против
+// собранного сервера: метрики должны быть доступны по своим именам.
+func TestRunDefaultServer(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the server")
+	}
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "server")
+	build := exec.Command(filepath.Join(runtime.GOROOT(), "bin", "go"), "build", "-o", bin, "go-musthave-devops-trainer/cmd/server")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("cannot build server: %v\n%s", err, out)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	server := exec.Command(bin, "-a", addr, "-f", filepath.Join(dir, "db.json"), "-r=false")
+	server.Env = []string{}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Process.Kill()
+		server.Wait()
+	})
+
+	// Значения флагов по умолчанию, кроме адреса и интервалов.
+	c := config{
+		address:        addr,
+		reportInterval: 20 * time.Millisecond,
+		pollInterval:   10 * time.Millisecond,
+		shutdown:       defaultShutdownTimeout,
+		compress:       true,
+		retry:          defaultRetry,
+		updatesMethod:  http.MethodPost,
+		updatesPath:    defaultUpdatesPath,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	}()
+
+	var resp *http.Response
+	for i := 0; i < 100; i++ {
+		resp, err = http.Get("http://" + addr + "/value/gauge/Alloc")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("/value/gauge/Alloc: want 200, got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Post("http://"+addr+"/value/", "application/json", strings.NewReader(`{"id":"PollCount","type":"counter"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m models.Metrics
+	err = json.NewDecoder(resp.Body).Decode(&m)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || err != nil || m.Delta == nil || *m.Delta == 0 {
+		t.Errorf("/value/ PollCount: unexpected response %d %+v (%v)", resp.StatusCode, m, err)
+	}
+}
+
+func TestShutdownNoLeaks(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	r := &countReporter{counters: make(map[string]int64)}
+	scope, closer := agent.NewRootScope(agent.ScopeOptions{Reporter: newQueuedReporter(r, 0)}, time.Millisecond)
+	stopMonitor := runMemMonitor(context.Background(), scope, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	scope.(agent.ReportableScope).SetReportInterval(2 * time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	// Остановка дожидается завершения горутин, поэтому проверка
+	// выполняется сразу, без ожидания. Горутины предыдущих тестов
+	// могут завершиться за это время, поэтому допускается меньшее количество.
+	stopMonitor()
+	if err := closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		buf := make([]byte, 1<<16)
+		t.Fatalf("want %d goroutines after shutdown, got %d:\n%s", before, after, buf[:runtime.Stack(buf, true)])
+	}
+	if r.counter("PollCount") == 0 {
+		t.Error("polls expected before shutdown")
+	}
+}
+
+func TestCPUUtilization(t *testing.T) {
+	prev := []cpu.TimesStat{
+		{User: 100, System: 50, Idle: 1000},
+		{User: 10, Idle: 10},
+	}
+	cur := []cpu.TimesStat{
+		// За интервал: 30 из 40 секунд заняты, с запуска - около 15%.
+		{User: 120, System: 60, Idle: 1010},
+		// Счетчики не изменились.
+		{User: 10, Idle: 10},
+	}
+	got := cpuUtilization(prev, cur)
+	if len(got) != 2 || got[0] != 75 || got[1] != 0 {
+		t.Errorf("want [75 0], got %v", got)
+	}
+
+	// Ядро, пропавшее после запуска, не учитывается.
+	if got := cpuUtilization(prev, cur[:1]); len(got) != 1 {
+		t.Errorf("want 1 core, got %v", got)
+	}
+}
+
+func TestParseSources(t *testing.T) {
+	sources, err := parseSources(" file:/tmp/a, ,file:/tmp/b")
+	if err != nil || len(sources) != 2 {
+		t.Errorf("want 2 sources, got %d, %v", len(sources), err)
+	}
+	if sources, err := parseSources(""); err != nil || len(sources) != 0 {
+		t.Errorf("want no sources, got %d, %v", len(sources), err)
+	}
+	for _, s := range []string{"file", "file:", "exec:ls"} {
+		if _, err := parseSources(s); err == nil {
+			t.Errorf("%q: want error", s)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-musthave-devops-trainer/internal/agent"
+	"go-musthave-devops-trainer/internal/logger"
+)
+
+const (
+	// defaultQueueSize количество пачек, ожидающих отправки.
+	defaultQueueSize = 4
+	// droppedMetric счетчик метрик, отброшенных из-за переполнения очереди.
+	droppedMetric = "ReporterDropped"
+)
+
+type queuedKind int
+
+const (
+	queuedCounter queuedKind = iota
+	queuedGauge
+	queuedIntGauge
+)
+
+type queuedMetric struct {
+	kind  queuedKind
+	name  string
+	tags  map[string]string
+	delta int64
+	value float64
+	rate  float64
+	at    time.Time
+}
+
+// queuedBatch пачка и контекст ее отправки.
+type queuedBatch struct {
+	ctx     context.Context
+	metrics []queuedMetric
+}
+
+// queuedReporter отделяет сбор метрик от их отправки: Flush ставит
+// накопленную пачку в ограниченную очередь и сразу возвращается, пачки
+// отправляет отдельная горутина. Если отправка не успевает и очередь
+// заполнена, новая пачка отбрасывается, а количество отброшенных метрик
+// передается со следующей принятой пачкой счетчиком ReporterDropped.
+type queuedReporter struct {
+	// panics количество пачек, отправка которых прервана паникой.
+	// Первое поле, что бы атомарные операции были выровнены на 32-битных платформах.
+	panics int64
+
+	next    agent.StatsReporter
+	batch   []queuedMetric
+	queue   chan queuedBatch
+	done    chan struct{}
+	once    sync.Once
+	dropped int64
+	// unreported отброшенные метрики, еще не переданные в ReporterDropped.
+	unreported int64
+	// draining при завершении пачки не отбрасываются, см. Drain.
+	draining int32
+}
+
+var (
+	_ agent.TimedStatsReporter   = (*queuedReporter)(nil)
+	_ agent.SampledStatsReporter = (*queuedReporter)(nil)
+	_ agent.ContextFlusher       = (*queuedReporter)(nil)
+	_ agent.PanicCounter         = (*queuedReporter)(nil)
+)
+
+func newQueuedReporter(next agent.StatsReporter, size int) *queuedReporter {
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	q := &queuedReporter{
+		next:  next,
+		queue: make(chan queuedBatch, size),
+		done:  make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *queuedReporter) ReportCounter(name string, tags map[string]string, value int64) {
+	q.batch = append(q.batch, queuedMetric{kind: queuedCounter, name: name, tags: tags, delta: value})
+}
+
+func (q *queuedReporter) ReportGauge(name string, tags map[string]string, value float64) {
+	q.batch = append(q.batch, queuedMetric{kind: queuedGauge, name: name, tags: tags, value: value})
+}
+
+func (q *queuedReporter) ReportIntGauge(name string, tags map[string]string, value int64) {
+	q.batch = append(q.batch, queuedMetric{kind: queuedIntGauge, name: name, tags: tags, delta: value})
+}
+
+func (q *queuedReporter) ReportCounterAt(name string, tags map[string]string, value int64, at time.Time) {
+	q.batch = append(q.batch, queuedMetric{kind: queuedCounter, name: name, tags: tags, delta: value, at: at})
+}
+
+func (q *queuedReporter) ReportGaugeAt(name string, tags map[string]string, value float64, at time.Time) {
+	q.batch = append(q.batch, queuedMetric{kind: queuedGauge, name: name, tags: tags, value: value, at: at})
+}
+
+func (q *queuedReporter) ReportIntGaugeAt(name string, tags map[string]string, value int64, at time.Time) {
+	q.batch = append(q.batch, queuedMetric{kind: queuedIntGauge, name: name, tags: tags, delta: value, at: at})
+}
+
+func (q *queuedReporter) ReportSampledCounter(name string, tags map[string]string, value int64, rate float64, at time.Time) {
+	q.batch = append(q.batch, queuedMetric{kind: queuedCounter, name: name, tags: tags, delta: value, rate: rate, at: at})
+}
+
+// Flush ставит пачку в очередь, не дожидаясь отправки.
+func (q *queuedReporter) Flush() {
+	q.FlushContext(context.Background())
+}
+
+// FlushContext ставит пачку в очередь, ctx прерывает ее отправку,
+// если репортер, выполняющий отправку, это поддерживает.
+func (q *queuedReporter) FlushContext(ctx context.Context) {
+	batch := q.batch
+	q.batch = nil
+	if len(batch) == 0 {
+		return
+	}
+	if q.unreported > 0 {
+		batch = append(batch, queuedMetric{kind: queuedCounter, name: droppedMetric, delta: q.unreported})
+	}
+	b := queuedBatch{ctx: ctx, metrics: batch}
+	if atomic.LoadInt32(&q.draining) == 1 {
+		// Ожидание ограничено ctx, т.е. таймаутом завершения scope.
+		select {
+		case q.queue <- b:
+			q.unreported = 0
+			return
+		case <-ctx.Done():
+		}
+	}
+	select {
+	case q.queue <- b:
+		q.unreported = 0
+	default:
+		// Счетчик отброшенных метрик в пачке уже учтен в unreported.
+		n := int64(len(batch))
+		if q.unreported > 0 {
+			n--
+		}
+		q.unreported += n
+		atomic.AddInt64(&q.dropped, n)
+		logger.Warnf("reporter: queue is full, %d metrics dropped", n)
+	}
+}
+
+// Dropped общее количество отброшенных метрик.
+func (q *queuedReporter) Dropped() int64 {
+	return atomic.LoadInt64(&q.dropped)
+}
+
+// ReportPanics количество пачек, отправка которых прервана паникой репортера.
+func (q *queuedReporter) ReportPanics() int64 {
+	return atomic.LoadInt64(&q.panics)
+}
+
+// Drain переводит репортер в режим завершения: при заполненной очереди
+// FlushContext ожидает места в ней, а не отбрасывает пачку, что бы
+// финальная отправка при остановке агента не теряла метрики.
+func (q *queuedReporter) Drain() {
+	atomic.StoreInt32(&q.draining, 1)
+}
+
+// Close отправляет оставшиеся в очереди пачки и закрывает репортер.
+func (q *queuedReporter) Close() error {
+	q.Drain()
+	q.Flush()
+	q.once.Do(func() { close(q.queue) })
+	<-q.done
+	if closer, ok := q.next.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (q *queuedReporter) run() {
+	defer close(q.done)
+	for batch := range q.queue {
+		q.send(batch)
+	}
+}
+
+// send передает пачку репортеру и отправляет ее. Паника репортера прерывает
+// только эту пачку: горутина отправки продолжает работать, паника
+// записывается в лог и учитывается в ReportPanics.
+func (q *queuedReporter) send(batch queuedBatch) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&q.panics, 1)
+			logger.Errorf("reporter: send panicked: %v\n%s", r, debug.Stack())
+		}
+	}()
+	timed, _ := q.next.(agent.TimedStatsReporter)
+	sampled, _ := q.next.(agent.SampledStatsReporter)
+	flusher, _ := q.next.(agent.ContextFlusher)
+	for _, m := range batch.metrics {
+		if m.rate != 0 {
+			if sampled != nil {
+				sampled.ReportSampledCounter(m.name, m.tags, m.delta, m.rate, m.at)
+				continue
+			}
+			// Репортер без поддержки выборки получает оценку полного значения.
+			m.delta = int64(math.Round(float64(m.delta) / m.rate))
+		}
+		if timed != nil && !m.at.IsZero() {
+			switch m.kind {
+			case queuedCounter:
+				timed.ReportCounterAt(m.name, m.tags, m.delta, m.at)
+			case queuedGauge:
+				timed.ReportGaugeAt(m.name, m.tags, m.value, m.at)
+			case queuedIntGauge:
+				timed.ReportIntGaugeAt(m.name, m.tags, m.delta, m.at)
+			}
+			continue
+		}
+		switch m.kind {
+		case queuedCounter:
+			q.next.ReportCounter(m.name, m.tags, m.delta)
+		case queuedGauge:
+			q.next.ReportGauge(m.name, m.tags, m.value)
+		case queuedIntGauge:
+			q.next.ReportIntGauge(m.name, m.tags, m.delta)
+		}
+	}
+	if flusher != nil {
+		flusher.FlushContext(batch.ctx)
+		return
+	}
+	q.next.Flush()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"go-musthave-devops-trainer/internal/agent"
+)
+
+// slowReporter отправляет пачку только после разрешения теста.
+type slowReporter struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	release  chan struct{}
+	flushes  chan struct{}
+}
+
+func (r *slowReporter) ReportCounter(name string, tags map[string]string, value int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[name] += value
+}
+
+func (r *slowReporter) ReportGauge(name string, tags map[string]string, value float64) {}
+
+func (r *slowReporter) ReportIntGauge(name string, tags map[string]string, value int64) {}
+
+func (r *slowReporter) Flush() {
+	<-r.release
+	r.flushes <- struct{}{}
+}
+
+func TestQueuedReporterDrops(t *testing.T) {
+	r := &slowReporter{
+		counters: make(map[string]int64),
+		release:  make(chan struct{}),
+		flushes:  make(chan struct{}, 100),
+	}
+	const size = 2
+	q := newQueuedReporter(r, size)
+
+	report := func() {
+		q.ReportCounter("PollCount", nil, 1)
+		q.ReportGauge("Alloc", nil, 1)
+		q.Flush()
+	}
+	// Первая пачка забирается горутиной отправки и блокирует ее,
+	// следующие две заполняют очередь, остальные отбрасываются.
+	report()
+	for i := 0; i < 100 && len(q.queue) != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		report()
+	}
+	if got := len(q.queue); got != size {
+		t.Fatalf("queue must be bounded: want %d batches, got %d", size, got)
+	}
+	if got := q.Dropped(); got != 16 {
+		t.Fatalf("want 16 dropped metrics, got %d", got)
+	}
+
+	// После освобождения следующая пачка сообщает об отброшенных метриках.
+	close(r.release)
+	for i := 0; i < 1+size; i++ {
+		<-r.flushes
+	}
+	report()
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if got := r.counters[droppedMetric]; got != 16 {
+		t.Errorf("want %s=16, got %d", droppedMetric, got)
+	}
+	if got := r.counters["PollCount"]; got != 4 {
+		t.Errorf("want 4 delivered PollCount, got %d", got)
+	}
+}
+
+func TestQueuedReporterDrain(t *testing.T) {
+	r := &slowReporter{
+		counters: make(map[string]int64),
+		release:  make(chan struct{}),
+		flushes:  make(chan struct{}, 100),
+	}
+	q := newQueuedReporter(r, 1)
+
+	// Горутина отправки заблокирована, очередь заполнена.
+	q.ReportCounter("PollCount", nil, 1)
+	q.Flush()
+	for i := 0; i < 100 && len(q.queue) != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	q.ReportCounter("PollCount", nil, 1)
+	q.Flush()
+
+	// Финальные пачки при завершении ожидают места в очереди.
+	q.Drain()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(r.release)
+	}()
+	for i := 0; i < 3; i++ {
+		q.ReportCounter("PollCount", nil, 1)
+		q.Flush()
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := q.Dropped(); got != 0 {
+		t.Errorf("no metrics expected to be dropped on shutdown, got %d", got)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if got := r.counters["PollCount"]; got != 5 {
+		t.Errorf("want 5 delivered PollCount, got %d", got)
+	}
+}
+
+// panicReporter паникует при отправке первой пачки.
+type panicReporter struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	flushes  int
+}
+
+func (r *panicReporter) ReportCounter(name string, tags map[string]string, value int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[name] += value
+}
+
+func (r *panicReporter) ReportGauge(name string, tags map[string]string, value float64) {}
+
+func (r *panicReporter) ReportIntGauge(name string, tags map[string]string, value int64) {}
+
+func (r *panicReporter) Flush() {
+	r.mu.Lock()
+	r.flushes++
+	n := r.flushes
+	r.mu.Unlock()
+	if n == 1 {
+		panic("broken flush")
+	}
+}
+
+func TestQueuedReporterSurvivesPanic(t *testing.T) {
+	r := &panicReporter{counters: make(map[string]int64)}
+	scope, closer := agent.NewRootScope(agent.ScopeOptions{Reporter: newQueuedReporter(r, 0)}, 0)
+	rs := scope.(agent.ReportableScope)
+
+	// Паника в горутине очереди не завершает процесс,
+	// следующая пачка отправляется.
+	scope.Counter("PollCount").Inc(1)
+	rs.Report()
+	scope.Counter("PollCount").Inc(2)
+	rs.Report()
+	if err := closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.flushes != 2 || r.counters["PollCount"] != 3 {
+		t.Errorf("want 2 flushes and PollCount=3, got %d and %d", r.flushes, r.counters["PollCount"])
+	}
+	if got := rs.ReportPanics(); got != 1 {
+		t.Errorf("want 1 panic, got %d", got)
+	}
+}
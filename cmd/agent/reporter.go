@@ -0,0 +1,848 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-musthave-devops-trainer/internal/agent"
+	"go-musthave-devops-trainer/internal/compress"
+	"go-musthave-devops-trainer/internal/logger"
+	"go-musthave-devops-trainer/internal/misc"
+	"go-musthave-devops-trainer/internal/sign"
+	"go-musthave-devops-trainer/internal/wire"
+	"go-musthave-devops-trainer/models"
+)
+
+const (
+	// maxResponseBody ограничение на размер ответа сервера, попадающего в лог.
+	maxResponseBody = 4 << 10
+	// defaultMaxBuffer максимальное количество метрик в буфере отправки.
+	defaultMaxBuffer = 10000
+	// defaultUpdatesPath путь для отправки пачек метрик.
+	defaultUpdatesPath = "/updates/"
+	// defaultRetry интервалы повторов отправки пачки при ошибке соединения
+	// и ответе 503.
+	defaultRetry = "1s,3s,5s"
+	// maxRetryAfter ограничение на ожидание, запрошенное сервером в Retry-After.
+	maxRetryAfter = time.Minute
+	// maxConnAge после этого времени соединения с сервером открываются
+	// заново, с новым разрешением имени сервера.
+	maxConnAge = time.Minute
+)
+
+// permanentCodes коды отказа сервера, при которых повтор отправки
+// метрики бесполезен. Остальные отклоненные метрики отправляются повторно.
+var permanentCodes = map[string]bool{
+	"bad_request":   true,
+	"hash_mismatch": true,
+	"unknown_type":  true,
+}
+
+type simpleReporter struct {
+	// Базовый URL сервера, без пути.
+	address      string
+	method       string
+	path         string
+	legacyURL    string
+	client       *http.Client
+	counterFlush int
+	key          []byte
+	hashExempt   sign.Exempt
+	metrics      []models.Metrics
+	maxBuffer    int
+	dualWrite    bool
+	binary       bool
+	// Интервалы ожидания перед повторами отправки пачки.
+	retry []time.Duration
+	// Максимальное количество метрик в одном запросе, 0 - без ограничения.
+	batchSize int
+	// Алгоритм сжатия пачек, выбранный по заголовку Accept-Encoding
+	// ответов сервера, nil - пачки не сжимаются.
+	encoding compress.Codec
+	// noCompress отключает сжатие, в том числе выбранное по ответам сервера.
+	noCompress bool
+	// Идентификатор экземпляра и номер следующей пачки, см. WithSequence.
+	// Пустой идентификатор - пачки не нумеруются.
+	reporterID string
+	seq        uint64
+	// Ключ идемпотентности пачки, возвращенной в буфер, и ее размер:
+	// следующая отправка повторяет ее с тем же ключом.
+	replayKey string
+	replayLen int
+
+	// Разрешение имени сервера при открытии соединения, nil - системное.
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+	// Время, с которого используются текущие соединения, см. maxConnAge.
+	connSince time.Time
+
+	// flushMu не дает пачкам отправляться одновременно, mu защищает
+	// буфер, что бы метрики добавлялись и во время отправки.
+	flushMu sync.Mutex
+	mu      sync.Mutex
+
+	// Интервал собственной отправки буфера, 0 - только по вызову Flush.
+	autoFlush time.Duration
+	stop      chan struct{}
+	stopped   chan struct{}
+	stopOnce  sync.Once
+}
+
+type reporterOption func(*simpleReporter)
+
+// WithMaxBuffer ограничивает количество метрик, ожидающих отправки.
+func WithMaxBuffer(n int) reporterOption {
+	return func(r *simpleReporter) {
+		r.maxBuffer = n
+	}
+}
+
+// WithHashExempt метрики, отправляемые без подписи.
+func WithHashExempt(exempt sign.Exempt) reporterOption {
+	return func(r *simpleReporter) {
+		r.hashExempt = exempt
+	}
+}
+
+// WithDualWrite дополнительно отправляет каждую метрику по legacy API.
+// Временная мера на период миграции коллекторов на /updates/.
+func WithDualWrite(dualWrite bool) reporterOption {
+	return func(r *simpleReporter) {
+		r.dualWrite = dualWrite
+	}
+}
+
+// WithBinary отправляет пачки метрик в компактном двоичном формате
+// вместо JSON. Сервер должен поддерживать формат wire.
+func WithBinary(binary bool) reporterOption {
+	return func(r *simpleReporter) {
+		r.binary = binary
+	}
+}
+
+// WithHTTP3 отправляет метрики через транспорт HTTP/3 (QUIC) rt,
+// см. пакет h3. Сервер должен обслуживать HTTP/3 с TLS, поэтому запросы
+// идут по https. nil оставляет HTTP/1.1.
+func WithHTTP3(rt http.RoundTripper) reporterOption {
+	return func(r *simpleReporter) {
+		if rt == nil {
+			return
+		}
+		r.client.Transport = rt
+		r.address = "https://" + strings.TrimPrefix(r.address, "http://")
+		r.legacyURL = "https://" + strings.TrimPrefix(r.legacyURL, "http://")
+	}
+}
+
+// WithEndpoint метод и путь для отправки пачек, по умолчанию POST /updates/.
+// Пустые значения оставляют значения по умолчанию.
+func WithEndpoint(method, path string) reporterOption {
+	return func(r *simpleReporter) {
+		if method != "" {
+			r.method = strings.ToUpper(method)
+		}
+		if path != "" {
+			if !strings.HasPrefix(path, "/") {
+				path = "/" + path
+			}
+			r.path = path
+		}
+	}
+}
+
+// WithRetry повторяет отправку пачки при ошибке соединения
+// (например, во время перезапуска сервера) после каждого из интервалов.
+// Пачка, которую не удалось отправить, остается в буфере до следующей отправки.
+func WithRetry(intervals ...time.Duration) reporterOption {
+	return func(r *simpleReporter) {
+		r.retry = intervals
+	}
+}
+
+// WithBatchSize разбивает буфер на запросы не более чем по n метрик,
+// 0 - весь буфер одним запросом. Каждая метрика подписывается отдельно
+// при добавлении в буфер, поэтому разбиение подписи не меняет: части
+// проверяются сервером независимо, а метрики неотправленной части
+// подписываются заново при возврате в буфер.
+func WithBatchSize(n int) reporterOption {
+	return func(r *simpleReporter) {
+		r.batchSize = n
+	}
+}
+
+// WithCompress сжимает пачки gzip с первой отправки, не дожидаясь
+// списка алгоритмов сервера, далее алгоритм выбирается по ответам сервера.
+// false отключает сжатие совсем. Без опции пачки сжимаются только после
+// того, как сервер сообщил поддерживаемые алгоритмы.
+func WithCompress(enabled bool) reporterOption {
+	return func(r *simpleReporter) {
+		r.noCompress = !enabled
+		r.encoding = nil
+		if enabled {
+			r.encoding, _ = compress.Lookup(compress.Default)
+		}
+	}
+}
+
+// WithSequence нумерует пачки: каждый запрос передает идентификатор
+// экземпляра репортера и номер пачки в заголовках. Номер увеличивается,
+// когда пачка доставлена или потеряна, пачка, возвращенная в буфер,
+// отправляется с тем же номером, поэтому пропуск номера на сервере
+// означает потерю данных.
+func WithSequence(enabled bool) reporterOption {
+	return func(r *simpleReporter) {
+		r.reporterID = ""
+		if enabled {
+			r.reporterID = newReporterID()
+			r.seq = 1
+		}
+	}
+}
+
+// newReporterID случайный идентификатор, номера пачек после перезапуска
+// агента начинаются заново и не считаются пропуском.
+func newReporterID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// newBatchKey случайный ключ идемпотентности пачки (заголовок
+// X-Report-Key), по нему сервер не применяет повтор пачки дважды.
+func newBatchKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// WithResolver разрешает имя сервера при каждом открытии соединения
+// функцией lookup вместо системного резолвера. Адреса перебираются по
+// порядку до первого успешного соединения.
+func WithResolver(lookup func(ctx context.Context, host string) ([]string, error)) reporterOption {
+	return func(r *simpleReporter) {
+		r.lookupHost = lookup
+	}
+}
+
+// WithAutoFlush отправляет буфер с заданным интервалом независимо от
+// вызовов Flush, для использования репортера без scope. Отправка
+// останавливается при закрытии репортера.
+func WithAutoFlush(interval time.Duration) reporterOption {
+	return func(r *simpleReporter) {
+		r.autoFlush = interval
+	}
+}
+
+// NewReporter репортер, отправляющий метрики на сервер по address.
+//
+// Имя сервера разрешается при каждом открытии соединения. Что бы после
+// смены адресов сервера (например, при переезде подов в k8s) агент не
+// продолжал отправлять метрики по старым соединениям, они закрываются
+// после ошибки соединения или ответа 5xx, а также через maxConnAge.
+func NewReporter(address, key string, opts ...reporterOption) agent.StatsReporter {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	client := &http.Client{Transport: transport}
+
+	network, addr := misc.SplitAddress(address)
+	if network == "unix" {
+		// Хост в URL только для формы, соединение всегда идет через сокет.
+		address = "unix"
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}
+	}
+
+	r := &simpleReporter{
+		address:   "http://" + address,
+		method:    http.MethodPost,
+		path:      defaultUpdatesPath,
+		legacyURL: "http://" + address + "/update/",
+		client:    client,
+		key:       []byte(key),
+		maxBuffer: defaultMaxBuffer,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.lookupHost != nil && network != "unix" {
+		transport.DialContext = r.dial
+	}
+	r.connSince = time.Now()
+	if r.autoFlush > 0 {
+		r.stop = make(chan struct{})
+		r.stopped = make(chan struct{})
+		go r.runAutoFlush()
+	}
+	return r
+}
+
+// dial открывает соединение по адресам, полученным от lookupHost.
+func (r *simpleReporter) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []string{host}
+	if net.ParseIP(host) == nil {
+		if addrs, err = r.lookupHost(ctx, host); err != nil {
+			return nil, err
+		}
+	}
+	var d net.Dialer
+	for _, a := range addrs {
+		var conn net.Conn
+		if conn, err = d.DialContext(ctx, network, net.JoinHostPort(a, port)); err == nil {
+			return conn, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("no addresses for %s", host)
+	}
+	return nil, err
+}
+
+// resetConns закрывает неиспользуемые соединения, следующий запрос
+// откроет новое и заново разрешит имя сервера.
+func (r *simpleReporter) resetConns() {
+	r.client.CloseIdleConnections()
+	r.connSince = time.Now()
+}
+
+// runAutoFlush отправляет накопленные метрики по таймеру до закрытия
+// репортера. Пустой буфер не отправляется.
+func (r *simpleReporter) runAutoFlush() {
+	defer close(r.stopped)
+	ticker := time.NewTicker(r.autoFlush)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			if r.pending() > 0 {
+				r.Flush()
+			}
+		}
+	}
+}
+
+// pending количество метрик в буфере.
+func (r *simpleReporter) pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.metrics)
+}
+
+// simpleReporter реализация тривиального варианта репортера.
+func (r *simpleReporter) ReportCounter(name string, tags map[string]string, delta int64) {
+	// Накапливаем данные для последующей отправки пачкой
+	r.add(models.Metrics{
+		ID:    name,
+		MType: models.Counter,
+		Tags:  tags,
+		Delta: &delta,
+	})
+}
+
+func (r *simpleReporter) ReportGauge(name string, tags map[string]string, value float64) {
+	// Накапливаем данные для последующей отправки пачкой
+	r.add(models.Metrics{
+		ID:    name,
+		MType: models.Gauge,
+		Tags:  tags,
+		Value: &value,
+	})
+}
+
+// ReportIntGauge передает значение датчика в поле delta, что бы
+// сохранить точность целых значений выше 2^53.
+func (r *simpleReporter) ReportIntGauge(name string, tags map[string]string, value int64) {
+	r.add(models.Metrics{
+		ID:    name,
+		MType: models.Gauge,
+		Tags:  tags,
+		Delta: &value,
+	})
+}
+
+// ReportCounterAt, ReportGaugeAt и ReportIntGaugeAt передают вместе
+// со значением время его измерения.
+func (r *simpleReporter) ReportCounterAt(name string, tags map[string]string, delta int64, at time.Time) {
+	r.add(models.Metrics{
+		ID:         name,
+		MType:      models.Counter,
+		Tags:       tags,
+		Delta:      &delta,
+		ObservedAt: at.UnixMilli(),
+	})
+}
+
+func (r *simpleReporter) ReportGaugeAt(name string, tags map[string]string, value float64, at time.Time) {
+	r.add(models.Metrics{
+		ID:         name,
+		MType:      models.Gauge,
+		Tags:       tags,
+		Value:      &value,
+		ObservedAt: at.UnixMilli(),
+	})
+}
+
+func (r *simpleReporter) ReportIntGaugeAt(name string, tags map[string]string, value int64, at time.Time) {
+	r.add(models.Metrics{
+		ID:         name,
+		MType:      models.Gauge,
+		Tags:       tags,
+		Delta:      &value,
+		ObservedAt: at.UnixMilli(),
+	})
+}
+
+// ReportSampledCounter передает вместе с приращением долю учтенных
+// увеличений, полное значение восстанавливает сервер.
+func (r *simpleReporter) ReportSampledCounter(name string, tags map[string]string, delta int64, rate float64, at time.Time) {
+	m := models.Metrics{
+		ID:         name,
+		MType:      models.Counter,
+		Tags:       tags,
+		Delta:      &delta,
+		SampleRate: rate,
+	}
+	if !at.IsZero() {
+		m.ObservedAt = at.UnixMilli()
+	}
+	r.add(m)
+}
+
+// add подписывает метрику ровно в том виде, в котором она уйдет на сервер,
+// вместе с тегами, и добавляет ее в буфер. Значение после подписи не меняется.
+func (r *simpleReporter) add(m models.Metrics) {
+	m = r.sign(m)
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+// sign подписывает метрику вместе с текущим временем,
+// по которому сервер отсекает повторную отправку.
+func (r *simpleReporter) sign(m models.Metrics) models.Metrics {
+	if len(r.key) == 0 || r.hashExempt.Match(m.ID) {
+		return m
+	}
+	m.SignedAt = time.Now().Unix()
+	m.Hash = sign.Hash(r.key, m)
+	return m
+}
+
+func (r *simpleReporter) Flush() {
+	r.FlushContext(context.Background())
+}
+
+// FlushContext отправляет буфер частями не более batchSize метрик, отмена
+// ctx прерывает отправку и ожидание повтора, метрики прерванной и еще не
+// отправленных частей теряются. Часть, которую не удалось отправить после
+// всех повторов, возвращается в буфер вместе с оставшимися частями.
+//
+// Каждая часть отправляется с ключом идемпотентности. Часть, возвращенная
+// в буфер, при следующей отправке повторяется отдельно с тем же ключом:
+// если сервер успел ее применить, повтор не удвоит счетчики.
+func (r *simpleReporter) FlushContext(ctx context.Context) {
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+	r.counterFlush++
+	logger.Debugf("reporter: flush, count: %d\n", r.counterFlush)
+	if time.Since(r.connSince) > maxConnAge {
+		r.resetConns()
+	}
+	// Отправляем ранее накопление данные
+	r.mu.Lock()
+	metrics := r.metrics
+	// Новый массив нужен, что бы повторно отправляемые метрики
+	// не затерли отправленные.
+	r.metrics = make([]models.Metrics, 0, len(metrics))
+	r.mu.Unlock()
+
+	key, replayLen := r.replayKey, r.replayLen
+	r.replayKey, r.replayLen = "", 0
+	for {
+		n := len(metrics)
+		if r.batchSize > 0 && n > r.batchSize {
+			n = r.batchSize
+		}
+		if key != "" && replayLen < n {
+			n = replayLen
+		} else if key == "" {
+			key = newBatchKey()
+		}
+		if !r.send(ctx, metrics[:n], key) {
+			if ctx.Err() == nil {
+				r.restore(metrics, key, n)
+				return
+			}
+			// Пачка потеряна, ее номер остается пропуском.
+			r.seq++
+			return
+		}
+		r.seq++
+		key = ""
+		metrics = metrics[n:]
+		if len(metrics) == 0 {
+			return
+		}
+	}
+}
+
+// send отправляет одну пачку и обрабатывает ответ сервера. Возвращает
+// false, если пачку не удалось доставить из-за ошибки соединения или
+// сервер не смог ее обработать (5xx).
+func (r *simpleReporter) send(ctx context.Context, metrics []models.Metrics, key string) bool {
+	body, contentType := r.encode(metrics)
+	encoding := r.encoding
+	if encoding != nil {
+		body = compressBody(body, encoding)
+	}
+
+	status := 0
+	delivered := false
+	resp, err := r.post(ctx, body, contentType, encoding, key)
+	if err != nil {
+		logger.Errorf("reporter: %v", err)
+	} else {
+		status = resp.StatusCode
+		delivered = r.receive(resp, metrics, encoding)
+	}
+
+	if r.dualWrite {
+		r.flushLegacy(ctx, metrics, status)
+	}
+	return delivered
+}
+
+// receive обрабатывает ответ на пачку, сжатую encoding. Возвращает false
+// при ошибке сервера: пачка не обработана и должна быть повторена.
+func (r *simpleReporter) receive(resp *http.Response, metrics []models.Metrics, encoding compress.Codec) bool {
+	respBody := drainBody(resp.Body)
+	status := resp.StatusCode
+	r.negotiate(resp.Header.Get("Accept-Encoding"))
+	if status >= http.StatusInternalServerError {
+		// Сервер может быть остановленным экземпляром, пока имя
+		// уже указывает на новый.
+		r.resetConns()
+		logger.Warnf("reporter: server error, status: %d, response: %s\n", status, respBody)
+		return false
+	}
+	if status == http.StatusUnsupportedMediaType && encoding != nil {
+		// Сервер перестал принимать алгоритм, пачка не обработана и
+		// отправляется повторно алгоритмом из нового списка или без сжатия.
+		logger.Warnf("reporter: server does not accept %s\n", encoding.Name())
+		if r.encoding != nil && r.encoding.Name() == encoding.Name() {
+			r.encoding = nil
+		}
+		for _, m := range metrics {
+			r.add(m)
+		}
+		return true
+	}
+	logger.Debugf("reporter: got response, status: %d, proto: %s, value: %+v\n", status, resp.Proto, metrics)
+	isJSON := strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json")
+	// Частичный прием (206) также сопровождается причинами отказа.
+	if status < 200 || status >= 300 || status == http.StatusPartialContent {
+		logger.Warnf("reporter: server rejected batch, status: %d, response: %s\n", status, respBody)
+		if isJSON {
+			r.requeue(metrics, respBody)
+		}
+	} else if isJSON {
+		logSummary(len(metrics), respBody)
+	}
+	return true
+}
+
+// post отправляет пачку, повторяя запрос при ошибке соединения или ответе
+// 503 после интервалов r.retry. На 503 повтор ждет не меньше, чем сервер
+// указал в Retry-After. Повторы идут с тем же ключом идемпотентности, поэтому
+// пачка, обработанная сервером до обрыва соединения, не применяется дважды.
+// Отмена ctx прерывает и запрос, и ожидание повтора.
+func (r *simpleReporter) post(ctx context.Context, body []byte, contentType string, encoding compress.Codec, key string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, r.method, r.address+r.path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Accept", "application/json")
+		if encoding != nil {
+			req.Header.Set("Content-Encoding", encoding.Name())
+		}
+		if key != "" {
+			req.Header.Set(models.HeaderReportKey, key)
+		}
+		if r.reporterID != "" {
+			req.Header.Set(models.HeaderReporterID, r.reporterID)
+			req.Header.Set(models.HeaderSequence, strconv.FormatUint(r.seq, 10))
+		}
+		resp, err := r.client.Do(req)
+		if err != nil {
+			r.resetConns()
+		}
+		unavailable := err == nil && resp.StatusCode == http.StatusServiceUnavailable
+		if (err == nil && !unavailable) || attempt >= len(r.retry) || ctx.Err() != nil {
+			return resp, err
+		}
+		wait := r.retry[attempt]
+		if unavailable {
+			if d := retryAfter(resp.Header.Get("Retry-After"), time.Now()); d > wait {
+				wait = d
+			}
+			drainBody(resp.Body)
+			r.resetConns()
+			logger.Warnf("reporter: server is unavailable, retry in %s", wait)
+		} else {
+			logger.Warnf("reporter: %v, retry in %s", err, wait)
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// retryAfter разбирает заголовок Retry-After: число секунд или дату.
+// Пустое или неверное значение - 0, ожидание ограничено maxRetryAfter.
+func retryAfter(h string, now time.Time) time.Duration {
+	var d time.Duration
+	if secs, err := strconv.Atoi(h); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if at, err := http.ParseTime(h); err == nil {
+		d = at.Sub(now)
+	}
+	if d < 0 {
+		return 0
+	}
+	if d > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return d
+}
+
+// restore возвращает неотправленную пачку в начало буфера, перед метриками,
+// добавленными во время отправки, что бы более новые значения датчиков
+// не затерлись старыми. Подпись обновляется, как и при requeue.
+// Первые n метрик - неотправленная часть с ключом key, она повторяется
+// с тем же ключом, если буфер не пришлось обрезать.
+func (r *simpleReporter) restore(metrics []models.Metrics, key string, n int) {
+	restored := make([]models.Metrics, 0, len(metrics))
+	for _, m := range metrics {
+		restored = append(restored, r.sign(m))
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(restored, r.metrics...)
+	if r.trimLocked() == 0 {
+		r.replayKey, r.replayLen = key, n
+	}
+}
+
+// negotiate выбирает алгоритм сжатия следующих пачек по списку,
+// который сервер сообщает в заголовке Accept-Encoding ответа.
+// Без заголовка или при отключенном сжатии выбор не меняется.
+func (r *simpleReporter) negotiate(acceptEncoding string) {
+	if acceptEncoding == "" || r.noCompress {
+		return
+	}
+	codec, ok := compress.Negotiate(acceptEncoding)
+	if !ok {
+		r.encoding = nil
+		return
+	}
+	if r.encoding == nil || r.encoding.Name() != codec.Name() {
+		logger.Debugf("reporter: compress batches with %s\n", codec.Name())
+	}
+	r.encoding = codec
+}
+
+// compressBody сжимает тело запроса. Сжатие в памяти не дает ошибок,
+// как и кодирование в encode, поэтому они считаются невозможными.
+func compressBody(body []byte, codec compress.Codec) []byte {
+	var buf bytes.Buffer
+	zw, err := codec.NewWriter(&buf)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := zw.Write(body); err != nil {
+		panic(err)
+	}
+	if err := zw.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// encode кодирует пачку метрик в формате, выбранном для отправки.
+func (r *simpleReporter) encode(metrics []models.Metrics) ([]byte, string) {
+	if r.binary {
+		var buf bytes.Buffer
+		if err := wire.Encode(&buf, metrics); err != nil {
+			panic(err)
+		}
+		return buf.Bytes(), wire.ContentType
+	}
+	jsonBody, err := json.Marshal(metrics)
+	if err != nil {
+		panic(err)
+	}
+	return jsonBody, "application/json"
+}
+
+// updatesResult ответ сервера с результатом по каждой отклоненной метрике.
+type updatesResult struct {
+	Accepted int `json:"accepted"`
+	Rejected []struct {
+		ID    string `json:"id"`
+		MType string `json:"type"`
+		Code  string `json:"code"`
+	} `json:"rejected"`
+}
+
+// logSummary выводит итог приема пачки, если сервер его прислал.
+// Успешный ответ (2xx) не зависит от тела: пустое или нечитаемое
+// тело только не дает вывести итог.
+func logSummary(sent int, respBody []byte) {
+	var result updatesResult
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		logger.Debugf("reporter: batch of %d metrics accepted, no summary: %v\n", sent, err)
+		return
+	}
+	logger.Debugf("reporter: batch of %d metrics, accepted: %d, rejected: %d\n", sent, result.Accepted, len(result.Rejected))
+}
+
+// requeue возвращает в буфер отклоненные сервером метрики, которые имеет
+// смысл отправить повторно. Принятые метрики повторно не отправляются,
+// что бы не применить приращение счетчика дважды.
+func (r *simpleReporter) requeue(sent []models.Metrics, respBody []byte) {
+	var result updatesResult
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		logger.Warnf("reporter: cannot parse server response: %v", err)
+		return
+	}
+
+	// Одна и та же метрика может встречаться в пачке несколько раз.
+	type key struct{ mtype, id string }
+	index := make(map[key][]int)
+	for i, m := range sent {
+		k := key{m.MType, m.ID}
+		index[k] = append(index[k], i)
+	}
+
+	for _, rm := range result.Rejected {
+		k := key{rm.MType, rm.ID}
+		idx := index[k]
+		if len(idx) == 0 {
+			continue
+		}
+		index[k] = idx[1:]
+		if permanentCodes[rm.Code] {
+			continue
+		}
+		// Подпись обновляется, что бы повтор не попал за окно времени сервера.
+		r.add(sent[idx[0]])
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.trimLocked()
+}
+
+// trimLocked отбрасывает самые старые метрики сверх maxBuffer и возвращает
+// их количество. Вызывается под r.mu.
+func (r *simpleReporter) trimLocked() int {
+	over := len(r.metrics) - r.maxBuffer
+	if r.maxBuffer <= 0 || over <= 0 {
+		return 0
+	}
+	logger.Warnf("reporter: buffer is full, %d metrics dropped", over)
+	r.metrics = r.metrics[over:]
+	return over
+}
+
+// Close останавливает отправку по таймеру, отправляет оставшиеся в буфере
+// метрики и закрывает простаивающие соединения. Вызывается scope при его закрытии.
+func (r *simpleReporter) Close() error {
+	if r.stop != nil {
+		r.stopOnce.Do(func() { close(r.stop) })
+		<-r.stopped
+	}
+	if r.pending() > 0 {
+		r.Flush()
+	}
+	r.client.CloseIdleConnections()
+	return nil
+}
+
+// flushLegacy отправляет метрики поштучно по legacy API
+// и сообщает о расхождениях с результатом пакетной отправки.
+// Теги legacy API передаются в имени метрики (см. models.SeriesID).
+func (r *simpleReporter) flushLegacy(ctx context.Context, metrics []models.Metrics, batchStatus int) {
+	batchAccepted := batchStatus == http.StatusOK
+	for _, m := range metrics {
+		var value string
+		switch {
+		case m.Delta != nil:
+			value = strconv.FormatInt(*m.Delta, 10)
+		case m.Value != nil:
+			value = strconv.FormatFloat(*m.Value, 'f', -1, 64)
+		default:
+			continue
+		}
+
+		status := 0
+		if ctx.Err() != nil {
+			return
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.legacyURL+m.MType+"/"+models.SeriesID(m.ID, m.Tags)+"/"+value, nil)
+		if err != nil {
+			logger.Errorf("reporter: legacy: %v", err)
+			continue
+		}
+		req.Header.Set("Content-Type", "text/plain")
+		resp, err := r.client.Do(req)
+		if err != nil {
+			logger.Errorf("reporter: legacy: %v", err)
+		} else {
+			drainBody(resp.Body)
+			status = resp.StatusCode
+		}
+
+		if accepted := status == http.StatusOK; accepted != batchAccepted {
+			logger.Warnf("reporter: dual-write discrepancy, %s %s: json status: %d, legacy status: %d\n",
+				m.MType, m.ID, batchStatus, status)
+		}
+	}
+}
+
+// drainBody читает ответ сервера (не более maxResponseBody байт),
+// дочитывает остаток и закрывает тело, что бы соединение
+// могло быть переиспользовано.
+func drainBody(body io.ReadCloser) []byte {
+	defer body.Close()
+	data, _ := io.ReadAll(io.LimitReader(body, maxResponseBody))
+	_, _ = io.Copy(io.Discard, body)
+	return data
+}
@@ -0,0 +1,59 @@
+//go:build http3
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go-musthave-devops-trainer/internal/h3"
+	"go-musthave-devops-trainer/models"
+)
+
+func TestReporterHTTP3(t *testing.T) {
+	got := make(chan []models.Metrics, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var metrics []models.Metrics
+		if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+			t.Error(err)
+		}
+		if r.ProtoMajor != 3 {
+			t.Errorf("want HTTP/3, got %s", r.Proto)
+		}
+		got <- metrics
+	})
+	// Тестовый сертификат httptest выдан для 127.0.0.1.
+	ts := httptest.NewUnstartedServer(handler)
+	ts.StartTLS()
+	defer ts.Close()
+	roots := ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := pc.LocalAddr().String()
+	pc.Close()
+	srv, err := h3.ListenAndServe(addr, &tls.Config{Certificates: ts.TLS.Certificates}, handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	rt, err := h3.NewRoundTripper(&tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReporter(addr, "", WithHTTP3(rt))
+	r.ReportCounter("PollCount", nil, 3)
+	r.Flush()
+
+	metrics := <-got
+	if len(metrics) != 1 || metrics[0].ID != "PollCount" || *metrics[0].Delta != 3 {
+		t.Errorf("unexpected metrics: %+v", metrics)
+	}
+}
@@ -0,0 +1,1154 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-musthave-devops-trainer/internal/agent"
+	"go-musthave-devops-trainer/internal/compress"
+	"go-musthave-devops-trainer/internal/logger"
+	"go-musthave-devops-trainer/internal/sign"
+	"go-musthave-devops-trainer/internal/wire"
+	"go-musthave-devops-trainer/models"
+)
+
+func TestReporterUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan []models.Metrics, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var metrics []models.Metrics
+		if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+			t.Error(err)
+		}
+		if r.URL.Path != "/updates/" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		got <- metrics
+	}))
+	srv.Listener.Close()
+	srv.Listener = listener
+	srv.Start()
+	defer srv.Close()
+
+	r := NewReporter("unix:"+sock, "")
+	r.ReportGauge("Alloc", nil, 42)
+	r.ReportCounter("PollCount", nil, 3)
+	r.Flush()
+
+	metrics := <-got
+	if len(metrics) != 2 {
+		t.Fatalf("want 2 metrics, got %d", len(metrics))
+	}
+	if metrics[0].ID != "Alloc" || *metrics[0].Value != 42 {
+		t.Errorf("unexpected gauge: %+v", metrics[0])
+	}
+	if metrics[1].ID != "PollCount" || *metrics[1].Delta != 3 {
+		t.Errorf("unexpected counter: %+v", metrics[1])
+	}
+}
+
+func TestReporterDualWrite(t *testing.T) {
+	var mu sync.Mutex
+	batch := map[string]string{}
+	legacy := map[string]string{}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/updates/", func(w http.ResponseWriter, r *http.Request) {
+		var metrics []models.Metrics
+		if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, m := range metrics {
+			switch m.MType {
+			case models.Counter:
+				batch[m.MType+"/"+m.ID] = strconv.FormatInt(*m.Delta, 10)
+			case models.Gauge:
+				batch[m.MType+"/"+m.ID] = strconv.FormatFloat(*m.Value, 'f', -1, 64)
+			}
+		}
+	})
+	mux.HandleFunc("/update/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/update/"), "/")
+		if len(parts) != 3 {
+			t.Errorf("unexpected legacy path: %s", r.URL.Path)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		legacy[parts[0]+"/"+parts[1]] = parts[2]
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	r := NewReporter(strings.TrimPrefix(srv.URL, "http://"), "", WithDualWrite(true))
+	r.ReportGauge("RandomValue", nil, 12.375)
+	r.ReportCounter("PollCount", nil, 7)
+	r.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(batch) != 2 {
+		t.Fatalf("want 2 metrics in batch, got %v", batch)
+	}
+	for k, v := range batch {
+		if legacy[k] != v {
+			t.Errorf("%s: batch value %q, legacy value %q", k, v, legacy[k])
+		}
+	}
+}
+
+func TestReporterLogsRejection(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `Incorrect hash of counter: "PollCount"`, http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	l, err := logger.New(&buf, logger.LevelInfo, logger.FormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.SetDefault(logger.SetDefault(l))
+
+	r := NewReporter(strings.TrimPrefix(srv.URL, "http://"), "")
+	r.ReportCounter("PollCount", nil, 1)
+	r.Flush()
+
+	if !strings.Contains(buf.String(), `Incorrect hash of counter: "PollCount"`) {
+		t.Errorf("server response not logged:\n%s", buf.String())
+	}
+}
+
+func TestReporterIntGaugePrecision(t *testing.T) {
+	const value = int64(1<<53 + 1) // не представимо в float64
+	key := "secret"
+
+	got := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- body
+	}))
+	defer srv.Close()
+
+	r := NewReporter(strings.TrimPrefix(srv.URL, "http://"), key)
+	r.ReportIntGauge("LastGC", nil, value)
+	r.Flush()
+
+	body := <-got
+	if !strings.Contains(string(body), `"delta":9007199254740993`) {
+		t.Fatalf("exact value expected on the wire: %s", body)
+	}
+	var metrics []models.Metrics
+	if err := json.Unmarshal(body, &metrics); err != nil {
+		t.Fatal(err)
+	}
+	m := metrics[0]
+	if m.MType != models.Gauge || m.Value != nil || *m.Delta != value {
+		t.Errorf("unexpected metric: %+v", m)
+	}
+	if m.SignedAt == 0 {
+		t.Fatal("signed metric must carry signing time")
+	}
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(fmt.Sprintf("LastGC:gauge:9007199254740993:%d", m.SignedAt)))
+	if want := fmt.Sprintf("%x", h.Sum(nil)); m.Hash != want {
+		t.Errorf("hash must cover exact value: want %s, got %s", want, m.Hash)
+	}
+}
+
+type trackingTransport struct {
+	http.RoundTripper
+	closed bool
+}
+
+func (t *trackingTransport) CloseIdleConnections() {
+	t.closed = true
+}
+
+func TestReporterClose(t *testing.T) {
+	got := make(chan []models.Metrics, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var metrics []models.Metrics
+		if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+			t.Error(err)
+		}
+		got <- metrics
+	}))
+	defer srv.Close()
+
+	r := NewReporter(strings.TrimPrefix(srv.URL, "http://"), "")
+	transport := &trackingTransport{RoundTripper: http.DefaultTransport}
+	r.(*simpleReporter).client.Transport = transport
+
+	// Scope при закрытии отправляет отчет и закрывает репортер.
+	scope, closer := agent.NewRootScope(agent.ScopeOptions{Reporter: r}, 0)
+	scope.Counter("PollCount").Inc(1)
+	if err := closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if metrics := <-got; len(metrics) != 1 || metrics[0].ID != "PollCount" {
+		t.Errorf("unexpected metrics: %+v", metrics)
+	}
+	if !transport.closed {
+		t.Error("idle connections not closed")
+	}
+
+	// Метрики, добавленные в обход scope, отправляются при закрытии.
+	r.ReportGauge("Alloc", nil, 1)
+	if err := r.(io.Closer).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if metrics := <-got; len(metrics) != 1 || metrics[0].ID != "Alloc" {
+		t.Errorf("unexpected metrics: %+v", metrics)
+	}
+}
+
+// TestReporterBatchedCountersVerify проверяет, что каждый счетчик пачки,
+// набранной во время конкурентных инкрементов, проходит проверку подписи
+// тем же кодом, что использует сервер, и ни одно приращение не теряется.
+func TestReporterBatchedCountersVerify(t *testing.T) {
+	key := []byte("secret")
+
+	var mu sync.Mutex
+	var total int64
+	var bad []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var metrics []models.Metrics
+		if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, m := range metrics {
+			if !sign.Check(key, m) {
+				bad = append(bad, fmt.Sprintf("%s=%d", m.ID, *m.Delta))
+				continue
+			}
+			total += *m.Delta
+		}
+	}))
+	defer srv.Close()
+
+	reporter := NewReporter(strings.TrimPrefix(srv.URL, "http://"), string(key))
+	scope, closer := agent.NewRootScope(agent.ScopeOptions{Reporter: reporter}, time.Millisecond)
+	counter := scope.Counter("PollCount")
+
+	const workers, incs = 8, 1000
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < incs; j++ {
+				counter.Inc(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bad) > 0 {
+		t.Errorf("counters failed hash verification: %v", bad)
+	}
+	if total != workers*incs {
+		t.Errorf("want total %d, got %d", workers*incs, total)
+	}
+}
+
+func TestReporterRequeueRejected(t *testing.T) {
+	batches := make(chan []models.Metrics, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var metrics []models.Metrics
+		if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+			t.Error(err)
+		}
+		batches <- metrics
+		if r.Header.Get("Accept") != "application/json" {
+			t.Error("structured response must be requested")
+		}
+		if len(batches) > 1 {
+			return
+		}
+		// Первая пачка принимается частично.
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = io.WriteString(w, `{"accepted":1,"rejected":[
+			{"id":"c2","type":"counter","code":"limit_exceeded"},
+			{"id":"g1","type":"gauge","code":"hash_mismatch"}]}`)
+	}))
+	defer srv.Close()
+
+	r := NewReporter(strings.TrimPrefix(srv.URL, "http://"), "")
+	r.ReportCounter("c1", nil, 1)
+	r.ReportCounter("c2", nil, 2)
+	r.ReportGauge("g1", nil, 1.5)
+	r.Flush()
+	if got := len(<-batches); got != 3 {
+		t.Fatalf("want 3 metrics in first batch, got %d", got)
+	}
+
+	r.ReportCounter("c1", nil, 3)
+	r.Flush()
+	second := <-batches
+	if len(second) != 2 {
+		t.Fatalf("want retried and new metric, got %+v", second)
+	}
+	if m := second[0]; m.ID != "c2" || *m.Delta != 2 {
+		t.Errorf("only retriable rejected metric must be resent, got %+v", m)
+	}
+	if m := second[1]; m.ID != "c1" || *m.Delta != 3 {
+		t.Errorf("unexpected new metric: %+v", m)
+	}
+}
+
+func TestReporterRequeueBufferCap(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(w, `{"accepted":0,"rejected":[
+			{"id":"c1","type":"counter","code":"limit_exceeded"},
+			{"id":"c2","type":"counter","code":"limit_exceeded"},
+			{"id":"c3","type":"counter","code":"limit_exceeded"}]}`)
+	}))
+	defer srv.Close()
+
+	r := NewReporter(strings.TrimPrefix(srv.URL, "http://"), "", WithMaxBuffer(2)).(*simpleReporter)
+	for _, id := range []string{"c1", "c2", "c3"} {
+		r.ReportCounter(id, nil, 1)
+	}
+	r.Flush()
+	if len(r.metrics) != 2 || r.metrics[0].ID != "c2" || r.metrics[1].ID != "c3" {
+		t.Errorf("want the newest metrics kept, got %+v", r.metrics)
+	}
+}
+
+func TestReporterHashExempt(t *testing.T) {
+	got := make(chan []models.Metrics, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var metrics []models.Metrics
+		if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+			t.Error(err)
+		}
+		got <- metrics
+	}))
+	defer srv.Close()
+
+	r := NewReporter(strings.TrimPrefix(srv.URL, "http://"), "secret", WithHashExempt(sign.ParseExempt("Random")))
+	r.ReportGauge("RandomValue", nil, 1)
+	r.ReportGauge("Alloc", nil, 1)
+	r.Flush()
+
+	metrics := <-got
+	if metrics[0].ID != "RandomValue" || metrics[0].Hash != "" {
+		t.Errorf("exempt metric must be sent without hash: %+v", metrics[0])
+	}
+	if metrics[1].ID != "Alloc" || !sign.Check([]byte("secret"), metrics[1]) {
+		t.Errorf("other metrics must be signed: %+v", metrics[1])
+	}
+}
+
+func TestReporterBinary(t *testing.T) {
+	got := make(chan []models.Metrics, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != wire.ContentType {
+			t.Errorf("unexpected content type: %q", ct)
+		}
+		metrics, err := wire.Decode(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		got <- metrics
+	}))
+	defer srv.Close()
+
+	r := NewReporter(strings.TrimPrefix(srv.URL, "http://"), "secret", WithBinary(true))
+	r.ReportCounter("PollCount", nil, 5)
+	r.ReportGauge("Alloc", nil, 1.5)
+	r.Flush()
+
+	metrics := <-got
+	if len(metrics) != 2 || *metrics[0].Delta != 5 || *metrics[1].Value != 1.5 {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+	for _, m := range metrics {
+		if !sign.Check([]byte("secret"), m) {
+			t.Errorf("signature must survive binary encoding: %+v", m)
+		}
+	}
+}
+
+func TestReporterObservedAt(t *testing.T) {
+	got := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- body
+	}))
+	defer srv.Close()
+
+	at := time.Date(2022, 5, 1, 12, 0, 0, 123e6, time.UTC)
+	r := NewReporter(strings.TrimPrefix(srv.URL, "http://"), "secret").(agent.TimedStatsReporter)
+	r.ReportGaugeAt("Alloc", nil, 1.5, at)
+	r.Flush()
+
+	var metrics []models.Metrics
+	if err := json.Unmarshal(<-got, &metrics); err != nil {
+		t.Fatal(err)
+	}
+	m := metrics[0]
+	if m.ObservedAt != at.UnixMilli() {
+		t.Errorf("want observed_at %d, got %d", at.UnixMilli(), m.ObservedAt)
+	}
+	if !sign.Check([]byte("secret"), m) {
+		t.Error("hash must cover observation time")
+	}
+}
+
+func TestReporterSuccessBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		log         string
+	}{
+		{"json summary", "application/json", `{"accepted":2,"rejected":[]}`, "accepted: 2, rejected: 0"},
+		{"broken json", "application/json", `{"accepted":`, "no summary"},
+		{"empty json", "application/json", "", "no summary"},
+		{"text", "text/plain", "OK", ""},
+		{"empty", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				_, _ = io.WriteString(w, tt.body)
+			}))
+			defer srv.Close()
+
+			var buf bytes.Buffer
+			l, err := logger.New(&buf, logger.LevelDebug, logger.FormatText)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer logger.SetDefault(logger.SetDefault(l))
+
+			r := NewReporter(strings.TrimPrefix(srv.URL, "http://"), "")
+			r.ReportCounter("PollCount", nil, 1)
+			r.ReportGauge("Alloc", nil, 1)
+			r.Flush()
+			// Успешно отправленная пачка не повторяется.
+			r.Flush()
+
+			if requests != 2 {
+				t.Errorf("want 2 requests, got %d", requests)
+			}
+			if strings.Contains(buf.String(), "WARN") || strings.Contains(buf.String(), "ERROR") {
+				t.Errorf("success must not be reported as failure:\n%s", buf.String())
+			}
+			if tt.log != "" && !strings.Contains(buf.String(), tt.log) {
+				t.Errorf("%q expected in log:\n%s", tt.log, buf.String())
+			}
+			if rep := r.(*simpleReporter); len(rep.metrics) != 0 {
+				t.Errorf("buffer must be empty, got %d metrics", len(rep.metrics))
+			}
+		})
+	}
+}
+
+func TestReporterNegotiatesEncoding(t *testing.T) {
+	type request struct {
+		encoding string
+		body     []byte
+	}
+	got := make(chan request, 3)
+	advertise := "zstd, gzip"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		enc := r.Header.Get("Content-Encoding")
+		got <- request{enc, body}
+		w.Header().Set("Accept-Encoding", advertise)
+		if enc == "zstd" && advertise == "gzip" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+		}
+	}))
+	defer srv.Close()
+
+	r := NewReporter(strings.TrimPrefix(srv.URL, "http://"), "")
+	send := func() request {
+		r.ReportCounter("PollCount", nil, 1)
+		r.Flush()
+		return <-got
+	}
+
+	// До первого ответа алгоритмы сервера неизвестны.
+	if req := send(); req.encoding != "" {
+		t.Fatalf("first batch must be uncompressed, got %q", req.encoding)
+	}
+
+	req := send()
+	if req.encoding != "zstd" {
+		t.Fatalf("want zstd, got %q", req.encoding)
+	}
+	codec, _ := compress.Lookup("zstd")
+	zr, err := codec.NewReader(bytes.NewReader(req.body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metrics []models.Metrics
+	if err := json.Unmarshal(body, &metrics); err != nil || len(metrics) != 1 || metrics[0].ID != "PollCount" {
+		t.Fatalf("unexpected batch %s: %v", body, err)
+	}
+
+	// Отказ в алгоритме: пачка повторяется в следующей отправке.
+	advertise = "gzip"
+	send()
+	req = send()
+	if req.encoding != "gzip" {
+		t.Fatalf("want gzip after server change, got %q", req.encoding)
+	}
+	zr, err = gzip.NewReader(bytes.NewReader(req.body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(zr)
+	if err := json.Unmarshal(body, &metrics); err != nil || len(metrics) != 2 {
+		t.Errorf("rejected batch must be resent, got %s", body)
+	}
+}
+
+func TestReporterEndpoint(t *testing.T) {
+	type request struct{ method, path string }
+	got := make(chan request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- request{r.Method, r.URL.Path}
+	}))
+	defer srv.Close()
+	address := strings.TrimPrefix(srv.URL, "http://")
+
+	tests := []struct {
+		name string
+		opts []reporterOption
+		want request
+	}{
+		{"default", nil, request{http.MethodPost, "/updates/"}},
+		{"custom", []reporterOption{WithEndpoint("put", "api/v2/metrics")}, request{http.MethodPut, "/api/v2/metrics"}},
+		{"empty keeps default", []reporterOption{WithEndpoint("", "")}, request{http.MethodPost, "/updates/"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReporter(address, "", tt.opts...)
+			r.ReportCounter("PollCount", nil, 1)
+			r.Flush()
+			if req := <-got; req != tt.want {
+				t.Errorf("want %+v, got %+v", tt.want, req)
+			}
+		})
+	}
+}
+
+func TestReporterAutoFlush(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		received int
+	)
+	got := make(chan struct{}, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var metrics []models.Metrics
+		_ = json.NewDecoder(r.Body).Decode(&metrics)
+		mu.Lock()
+		received += len(metrics)
+		mu.Unlock()
+		got <- struct{}{}
+	}))
+	defer srv.Close()
+
+	r := NewReporter(strings.TrimPrefix(srv.URL, "http://"), "", WithAutoFlush(10*time.Millisecond))
+	closer := r.(io.Closer)
+
+	// Без вызова Flush метрики отправляются по таймеру.
+	r.ReportCounter("PollCount", nil, 1)
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Fatal("metrics are not flushed by timer")
+	}
+	r.ReportGauge("Alloc", nil, 1.5)
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Fatal("second batch is not flushed by timer")
+	}
+
+	// Ручной Flush безопасен при работающем таймере.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				r.ReportCounter("PollCount", nil, 1)
+				r.Flush()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	total := received
+	mu.Unlock()
+	if total != 42 {
+		t.Errorf("want 42 metrics received, got %d", total)
+	}
+
+	// После закрытия таймер остановлен.
+	r.ReportCounter("PollCount", nil, 1)
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if received != total {
+		t.Errorf("metrics flushed after close: %d", received-total)
+	}
+}
+
+func TestReporterFlushContextCancel(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	r := NewReporter(strings.TrimPrefix(srv.URL, "http://"), "", WithDualWrite(true)).(agent.ContextFlusher)
+	r.(agent.StatsReporter).ReportCounter("PollCount", nil, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		r.FlushContext(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("slow flush is not cancelled")
+	}
+}
+
+// dropConnection закрывает соединение без ответа, клиент получает ошибку.
+func dropConnection(t *testing.T, w http.ResponseWriter) {
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	conn.Close()
+}
+
+func TestReporterRetry(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		failures int
+		attempts int
+		got      [][]models.Metrics
+		keys     []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		keys = append(keys, r.Header.Get(models.HeaderReportKey))
+		if failures > 0 {
+			failures--
+			dropConnection(t, w)
+			return
+		}
+		var metrics []models.Metrics
+		if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+			t.Error(err)
+		}
+		got = append(got, metrics)
+	}))
+	defer srv.Close()
+	setup := func(n int) {
+		mu.Lock()
+		defer mu.Unlock()
+		failures, attempts, got, keys = n, 0, nil, nil
+	}
+	state := func() (int, [][]models.Metrics) {
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts, got
+	}
+
+	r := NewReporter(strings.TrimPrefix(srv.URL, "http://"), "",
+		WithRetry(time.Millisecond, time.Millisecond)).(*simpleReporter)
+
+	// Пачка доходит с последней попытки.
+	setup(2)
+	r.ReportCounter("PollCount", nil, 1)
+	r.Flush()
+	if attempts, got := state(); attempts != 3 || len(got) != 1 || len(got[0]) != 1 {
+		t.Fatalf("want 3 attempts and one batch, got %d, %+v", attempts, got)
+	}
+
+	// После всех неудачных попыток пачка остается в буфере и уходит
+	// со следующей отдельно, раньше новых значений и с тем же ключом.
+	setup(3)
+	r.ReportGauge("Alloc", nil, 1)
+	r.Flush()
+	if attempts, got := state(); attempts != 3 || len(got) != 0 || r.pending() != 1 {
+		t.Fatalf("want batch kept after 3 attempts, got %d, %d pending", attempts, r.pending())
+	}
+	r.ReportGauge("Alloc", nil, 2)
+	r.Flush()
+	if _, got := state(); len(got) != 2 || *got[0][0].Value != 1 || *got[1][0].Value != 2 {
+		t.Fatalf("want restored batch before new values, got %+v", got)
+	}
+	mu.Lock()
+	if len(keys) != 5 || keys[0] == "" || keys[3] != keys[0] || keys[4] == keys[0] {
+		t.Errorf("want restored batch sent with its key, got %q", keys)
+	}
+	mu.Unlock()
+
+	// Отмена контекста прерывает ожидание повтора.
+	setup(1)
+	r.retry = []time.Duration{time.Hour}
+	r.ReportCounter("PollCount", nil, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		r.FlushContext(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("retry wait is not cancelled")
+	}
+}
+
+func TestReporterServerError(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		failures = 1
+		keys     []string
+		got      []models.Metrics
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, r.Header.Get(models.HeaderReportKey))
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var metrics []models.Metrics
+		if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+			t.Error(err)
+		}
+		got = append(got, metrics...)
+	}))
+	defer srv.Close()
+
+	r := NewReporter(strings.TrimPrefix(srv.URL, "http://"), "").(*simpleReporter)
+	r.ReportCounter("PollCount", nil, 5)
+	r.Flush()
+	if r.pending() != 1 {
+		t.Fatalf("want batch kept after 503, got %d pending", r.pending())
+	}
+	r.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 1 || got[0].ID != "PollCount" || *got[0].Delta != 5 || r.pending() != 0 {
+		t.Errorf("want PollCount delivered exactly once, got %+v, %d pending", got, r.pending())
+	}
+	if len(keys) != 2 || keys[0] == "" || keys[1] != keys[0] {
+		t.Errorf("want batch repeated with its key, got %q", keys)
+	}
+}
+
+func TestReporterRetryAfter(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		failures = 1
+		times    []time.Time
+		keys     []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		times = append(times, time.Now())
+		keys = append(keys, r.Header.Get(models.HeaderReportKey))
+		if failures > 0 {
+			failures--
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	// Ответ 503 повторяется в той же отправке, не раньше Retry-After.
+	r := NewReporter(strings.TrimPrefix(srv.URL, "http://"), "",
+		WithRetry(time.Millisecond)).(*simpleReporter)
+	r.ReportCounter("PollCount", nil, 1)
+	r.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(times) != 2 || r.pending() != 0 {
+		t.Fatalf("want batch delivered with the retry, got %d requests, %d pending", len(times), r.pending())
+	}
+	if wait := times[1].Sub(times[0]); wait < time.Second {
+		t.Errorf("want retry after Retry-After, got %s", wait)
+	}
+	if keys[1] != keys[0] {
+		t.Errorf("want retry with the same key, got %q", keys)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for h, want := range map[string]time.Duration{
+		"":                              0,
+		"3":                             3 * time.Second,
+		"-1":                            0,
+		"3600":                          maxRetryAfter,
+		"Sat, 01 Jan 2022 00:00:10 GMT": 10 * time.Second,
+		"Fri, 31 Dec 2021 23:59:00 GMT": 0,
+		"soon":                          0,
+	} {
+		if got := retryAfter(h, now); got != want {
+			t.Errorf("%q: want %s, got %s", h, want, got)
+		}
+	}
+}
+
+func TestParseRetry(t *testing.T) {
+	got, err := parseRetry(" 1s, 3s,,500ms ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Duration{time.Second, 3 * time.Second, 500 * time.Millisecond}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if got, err := parseRetry(""); err != nil || len(got) != 0 {
+		t.Errorf("empty list must disable retries: %v, %v", got, err)
+	}
+	for _, s := range []string{"1", "-1s", "soon"} {
+		if _, err := parseRetry(s); err == nil {
+			t.Errorf("%q: error expected", s)
+		}
+	}
+}
+
+func TestReporterCompress(t *testing.T) {
+	type request struct {
+		encoding string
+		metrics  []models.Metrics
+	}
+	got := make(chan request, 1)
+	// Сервер распаковывает тело так же, как compressMiddleware сервера метрик.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := r.Header.Get("Content-Encoding")
+		body := io.Reader(r.Body)
+		if enc != "" {
+			codec, ok := compress.Lookup(enc)
+			if !ok {
+				t.Errorf("unknown encoding %q", enc)
+				return
+			}
+			zr, err := codec.NewReader(r.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer zr.Close()
+			body = zr
+		}
+		var metrics []models.Metrics
+		if err := json.NewDecoder(body).Decode(&metrics); err != nil {
+			t.Error(err)
+		}
+		w.Header().Set("Accept-Encoding", compress.Advertise())
+		got <- request{enc, metrics}
+	}))
+	defer srv.Close()
+
+	for _, enabled := range []bool{true, false} {
+		r := NewReporter(strings.TrimPrefix(srv.URL, "http://"), "", WithCompress(enabled))
+		want := "gzip"
+		if !enabled {
+			want = ""
+		}
+		// Вторая пачка проверяет, что ответ сервера не меняет выбор.
+		for i := 0; i < 2; i++ {
+			r.ReportCounter("PollCount", nil, 1)
+			r.Flush()
+			req := <-got
+			if req.encoding != want {
+				t.Errorf("compress=%v, batch %d: want encoding %q, got %q", enabled, i, want, req.encoding)
+			}
+			if len(req.metrics) != 1 || req.metrics[0].ID != "PollCount" {
+				t.Errorf("unexpected batch: %+v", req.metrics)
+			}
+		}
+	}
+}
+
+func TestReporterBatchSize(t *testing.T) {
+	key := []byte("secret")
+	var (
+		mu      sync.Mutex
+		batches [][]models.Metrics
+		// failAt номер запроса, на котором сервер обрывает соединение.
+		failAt   int
+		requests int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests == failAt {
+			dropConnection(t, w)
+			return
+		}
+		var metrics []models.Metrics
+		if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+			t.Error(err)
+		}
+		for _, m := range metrics {
+			if !sign.Check(key, m) {
+				t.Errorf("hash mismatch: %+v", m)
+			}
+		}
+		batches = append(batches, metrics)
+	}))
+	defer srv.Close()
+	sizes := func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		var sizes []int
+		for _, b := range batches {
+			sizes = append(sizes, len(b))
+		}
+		batches = nil
+		return sizes
+	}
+
+	r := NewReporter(strings.TrimPrefix(srv.URL, "http://"), string(key), WithBatchSize(2)).(*simpleReporter)
+	for i := 0; i < 5; i++ {
+		r.ReportCounter(fmt.Sprintf("c%d", i), nil, 1)
+	}
+	r.Flush()
+	if got := fmt.Sprint(sizes()); got != "[2 2 1]" {
+		t.Errorf("want batches [2 2 1], got %s", got)
+	}
+
+	// Неотправленная часть и следующие за ней остаются в буфере.
+	mu.Lock()
+	failAt, requests = 2, 0
+	mu.Unlock()
+	for i := 0; i < 5; i++ {
+		r.ReportCounter(fmt.Sprintf("c%d", i), nil, 1)
+	}
+	r.Flush()
+	if got := fmt.Sprint(sizes()); got != "[2]" {
+		t.Errorf("want one delivered batch, got %s", got)
+	}
+	r.mu.Lock()
+	var pending []string
+	for _, m := range r.metrics {
+		pending = append(pending, m.ID)
+	}
+	r.mu.Unlock()
+	if got := fmt.Sprint(pending); got != "[c2 c3 c4]" {
+		t.Errorf("want undelivered metrics kept, got %s", got)
+	}
+	r.Flush()
+	if got := fmt.Sprint(sizes()); got != "[2 1]" {
+		t.Errorf("want kept metrics sent, got %s", got)
+	}
+}
+
+func TestReporterTags(t *testing.T) {
+	key := []byte("secret")
+	got := make(chan []models.Metrics, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var metrics []models.Metrics
+		if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+			t.Error(err)
+		}
+		if len(metrics) > 0 {
+			got <- metrics
+		}
+	}))
+	defer srv.Close()
+
+	r := NewReporter(strings.TrimPrefix(srv.URL, "http://"), string(key))
+	scope, closer := agent.NewRootScope(agent.ScopeOptions{
+		Tags:     map[string]string{"instance": "a"},
+		Reporter: r,
+	}, 0)
+	defer closer.Close()
+	scope.Tagged(map[string]string{"role": "db"}).Gauge("Load").Update(1)
+	scope.(agent.ReportableScope).Report()
+
+	metrics := <-got
+	if len(metrics) != 1 {
+		t.Fatalf("unexpected batch: %+v", metrics)
+	}
+	m := metrics[0]
+	if want := "instance=a,role=db"; models.JoinTags(m.Tags) != want {
+		t.Errorf("want tags %s, got %v", want, m.Tags)
+	}
+	if !sign.Check(key, m) {
+		t.Errorf("tags are not signed: %+v", m)
+	}
+}
+
+func TestReporterSequence(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		fail bool
+		ids  = make(map[string]bool)
+		seqs []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		ids[r.Header.Get(models.HeaderReporterID)] = true
+		seqs = append(seqs, r.Header.Get(models.HeaderSequence))
+		if fail {
+			fail = false
+			dropConnection(t, w)
+		}
+	}))
+	defer srv.Close()
+
+	r := NewReporter(strings.TrimPrefix(srv.URL, "http://"), "", WithSequence(true))
+	r.ReportGauge("g", nil, 1)
+	r.Flush()
+	r.ReportGauge("g", nil, 2)
+	r.Flush()
+
+	// Пачка, возвращенная в буфер, отправляется повторно с тем же номером.
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	r.ReportGauge("g", nil, 3)
+	r.Flush()
+	r.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := fmt.Sprint(seqs); got != "[1 2 3 3]" {
+		t.Errorf("want sequence [1 2 3 3], got %s", got)
+	}
+	if len(ids) != 1 || ids[""] {
+		t.Errorf("want one reporter id, got %v", ids)
+	}
+}
+
+func TestReporterResolver(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		target string
+		hits   = make(map[string]int)
+	)
+	newServer := func(name, addr string, status int) string {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Skipf("cannot listen %s: %v", addr, err)
+		}
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hits[name]++
+			mu.Unlock()
+			w.WriteHeader(status)
+		}))
+		srv.Listener.Close()
+		srv.Listener = l
+		srv.Start()
+		t.Cleanup(srv.Close)
+		return l.Addr().String()
+	}
+	// Экземпляры сервера за одним именем различаются только адресом,
+	// старый еще отвечает, но уже останавливается.
+	oldAddr := newServer("old", "127.0.0.1:0", http.StatusServiceUnavailable)
+	oldIP, port, _ := net.SplitHostPort(oldAddr)
+	newServer("new", net.JoinHostPort("127.0.0.2", port), http.StatusOK)
+
+	target = oldIP
+	lookup := func(ctx context.Context, host string) ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if host != "metrics.test" {
+			return nil, fmt.Errorf("unknown host %s", host)
+		}
+		return []string{target}, nil
+	}
+
+	r := NewReporter("metrics.test:"+port, "", WithResolver(lookup))
+	r.ReportGauge("g", nil, 1)
+	r.Flush()
+
+	// Имя указывает на новый экземпляр. Соединение со старым закрыто
+	// после ответа 5xx, не принятая им пачка и следующая уходят на новый адрес.
+	mu.Lock()
+	target = "127.0.0.2"
+	mu.Unlock()
+	r.ReportGauge("g", nil, 2)
+	r.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if hits["old"] != 1 || hits["new"] != 2 {
+		t.Errorf("want one request to the old instance and two to the new, got %v", hits)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"go-musthave-devops-trainer/internal/agent"
+	"go-musthave-devops-trainer/internal/logger"
+	"go-musthave-devops-trainer/internal/sign"
+	"go-musthave-devops-trainer/models"
+)
+
+// RunStdin читает метрики из in в формате name:type:value (по одной на
+// строке) и отправляет их одним запросом на путь отправки пачек (/updates/ по умолчанию). Пустые строки
+// пропускаются. При ошибке разбора ничего не отправляется.
+func (c *config) RunStdin(in io.Reader) error {
+	retry, err := parseRetry(c.retry)
+	if err != nil {
+		return err
+	}
+	r := NewReporter(c.address, c.key,
+		WithBinary(c.binary),
+		WithCompress(c.compress),
+		WithBatchSize(c.batchSize),
+		WithRetry(retry...),
+		WithEndpoint(c.updatesMethod, c.updatesPath),
+		WithHashExempt(sign.ParseExempt(c.hashExempt)))
+	if err := readMetrics(in, r); err != nil {
+		return err
+	}
+	r.Flush()
+	logger.Infof("client: metrics from stdin sent")
+	return nil
+}
+
+// readMetrics разбирает строки и передает метрики репортеру,
+// который их подписывает и накапливает до отправки.
+func readMetrics(in io.Reader, r agent.StatsReporter) error {
+	type line struct {
+		name, mtype, value string
+	}
+	var lines []line
+
+	scanner := bufio.NewScanner(in)
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		parts := strings.Split(text, ":")
+		if len(parts) != 3 || parts[0] == "" {
+			return fmt.Errorf("line %d: want name:type:value, got %q", n, text)
+		}
+		l := line{name: parts[0], mtype: parts[1], value: parts[2]}
+		switch l.mtype {
+		case models.Counter:
+			if _, err := strconv.ParseInt(l.value, 10, 64); err != nil {
+				return fmt.Errorf("line %d: wrong counter value: %w", n, err)
+			}
+		case models.Gauge:
+			if _, err := strconv.ParseFloat(l.value, 64); err != nil {
+				return fmt.Errorf("line %d: wrong gauge value: %w", n, err)
+			}
+		default:
+			return fmt.Errorf("line %d: unknown type of metrics: %q", n, l.mtype)
+		}
+		lines = append(lines, l)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for _, l := range lines {
+		if l.mtype == models.Counter {
+			delta, _ := strconv.ParseInt(l.value, 10, 64)
+			r.ReportCounter(l.name, nil, delta)
+			continue
+		}
+		value, _ := strconv.ParseFloat(l.value, 64)
+		r.ReportGauge(l.name, nil, value)
+	}
+	return nil
+}
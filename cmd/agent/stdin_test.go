@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go-musthave-devops-trainer/internal/sign"
+	"go-musthave-devops-trainer/models"
+)
+
+func TestRunStdin(t *testing.T) {
+	key := []byte("secret")
+
+	got := make(chan []byte, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/updates/" {
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		got <- body
+	}))
+	defer srv.Close()
+
+	c := config{address: strings.TrimPrefix(srv.URL, "http://"), key: string(key)}
+	in := "PollCount:counter:5\n\nAlloc:gauge:1.5\n"
+	if err := c.RunStdin(strings.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+
+	var metrics []models.Metrics
+	if err := json.Unmarshal(<-got, &metrics); err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("want 2 metrics, got %+v", metrics)
+	}
+	if m := metrics[0]; m.ID != "PollCount" || m.MType != models.Counter || *m.Delta != 5 {
+		t.Errorf("unexpected counter: %+v", m)
+	}
+	if m := metrics[1]; m.ID != "Alloc" || m.MType != models.Gauge || *m.Value != 1.5 {
+		t.Errorf("unexpected gauge: %+v", m)
+	}
+	for _, m := range metrics {
+		if !sign.Check(key, m) {
+			t.Errorf("bad hash of %s", m.ID)
+		}
+	}
+}
+
+func TestRunStdinInvalid(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("nothing must be sent on invalid input")
+	}))
+	defer srv.Close()
+
+	c := config{address: strings.TrimPrefix(srv.URL, "http://")}
+	for _, in := range []string{"PollCount:counter", "PollCount:counter:1.5", "x:histogram:1", "ok:gauge:1\n:gauge:1"} {
+		if err := c.RunStdin(strings.NewReader(in)); err == nil {
+			t.Errorf("want error for %q", in)
+		}
+	}
+}
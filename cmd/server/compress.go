@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"go-musthave-devops-trainer/internal/compress"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// maxDecompressedSize ограничение на размер распакованного тела запроса,
+// не меньше maxImportSize, так как файл хранилища также может быть сжат.
+const maxDecompressedSize = 32 << 20
+
+var errBodyTooLarge = errors.New("decompressed body is too large")
+
+// legacyRoutes маршруты с параметрами в пути: их тело ограничено
+// maxLegacyBodySize уже при распаковке, а не после распаковки
+// maxDecompressedSize байт.
+var legacyRoutes = func() *chi.Mux {
+	r := chi.NewRouter()
+	r.Post(legacyUpdatePattern, http.NotFound)
+	r.Get(legacyValuePattern, http.NotFound)
+	return r
+}()
+
+// bodyLimit ограничение на размер распакованного тела запроса r.
+func bodyLimit(r *http.Request) int64 {
+	path := r.URL.RawPath
+	if path == "" {
+		path = r.URL.Path
+	}
+	if legacyRoutes.Match(chi.NewRouteContext(), r.Method, path) {
+		return maxLegacyBodySize
+	}
+	return maxDecompressedSize
+}
+
+// compressWriter сжимает тело ответа выбранным алгоритмом. Заголовок
+// Content-Encoding выставляется при отправке статуса для любого ответа
+// с телом, включая ошибки, поэтому обработчики его не трогают.
+type compressWriter struct {
+	w           http.ResponseWriter
+	codec       compress.Codec
+	zw          compress.Writer
+	wroteHeader bool
+	compress    bool
+}
+
+func newCompressWriter(w http.ResponseWriter, codec compress.Codec) *compressWriter {
+	return &compressWriter{w: w, codec: codec}
+}
+
+func (c *compressWriter) Header() http.Header {
+	return c.w.Header()
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.compress {
+		return c.w.Write(p)
+	}
+	if c.zw == nil {
+		zw, err := c.codec.NewWriter(c.w)
+		if err != nil {
+			return 0, err
+		}
+		c.zw = zw
+	}
+	return c.zw.Write(p)
+}
+
+func (c *compressWriter) WriteHeader(statusCode int) {
+	if c.wroteHeader {
+		return
+	}
+	if statusCode < http.StatusOK {
+		// Информационные ответы не завершают отправку заголовков.
+		c.w.WriteHeader(statusCode)
+		return
+	}
+	c.wroteHeader = true
+	c.compress = bodyAllowed(statusCode)
+	if c.compress {
+		c.w.Header().Set("Content-Encoding", c.codec.Name())
+		c.w.Header().Add("Vary", "Accept-Encoding")
+		c.w.Header().Del("Content-Length")
+	}
+	c.w.WriteHeader(statusCode)
+}
+
+// Flush отправляет клиенту уже сжатые данные, что бы ответы, которые
+// обработчик отдает порциями (страница с информацией), не задерживались
+// до конца сжатия.
+func (c *compressWriter) Flush() {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if c.zw != nil {
+		_ = c.zw.Flush()
+	}
+	if f, ok := c.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close завершает сжатый поток. Если заголовок уже обещал сжатие,
+// а тело так и не было записано, отправляется пустой сжатый поток.
+func (c *compressWriter) Close() error {
+	if c.compress && c.zw == nil {
+		zw, err := c.codec.NewWriter(c.w)
+		if err != nil {
+			return err
+		}
+		c.zw = zw
+	}
+	if c.zw == nil {
+		return nil
+	}
+	return c.zw.Close()
+}
+
+func bodyAllowed(statusCode int) bool {
+	return statusCode != http.StatusNoContent && statusCode != http.StatusNotModified
+}
+
+type compressReader struct {
+	r  io.ReadCloser
+	zr io.ReadCloser
+}
+
+func newCompressReader(r io.ReadCloser, codec compress.Codec) (*compressReader, error) {
+	zr, err := codec.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &compressReader{
+		r:  r,
+		zr: zr,
+	}, nil
+}
+
+func (c compressReader) Read(p []byte) (n int, err error) {
+	return c.zr.Read(p)
+}
+
+func (c *compressReader) Close() error {
+	if err := c.r.Close(); err != nil {
+		return err
+	}
+	return c.zr.Close()
+}
+
+// readCompressedBody распаковывает тело запроса целиком, но не больше limit
+// байт. Обрезанное или поврежденное тело (в том числе из-за неверного
+// Content-Length) дает ошибку до вызова обработчика, а не частично
+// разобранные данные.
+func readCompressedBody(body io.ReadCloser, codec compress.Codec, limit int64) ([]byte, error) {
+	cr, err := newCompressReader(body, codec)
+	if err != nil {
+		return nil, err
+	}
+	defer cr.Close()
+
+	data, err := io.ReadAll(io.LimitReader(cr, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return data, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-musthave-devops-trainer/internal/clock"
+)
+
+// rateWindow размер скользящего окна для расчета частоты запросов.
+const rateWindow = time.Minute
+
+// connStats учет открытых соединений и частоты запросов.
+type connStats struct {
+	active int64
+
+	mu      sync.Mutex
+	clock   clock.Clock
+	buckets [int(rateWindow / time.Second)]rateBucket
+}
+
+// rateBucket количество запросов за одну секунду.
+type rateBucket struct {
+	second int64
+	count  int64
+}
+
+func newConnStats(c clock.Clock) *connStats {
+	return &connStats{clock: c}
+}
+
+// track обработчик http.Server.ConnState.
+func (s *connStats) track(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&s.active, 1)
+	case http.StateHijacked, http.StateClosed:
+		atomic.AddInt64(&s.active, -1)
+	}
+}
+
+func (s *connStats) Active() int64 {
+	return atomic.LoadInt64(&s.active)
+}
+
+// middleware учитывает каждый запрос в скользящем окне.
+func (s *connStats) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.observe()
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *connStats) observe() {
+	now := s.clock.Now().Unix()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := &s.buckets[now%int64(len(s.buckets))]
+	if b.second != now {
+		b.second = now
+		b.count = 0
+	}
+	b.count++
+}
+
+// Rate средняя частота запросов в секунду за последнюю минуту.
+func (s *connStats) Rate() float64 {
+	now := s.clock.Now().Unix()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var total int64
+	for _, b := range s.buckets {
+		if now-b.second < int64(len(s.buckets)) {
+			total += b.count
+		}
+	}
+	return float64(total) / rateWindow.Seconds()
+}
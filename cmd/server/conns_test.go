@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go-musthave-devops-trainer/internal/clock"
+	"go-musthave-devops-trainer/internal/store"
+)
+
+func TestConnStatsActive(t *testing.T) {
+	conns := newConnStats(clock.Real())
+	srv := httptest.NewUnstartedServer(newRouter(&serverStorage{db: store.NewFDB(context.Background()), conns: conns}))
+	srv.Config.ConnState = conns.track
+	srv.Start()
+	defer srv.Close()
+
+	waitActive := func(want int64) {
+		t.Helper()
+		for i := 0; i < 100 && conns.Active() != want; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if got := conns.Active(); got != want {
+			t.Fatalf("want %d active connections, got %d", want, got)
+		}
+	}
+
+	addr := srv.Listener.Addr().String()
+	c1, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitActive(2)
+
+	// Сервер узнает о закрытии соединения клиентом при попытке чтения.
+	c2.Close()
+	waitActive(1)
+	c1.Close()
+	waitActive(0)
+}
+
+func TestConnStatsRate(t *testing.T) {
+	c := clock.NewFake(time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC))
+	conns := newConnStats(c)
+
+	for i := 0; i < 30; i++ {
+		conns.observe()
+	}
+	c.Advance(30 * time.Second)
+	for i := 0; i < 30; i++ {
+		conns.observe()
+	}
+	if got := conns.Rate(); got != 1 {
+		t.Errorf("want 1 rps, got %v", got)
+	}
+
+	// Запросы старше окна не учитываются.
+	c.Advance(45 * time.Second)
+	if got := conns.Rate(); got != 0.5 {
+		t.Errorf("want 0.5 rps, got %v", got)
+	}
+	c.Advance(time.Minute)
+	if got := conns.Rate(); got != 0 {
+		t.Errorf("want 0 rps, got %v", got)
+	}
+}
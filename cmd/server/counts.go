@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// seriesCountsTTL как долго количество метрик используется без повторного
+// чтения из хранилища.
+const seriesCountsTTL = 30 * time.Second
+
+// seriesCounts количество уникальных метрик по типам для ограничений
+// и порога предупреждения, что бы не запрашивать его у хранилища (в базе -
+// count(*)) при каждой записи новой метрики. Новые метрики, принятые
+// сервером, учитываются сразу, изменения в обход него (удаление датчиков
+// по TTL, другие экземпляры сервера с той же базой) - при следующем
+// чтении, не позднее seriesCountsTTL. Нулевое значение готово к работе.
+type seriesCounts struct {
+	mu      sync.Mutex
+	entries map[string]seriesCount
+}
+
+type seriesCount struct {
+	n    int
+	read time.Time
+}
+
+// get возвращает количество метрик типа mtype, читая его через read,
+// если значения нет или оно старше seriesCountsTTL.
+func (sc *seriesCounts) get(ctx context.Context, mtype string, now time.Time, read func(ctx context.Context) (int, error)) (int, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if e, ok := sc.entries[mtype]; ok && now.Sub(e.read) < seriesCountsTTL {
+		return e.n, nil
+	}
+	n, err := read(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if sc.entries == nil {
+		sc.entries = make(map[string]seriesCount)
+	}
+	sc.entries[mtype] = seriesCount{n: n, read: now}
+	return n, nil
+}
+
+// add учитывает новую метрику типа mtype.
+func (sc *seriesCounts) add(mtype string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if e, ok := sc.entries[mtype]; ok {
+		e.n++
+		sc.entries[mtype] = e
+	}
+}
+
+// reset сбрасывает количество после изменений, которые сервер не учитывает
+// по одной метрике: удаление, импорт, ошибка записи принятых метрик.
+func (sc *seriesCounts) reset() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.entries = nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// runtimeDescriptions описания метрик runtime, отправляемых агентом.
+var runtimeDescriptions = map[string]string{
+	"PollCount":     "Number of metric polls performed by the agent.",
+	"RandomValue":   "Random value updated on every poll.",
+	"Alloc":         "Bytes of allocated heap objects.",
+	"TotalAlloc":    "Cumulative bytes allocated for heap objects.",
+	"Sys":           "Total bytes of memory obtained from the OS.",
+	"Lookups":       "Number of pointer lookups performed by the runtime.",
+	"Mallocs":       "Cumulative count of heap objects allocated.",
+	"Frees":         "Cumulative count of heap objects freed.",
+	"HeapAlloc":     "Bytes of allocated heap objects.",
+	"HeapSys":       "Bytes of heap memory obtained from the OS.",
+	"HeapIdle":      "Bytes in idle (unused) spans.",
+	"HeapInuse":     "Bytes in in-use spans.",
+	"HeapReleased":  "Bytes of physical memory returned to the OS.",
+	"HeapObjects":   "Number of allocated heap objects.",
+	"StackInuse":    "Bytes in stack spans.",
+	"StackSys":      "Bytes of stack memory obtained from the OS.",
+	"MSpanInuse":    "Bytes of allocated mspan structures.",
+	"MSpanSys":      "Bytes of memory obtained from the OS for mspan structures.",
+	"MCacheInuse":   "Bytes of allocated mcache structures.",
+	"MCacheSys":     "Bytes of memory obtained from the OS for mcache structures.",
+	"BuckHashSys":   "Bytes of memory in profiling bucket hash tables.",
+	"GCSys":         "Bytes of memory in garbage collection metadata.",
+	"OtherSys":      "Bytes of memory in miscellaneous off-heap runtime allocations.",
+	"NextGC":        "Target heap size of the next GC cycle.",
+	"LastGC":        "Time the last garbage collection finished, as nanoseconds since the UNIX epoch.",
+	"PauseTotalNs":  "Cumulative nanoseconds in GC stop-the-world pauses since the program started.",
+	"NumGC":         "Number of completed GC cycles.",
+	"NumForcedGC":   "Number of GC cycles that were forced by the application.",
+	"GCCPUFraction": "Fraction of available CPU time used by the GC since the program started.",
+}
+
+// loadDescriptions возвращает описания метрик для страницы с информацией:
+// описания runtime метрик, дополненные (или переопределенные) из JSON файла
+// вида {"name": "description"}. Пустой путь - только описания runtime метрик.
+func loadDescriptions(path string) (map[string]string, error) {
+	descriptions := make(map[string]string, len(runtimeDescriptions))
+	for k, v := range runtimeDescriptions {
+		descriptions[k] = v
+	}
+	if path == "" {
+		return descriptions, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read descriptions: %w", err)
+	}
+	var custom map[string]string
+	if err := json.Unmarshal(data, &custom); err != nil {
+		return nil, fmt.Errorf("cannot parse descriptions %s: %w", path, err)
+	}
+	for k, v := range custom {
+		descriptions[k] = v
+	}
+	return descriptions, nil
+}
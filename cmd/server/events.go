@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go-musthave-devops-trainer/internal/logger"
+	"go-musthave-devops-trainer/internal/store"
+)
+
+// eventsKeepAlive интервал комментариев, которые не дают прокси
+// закрыть соединение без событий.
+const eventsKeepAlive = 15 * time.Second
+
+// eventsHandler передает изменения метрик в формате Server-Sent Events,
+// каждое событие - метрика в JSON с новым значением. События для клиента,
+// который не успевает их принимать, отбрасываются хранилищем (см. store.Notifier),
+// после переподключения клиенту стоит перечитать значения целиком.
+func (s *serverStorage) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	n, ok := s.db.(store.Notifier)
+	if !ok {
+		http.Error(w, "Events are not supported by storage", http.StatusNotImplemented)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ctx := r.Context()
+	changes := n.Subscribe(ctx)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	ticker := time.NewTicker(eventsKeepAlive)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.eventsStop:
+			return
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		case c, ok := <-changes:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(c.Metric)
+			_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		if err != nil {
+			logger.Debugf("server: events client gone: %v", err)
+			return
+		}
+		f.Flush()
+	}
+}
+
+// acceptsEvents запрос потока событий, ответ на него не сжимается,
+// что бы события доходили до клиента сразу.
+func acceptsEvents(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
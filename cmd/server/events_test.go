@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go-musthave-devops-trainer/models"
+)
+
+func TestEvents(t *testing.T) {
+	if status, _ := doRequest(t, newTestServer(t, &serverStorage{}), http.MethodGet, "/events", ""); status != http.StatusNotFound {
+		t.Errorf("events must be disabled by default, got %d", status)
+	}
+
+	srv := newTestServer(t, &serverStorage{events: true})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" {
+		t.Fatalf("event stream must not be compressed, got %q", ce)
+	}
+
+	// Подписка оформляется до отправки заголовков, поэтому обновление
+	// после получения ответа обязательно попадает в поток.
+	doRequest(t, srv, http.MethodPost, "/update/", `{"id":"PollCount","type":"counter","delta":2}`)
+
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var m models.Metrics
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.ID != "PollCount" || m.MType != models.Counter || m.Delta == nil || *m.Delta != 2 {
+			t.Errorf("unexpected event: %+v", m)
+		}
+		return
+	}
+	t.Fatalf("no event received: %v", sc.Err())
+}
+
+func TestInfoLiveUpdates(t *testing.T) {
+	server := &serverStorage{}
+	srv := newTestServer(t, server)
+	server.db.UpdateGauge(context.Background(), "Alloc", 1)
+
+	_, body := doRequest(t, srv, http.MethodGet, "/", "")
+	if !strings.Contains(body, `http-equiv="refresh"`) || strings.Contains(body, "EventSource") {
+		t.Errorf("page refresh expected without events:\n%s", body)
+	}
+
+	server.events = true
+	_, body = doRequest(t, srv, http.MethodGet, "/", "")
+	for _, want := range []string{"EventSource", `<span id="gauge-Alloc">1.000</span>`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("%q expected in page:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, `http-equiv="refresh"`) {
+		t.Error("page refresh not expected with events")
+	}
+}
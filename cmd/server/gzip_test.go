@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go-musthave-devops-trainer/internal/compress"
+	"go-musthave-devops-trainer/models"
+)
+
+func TestGzipResponses(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{key: []byte("secret")})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		want   string
+	}{
+		{"update ok", http.MethodPost, "/update/counter/c/1", "", http.StatusOK, ""},
+		{"value ok", http.MethodGet, "/value/counter/c", "", http.StatusOK, "1"},
+		{"bad request", http.MethodPost, "/update/", "{", http.StatusBadRequest, "Bad request body given"},
+		{"hash mismatch", http.MethodPost, "/updates/", `[{"id":"c","type":"counter","delta":1,"hash":"bad"}]`, http.StatusConflict, "Incorrect hash of counter"},
+		{"not found", http.MethodPost, "/value/", `{"id":"unknown","type":"counter"}`, http.StatusNotFound, "Metrics not found"},
+		{"unknown type", http.MethodPost, "/update/histogram/h/1", "", http.StatusNotImplemented, "unknown type of metrics"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Заголовок выставлен явно, поэтому клиент не распаковывает ответ сам.
+			req.Header.Set("Accept-Encoding", "gzip")
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("want status %d, got %d", tt.status, resp.StatusCode)
+			}
+			if enc := resp.Header.Get("Content-Encoding"); enc != "gzip" {
+				t.Fatalf("want gzip encoding, got %q", enc)
+			}
+			zr, err := gzip.NewReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(body), tt.want) {
+				t.Errorf("want body containing %q, got %q", tt.want, body)
+			}
+		})
+	}
+}
+
+func TestGzipNotRequested(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{})
+
+	status, body := doRequest(t, srv, http.MethodPost, "/update/", "{")
+	if status != http.StatusBadRequest || body != "Bad request body given" {
+		t.Errorf("unexpected response: %d %q", status, body)
+	}
+}
+
+// Клиент без Accept-Encoding получает несжатые ответы без Content-Encoding.
+func TestGzipPlainClient(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{})
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	do := func(method, path, body string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enc := resp.Header.Get("Content-Encoding"); enc != "" {
+			t.Errorf("%s %s: unexpected Content-Encoding %q", method, path, enc)
+		}
+		return resp, string(b)
+	}
+
+	_, body := do(http.MethodPost, "/update/", `{"id":"c","type":"counter","delta":2}`)
+	var m models.Metrics
+	if err := json.Unmarshal([]byte(body), &m); err != nil || m.Delta == nil || *m.Delta != 2 {
+		t.Errorf("want plain JSON metric, got %q, %v", body, err)
+	}
+	if resp, body := do(http.MethodGet, "/", ""); resp.StatusCode != http.StatusOK || !strings.Contains(body, "<html>") {
+		t.Errorf("want plain info page, got %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestGzipFlush(t *testing.T) {
+	codec, _ := compress.Lookup("gzip")
+	rec := httptest.NewRecorder()
+	cw := newCompressWriter(rec, codec)
+	var w http.ResponseWriter = cw
+	f, ok := w.(http.Flusher)
+	if !ok {
+		t.Fatal("compressWriter must implement http.Flusher")
+	}
+
+	_, _ = w.Write([]byte("first rows"))
+	f.Flush()
+	if !rec.Flushed {
+		t.Error("want underlying writer flushed")
+	}
+	// До завершения потока клиенту доступно все, что записано до Flush.
+	zr, err := gzip.NewReader(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len("first rows"))
+	if _, err := io.ReadFull(zr, got); err != nil || string(got) != "first rows" {
+		t.Errorf("want flushed data, got %q, %v", got, err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func gzipBody(t *testing.T, body string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGzipRequestBody(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{})
+	valid := gzipBody(t, `[{"id":"c","type":"counter","delta":1}]`)
+
+	tests := []struct {
+		name   string
+		body   []byte
+		status int
+	}{
+		{"valid", valid, http.StatusOK},
+		{"not gzip", []byte(`[{"id":"c","type":"counter","delta":1}]`), http.StatusBadRequest},
+		// Данные целы, обрезан только трейлер с контрольной суммой.
+		{"truncated trailer", valid[:len(valid)-4], http.StatusBadRequest},
+		{"truncated data", valid[:len(valid)/2], http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, srv.URL+"/updates/", bytes.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Encoding", "gzip")
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("want status %d, got %d", tt.status, resp.StatusCode)
+			}
+		})
+	}
+
+	// Счетчик обновлен только корректным запросом.
+	if _, body := doRequest(t, srv, http.MethodGet, "/value/counter/c", ""); body != "1" {
+		t.Errorf("want counter 1, got %q", body)
+	}
+}
+
+func TestGzipLegacyBodyLimit(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{})
+	// Сжатое тело меньше ограничения, распакованное - больше.
+	big := gzipBody(t, strings.Repeat("x", maxLegacyBodySize+1))
+	if len(big) > maxLegacyBodySize {
+		t.Fatalf("compressed body is too large: %d", len(big))
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   []byte
+		status int
+	}{
+		{"legacy update", http.MethodPost, "/update/counter/c/1", big, http.StatusRequestEntityTooLarge},
+		{"legacy value", http.MethodGet, "/value/counter/c", big, http.StatusRequestEntityTooLarge},
+		{"legacy update small", http.MethodPost, "/update/counter/c/1", gzipBody(t, "small"), http.StatusOK},
+		// Тела остальных маршрутов ограничены maxDecompressedSize.
+		{"json update", http.MethodPost, "/update/", gzipBody(t, `{"id":"g","type":"gauge","value":1}`+strings.Repeat(" ", maxLegacyBodySize)), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, bytes.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Encoding", "gzip")
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("want status %d, got %d", tt.status, resp.StatusCode)
+			}
+		})
+	}
+
+	// Отклоненное обновление не применено.
+	if _, body := doRequest(t, srv, http.MethodGet, "/value/counter/c", ""); body != "1" {
+		t.Errorf("want counter 1, got %q", body)
+	}
+}
+
+func TestBodyLimit(t *testing.T) {
+	tests := []struct {
+		method string
+		target string
+		want   int64
+	}{
+		{http.MethodPost, "/update/counter/c/1", maxLegacyBodySize},
+		{http.MethodPost, "/update/gauge/a%2Fb/1", maxLegacyBodySize},
+		{http.MethodGet, "/value/gauge/Alloc", maxLegacyBodySize},
+		{http.MethodPost, "/update/", maxDecompressedSize},
+		{http.MethodPost, "/updates/", maxDecompressedSize},
+		{http.MethodPost, "/admin/import", maxDecompressedSize},
+		{http.MethodDelete, "/value/gauge/Alloc", maxDecompressedSize},
+	}
+	for _, tt := range tests {
+		if got := bodyLimit(httptest.NewRequest(tt.method, tt.target, nil)); got != tt.want {
+			t.Errorf("%s %s: want %d, got %d", tt.method, tt.target, tt.want, got)
+		}
+	}
+}
+
+func TestGzipContentLengthMismatch(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{})
+	body := gzipBody(t, `[{"id":"c","type":"counter","delta":1}]`)
+
+	tests := []struct {
+		name          string
+		contentLength int
+	}{
+		{"shorter than body", len(body) - 5},
+		{"longer than body", len(body) + 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			fmt.Fprintf(conn, "POST /updates/ HTTP/1.1\r\nHost: test\r\nContent-Encoding: gzip\r\n"+
+				"Content-Length: %d\r\nConnection: close\r\n\r\n", tt.contentLength)
+			_, _ = conn.Write(body)
+			// Клиент больше ничего не пришлет.
+			_ = conn.(*net.TCPConn).CloseWrite()
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("want status 400, got %d", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestCompressCodecs(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{})
+
+	for _, name := range []string{"gzip", "deflate", "zstd"} {
+		t.Run(name, func(t *testing.T) {
+			codec, _ := compress.Lookup(name)
+			var buf bytes.Buffer
+			zw, err := codec.NewWriter(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = io.WriteString(zw, `{"id":"`+name+`","type":"counter","delta":1}`)
+			if err := zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			req, err := http.NewRequest(http.MethodPost, srv.URL+"/update/", &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Encoding", name)
+			req.Header.Set("Accept-Encoding", name)
+			req.Header.Set("Accept", "application/json")
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("want 200, got %d", resp.StatusCode)
+			}
+			if enc := resp.Header.Get("Content-Encoding"); enc != name {
+				t.Fatalf("want %s response, got %q", name, enc)
+			}
+			zr, err := codec.NewReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer zr.Close()
+			body, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(body), `"delta":1`) {
+				t.Errorf("unexpected body %q", body)
+			}
+		})
+	}
+}
+
+func TestCompressNegotiation(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{})
+
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"gzip, zstd, deflate", "gzip"},
+		{"zstd, gzip", "zstd"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"br", ""},
+		{"identity", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/value/all", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Accept-Encoding", tt.accept)
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if enc := resp.Header.Get("Content-Encoding"); enc != tt.want {
+				t.Errorf("want encoding %q, got %q", tt.want, enc)
+			}
+			if adv := resp.Header.Get("Accept-Encoding"); adv != compress.Advertise() {
+				t.Errorf("supported encodings must be advertised, got %q", adv)
+			}
+		})
+	}
+
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/updates/", strings.NewReader("[]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Encoding", "br")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("want 415 for unsupported encoding, got %d", resp.StatusCode)
+	}
+}
@@ -1,17 +1,26 @@
 package main
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
-	"log"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"go-musthave-devops-trainer/internal/logger"
+	"go-musthave-devops-trainer/internal/sign"
+	"go-musthave-devops-trainer/internal/store"
+	"go-musthave-devops-trainer/internal/wire"
 	"go-musthave-devops-trainer/models"
+
+	"github.com/go-chi/chi/v5"
 )
 
 func (s *serverStorage) updateHandler(w http.ResponseWriter, r *http.Request) {
@@ -21,10 +30,9 @@ func (s *serverStorage) updateHandler(w http.ResponseWriter, r *http.Request) {
 	// Сервер не санитайзит полученные данные.
 	// Вероятно добавим позднее, т.к. боюсь перегружать инкремент.
 	var req models.Metrics
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil || req.ID == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		_, _ = w.Write([]byte("Bad request body given"))
+	err := decodeJSON(r.Body, &req)
+	if err != nil || req.ID == "" || !models.ValidTags(req.Tags) {
+		writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Bad request body given")
 		return
 	}
 
@@ -32,92 +40,260 @@ func (s *serverStorage) updateHandler(w http.ResponseWriter, r *http.Request) {
 	defer s.Unlock()
 	switch {
 	case req.MType == models.Counter && req.Delta != nil:
-		data := fmt.Sprintf("%s:%s:%d", req.ID, req.MType, *req.Delta)
-		if !s.hashCorrect(data, req.Hash) {
-			w.WriteHeader(http.StatusBadRequest)
-			_, _ = w.Write([]byte("Incorrect hash of counter"))
+		delta, ok := counterDelta(req)
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Sample rate of counter is out of range")
 			return
 		}
-		count := s.db.UpdateCounter(ctx, req.ID, *req.Delta)
-		log.Printf("server: update %s %s=%d, %d\n", req.MType, req.ID, *req.Delta, count)
-	case req.MType == models.Gauge && req.Value != nil:
-		data := fmt.Sprintf("%s:%s:%f", req.ID, req.MType, *req.Value)
-		if !s.hashCorrect(data, req.Hash) {
-			w.WriteHeader(http.StatusBadRequest)
-			_, _ = w.Write([]byte("Incorrect hash of gauge"))
+		if !s.hashCorrect(req) {
+			writeError(w, r, http.StatusConflict, errCodeHashMismatch, "Incorrect hash of counter")
+			return
+		}
+		if !s.signedInWindow(req) {
+			writeError(w, r, http.StatusConflict, errCodeTimestampSkew, "Signing time of counter is out of window")
+			return
+		}
+		// Имя преобразуется после проверки подписи, подписано исходное имя.
+		id := s.seriesID(req)
+		ok, err := s.withinLimit(ctx, req.MType, id, nil)
+		if err != nil {
+			limitError(w, r, req.MType, id, err)
+			return
+		}
+		if !ok {
+			writeError(w, r, http.StatusInsufficientStorage, errCodeLimitExceeded, "Too many distinct counters")
+			return
+		}
+		total, err := s.db.IncrAndGet(ctx, id, delta)
+		if err != nil {
+			s.counts.reset()
+		}
+		if errors.Is(err, store.ErrUnavailable) {
+			writeError(w, r, http.StatusServiceUnavailable, errCodeUnavailable, "Storage is temporarily unavailable")
+			return
+		}
+		if err != nil {
+			logger.Errorf("update %s: %s, error: %v\n", req.MType, id, err)
+			writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Storage error")
 			return
 		}
-		count := s.db.UpdateGauge(ctx, req.ID, *req.Value)
-		log.Printf("server: update %s %s=%.3f, %d\n", req.MType, req.ID, *req.Value, count)
+		logger.Debugf("server: update %s %s=%d, %d\n", req.MType, id, delta, total)
+		s.setObserved(ctx, req, id)
+		s.checkCardinality(ctx)
+		// Клиенты, запросившие JSON, получают новое значение счетчика.
+		if acceptsJSON(r) {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(models.Metrics{ID: s.names.apply(req.ID), MType: req.MType, Delta: &total, ObservedAt: req.ObservedAt, Tags: req.Tags})
+			return
+		}
+	case req.MType == models.Gauge && (req.Value != nil || req.Delta != nil):
+		if !s.hashCorrect(req) {
+			writeError(w, r, http.StatusConflict, errCodeHashMismatch, "Incorrect hash of gauge")
+			return
+		}
+		if !s.signedInWindow(req) {
+			writeError(w, r, http.StatusConflict, errCodeTimestampSkew, "Signing time of gauge is out of window")
+			return
+		}
+		// Имя преобразуется после проверки подписи, подписано исходное имя.
+		id := s.seriesID(req)
+		ok, err := s.withinLimit(ctx, req.MType, id, nil)
+		if err != nil {
+			limitError(w, r, req.MType, id, err)
+			return
+		}
+		if !ok {
+			writeError(w, r, http.StatusInsufficientStorage, errCodeLimitExceeded, "Too many distinct gauges")
+			return
+		}
+		value := s.roundGauge(gaugeValue(req))
+		count := s.db.UpdateGauge(ctx, id, value)
+		logger.Debugf("server: update %s %s=%.3f, %d\n", req.MType, id, value, count)
+		s.setObserved(ctx, req, id)
+		s.checkCardinality(ctx)
 	default:
-		w.WriteHeader(http.StatusNotImplemented)
-		_, _ = w.Write([]byte("Unknown type of metrics"))
+		writeError(w, r, http.StatusNotImplemented, errCodeUnknownType, "Unknown type of metrics")
 		return
 	}
-	// w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Content-Encoding", "gzip")
 }
 
 func (s *serverStorage) updatesHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	ctx := r.Context()
 
+	// Двоичный формат передается агентом по запросу, по умолчанию JSON.
 	var metrics []models.Metrics
-	err := json.NewDecoder(r.Body).Decode(&metrics)
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), wire.ContentType) {
+		metrics, err = wire.Decode(r.Body)
+	} else {
+		err = decodeJSON(r.Body, &metrics)
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_, _ = w.Write([]byte("Bad request body given"))
+		writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Bad request body given")
 		return
 	}
 
 	if len(metrics) == 0 {
 		w.WriteHeader(http.StatusNoContent)
-		_, _ = w.Write([]byte("Empty request"))
+		return
+	}
+
+	var rejected []rejectedMetric
+	unknown := 0
+	reject := func(m models.Metrics, code, message string) {
+		rejected = append(rejected, rejectedMetric{ID: m.ID, MType: m.MType, Code: code, Message: message})
+		if code == errCodeUnknownType {
+			unknown++
+		}
 	}
+	hashErrs := 0
 
-	errs := []string{}
+	// Хранилище с BatchUpdater получает принятые метрики одной пачкой
+	// после проверки всех, остальные - по одной.
+	batcher, batched := s.db.(store.BatchUpdater)
+	var (
+		batch   []models.Metrics
+		pending batchSeries
+	)
+	if batched {
+		pending = make(batchSeries)
+	}
 
 	s.Lock()
 	defer s.Unlock()
 	for _, m := range metrics {
 		if m.ID == "" {
-			errs = append(errs, "Taked metric with empty ID")
+			reject(m, errCodeBadRequest, "Taked metric with empty ID")
+			continue
+		}
+		if !models.ValidTags(m.Tags) {
+			reject(m, errCodeBadRequest, fmt.Sprintf("Invalid tags of metric: %q", m.ID))
 			continue
 		}
 		switch {
 		case m.MType == models.Counter && m.Delta != nil:
-			data := fmt.Sprintf("%s:%s:%d", m.ID, m.MType, *m.Delta)
-			if !s.hashCorrect(data, m.Hash) {
-				errs = append(errs, fmt.Sprintf("Incorrect hash of counter: %q", m.ID))
+			delta, ok := counterDelta(m)
+			if !ok {
+				reject(m, errCodeBadRequest, fmt.Sprintf("Sample rate of counter is out of range: %q", m.ID))
+				continue
+			}
+			if !s.hashCorrect(m) {
+				reject(m, errCodeHashMismatch, fmt.Sprintf("Incorrect hash of counter: %q", m.ID))
+				hashErrs++
+				continue
+			}
+			if !s.signedInWindow(m) {
+				reject(m, errCodeTimestampSkew, fmt.Sprintf("Signing time of counter is out of window: %q", m.ID))
+				continue
+			}
+			id := s.seriesID(m)
+			ok, err := s.withinLimit(ctx, m.MType, id, pending)
+			if err != nil {
+				// Ни одна метрика пачки не записывается, пачку можно повторить.
+				s.updates.add(0, len(metrics)-unknown, unknown)
+				limitError(w, r, m.MType, id, err)
+				return
+			}
+			if !ok {
+				reject(m, errCodeLimitExceeded, fmt.Sprintf("Too many distinct counters: %q", m.ID))
+				continue
+			}
+			if batched {
+				batch = append(batch, models.Metrics{ID: id, MType: m.MType, Delta: &delta, ObservedAt: m.ObservedAt})
+				continue
+			}
+			count := s.db.UpdateCounter(ctx, id, delta)
+			logger.Debugf("server: update %s %s=%d, %d\n", m.MType, id, delta, count)
+			s.setObserved(ctx, m, id)
+		case m.MType == models.Gauge && (m.Value != nil || m.Delta != nil):
+			if !s.hashCorrect(m) {
+				reject(m, errCodeHashMismatch, fmt.Sprintf("Incorrect hash of gauge: %q", m.ID))
+				hashErrs++
+				continue
+			}
+			if !s.signedInWindow(m) {
+				reject(m, errCodeTimestampSkew, fmt.Sprintf("Signing time of gauge is out of window: %q", m.ID))
 				continue
 			}
-			count := s.db.UpdateCounter(ctx, m.ID, *m.Delta)
-			log.Printf("server: update %s %s=%d, %d\n", m.MType, m.ID, *m.Delta, count)
-		case m.MType == models.Gauge && m.Value != nil:
-			data := fmt.Sprintf("%s:%s:%f", m.ID, m.MType, *m.Value)
-			if !s.hashCorrect(data, m.Hash) {
-				errs = append(errs, fmt.Sprintf("Incorrect hash of gauge: %q", m.ID))
+			id := s.seriesID(m)
+			ok, err := s.withinLimit(ctx, m.MType, id, pending)
+			if err != nil {
+				// Ни одна метрика пачки не записывается, пачку можно повторить.
+				s.updates.add(0, len(metrics)-unknown, unknown)
+				limitError(w, r, m.MType, id, err)
+				return
+			}
+			if !ok {
+				reject(m, errCodeLimitExceeded, fmt.Sprintf("Too many distinct gauges: %q", m.ID))
 				continue
 			}
-			count := s.db.UpdateGauge(ctx, m.ID, *m.Value)
-			log.Printf("server: update %s %s=%.3f, %d\n", m.MType, m.ID, *m.Value, count)
+			value := s.roundGauge(gaugeValue(m))
+			if batched {
+				batch = append(batch, models.Metrics{ID: id, MType: m.MType, Value: &value, ObservedAt: m.ObservedAt})
+				continue
+			}
+			count := s.db.UpdateGauge(ctx, id, value)
+			logger.Debugf("server: update %s %s=%.3f, %d\n", m.MType, id, value, count)
+			s.setObserved(ctx, m, id)
 		default:
-			errs = append(errs, fmt.Sprintf("Unknown type %q or content of metrics: %q", m.MType, m.ID))
+			reject(m, errCodeUnknownType, fmt.Sprintf("Unknown type %q or content of metrics: %q", m.MType, m.ID))
 			continue
 		}
 	}
+	if len(batch) > 0 {
+		if err := batcher.UpdateBatch(ctx, batch); err != nil {
+			logger.Errorf("server: batch update of %d metrics failed: %v", len(batch), err)
+			s.counts.reset()
+			s.updates.add(0, len(metrics)-unknown, unknown)
+			if errors.Is(err, store.ErrUnavailable) {
+				writeError(w, r, http.StatusServiceUnavailable, errCodeUnavailable, "Storage is temporarily unavailable")
+				return
+			}
+			writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Storage error")
+			return
+		}
+		logger.Debugf("server: batch update of %d metrics\n", len(batch))
+		for _, m := range batch {
+			s.setObserved(ctx, m, m.ID)
+		}
+	}
+	s.checkCardinality(ctx)
+	s.updates.add(len(metrics)-len(rejected), len(rejected)-unknown, unknown)
 
-	if len(errs) != 0 {
-		if len(errs) == len(metrics) {
-			w.WriteHeader(http.StatusBadRequest)
+	if len(rejected) != 0 {
+		// Клиенты, запросившие JSON, получают результат по каждой
+		// отклоненной метрике, остальные - текстовый список причин.
+		asJSON := acceptsJSON(r)
+		if asJSON {
+			w.Header().Set("Content-Type", "application/json")
 		} else {
+			w.Header().Set("Content-Type", "text/plain")
+		}
+		switch {
+		case hashErrs == len(metrics):
+			w.Header().Set(errCodeHeader, errCodeHashMismatch)
+			w.WriteHeader(http.StatusConflict)
+		case len(rejected) == len(metrics):
+			w.WriteHeader(http.StatusBadRequest)
+		default:
 			w.WriteHeader(http.StatusPartialContent)
 		}
-		w.Header().Set("Content-Type", "text/plain")
-		w.Header().Set("Content-Encoding", "gzip")
+
+		errs := make([]string, 0, len(rejected))
+		for _, rm := range rejected {
+			errs = append(errs, rm.Message)
+		}
 		resp := strings.Join(errs, "\n")
-		log.Println(resp)
+		logger.Warnf("server: rejected metrics:\n%s", resp)
+		if asJSON {
+			_ = json.NewEncoder(w).Encode(&updatesResult{
+				Accepted: len(metrics) - len(rejected),
+				Rejected: rejected,
+			})
+			return
+		}
 		_, _ = w.Write([]byte(resp))
 		return
 	}
@@ -127,59 +303,60 @@ func (s *serverStorage) updatesHandler(w http.ResponseWriter, r *http.Request) {
 
 func (s *serverStorage) valueHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	ctx := r.Context()
 
 	// Сервер не санитайзит полученные данные.
 	// Вероятно добавим позднее, т.к. боюсь перегружать инкремент.
 	var m models.Metrics
-	err := json.NewDecoder(r.Body).Decode(&m)
-	if err != nil || m.ID == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		_, _ = w.Write([]byte("Bad request body given"))
+	err := decodeJSON(r.Body, &m)
+	if err != nil || m.ID == "" || !models.ValidTags(m.Tags) {
+		writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Bad request body given")
 		return
 	}
-	log.Printf("get %s: %s\n", m.MType, m.ID)
+	s.writeMetric(w, r, m.MType, m.ID, m.Tags)
+}
+
+// writeMetric отправляет метрику в JSON вместе с подписью сервера.
+// Метрика с тегами ищется по имени ряда (см. models.SeriesID), в ответе
+// имя и теги передаются раздельно, как в запросе.
+func (s *serverStorage) writeMetric(w http.ResponseWriter, r *http.Request, mtype, id string, tags map[string]string) {
+	ctx := r.Context()
+	logger.Debugf("get %s: %s\n", mtype, id)
 
-	var ok bool
 	s.Lock()
 	defer s.Unlock()
-	var data string
+	name := s.names.apply(id)
+	m, ok, err := s.db.Get(ctx, mtype, models.SeriesID(name, tags))
 	switch {
-	case m.MType == models.Counter:
-		var result int64
-		result, ok = s.db.Counter(ctx, m.ID)
-		m.Delta = &result
-		data = fmt.Sprintf("%s:%s:%d", m.ID, m.MType, *m.Delta)
-	case m.MType == models.Gauge:
-		var result float64
-		result, ok = s.db.Gauge(ctx, m.ID)
-		m.Value = &result
-		data = fmt.Sprintf("%s:%s:%f", m.ID, m.MType, *m.Value)
-	default:
-		log.Printf("unknown type of metrics: %s\n", m.MType)
-		w.WriteHeader(http.StatusNotImplemented)
-		_, _ = w.Write([]byte("Unknown type of metrics"))
+	case errors.Is(err, store.ErrUnavailable):
+		writeError(w, r, http.StatusServiceUnavailable, errCodeUnavailable, "Storage is temporarily unavailable")
 		return
-	}
-
-	if !ok {
-		w.WriteHeader(http.StatusNotFound)
-		_, _ = w.Write([]byte("Metrics not found"))
+	case errors.Is(err, store.ErrUnknownType):
+		logger.Warnf("unknown type of metrics: %s\n", mtype)
+		writeError(w, r, http.StatusNotImplemented, errCodeUnknownType, "Unknown type of metrics")
+		return
+	case err != nil:
+		logger.Errorf("get %s: %s, error: %v\n", mtype, id, err)
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Storage error")
+		return
+	case !ok:
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Metrics not found")
 		return
 	}
 
-	if len(s.key) > 0 {
-		h := hmac.New(sha256.New, s.key)
-		h.Write([]byte(data))
-		hash := fmt.Sprintf("%x", h.Sum(nil))
-		m.Hash = hash
+	if o, ok := s.db.(store.Observations); ok {
+		if t, ok := o.Observed(ctx, m.MType, m.ID); ok {
+			m.ObservedAt = t.UnixMilli()
+		}
 	}
+	if len(tags) > 0 {
+		m.ID, m.Tags = name, tags
+	}
+	m.Hash = sign.Hash(s.key, m)
 
 	jsonBody, err := json.Marshal(m)
-	log.Printf("get result %s: %s, body: %s\n", m.MType, m.ID, jsonBody)
+	logger.Debugf("get result %s: %s, body: %s\n", m.MType, m.ID, jsonBody)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte("Encoding error"))
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Encoding error")
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -187,55 +364,505 @@ func (s *serverStorage) valueHandler(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte(jsonBody))
 }
 
+// deleteHandler удаляет метрику, например устаревший ряд после
+// переименования. Имя преобразуется так же, как при записи.
+func (s *serverStorage) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "Undefined field 'id'")
+		return
+	}
+	id = s.legacySeriesID(id)
+
+	mtype := chi.URLParam(r, "type")
+
+	s.Lock()
+	defer s.Unlock()
+	var deleted bool
+	switch mtype {
+	case models.Counter:
+		deleted = s.db.DeleteCounter(ctx, id)
+	case models.Gauge:
+		deleted = s.db.DeleteGauge(ctx, id)
+	default:
+		writeError(w, r, http.StatusNotImplemented, errCodeUnknownType, "Unknown type of metrics")
+		return
+	}
+	if !deleted {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Metrics not found")
+		return
+	}
+	s.counts.reset()
+	logger.Infof("server: %s %q deleted", mtype, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (s *serverStorage) infoHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	ctx := r.Context()
 
-	// Тут бы пригодились шаблоны, но увы...
-	// Кроме того, верстку можно было бы сделать лучше,
-	// но как мне кажется, это на текущий момент не так уж принципиально.
-	// Впрочем, обсуждаемо...
-	// w.Header().Set("Content-Type", "text/plain")
-	// w.Header().Set("Content-Encoding", "gzip")
+	filter, err := parseInfoFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Под блокировкой только копируются значения, страница формируется
+	// после ее снятия, что бы медленный клиент не задерживал обновления.
+	page := &infoPage{Events: s.events, w: w}
+	s.Lock()
+	page.Gen = s.db.UpdateCount(ctx)
+	page.Timestamp = s.db.Timestamp(ctx, time.StampMilli)
+	matchCounter, matchGauge := filter.matcher(), filter.matcher()
+	err = s.mapMetrics(ctx, func(k string, v int64) {
+		if matchCounter(k) {
+			page.Counters = append(page.Counters, s.infoRow(models.Counter, k, fmt.Sprintf("%d", v)))
+		}
+	}, func(k string, v float64) {
+		if matchGauge(k) {
+			page.Gauges = append(page.Gauges, s.infoRow(models.Gauge, k, fmt.Sprintf("%.3f", v)))
+		}
+	})
+	s.Unlock()
+	if err != nil {
+		logger.Errorf("server: read all metrics: %v", err)
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
+	if err := infoTemplate.Execute(w, page); err != nil {
+		// Заголовки уже отправлены, остается только записать в лог.
+		logger.Errorf("server: render info page: %v", err)
+	}
+}
 
-	s.Lock()
-	defer s.Unlock()
-	_, _ = io.WriteString(w, `<html>
+// infoPage данные страницы с информацией.
+type infoPage struct {
+	Events    bool // обновление по событиям вместо перезагрузки
+	Gen       int
+	Timestamp string
+	Counters  []infoRow
+	Gauges    []infoRow
+
+	w    http.ResponseWriter
+	rows int
+}
+
+// Flush вызывается шаблоном после каждой строки: строки отправляются
+// клиенту порциями по мере формирования.
+func (p *infoPage) Flush() string {
+	if p.rows++; p.rows%infoFlushRows == 0 {
+		if f, ok := p.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	return ""
+}
+
+// infoRow строка страницы с информацией.
+type infoRow struct {
+	Name        string // имя без тегов
+	Tags        string
+	Description string
+	Value       string
+	ElemID      string // id элемента для обновления по событиям
+}
+
+// infoRow строка метрики для страницы с информацией. Описание задается
+// для имени без тегов и выводится всплывающей подсказкой и вторичным текстом.
+func (s *serverStorage) infoRow(mtype, id, value string) infoRow {
+	base, tags := models.ParseSeriesID(id)
+	row := infoRow{Name: base, Description: s.descriptions[base], Value: value}
+	if len(tags) > 0 {
+		row.Tags = models.JoinTags(tags)
+	}
+	if s.events {
+		row.ElemID = mtype + "-" + id
+	}
+	return row
+}
+
+// infoTemplate шаблон страницы с информацией. Без событий страница
+// перезагружается каждые 5 секунд, с событиями значения обновляются
+// по /events, а при появлении новой метрики страница перезагружается.
+var infoTemplate = template.Must(template.New("info").Parse(`<html>
 <head>
 <title>Metrics, MustHave.DevOps by Yandex-Practicum</title>
-<meta http-equiv="refresh" content="5" />
+{{if .Events}}<script>
+new EventSource("/events").onmessage = function(e) {
+	var m = JSON.parse(e.data);
+	var el = document.getElementById(m.type + "-" + m.id);
+	if (!el) { location.reload(); return; }
+	el.textContent = m.type == "counter" ? m.delta : m.value.toFixed(3);
+};
+</script>{{else}}<meta http-equiv="refresh" content="5" />{{end}}
 </head>
-<body><h1>Metrics values</h1><h3>Main</h3>`)
-	_, _ = io.WriteString(w, `Gen: `+fmt.Sprintf("%d", s.db.UpdateCount(ctx))+"<br>\n")
-	_, _ = io.WriteString(w, `Timestamp: `+s.db.Timestamp(ctx, time.StampMilli)+"<br>\n")
-	_, _ = io.WriteString(w, `<h3>Counters</h3>`)
-	s.db.MapOrderedCounter(ctx, func(k string, v int64) {
-		_, _ = io.WriteString(w, k+": "+fmt.Sprintf("%d", v)+"<br>\n")
-	})
-	_, _ = io.WriteString(w, `<h3>Gauges</h3>`)
-	s.db.MapOrderedGauge(ctx, func(k string, v float64) {
-		_, _ = io.WriteString(w, k+": "+fmt.Sprintf("%.3f", v)+"<br>\n")
-	})
-	_, _ = io.WriteString(w, `<html></body></html>`)
+<body><h1>Metrics values</h1><h3>Main</h3>Gen: {{.Gen}}<br>
+Timestamp: {{.Timestamp}}<br>
+<h3>Counters</h3>{{range .Counters}}{{template "row" .}}{{$.Flush}}{{end}}
+<h3>Gauges</h3>{{range .Gauges}}{{template "row" .}}{{$.Flush}}{{end}}
+</body></html>
+{{define "row"}}
+{{- if .Description}}<span title="{{.Description}}">{{.Name}}</span>{{else}}{{.Name}}{{end}}
+{{- with .Tags}} <code>{{printf "{%s}" .}}</code>{{end}}{{": "}}
+{{- if .ElemID}}<span id="{{.ElemID}}">{{.Value}}</span>{{else}}{{.Value}}{{end}}
+{{- with .Description}} <small>{{.}}</small>{{end}}<br>
+{{end}}`))
+
+// infoFlushRows через сколько строк страницы с информацией отправлять
+// накопленные данные клиенту.
+const infoFlushRows = 100
+
+// infoFilter параметры отбора метрик для страницы с информацией.
+// Применяются к счетчикам и датчикам по отдельности.
+type infoFilter struct {
+	prefix string
+	limit  int // 0 - без ограничений
+	offset int
+}
+
+func parseInfoFilter(q url.Values) (infoFilter, error) {
+	f := infoFilter{prefix: q.Get("prefix")}
+	for name, dst := range map[string]*int{"limit": &f.limit, "offset": &f.offset} {
+		raw := q.Get(name)
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.Atoi(raw)
+		if err != nil || v < 0 {
+			return f, fmt.Errorf("invalid %s: %q", name, raw)
+		}
+		*dst = v
+	}
+	return f, nil
+}
+
+// matcher возвращает функцию отбора для упорядоченного обхода метрик.
+func (f infoFilter) matcher() func(k string) bool {
+	n := 0
+	return func(k string) bool {
+		if !strings.HasPrefix(k, f.prefix) {
+			return false
+		}
+		n++
+		if n <= f.offset {
+			return false
+		}
+		return f.limit == 0 || n <= f.offset+f.limit
+	}
+}
+
+// Коды ошибок позволяют клиентам отличать причины отказа
+// с одинаковым HTTP статусом и принимать решение о повторе.
+const (
+	errCodeHeader = "X-Error-Code"
+
+	errCodeBadRequest    = "bad_request"
+	errCodeHashMismatch  = "hash_mismatch"
+	errCodeUnknownType   = "unknown_type"
+	errCodeLimitExceeded = "limit_exceeded"
+	errCodeTimestampSkew = "timestamp_skew"
+	errCodeNotFound      = "not_found"
+	errCodeUnavailable   = "unavailable"
+	errCodeInternal      = "internal_error"
+	errCodeNotSupported  = "not_supported"
+	errCodeUnauthorized  = "unauthorized"
+	errCodeForbidden     = "forbidden"
+	errCodeTooLarge      = "too_large"
+	errCodeInProgress    = "in_progress"
+
+	errCodeUnsupportedEncoding = "unsupported_encoding"
+)
+
+// updatesResult результат пакетного обновления для клиентов, принимающих JSON.
+type updatesResult struct {
+	Accepted int              `json:"accepted"`
+	Rejected []rejectedMetric `json:"rejected"`
+}
+
+type rejectedMetric struct {
+	ID      string `json:"id"`
+	MType   string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// errorResponse ответ с ошибкой для клиентов, принимающих JSON.
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type errorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeError отправляет ошибку с кодом в заголовке X-Error-Code, а в теле -
+// JSON {"error":{"code":...,"message":...}} для клиентов, принимающих JSON,
+// или текст сообщения для остальных. Legacy маршруты отвечают только текстом.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	w.Header().Set(errCodeHeader, code)
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "1")
+	}
+	if !acceptsJSON(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(message))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(errorResponse{Error: errorBody{Code: code, Message: message}})
+}
+
+// acceptsJSON клиент запросил ответ в JSON заголовком Accept
+// или параметром format=json (удобно для браузера и curl).
+func acceptsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json") ||
+		r.URL.Query().Get("format") == "json"
+}
+
+var errTrailingData = errors.New("unexpected data after JSON value")
+
+// decodeJSON разбирает тело запроса, содержащее ровно одно значение JSON.
+// Данные после него (например, второй объект) считаются ошибкой, что бы
+// не обработать молча только первую метрику.
+func decodeJSON(body io.Reader, v interface{}) error {
+	dec := json.NewDecoder(body)
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errTrailingData
+	}
+	return nil
+}
+
+// seriesID имя, под которым хранится метрика: преобразованное имя
+// и теги метрики (см. models.SeriesID). Преобразование имен к тегам
+// не применяется.
+func (s *serverStorage) seriesID(m models.Metrics) string {
+	return models.SeriesID(s.names.apply(m.ID), m.Tags)
+}
+
+// gaugeValue значение датчика для сохранения. Датчики хранятся в float64,
+// поэтому целые значения выше 2^53 сохраняются с округлением.
+func gaugeValue(m models.Metrics) float64 {
+	if m.Value != nil {
+		return *m.Value
+	}
+	return float64(*m.Delta)
 }
 
-func (s *serverStorage) hashCorrect(data, hash string) bool {
-	if len(s.key) == 0 {
+// roundGauge округляет значение датчика до точности хранения, что бы
+// сохраненное, выводимое и подписанное в ответах значение совпадали.
+// Подпись агента проверяется до округления, по переданному значению.
+// Значения, которые нельзя округлить без переполнения, не меняются.
+func (s *serverStorage) roundGauge(v float64) float64 {
+	if s.gaugeScale == 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return v
+	}
+	scaled := v * s.gaugeScale
+	if math.Abs(scaled) >= 1<<53 {
+		return v
+	}
+	return math.Round(scaled) / s.gaugeScale
+}
+
+// counterDelta приращение счетчика для сохранения. Агент, отправляющий
+// счетчик с выборкой, передает долю учтенных увеличений в sample_rate,
+// приращение восстанавливается делением на нее и округляется до целого.
+// Доля вне (0, 1] считается ошибкой.
+func counterDelta(m models.Metrics) (int64, bool) {
+	if m.SampleRate == 0 {
+		return *m.Delta, true
+	}
+	if !(m.SampleRate > 0 && m.SampleRate <= 1) {
+		return 0, false
+	}
+	return int64(math.Round(float64(*m.Delta) / m.SampleRate)), true
+}
+
+// hashCorrect проверяет подпись метрики. Метрики из списка исключений
+// принимаются без подписи, но переданная подпись проверяется всегда.
+// С -legacy-gauge-hash для совместимости с прежними агентами принимается
+// и подпись датчика со значением в формате %f.
+func (s *serverStorage) hashCorrect(m models.Metrics) bool {
+	if m.Hash == "" && s.hashExempt.Match(m.ID) {
 		return true
 	}
-	h := hmac.New(sha256.New, s.key)
-	h.Write([]byte(data))
-	return fmt.Sprintf("%x", h.Sum(nil)) == hash
+	return sign.Check(s.key, m) || (s.legacyHash && sign.CheckLegacy(s.key, m))
+}
+
+// signedInWindow проверяет время подписи метрики (защита от повторной
+// отправки). Вызывается после hashCorrect, метрики без подписи не проверяются.
+func (s *serverStorage) signedInWindow(m models.Metrics) bool {
+	if len(s.key) == 0 || (m.Hash == "" && s.hashExempt.Match(m.ID)) {
+		return true
+	}
+	return sign.InWindow(m, s.now(), s.maxSkew)
+}
+
+// setObserved сохраняет время измерения, переданное агентом,
+// если хранилище его поддерживает.
+func (s *serverStorage) setObserved(ctx context.Context, m models.Metrics, id string) {
+	if m.ObservedAt == 0 {
+		return
+	}
+	if o, ok := s.db.(store.Observations); ok {
+		o.SetObserved(ctx, m.MType, id, time.UnixMilli(m.ObservedAt))
+	}
+}
+
+func (s *serverStorage) now() time.Time {
+	if s.clock == nil {
+		return time.Now()
+	}
+	return s.clock.Now()
+}
+
+// batchSeries новые ряды пачки, принятые, но еще не записанные
+// в хранилище (см. store.BatchUpdater), по типам метрик.
+type batchSeries map[string]map[string]bool
+
+// withinLimit проверяет, что метрику можно сохранить, не превышая
+// ограничение на количество уникальных метрик. Обновление уже
+// существующих метрик разрешено всегда. Количество метрик берется
+// из s.counts, новая метрика сразу в нем учитывается, в том числе
+// без ограничений, если задан порог предупреждения (см. checkCardinality).
+// Ошибка чтения хранилища возвращается, а не пропускает запись: пока
+// хранилище недоступно, ограничение не должно отключаться.
+func (s *serverStorage) withinLimit(ctx context.Context, mtype, id string, pending batchSeries) (bool, error) {
+	var limit int
+	switch mtype {
+	case models.Counter:
+		limit = s.maxCounters
+	case models.Gauge:
+		limit = s.maxGauges
+	default:
+		return true, nil
+	}
+	if limit <= 0 && s.warnCardinality <= 0 {
+		return true, nil
+	}
+	if pending[mtype][id] {
+		return true, nil
+	}
+	ok, err := s.db.Exists(ctx, mtype, id)
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		return true, nil
+	}
+	count, err := s.counts.get(ctx, mtype, s.now(), func(ctx context.Context) (int, error) {
+		// Принятые метрики пачки еще не записаны в хранилище.
+		n, err := s.countSeries(ctx, mtype)
+		return n + len(pending[mtype]), err
+	})
+	if err != nil {
+		return false, err
+	}
+	if limit > 0 && count >= limit {
+		return false, nil
+	}
+	s.counts.add(mtype)
+	if pending != nil {
+		if pending[mtype] == nil {
+			pending[mtype] = make(map[string]bool)
+		}
+		pending[mtype][id] = true
+	}
+	return true, nil
+}
+
+// countSeries количество метрик типа mtype. Ошибку чтения сообщают
+// только хранилища с store.CardinalityChecker.
+func (s *serverStorage) countSeries(ctx context.Context, mtype string) (int, error) {
+	if cc, ok := s.db.(store.CardinalityChecker); ok {
+		return cc.Count(ctx, mtype)
+	}
+	if mtype == models.Counter {
+		return s.db.CountCounters(ctx), nil
+	}
+	return s.db.CountGauges(ctx), nil
+}
+
+// limitError отвечает на ошибку хранилища при проверке ограничения
+// на количество метрик, метрика не записывается.
+func limitError(w http.ResponseWriter, r *http.Request, mtype, id string, err error) {
+	logger.Errorf("server: cannot check limit for %s %s: %v", mtype, id, err)
+	if errors.Is(err, store.ErrUnavailable) {
+		writeError(w, r, http.StatusServiceUnavailable, errCodeUnavailable, "Storage is temporarily unavailable")
+		return
+	}
+	writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Storage error")
+}
+
+// checkCardinality однократно предупреждает о превышении порога
+// количества уникальных метрик. Если количество опустится ниже порога,
+// предупреждение сработает при следующем превышении. Количество берется
+// из s.counts, новые метрики в нем учитывает withinLimit.
+func (s *serverStorage) checkCardinality(ctx context.Context) {
+	if s.warnCardinality <= 0 {
+		return
+	}
+	total := 0
+	for _, mtype := range []string{models.Counter, models.Gauge} {
+		mtype := mtype
+		n, err := s.counts.get(ctx, mtype, s.now(), func(ctx context.Context) (int, error) {
+			return s.countSeries(ctx, mtype)
+		})
+		if err != nil {
+			logger.Errorf("server: cannot count %s metrics: %v", mtype, err)
+			return
+		}
+		total += n
+	}
+	if total < s.warnCardinality {
+		s.cardinalityWarned = false
+		return
+	}
+	if !s.cardinalityWarned {
+		s.cardinalityWarned = true
+		logger.Warnf("server: number of distinct metrics reached %d (threshold %d)", total, s.warnCardinality)
+	}
 }
 
 func (s *serverStorage) pingHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("ping request")
+	logger.Debugf("ping request")
 	if err := s.db.Ping(r.Context()); err != nil {
-		log.Printf("ping result: %v\n", err)
+		logger.Errorf("ping result: %v\n", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	log.Println("ping response ok")
+	logger.Debugf("ping response ok")
+}
+
+// versionHandler отдает информацию о сборке сервера.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Version string `json:"version"`
+		Commit  string `json:"commit"`
+		Date    string `json:"date"`
+	}{
+		Version: buildVersion,
+		Commit:  buildCommit,
+		Date:    buildDate,
+	})
+}
+
+// healthzHandler сообщает, может ли сервер обслуживать запросы.
+func (s *serverStorage) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if hc, ok := s.db.(store.Health); ok && hc.Degraded() {
+		http.Error(w, "degraded", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok"))
 }
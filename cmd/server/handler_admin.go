@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"go-musthave-devops-trainer/internal/logger"
+	"go-musthave-devops-trainer/internal/store"
+)
+
+const (
+	// adminKeyHeader заголовок с ключом для доступа к /admin/.
+	adminKeyHeader = "X-Admin-Key"
+	// maxImportSize ограничение на размер загружаемого файла хранилища.
+	maxImportSize = 32 << 20
+)
+
+// adminMiddleware пропускает только запросы с ключом администратора.
+// Если ключ не задан, административные методы недоступны.
+func (s *serverStorage) adminMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.adminKey) == 0 {
+			writeError(w, r, http.StatusForbidden, errCodeForbidden, "admin API is disabled: no admin key configured")
+			return
+		}
+		if !hmac.Equal([]byte(r.Header.Get(adminKeyHeader)), s.adminKey) {
+			writeError(w, r, http.StatusUnauthorized, errCodeUnauthorized, "invalid admin key")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// importHandler загружает сохраненный файл хранилища.
+// Режим задается параметром mode: merge (по умолчанию) или replace.
+func (s *serverStorage) importHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	mode := r.URL.Query().Get("mode")
+	switch mode {
+	case "":
+		mode = "merge"
+	case "merge", "replace":
+	default:
+		writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "unknown import mode: "+mode)
+		return
+	}
+
+	importer, ok := s.db.(store.Importer)
+	if !ok {
+		writeError(w, r, http.StatusNotImplemented, errCodeNotSupported, "import is not supported by the storage")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "cannot read store file: "+err.Error())
+		return
+	}
+	dump, err := store.DecodeDump(body)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, errCodeBadRequest, "invalid store file: "+err.Error())
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	defer s.counts.reset()
+	if err := importer.Import(ctx, dump, mode == "replace"); err != nil {
+		logger.Errorf("server: import: %v", err)
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, "import failed")
+		return
+	}
+	logger.Infof("server: imported %d counters and %d gauges, mode: %s", len(dump.Counters), len(dump.Gauges), mode)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Mode     string `json:"mode"`
+		Counters int    `json:"counters"`
+		Gauges   int    `json:"gauges"`
+	}{mode, len(dump.Counters), len(dump.Gauges)})
+}
+
+// exportHandler выгружает все метрики в формате файла хранилища (FDB),
+// в том числе из базы. Выгрузку принимает importHandler и загрузка
+// хранилища из файла.
+func (s *serverStorage) exportHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	d := store.Dump{Counters: make(map[string]int64), Gauges: make(map[string]float64)}
+	s.Lock()
+	err := s.mapMetrics(ctx, func(k string, v int64) {
+		d.Counters[k] = v
+	}, func(k string, v float64) {
+		d.Gauges[k] = v
+	})
+	updateCount := s.db.UpdateCount(ctx)
+	tstamp, _ := time.Parse(time.RFC3339Nano, s.db.Timestamp(ctx, time.RFC3339Nano))
+	s.Unlock()
+	if err != nil {
+		logger.Errorf("server: export: %v", err)
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Storage error")
+		return
+	}
+
+	body, err := store.EncodeDump(d, updateCount, tstamp)
+	if err != nil {
+		logger.Errorf("server: export: %v", err)
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, "export failed")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="metrics.json"`)
+	_, _ = w.Write(body)
+}
+
+// compactHandler запускает обслуживание хранилища (см. store.Compactor).
+// Обновления метрик при этом не блокируются.
+func (s *serverStorage) compactHandler(w http.ResponseWriter, r *http.Request) {
+	compactor, ok := s.db.(store.Compactor)
+	if !ok {
+		writeError(w, r, http.StatusNotImplemented, errCodeNotSupported, "compaction is not supported by the storage")
+		return
+	}
+
+	start := time.Now()
+	if err := compactor.Compact(r.Context()); err != nil {
+		logger.Errorf("server: compact: %v", err)
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, "compaction failed")
+		return
+	}
+	elapsed := time.Since(start)
+	logger.Infof("server: storage compacted in %s", elapsed)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Duration string `json:"duration"`
+	}{elapsed.String()})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go-musthave-devops-trainer/internal/store"
+)
+
+func doAdminRequest(t *testing.T, srv string, key, path, body string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, srv+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		req.Header.Set(adminKeyHeader, key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAdminKey(t *testing.T) {
+	noKey := newTestServer(t, &serverStorage{})
+	if status := doAdminRequest(t, noKey.URL, "secret", "/admin/import", `{}`); status != http.StatusForbidden {
+		t.Errorf("admin without admin key: want 403, got %d", status)
+	}
+	// Ключ подписи не открывает административные методы.
+	signOnly := newTestServer(t, &serverStorage{key: []byte("sign")})
+	if status := doAdminRequest(t, signOnly.URL, "sign", "/admin/import", `{}`); status != http.StatusForbidden {
+		t.Errorf("admin with signing key only: want 403, got %d", status)
+	}
+
+	srv := newTestServer(t, &serverStorage{key: []byte("sign"), adminKey: []byte("secret")})
+	if status := doAdminRequest(t, srv.URL, "sign", "/admin/import", `{}`); status != http.StatusUnauthorized {
+		t.Errorf("signing key: want 401, got %d", status)
+	}
+	if status := doAdminRequest(t, srv.URL, "", "/admin/import", `{}`); status != http.StatusUnauthorized {
+		t.Errorf("missing key: want 401, got %d", status)
+	}
+	if status := doAdminRequest(t, srv.URL, "wrong", "/admin/import", `{}`); status != http.StatusUnauthorized {
+		t.Errorf("wrong key: want 401, got %d", status)
+	}
+	if status := doAdminRequest(t, srv.URL, "secret", "/admin/import", `{}`); status != http.StatusOK {
+		t.Errorf("valid key: want 200, got %d", status)
+	}
+}
+
+func TestAdminImport(t *testing.T) {
+	ctx := context.Background()
+	const file = `{"counters": {"c1": 10}, "gauges": {"g1": 1.5}}`
+
+	newServer := func() (string, store.Store) {
+		db := store.NewFDB(ctx)
+		db.UpdateCounter(ctx, "c1", 1)
+		db.UpdateCounter(ctx, "c2", 2)
+		return newTestServer(t, &serverStorage{db: db, adminKey: []byte("secret")}).URL, db
+	}
+
+	srv, db := newServer()
+	if status := doAdminRequest(t, srv, "secret", "/admin/import", file); status != http.StatusOK {
+		t.Fatalf("merge: want 200, got %d", status)
+	}
+	if v, _ := db.Counter(ctx, "c1"); v != 10 {
+		t.Errorf("merge: want c1=10, got %d", v)
+	}
+	if _, ok := db.Counter(ctx, "c2"); !ok {
+		t.Error("merge: c2 must be kept")
+	}
+
+	srv, db = newServer()
+	if status := doAdminRequest(t, srv, "secret", "/admin/import?mode=replace", file); status != http.StatusOK {
+		t.Fatalf("replace: want 200, got %d", status)
+	}
+	if _, ok := db.Counter(ctx, "c2"); ok {
+		t.Error("replace: c2 must be removed")
+	}
+	if v, _ := db.Gauge(ctx, "g1"); v != 1.5 {
+		t.Errorf("replace: want g1=1.5, got %v", v)
+	}
+
+	if status := doAdminRequest(t, srv, "secret", "/admin/import?mode=append", file); status != http.StatusBadRequest {
+		t.Errorf("unknown mode: want 400, got %d", status)
+	}
+	if status := doAdminRequest(t, srv, "secret", "/admin/import", `{"counters": [1]}`); status != http.StatusBadRequest {
+		t.Errorf("invalid file: want 400, got %d", status)
+	}
+}
+
+func TestAdminExport(t *testing.T) {
+	ctx := context.Background()
+	export := func(srv string) []byte {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, srv+"/admin/export", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(adminKeyHeader, "secret")
+		// Без явного Accept-Encoding клиент запрашивает gzip и сам распаковывает ответ.
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || !resp.Uncompressed {
+			t.Fatalf("want 200 and gzip response, got %d, %v", resp.StatusCode, resp.Uncompressed)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	src := store.NewFDB(ctx)
+	src.UpdateCounter(ctx, "PollCount", 5)
+	src.UpdateCounter(ctx, "Big", math.MaxInt64)
+	src.UpdateGauge(ctx, "Alloc", 0.1)
+	src.UpdateGauge(ctx, "Tiny", math.SmallestNonzeroFloat64)
+	src.UpdateGauge(ctx, "Max", math.MaxFloat64)
+	srv := newTestServer(t, &serverStorage{db: src, adminKey: []byte("secret")}).URL
+	if status := doAdminRequest(t, srv, "", "/admin/export", ""); status != http.StatusUnauthorized {
+		t.Errorf("missing key: want 401, got %d", status)
+	}
+	body := export(srv)
+	want, err := store.DecodeDump(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want.Counters["Big"] != math.MaxInt64 || want.Gauges["Tiny"] != math.SmallestNonzeroFloat64 {
+		t.Errorf("unexpected export: %+v", want)
+	}
+
+	// Выгрузка, загруженная в другой сервер, выгружается без изменений.
+	dst := store.NewFDB(ctx)
+	dst.UpdateGauge(ctx, "Stale", 1)
+	srv = newTestServer(t, &serverStorage{db: dst, adminKey: []byte("secret")}).URL
+	if status := doAdminRequest(t, srv, "secret", "/admin/import?mode=replace", string(body)); status != http.StatusOK {
+		t.Fatalf("import: want 200, got %d", status)
+	}
+	body = export(srv)
+	got, err := store.DecodeDump(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+}
+
+func TestAdminCompact(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{adminKey: []byte("secret")})
+	if status := doAdminRequest(t, srv.URL, "", "/admin/compact", ""); status != http.StatusUnauthorized {
+		t.Errorf("missing key: want 401, got %d", status)
+	}
+	if status := doAdminRequest(t, srv.URL, "secret", "/admin/compact", ""); status != http.StatusOK {
+		t.Errorf("compact: want 200, got %d", status)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"go-musthave-devops-trainer/internal/logger"
+	"go-musthave-devops-trainer/internal/store"
+	"go-musthave-devops-trainer/models"
+)
+
+// metricAge значение метрики и время с момента ее последнего обновления
+// по часам сервера. Если время обновления неизвестно, age_seconds не выводится.
+type metricAge struct {
+	models.Metrics
+	AgeSeconds *float64 `json:"age_seconds,omitempty"`
+}
+
+// valueAllHandler отдает все метрики с их "свежестью".
+func (s *serverStorage) valueAllHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	s.Lock()
+	var metrics []metricAge
+	err := s.mapMetrics(ctx, func(k string, v int64) {
+		metrics = append(metrics, metricAge{Metrics: models.Metrics{ID: k, MType: models.Counter, Delta: &v}})
+	}, func(k string, v float64) {
+		metrics = append(metrics, metricAge{Metrics: models.Metrics{ID: k, MType: models.Gauge, Value: &v}})
+	})
+	if err != nil {
+		s.Unlock()
+		logger.Errorf("server: read all metrics: %v", err)
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Storage error")
+		return
+	}
+	// Время запрашиваем после обхода, т.к. обход выполняется под блокировкой хранилища.
+	if fr, ok := s.db.(store.Freshness); ok {
+		now := time.Now()
+		for i := range metrics {
+			if t, ok := fr.LastUpdated(ctx, metrics[i].MType, metrics[i].ID); ok {
+				age := now.Sub(t).Seconds()
+				metrics[i].AgeSeconds = &age
+			}
+		}
+	}
+	s.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(metrics); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// mapMetrics обходит счетчики, затем датчики в порядке имен. Хранилища,
+// читающие метрики запросами (store.Snapshotter), читают их за один раз,
+// что бы счетчики и датчики соответствовали одному состоянию.
+func (s *serverStorage) mapMetrics(ctx context.Context, counter func(k string, v int64), gauge func(k string, v float64)) error {
+	sn, ok := s.db.(store.Snapshotter)
+	if !ok {
+		s.db.MapOrderedCounter(ctx, counter)
+		s.db.MapOrderedGauge(ctx, gauge)
+		return nil
+	}
+	d, err := sn.Snapshot(ctx)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(d.Counters))
+	for id := range d.Counters {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		counter(id, d.Counters[id])
+	}
+	ids = ids[:0]
+	for id := range d.Gauges {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		gauge(id, d.Gauges[id])
+	}
+	return nil
+}
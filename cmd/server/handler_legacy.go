@@ -2,15 +2,47 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"io"
 	"net/http"
 	"strconv"
 
+	"go-musthave-devops-trainer/internal/logger"
+	"go-musthave-devops-trainer/models"
+
 	"github.com/go-chi/chi/v5"
 )
 
-func (s *serverStorage) updateHandlerLegacy(w http.ResponseWriter, r *http.Request) {
+// maxLegacyBodySize ограничение тела запросов с параметрами в пути:
+// данные передаются в URL, тело им не нужно.
+const maxLegacyBodySize = 1 << 10
+
+// Маршруты запросов с параметрами в пути.
+const (
+	legacyUpdatePattern = "/update/{type}/{id}/{value}"
+	legacyValuePattern  = "/value/{type}/{id}"
+)
+
+// discardLegacyBody вычитывает и закрывает тело запроса, не превышающее
+// maxLegacyBodySize, что бы соединение можно было использовать повторно.
+// Заявленное или фактически большее тело отклоняется сразу, не дожидаясь
+// его получения целиком.
+func discardLegacyBody(w http.ResponseWriter, r *http.Request) bool {
 	defer r.Body.Close()
+	if r.ContentLength > maxLegacyBodySize {
+		http.Error(w, "Request body is too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	if _, err := io.Copy(io.Discard, http.MaxBytesReader(w, r.Body, maxLegacyBodySize)); err != nil {
+		http.Error(w, "Request body is too large", http.StatusRequestEntityTooLarge)
+		return false
+	}
+	return true
+}
+
+func (s *serverStorage) updateHandlerLegacy(w http.ResponseWriter, r *http.Request) {
+	if !discardLegacyBody(w, r) {
+		return
+	}
 	ctx := r.Context()
 
 	// Сервер не санитайзит полученные данные.
@@ -20,6 +52,7 @@ func (s *serverStorage) updateHandlerLegacy(w http.ResponseWriter, r *http.Reque
 		http.Error(w, "undefined field 'id'", http.StatusBadRequest)
 		return
 	}
+	id = s.legacySeriesID(id)
 
 	rawValue := chi.URLParam(r, "value")
 	if rawValue == "" {
@@ -27,37 +60,57 @@ func (s *serverStorage) updateHandlerLegacy(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	var count int
+	// Значение проверяется до ограничения на количество метрик:
+	// неверный запрос получает 400 и не требует запросов к хранилищу.
+	var (
+		delta int64
+		value float64
+		err   error
+	)
 	reqType := chi.URLParam(r, "type")
-
-	s.Lock()
-	defer s.Unlock()
 	switch reqType {
 	case "counter":
-		delta, err := strconv.ParseInt(rawValue, 10, 64)
-		if err != nil {
+		if delta, err = strconv.ParseInt(rawValue, 10, 64); err != nil {
 			http.Error(w, "wrong type of counter value", http.StatusBadRequest)
 			return
 		}
-		count = s.db.UpdateCounter(ctx, id, delta)
 	case "gauge":
-		value, err := strconv.ParseFloat(rawValue, 64)
-		if err != nil {
+		if value, err = strconv.ParseFloat(rawValue, 64); err != nil {
 			http.Error(w, "wrong type of gauge value", http.StatusBadRequest)
 			return
 		}
-		count = s.db.UpdateGauge(ctx, id, value)
 	default:
 		http.Error(w, "unknown type of metrics", http.StatusNotImplemented)
 		return
 	}
 
-	log.Printf("update %s: %s=%s, %d\n", reqType, id, rawValue, count)
+	s.Lock()
+	defer s.Unlock()
+	ok, err := s.withinLimit(ctx, reqType, id, nil)
+	if err != nil {
+		limitError(w, r, reqType, id, err)
+		return
+	}
+	if !ok {
+		http.Error(w, "too many distinct metrics of type "+reqType, http.StatusInsufficientStorage)
+		return
+	}
+	var count int
+	if reqType == "counter" {
+		count = s.db.UpdateCounter(ctx, id, delta)
+	} else {
+		count = s.db.UpdateGauge(ctx, id, s.roundGauge(value))
+	}
+	s.checkCardinality(ctx)
+
+	logger.Debugf("update %s: %s=%s, %d\n", reqType, id, rawValue, count)
 	_, _ = w.Write([]byte("Updated: " + fmt.Sprintf("%d\n", count)))
 }
 
 func (s *serverStorage) valueHandlerLegacy(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
+	if !discardLegacyBody(w, r) {
+		return
+	}
 	ctx := r.Context()
 
 	// Сервер не санитайзит полученные данные.
@@ -67,8 +120,14 @@ func (s *serverStorage) valueHandlerLegacy(w http.ResponseWriter, r *http.Reques
 		http.Error(w, "undefined field 'id'", http.StatusBadRequest)
 		return
 	}
-
 	reqType := chi.URLParam(r, "type")
+	// Вариант в JSON с подписью, как у POST /value/.
+	if acceptsJSON(r) {
+		name, tags := models.ParseSeriesID(id)
+		s.writeMetric(w, r, reqType, name, tags)
+		return
+	}
+	id = s.legacySeriesID(id)
 
 	s.Lock()
 	defer s.Unlock()
@@ -89,3 +148,10 @@ func (s *serverStorage) valueHandlerLegacy(w http.ResponseWriter, r *http.Reques
 	}
 	http.NotFound(w, r)
 }
+
+// legacySeriesID имя хранения для legacy API, в котором теги передаются
+// в имени метрики: преобразуется только имя, теги остаются как есть.
+func (s *serverStorage) legacySeriesID(id string) string {
+	name, tags := models.ParseSeriesID(id)
+	return models.SeriesID(s.names.apply(name), tags)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go-musthave-devops-trainer/internal/logger"
+	"go-musthave-devops-trainer/models"
+)
+
+// prometheusContentType текстовый формат экспозиции Prometheus.
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// promFamily метрики Prometheus с одним именем: ряды, различающиеся тегами.
+type promFamily struct {
+	mtype   string
+	samples []string
+}
+
+// prometheusHandler отдает все метрики в текстовом формате Prometheus.
+// Имена приводятся к допустимому виду (см. promName), к именам счетчиков
+// добавляется _total, теги рядов выводятся метками. Если после
+// преобразования имя совпадает с метрикой другого типа или имя и метки
+// совпадают с уже выведенным рядом (например, a.b и a-b), метрика
+// пропускается, т.к. Prometheus отвергает такой ответ целиком.
+func (s *serverStorage) prometheusHandler(w http.ResponseWriter, r *http.Request) {
+	families := make(map[string]*promFamily)
+	series := make(map[string]bool)
+	add := func(id, mtype, value string) {
+		base, tags := models.ParseSeriesID(id)
+		name := promName(base)
+		if mtype == models.Counter {
+			name += "_total"
+		}
+		f, ok := families[name]
+		if !ok {
+			f = &promFamily{mtype: mtype}
+			families[name] = f
+		}
+		if f.mtype != mtype {
+			logger.Debugf("server: skip %s %q in prometheus output, name %s is taken", mtype, id, name)
+			return
+		}
+		sample := name + promLabels(tags)
+		if series[sample] {
+			logger.Debugf("server: skip %s %q in prometheus output, series %s is taken", mtype, id, sample)
+			return
+		}
+		series[sample] = true
+		f.samples = append(f.samples, sample+" "+value)
+	}
+
+	s.Lock()
+	err := s.mapMetrics(r.Context(), func(k string, v int64) {
+		add(k, models.Counter, strconv.FormatInt(v, 10))
+	}, func(k string, v float64) {
+		add(k, models.Gauge, strconv.FormatFloat(v, 'g', -1, 64))
+	})
+	s.Unlock()
+	if err != nil {
+		logger.Errorf("server: read all metrics: %v", err)
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Storage error")
+		return
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		f := families[name]
+		buf.WriteString("# TYPE " + name + " " + f.mtype + "\n")
+		for _, sample := range f.samples {
+			buf.WriteString(sample)
+			buf.WriteByte('\n')
+		}
+	}
+	w.Header().Set("Content-Type", prometheusContentType)
+	_, _ = w.Write(buf.Bytes())
+}
+
+// promName имя, допустимое в Prometheus: символы кроме [A-Za-z0-9_:]
+// заменяются на "_", перед цифрой в начале добавляется "_".
+func promName(id string) string {
+	name := nameTransforms["sanitize"](id)
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// promLabels теги ряда в виде меток {k="v",...}, отсортированных по имени.
+func promLabels(tags map[string]string) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		// Двоеточие в именах меток недопустимо, в отличие от имен метрик.
+		b.WriteString(strings.ReplaceAll(promName(k), ":", "_"))
+		b.WriteString(`="`)
+		b.WriteString(promLabelValue.Replace(tags[k]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var promLabelValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go-musthave-devops-trainer/internal/store"
+)
+
+// statsResponse диагностическая информация о сервере.
+// Разделы, не поддерживаемые хранилищем, не выводятся.
+type statsResponse struct {
+	Server      serverStats      `json:"server"`
+	Metrics     metricStats      `json:"metrics"`
+	Connections *connectionStats `json:"connections,omitempty"`
+	Store       *storeStats      `json:"store,omitempty"`
+	Reports     *reportStats     `json:"reports,omitempty"`
+}
+
+type serverStats struct {
+	Version  string `json:"version"`
+	Uptime   string `json:"uptime"`
+	Degraded bool   `json:"degraded"`
+}
+
+// metricStats количество метрик в хранилище и результаты обновлений
+// с запуска сервера: принятые, отклоненные и неизвестного типа.
+type metricStats struct {
+	Counters    int   `json:"counters"`
+	Gauges      int   `json:"gauges"`
+	Accepted    int64 `json:"accepted"`
+	Rejected    int64 `json:"rejected"`
+	UnknownType int64 `json:"unknown_type"`
+}
+
+type connectionStats struct {
+	Active      int64   `json:"active"`
+	RequestRate float64 `json:"request_rate"`
+}
+
+// reportStats пропуски в номерах пачек агентов (см. reportSequences)
+// и повторы пачек, не примененные повторно (см. idempotencyKeys).
+type reportStats struct {
+	MissedBatches   int64 `json:"missed_batches"`
+	ReplayedBatches int64 `json:"replayed_batches"`
+}
+
+type storeStats struct {
+	PendingWrites    int    `json:"pending_writes"`
+	LastSaveDuration string `json:"last_save_duration"`
+	SaveCount        int    `json:"save_count"`
+}
+
+// updateStats счетчики обновленных метрик для /stats.
+type updateStats struct {
+	accepted int64
+	rejected int64
+	unknown  int64
+}
+
+func (u *updateStats) add(accepted, rejected, unknown int) {
+	atomic.AddInt64(&u.accepted, int64(accepted))
+	atomic.AddInt64(&u.rejected, int64(rejected))
+	atomic.AddInt64(&u.unknown, int64(unknown))
+}
+
+// middleware учитывает обновление одной метрики по статусу ответа.
+// Некорректный запрос считается отклоненной метрикой.
+func (u *updateStats) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+		switch {
+		case sw.status >= 200 && sw.status < 300:
+			u.add(1, 0, 0)
+		case sw.status == http.StatusNotImplemented:
+			u.add(0, 0, 1)
+		default:
+			u.add(0, 1, 0)
+		}
+	})
+}
+
+// statusWriter запоминает статус ответа.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// keyedAdminMiddleware требует ключ администратора, если задан ключ
+// сервера или администратора: статистика раскрывает внутреннее состояние
+// сервера, удаление метрик теряет данные. Без ключей сервер доступен без
+// авторизации.
+func (s *serverStorage) keyedAdminMiddleware(h http.Handler) http.Handler {
+	if len(s.key) == 0 && len(s.adminKey) == 0 {
+		return h
+	}
+	return s.adminMiddleware(h)
+}
+
+func (s *serverStorage) statsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var resp statsResponse
+	resp.Server.Version = buildVersion
+	if !s.started.IsZero() {
+		resp.Server.Uptime = time.Since(s.started).Round(time.Second).String()
+	}
+	if hc, ok := s.db.(store.Health); ok {
+		resp.Server.Degraded = hc.Degraded()
+	}
+	resp.Metrics = metricStats{
+		Counters:    s.db.CountCounters(ctx),
+		Gauges:      s.db.CountGauges(ctx),
+		Accepted:    atomic.LoadInt64(&s.updates.accepted),
+		Rejected:    atomic.LoadInt64(&s.updates.rejected),
+		UnknownType: atomic.LoadInt64(&s.updates.unknown),
+	}
+	if s.conns != nil {
+		resp.Connections = &connectionStats{
+			Active:      s.conns.Active(),
+			RequestRate: s.conns.Rate(),
+		}
+	}
+	if s.sequences != nil || s.idempotency != nil {
+		resp.Reports = &reportStats{}
+		if s.sequences != nil {
+			resp.Reports.MissedBatches = s.sequences.Missed()
+		}
+		if s.idempotency != nil {
+			resp.Reports.ReplayedBatches = s.idempotency.Replayed()
+		}
+	}
+	if ss, ok := s.db.(store.SaveStats); ok {
+		resp.Store = &storeStats{
+			PendingWrites:    ss.PendingWrites(),
+			LastSaveDuration: ss.LastSaveDuration().String(),
+			SaveCount:        ss.SaveCount(),
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
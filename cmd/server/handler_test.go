@@ -0,0 +1,1579 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-musthave-devops-trainer/internal/clock"
+	"go-musthave-devops-trainer/internal/logger"
+	"go-musthave-devops-trainer/internal/sign"
+	"go-musthave-devops-trainer/internal/store"
+	"go-musthave-devops-trainer/internal/store/storetest"
+	"go-musthave-devops-trainer/internal/wire"
+	"go-musthave-devops-trainer/models"
+)
+
+func newTestServer(t *testing.T, server *serverStorage) *httptest.Server {
+	t.Helper()
+	if server.db == nil {
+		server.db = store.NewFDB(context.Background())
+	}
+	srv := httptest.NewServer(newRouter(server))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func doRequest(t *testing.T, srv *httptest.Server, method, path, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(respBody)
+}
+
+func TestCardinalityLimit(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{maxCounters: 1, maxGauges: 1})
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+	}{
+		{"first counter", "/update/", `{"id":"c1","type":"counter","delta":1}`, http.StatusOK},
+		{"new counter at cap", "/update/", `{"id":"c2","type":"counter","delta":1}`, http.StatusInsufficientStorage},
+		{"existing counter at cap", "/update/", `{"id":"c1","type":"counter","delta":2}`, http.StatusOK},
+		{"first gauge", "/update/gauge/g1/1.5", "", http.StatusOK},
+		{"new gauge at cap", "/update/gauge/g2/1.5", "", http.StatusInsufficientStorage},
+		{"new gauge with bad value", "/update/gauge/g2/none", "", http.StatusBadRequest},
+		{"new counter with bad value", "/update/counter/c2/1.5", "", http.StatusBadRequest},
+		{"existing gauge at cap", "/update/gauge/g1/2.5", "", http.StatusOK},
+		{"batch with new ids", "/updates/", `[{"id":"c3","type":"counter","delta":1},{"id":"g3","type":"gauge","value":1}]`, http.StatusBadRequest},
+		{"batch with mixed ids", "/updates/", `[{"id":"c1","type":"counter","delta":1},{"id":"g3","type":"gauge","value":1}]`, http.StatusPartialContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := doRequest(t, srv, http.MethodPost, tt.path, tt.body)
+			if status != tt.status {
+				t.Errorf("want status %d, got %d: %s", tt.status, status, body)
+			}
+		})
+	}
+
+	status, body := doRequest(t, srv, http.MethodGet, "/value/counter/c1", "")
+	if status != http.StatusOK || body != "4" {
+		t.Errorf("unexpected counter value: %d %q", status, body)
+	}
+}
+
+// countingStore считает чтения количества метрик.
+type countingStore struct {
+	*storetest.Fake
+	mu    sync.Mutex
+	calls int
+}
+
+func (c *countingStore) Count(ctx context.Context, mtype string) (int, error) {
+	c.mu.Lock()
+	c.calls++
+	c.mu.Unlock()
+	return c.Fake.Count(ctx, mtype)
+}
+
+func (c *countingStore) countCalls() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls
+}
+
+func TestCardinalityLimitCounts(t *testing.T) {
+	ctx := context.Background()
+	db := &countingStore{Fake: storetest.NewFake()}
+	c := clock.NewFake(time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC))
+	srv := newTestServer(t, &serverStorage{db: db, maxCounters: 3, clock: c})
+
+	update := func(id string, want int) {
+		t.Helper()
+		if status, body := doRequest(t, srv, http.MethodPost, "/update/counter/"+id+"/1", ""); status != want {
+			t.Errorf("%s: want %d, got %d: %s", id, want, status, body)
+		}
+	}
+
+	// Количество читается один раз, новые метрики учитываются сервером.
+	update("c1", http.StatusOK)
+	update("c2", http.StatusOK)
+	update("c3", http.StatusOK)
+	update("c4", http.StatusInsufficientStorage)
+	if n := db.countCalls(); n != 1 {
+		t.Errorf("want 1 count query, got %d", n)
+	}
+
+	// Удаление через сервер сбрасывает количество.
+	if status, body := doRequest(t, srv, http.MethodDelete, "/value/counter/c1", ""); status != http.StatusNoContent {
+		t.Fatalf("unexpected delete: %d %s", status, body)
+	}
+	update("c4", http.StatusOK)
+	if n := db.countCalls(); n != 2 {
+		t.Errorf("want 2 count queries, got %d", n)
+	}
+
+	// Удаление в обход сервера учитывается после seriesCountsTTL.
+	db.DeleteCounter(ctx, "c2")
+	update("c5", http.StatusInsufficientStorage)
+	c.Advance(seriesCountsTTL)
+	update("c5", http.StatusOK)
+	if n := db.countCalls(); n != 3 {
+		t.Errorf("want 3 count queries, got %d", n)
+	}
+}
+
+func TestCardinalityLimitStoreError(t *testing.T) {
+	errBroken := errors.New("broken")
+	tests := []struct {
+		name   string
+		method string
+		err    error
+		path   string
+		body   string
+		status int
+	}{
+		{"count error", storetest.MethodCount, errBroken, "/update/", `{"id":"c2","type":"counter","delta":1}`, http.StatusInternalServerError},
+		{"count unavailable", storetest.MethodCount, store.ErrUnavailable, "/update/", `{"id":"g2","type":"gauge","value":1}`, http.StatusServiceUnavailable},
+		{"exists error", storetest.MethodExists, errBroken, "/update/", `{"id":"c1","type":"counter","delta":1}`, http.StatusInternalServerError},
+		{"batch count error", storetest.MethodCount, store.ErrUnavailable, "/updates/", `[{"id":"c2","type":"counter","delta":1}]`, http.StatusServiceUnavailable},
+		{"legacy count error", storetest.MethodCount, errBroken, "/update/gauge/g2/1", "", http.StatusInternalServerError},
+		{"existing with count error", storetest.MethodCount, errBroken, "/update/", `{"id":"c1","type":"counter","delta":1}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := storetest.NewFake()
+			db.SetCounter("c1", 1)
+			db.FailWith(tt.method, tt.err)
+			srv := newTestServer(t, &serverStorage{db: db, maxCounters: 10, maxGauges: 10})
+
+			// Ограничение не пропускает запись, пока количество не прочитано.
+			if status, body := doRequest(t, srv, http.MethodPost, tt.path, tt.body); status != tt.status {
+				t.Errorf("want %d, got %d: %s", tt.status, status, body)
+			}
+			if tt.status != http.StatusOK && db.CountCounters(context.Background())+db.CountGauges(context.Background()) != 1 {
+				t.Error("metric must not be written")
+			}
+		})
+	}
+}
+
+func TestInfoFilter(t *testing.T) {
+	ctx := context.Background()
+	db := store.NewFDB(ctx)
+	for _, id := range []string{"HeapAlloc", "HeapIdle", "HeapInuse", "HeapSys", "StackSys"} {
+		db.UpdateGauge(ctx, id, 1)
+	}
+	db.UpdateCounter(ctx, "PollCount", 1)
+	srv := newTestServer(t, &serverStorage{db: db})
+
+	tests := []struct {
+		name    string
+		query   string
+		status  int
+		present []string
+		absent  []string
+	}{
+		{"all", "", http.StatusOK, []string{"HeapAlloc", "StackSys", "PollCount"}, nil},
+		{"prefix", "?prefix=Heap", http.StatusOK, []string{"HeapAlloc", "HeapSys"}, []string{"StackSys", "PollCount"}},
+		{"page", "?prefix=Heap&limit=2&offset=1", http.StatusOK, []string{"HeapIdle", "HeapInuse"}, []string{"HeapAlloc", "HeapSys"}},
+		{"offset out of range", "?offset=10", http.StatusOK, nil, []string{"HeapAlloc", "PollCount"}},
+		{"limit over size", "?prefix=Stack&limit=100", http.StatusOK, []string{"StackSys"}, []string{"HeapAlloc"}},
+		{"negative limit", "?limit=-1", http.StatusBadRequest, nil, nil},
+		{"bad offset", "?offset=x", http.StatusBadRequest, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := doRequest(t, srv, http.MethodGet, "/"+tt.query, "")
+			if status != tt.status {
+				t.Fatalf("want status %d, got %d", tt.status, status)
+			}
+			for _, id := range tt.present {
+				if !strings.Contains(body, id+":") {
+					t.Errorf("%s expected in page", id)
+				}
+			}
+			for _, id := range tt.absent {
+				if strings.Contains(body, id+":") {
+					t.Errorf("%s not expected in page", id)
+				}
+			}
+		})
+	}
+}
+
+func TestInfoDescriptions(t *testing.T) {
+	ctx := context.Background()
+	db := store.NewFDB(ctx)
+	db.UpdateGauge(ctx, "Alloc", 1)
+	db.UpdateGauge(ctx, "Custom", 1)
+
+	_, body := doRequest(t, newTestServer(t, &serverStorage{db: db}), http.MethodGet, "/", "")
+	if strings.Contains(body, "<small>") || strings.Contains(body, "title=") {
+		t.Errorf("descriptions not expected:\n%s", body)
+	}
+
+	srv := newTestServer(t, &serverStorage{db: db, descriptions: map[string]string{
+		"Alloc": "Bytes of allocated <heap> objects.",
+	}})
+	_, body = doRequest(t, srv, http.MethodGet, "/", "")
+	for _, want := range []string{
+		`<span title="Bytes of allocated &lt;heap&gt; objects.">Alloc</span>: 1.000 <small>Bytes of allocated &lt;heap&gt; objects.</small>`,
+		"Custom: 1.000<br>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("%q expected in page:\n%s", want, body)
+		}
+	}
+}
+
+func TestInfoEscaping(t *testing.T) {
+	ctx := context.Background()
+	db := store.NewFDB(ctx)
+	db.UpdateCounter(ctx, "<script>alert(1)</script>", 1)
+	db.UpdateGauge(ctx, `Alloc{host=<b>"x"</b>}`, 1)
+
+	_, body := doRequest(t, newTestServer(t, &serverStorage{db: db}), http.MethodGet, "/", "")
+	if strings.Contains(body, "<script>") || strings.Contains(body, "<b>") {
+		t.Errorf("metric names must be escaped:\n%s", body)
+	}
+	for _, want := range []string{
+		"&lt;script&gt;alert(1)&lt;/script&gt;: 1<br>",
+		`Alloc <code>{host=&lt;b&gt;&#34;x&#34;&lt;/b&gt;}</code>: 1.000<br>`,
+		`<meta http-equiv="refresh" content="5" />`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("%q expected in page:\n%s", want, body)
+		}
+	}
+}
+
+// lockCheckWriter проверяет при каждой записи ответа,
+// что ни сервер, ни хранилище не заблокированы.
+type lockCheckWriter struct {
+	*httptest.ResponseRecorder
+	server  *serverStorage
+	writes  int
+	flushes int
+	locked  int
+}
+
+func (w *lockCheckWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.server.TryLock() {
+		w.server.Unlock()
+	} else {
+		w.locked++
+	}
+	done := make(chan struct{})
+	go func() {
+		w.server.db.UpdateCounter(context.Background(), "WriteCount", 1)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		w.locked++
+		<-done
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func (w *lockCheckWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *lockCheckWriter) Flush() {
+	w.flushes++
+}
+
+func TestInfoStreaming(t *testing.T) {
+	ctx := context.Background()
+	db := store.NewFDB(ctx)
+	for i := 0; i < 3*infoFlushRows; i++ {
+		db.UpdateGauge(ctx, fmt.Sprintf("g%04d", i), float64(i))
+	}
+	server := &serverStorage{db: db}
+
+	w := &lockCheckWriter{ResponseRecorder: httptest.NewRecorder(), server: server}
+	server.infoHandler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.writes < 3*infoFlushRows {
+		t.Fatalf("rows expected to be written one by one, got %d writes", w.writes)
+	}
+	if w.locked != 0 {
+		t.Errorf("lock held during %d of %d writes", w.locked, w.writes)
+	}
+	if w.flushes < 3 {
+		t.Errorf("want periodic flushes, got %d", w.flushes)
+	}
+	if !strings.Contains(w.Body.String(), "g0299: 299.000") {
+		t.Error("last gauge expected in page")
+	}
+}
+
+func TestLoadDescriptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "descriptions.json")
+	if err := os.WriteFile(path, []byte(`{"Custom":"My metric","Alloc":"Heap bytes"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := loadDescriptions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d["Custom"] != "My metric" || d["Alloc"] != "Heap bytes" || d["HeapIdle"] != runtimeDescriptions["HeapIdle"] {
+		t.Errorf("unexpected descriptions: %v", d)
+	}
+
+	if err := os.WriteFile(path, []byte(`[]`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDescriptions(path); err == nil {
+		t.Error("error expected for invalid file")
+	}
+}
+
+func TestUpdateIntGauge(t *testing.T) {
+	key := "secret"
+	srv := newTestServer(t, &serverStorage{key: []byte(key)})
+
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte("LastGC:gauge:9007199254740993"))
+	body := fmt.Sprintf(`{"id":"LastGC","type":"gauge","delta":9007199254740993,"hash":"%x"}`, h.Sum(nil))
+	if status, resp := doRequest(t, srv, http.MethodPost, "/update/", body); status != http.StatusOK {
+		t.Fatalf("want status 200, got %d: %s", status, resp)
+	}
+
+	// Хеш, посчитанный от значения с округлением, не принимается.
+	body = `{"id":"LastGC","type":"gauge","delta":9007199254740993,"hash":"bad"}`
+	if status, resp := doRequest(t, srv, http.MethodPost, "/updates/", "["+body+"]"); status != http.StatusConflict {
+		t.Fatalf("want status 409, got %d: %s", status, resp)
+	}
+}
+
+func TestUpdateErrorStatuses(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{key: []byte("secret")})
+
+	tests := []struct {
+		name   string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{"malformed body", "/update/", `{"id":"c1","type":`, http.StatusBadRequest, errCodeBadRequest},
+		{"bad hash", "/update/", `{"id":"c1","type":"counter","delta":1,"hash":"bad"}`, http.StatusConflict, errCodeHashMismatch},
+		{"unknown type", "/update/", `{"id":"c1","type":"histogram","delta":1}`, http.StatusNotImplemented, errCodeUnknownType},
+		{"batch malformed body", "/updates/", `[{"id":"c1"`, http.StatusBadRequest, errCodeBadRequest},
+		{"batch bad hash", "/updates/", `[{"id":"c1","type":"counter","delta":1,"hash":"bad"}]`, http.StatusConflict, errCodeHashMismatch},
+		{"batch unknown type", "/updates/", `[{"id":"c1","type":"histogram","delta":1}]`, http.StatusBadRequest, ""},
+		{"batch mixed errors", "/updates/", `[{"id":"c1","type":"counter","delta":1,"hash":"bad"},{"id":"c1","type":"histogram"}]`, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, srv.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("want status %d, got %d", tt.status, resp.StatusCode)
+			}
+			if code := resp.Header.Get(errCodeHeader); code != tt.code {
+				t.Errorf("want code %q, got %q", tt.code, code)
+			}
+		})
+	}
+}
+
+func TestStatsStore(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{})
+
+	doRequest(t, srv, http.MethodPost, "/update/counter/c/1", "")
+	doRequest(t, srv, http.MethodPost, "/update/gauge/g/1", "")
+
+	status, body := doRequest(t, srv, http.MethodGet, "/stats", "")
+	if status != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", status, body)
+	}
+	var got statsResponse
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Store == nil || got.Store.PendingWrites != 2 || got.Store.SaveCount != 0 {
+		t.Errorf("unexpected store stats: %s", body)
+	}
+}
+
+func TestStatsDocument(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{
+		key:        []byte("secret"),
+		adminKey:   []byte("admin"),
+		hashExempt: sign.ParseExempt("c,g"),
+		conns:      newConnStats(clock.Real()),
+		sequences:  newReportSequences(),
+		started:    time.Now().Add(-time.Minute),
+	})
+
+	doRequest(t, srv, http.MethodPost, "/update/counter/c/1", "")
+	doRequest(t, srv, http.MethodPost, "/update/unknown/u/1", "")
+	doRequest(t, srv, http.MethodPost, "/update/", `{"id":"g","type":"gauge","value":1}`)
+	doRequest(t, srv, http.MethodPost, "/updates/", `[{"id":"c","type":"counter","delta":1},{"type":"counter","delta":1},{"id":"y","type":"histogram","value":1}]`)
+
+	if status, _ := doRequest(t, srv, http.MethodGet, "/stats", ""); status != http.StatusUnauthorized {
+		t.Errorf("stats without key: want 401, got %d", status)
+	}
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/stats", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(adminKeyHeader, "admin")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(body, &sections); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"server", "metrics", "connections", "store", "reports"} {
+		if _, ok := sections[name]; !ok {
+			t.Errorf("missing section %q: %s", name, body)
+		}
+	}
+	var got statsResponse
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := metricStats{Counters: 1, Gauges: 1, Accepted: 3, Rejected: 1, UnknownType: 2}
+	if got.Metrics != want {
+		t.Errorf("want metrics %+v, got %+v", want, got.Metrics)
+	}
+	if got.Server.Uptime != "1m0s" || got.Server.Version == "" {
+		t.Errorf("unexpected server section: %+v", got.Server)
+	}
+	if got.Connections.RequestRate == 0 {
+		t.Errorf("want request rate, got %+v", got.Connections)
+	}
+}
+
+func TestCardinalityWarning(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := logger.New(&buf, logger.LevelWarn, logger.FormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.SetDefault(logger.SetDefault(l))
+
+	srv := newTestServer(t, &serverStorage{warnCardinality: 2})
+
+	doRequest(t, srv, http.MethodPost, "/update/counter/c1/1", "")
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected warning below threshold: %s", buf.String())
+	}
+	doRequest(t, srv, http.MethodPost, "/update/", `{"id":"g1","type":"gauge","value":1}`)
+	doRequest(t, srv, http.MethodPost, "/updates/", `[{"id":"c2","type":"counter","delta":1}]`)
+	doRequest(t, srv, http.MethodPost, "/update/counter/c1/1", "")
+
+	if n := strings.Count(buf.String(), "distinct metrics reached"); n != 1 {
+		t.Errorf("want exactly one warning, got %d:\n%s", n, buf.String())
+	}
+}
+
+func TestValueAllAge(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{})
+	doRequest(t, srv, http.MethodPost, "/update/counter/c/1", "")
+
+	age := func() float64 {
+		t.Helper()
+		status, body := doRequest(t, srv, http.MethodGet, "/value/all", "")
+		if status != http.StatusOK {
+			t.Fatalf("unexpected status: %d %s", status, body)
+		}
+		var metrics []metricAge
+		if err := json.Unmarshal([]byte(body), &metrics); err != nil {
+			t.Fatal(err)
+		}
+		if len(metrics) != 1 || metrics[0].AgeSeconds == nil {
+			t.Fatalf("unexpected response: %s", body)
+		}
+		return *metrics[0].AgeSeconds
+	}
+
+	first := age()
+	time.Sleep(20 * time.Millisecond)
+	if second := age(); second <= first {
+		t.Errorf("age of not refreshed metric must grow: %f, %f", first, second)
+	}
+}
+
+func TestPrometheus(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{})
+	// PollCount_total совпадает с именем счетчика после добавления _total,
+	// Heap/Alloc - с уже выведенным рядом Heap_Alloc.
+	data := `[
+		{"id":"PollCount","type":"counter","delta":3},
+		{"id":"PollCount","type":"counter","delta":2,"tags":{"instance":"a\"b"}},
+		{"id":"Heap.Alloc","type":"gauge","value":1.5},
+		{"id":"Heap/Alloc","type":"gauge","value":2.5},
+		{"id":"1m","type":"gauge","value":0.1},
+		{"id":"PollCount_total","type":"gauge","value":1}
+	]`
+	if status, body := doRequest(t, srv, http.MethodPost, "/updates/", data); status != http.StatusOK {
+		t.Fatalf("unexpected response: %d %q", status, body)
+	}
+
+	resp, err := srv.Client().Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if ct := resp.Header.Get("Content-Type"); ct != prometheusContentType {
+		t.Errorf("unexpected content type: %q", ct)
+	}
+	want := `# TYPE Heap_Alloc gauge
+Heap_Alloc 1.5
+# TYPE PollCount_total counter
+PollCount_total 3
+PollCount_total{instance="a\"b"} 2
+# TYPE _1m gauge
+_1m 0.1
+`
+	if string(body) != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, body)
+	}
+}
+
+type degradedStore struct {
+	store.Store
+	degraded bool
+}
+
+func (d *degradedStore) Degraded() bool {
+	return d.degraded
+}
+
+func TestDegradedStore(t *testing.T) {
+	db := &degradedStore{Store: store.NewFDB(context.Background()), degraded: true}
+	srv := newTestServer(t, &serverStorage{db: db})
+
+	if status, _ := doRequest(t, srv, http.MethodGet, "/healthz", ""); status != http.StatusServiceUnavailable {
+		t.Errorf("healthz: want 503, got %d", status)
+	}
+	if status, _ := doRequest(t, srv, http.MethodPost, "/update/counter/c/1", ""); status != http.StatusServiceUnavailable {
+		t.Errorf("update: want 503, got %d", status)
+	}
+
+	db.degraded = false
+	if status, _ := doRequest(t, srv, http.MethodGet, "/healthz", ""); status != http.StatusOK {
+		t.Errorf("healthz: want 200, got %d", status)
+	}
+	if status, _ := doRequest(t, srv, http.MethodPost, "/update/counter/c/1", ""); status != http.StatusOK {
+		t.Errorf("update: want 200, got %d", status)
+	}
+}
+
+func TestVersion(t *testing.T) {
+	defer func(version, commit, date string) {
+		buildVersion, buildCommit, buildDate = version, commit, date
+	}(buildVersion, buildCommit, buildDate)
+	buildVersion, buildCommit, buildDate = "v1.2.3", "abc123", "2022-05-01T00:00:00Z"
+
+	srv := newTestServer(t, &serverStorage{})
+	status, body := doRequest(t, srv, http.MethodGet, "/version", "")
+	if status != http.StatusOK {
+		t.Fatalf("unexpected status: %d", status)
+	}
+	var got map[string]string
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"version": "v1.2.3", "commit": "abc123", "date": "2022-05-01T00:00:00Z"}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: want %q, got %q", k, v, got[k])
+		}
+	}
+}
+
+func TestUpdateReturnsCounterTotal(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{})
+
+	const n = 20
+	totals := make(chan int64, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodPost, srv.URL+"/update/",
+				strings.NewReader(`{"id":"PollCount","type":"counter","delta":1}`))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			req.Header.Set("Accept", "application/json")
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			var m models.Metrics
+			if err := json.NewDecoder(resp.Body).Decode(&m); err != nil || m.Delta == nil {
+				t.Errorf("unexpected response: %+v, %v", m, err)
+				return
+			}
+			totals <- *m.Delta
+		}()
+	}
+	wg.Wait()
+	close(totals)
+
+	seen := make(map[int64]bool)
+	for total := range totals {
+		seen[total] = true
+	}
+	for total := int64(1); total <= n; total++ {
+		if !seen[total] {
+			t.Errorf("total %d was never returned", total)
+		}
+	}
+
+	// Без запроса JSON тело ответа остается пустым.
+	status, body := doRequest(t, srv, http.MethodPost, "/update/", `{"id":"PollCount","type":"counter","delta":1}`)
+	if status != http.StatusOK || body != "" {
+		t.Errorf("unexpected response: %d %q", status, body)
+	}
+}
+
+func TestUpdatesStructuredResponse(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{maxCounters: 1})
+
+	body := `[{"id":"c1","type":"counter","delta":1},
+		{"id":"c2","type":"counter","delta":1},
+		{"id":"h1","type":"histogram","delta":1}]`
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/updates/", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Errorf("want 206, got %d", resp.StatusCode)
+	}
+	var got updatesResult
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := updatesResult{
+		Accepted: 1,
+		Rejected: []rejectedMetric{
+			{ID: "c2", MType: "counter", Code: errCodeLimitExceeded, Message: `Too many distinct counters: "c2"`},
+			{ID: "h1", MType: "histogram", Code: errCodeUnknownType, Message: `Unknown type "histogram" or content of metrics: "h1"`},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+}
+
+func TestHashExempt(t *testing.T) {
+	key := []byte("secret")
+	srv := newTestServer(t, &serverStorage{key: key, hashExempt: sign.ParseExempt("Random, debug.")})
+	legacySrv := newTestServer(t, &serverStorage{key: key, legacyHash: true})
+
+	signed := models.Metrics{ID: "Alloc", MType: models.Gauge, Value: new(float64)}
+	signed.Hash = sign.Hash(key, signed)
+	signedBody, _ := json.Marshal(signed)
+	// Подпись прежних агентов и автотестов: значение датчика в формате %f.
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(fmt.Sprintf("%s:gauge:%f", "Alloc", 0.1234567)))
+	legacyBody := fmt.Sprintf(`{"id":"Alloc","type":"gauge","value":0.1234567,"hash":"%x"}`, h.Sum(nil))
+
+	tests := []struct {
+		name   string
+		legacy bool
+		body   string
+		status int
+	}{
+		{"exempt without hash", false, `{"id":"RandomValue","type":"gauge","value":1}`, http.StatusOK},
+		{"exempt prefix without hash", false, `{"id":"debug.polls","type":"counter","delta":1}`, http.StatusOK},
+		{"exempt with wrong hash", false, `{"id":"RandomValue","type":"gauge","value":1,"hash":"bad"}`, http.StatusConflict},
+		{"not exempt without hash", false, `{"id":"Alloc","type":"gauge","value":1}`, http.StatusConflict},
+		{"not exempt with hash", false, string(signedBody), http.StatusOK},
+		{"legacy gauge hash", false, legacyBody, http.StatusConflict},
+		{"legacy gauge hash allowed", true, legacyBody, http.StatusOK},
+		{"legacy mode with hash", true, string(signedBody), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := srv
+			if tt.legacy {
+				s = legacySrv
+			}
+			if status, body := doRequest(t, s, http.MethodPost, "/update/", tt.body); status != tt.status {
+				t.Errorf("want %d, got %d: %s", tt.status, status, body)
+			}
+		})
+	}
+}
+
+func TestSigningWindow(t *testing.T) {
+	key := []byte("secret")
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	srv := newTestServer(t, &serverStorage{
+		key:        key,
+		hashExempt: sign.ParseExempt("Random"),
+		maxSkew:    30 * time.Second,
+		clock:      clock.NewFake(now),
+	})
+
+	signedAt := func(at time.Time) string {
+		m := models.Metrics{ID: "PollCount", MType: models.Counter, Delta: new(int64)}
+		if !at.IsZero() {
+			m.SignedAt = at.Unix()
+		}
+		m.Hash = sign.Hash(key, m)
+		body, _ := json.Marshal(m)
+		return string(body)
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"in window", signedAt(now), http.StatusOK},
+		{"agent clock behind", signedAt(now.Add(-30 * time.Second)), http.StatusOK},
+		{"agent clock ahead", signedAt(now.Add(30 * time.Second)), http.StatusOK},
+		{"replayed", signedAt(now.Add(-time.Minute)), http.StatusConflict},
+		{"from future", signedAt(now.Add(time.Minute)), http.StatusConflict},
+		{"without signing time", signedAt(time.Time{}), http.StatusConflict},
+		{"exempt without hash", `{"id":"RandomValue","type":"gauge","value":1}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, body := doRequest(t, srv, http.MethodPost, "/update/", tt.body); status != tt.status {
+				t.Errorf("want %d, got %d: %s", tt.status, status, body)
+			}
+		})
+	}
+
+	// В пакете отклоняются только метрики вне окна.
+	status, body := doRequest(t, srv, http.MethodPost, "/updates/",
+		"["+signedAt(now)+","+signedAt(now.Add(-time.Hour))+"]")
+	if status != http.StatusPartialContent || !strings.Contains(body, "out of window") {
+		t.Errorf("unexpected response: %d %s", status, body)
+	}
+}
+
+func TestUpdatesBinary(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{})
+
+	delta, value := int64(3), 1.5
+	var buf bytes.Buffer
+	if err := wire.Encode(&buf, []models.Metrics{
+		{ID: "PollCount", MType: models.Counter, Delta: &delta},
+		{ID: "Alloc", MType: models.Gauge, Value: &value},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Client().Post(srv.URL+"/updates/", wire.ContentType, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("want 200, got %d", resp.StatusCode)
+	}
+	if status, body := doRequest(t, srv, http.MethodGet, "/value/counter/PollCount", ""); body != "3" {
+		t.Errorf("unexpected counter: %d %q", status, body)
+	}
+
+	resp, err = srv.Client().Post(srv.URL+"/updates/", wire.ContentType, strings.NewReader("\x01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("want 400 for malformed body, got %d", resp.StatusCode)
+	}
+}
+
+func TestHandlerStoreErrors(t *testing.T) {
+	errBroken := errors.New("broken")
+	tests := []struct {
+		name   string
+		method string
+		err    error
+		path   string
+		body   string
+		status int
+	}{
+		{"ping", storetest.MethodPing, errBroken, "/ping", "", http.StatusInternalServerError},
+		{"value error", storetest.MethodGet, errBroken, "/value/", `{"id":"c","type":"counter"}`, http.StatusInternalServerError},
+		{"value unavailable", storetest.MethodGet, store.ErrUnavailable, "/value/", `{"id":"c","type":"counter"}`, http.StatusServiceUnavailable},
+		{"update error", storetest.MethodIncrAndGet, errBroken, "/update/", `{"id":"c","type":"counter","delta":1}`, http.StatusInternalServerError},
+		{"update unavailable", storetest.MethodIncrAndGet, store.ErrUnavailable, "/update/", `{"id":"c","type":"counter","delta":1}`, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := storetest.NewFake()
+			db.FailWith(tt.method, tt.err)
+			srv := newTestServer(t, &serverStorage{db: db})
+
+			httpMethod := http.MethodPost
+			if tt.body == "" {
+				httpMethod = http.MethodGet
+			}
+			if status, body := doRequest(t, srv, httpMethod, tt.path, tt.body); status != tt.status {
+				t.Errorf("want %d, got %d: %s", tt.status, status, body)
+			}
+
+			// После снятия ошибки запрос выполняется.
+			db.FailWith(tt.method, nil)
+			if status, body := doRequest(t, srv, httpMethod, tt.path, tt.body); status >= 300 && status != http.StatusNotFound {
+				t.Errorf("want success, got %d: %s", status, body)
+			}
+		})
+	}
+}
+
+func TestHandlerFakeStore(t *testing.T) {
+	db := storetest.NewFake()
+	db.SetCounter("PollCount", 41)
+	db.SetGauge("Alloc", 1.5)
+	srv := newTestServer(t, &serverStorage{db: db})
+
+	if status, body := doRequest(t, srv, http.MethodGet, "/value/gauge/Alloc", ""); status != http.StatusOK || body != "1.500" {
+		t.Errorf("unexpected gauge: %d %q", status, body)
+	}
+	status, body := doRequest(t, srv, http.MethodPost, "/update/", `{"id":"PollCount","type":"counter","delta":1}`)
+	if status != http.StatusOK {
+		t.Fatalf("unexpected update: %d %q", status, body)
+	}
+	if v, _ := db.Counter(context.Background(), "PollCount"); v != 42 {
+		t.Errorf("want 42, got %d", v)
+	}
+
+	db.SetDegraded(true)
+	if status, _ := doRequest(t, srv, http.MethodGet, "/healthz", ""); status != http.StatusServiceUnavailable {
+		t.Errorf("healthz: want 503, got %d", status)
+	}
+}
+
+func TestObservedAtRoundTrip(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{})
+
+	const observedAt = int64(1651406400123)
+	for _, body := range []string{
+		fmt.Sprintf(`{"id":"PollCount","type":"counter","delta":1,"observed_at":%d}`, observedAt),
+		fmt.Sprintf(`{"id":"Alloc","type":"gauge","value":1.5,"observed_at":%d}`, observedAt),
+	} {
+		if status, resp := doRequest(t, srv, http.MethodPost, "/update/", body); status != http.StatusOK {
+			t.Fatalf("update: %d %q", status, resp)
+		}
+	}
+	for _, body := range []string{
+		`{"id":"PollCount","type":"counter"}`,
+		`{"id":"Alloc","type":"gauge"}`,
+	} {
+		status, resp := doRequest(t, srv, http.MethodPost, "/value/", body)
+		if status != http.StatusOK {
+			t.Fatalf("value: %d %q", status, resp)
+		}
+		var m models.Metrics
+		if err := json.Unmarshal([]byte(resp), &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.ObservedAt != observedAt {
+			t.Errorf("%s: want observed_at %d, got %d", m.ID, observedAt, m.ObservedAt)
+		}
+	}
+
+	// Метрики без времени измерения его не получают.
+	doRequest(t, srv, http.MethodPost, "/update/", `{"id":"Other","type":"gauge","value":1}`)
+	if _, resp := doRequest(t, srv, http.MethodPost, "/value/", `{"id":"Other","type":"gauge"}`); strings.Contains(resp, "observed_at") {
+		t.Errorf("unexpected observed_at: %s", resp)
+	}
+}
+
+func TestLegacyBodyLimit(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{})
+
+	big := strings.Repeat("x", maxLegacyBodySize+1)
+	if status, _ := doRequest(t, srv, http.MethodPost, "/update/counter/c/1", big); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("want 413, got %d", status)
+	}
+	if status, _ := doRequest(t, srv, http.MethodGet, "/value/counter/c", ""); status != http.StatusNotFound {
+		t.Errorf("rejected update must not be applied, got %d", status)
+	}
+
+	// Без Content-Length размер проверяется при чтении.
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/update/counter/c/1", io.MultiReader(strings.NewReader(big)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunked: want 413, got %d", resp.StatusCode)
+	}
+
+	if status, _ := doRequest(t, srv, http.MethodPost, "/update/counter/c/1", "small"); status != http.StatusOK {
+		t.Errorf("small body: want 200, got %d", status)
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	key := []byte("secret")
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	srv := newTestServer(t, &serverStorage{key: key, adminKey: []byte("admin"), maxCounters: 1, maxSkew: time.Minute, clock: clock.NewFake(now)})
+	doRequest(t, srv, http.MethodPost, "/update/counter/c0/1", "")
+	signedAt := func(at time.Time) string {
+		m := models.Metrics{ID: "c1", MType: models.Counter, Delta: new(int64), SignedAt: at.Unix()}
+		m.Hash = sign.Hash(key, m)
+		body, _ := json.Marshal(m)
+		return string(body)
+	}
+	degraded := newTestServer(t, &serverStorage{db: &degradedStore{Store: store.NewFDB(context.Background()), degraded: true}})
+
+	tests := []struct {
+		name    string
+		srv     *httptest.Server
+		path    string
+		headers map[string]string
+		body    string
+		status  int
+		code    string
+	}{
+		{"malformed body", srv, "/update/", nil, `{"id":"c1","type":`, http.StatusBadRequest, errCodeBadRequest},
+		{"bad hash", srv, "/update/", nil, `{"id":"c1","type":"counter","delta":1,"hash":"bad"}`, http.StatusConflict, errCodeHashMismatch},
+		{"stale signature", srv, "/update/", nil, signedAt(now.Add(-time.Hour)), http.StatusConflict, errCodeTimestampSkew},
+		{"limit exceeded", srv, "/update/", nil, signedAt(now), http.StatusInsufficientStorage, errCodeLimitExceeded},
+		{"unknown type", srv, "/update/", nil, `{"id":"c1","type":"histogram","delta":1}`, http.StatusNotImplemented, errCodeUnknownType},
+		{"batch malformed body", srv, "/updates/", nil, `[{"id":"c1"`, http.StatusBadRequest, errCodeBadRequest},
+		{"value malformed body", srv, "/value/", nil, `{`, http.StatusBadRequest, errCodeBadRequest},
+		{"value not found", srv, "/value/", nil, `{"id":"missing","type":"gauge"}`, http.StatusNotFound, errCodeNotFound},
+		{"value unknown type", srv, "/value/", nil, `{"id":"c0","type":"histogram"}`, http.StatusNotImplemented, errCodeUnknownType},
+		{"unsupported encoding", srv, "/update/", map[string]string{"Content-Encoding": "br"}, `{}`, http.StatusUnsupportedMediaType, errCodeUnsupportedEncoding},
+		{"bad compressed body", srv, "/update/", map[string]string{"Content-Encoding": "gzip"}, `{}`, http.StatusBadRequest, errCodeBadRequest},
+		{"admin unauthorized", srv, "/admin/compact", nil, "", http.StatusUnauthorized, errCodeUnauthorized},
+		{"storage unavailable", degraded, "/update/", nil, `{"id":"c1","type":"counter","delta":1}`, http.StatusServiceUnavailable, errCodeUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, tt.srv.URL+tt.path, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Accept", "application/json")
+			req.Header.Set("Accept-Encoding", "identity")
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			resp, err := tt.srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Errorf("want status %d, got %d", tt.status, resp.StatusCode)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("want JSON, got %q", ct)
+			}
+			var got errorResponse
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Error.Code != tt.code || got.Error.Code != resp.Header.Get(errCodeHeader) {
+				t.Errorf("want code %q, got %q (header %q)", tt.code, got.Error.Code, resp.Header.Get(errCodeHeader))
+			}
+			if got.Error.Message == "" {
+				t.Error("message expected")
+			}
+		})
+	}
+
+	// Без Accept: application/json ошибка передается текстом.
+	status, body := doRequest(t, srv, http.MethodPost, "/value/", `{"id":"missing","type":"gauge"}`)
+	if status != http.StatusNotFound || body != "Metrics not found" {
+		t.Errorf("want plain text error, got %d %q", status, body)
+	}
+}
+
+func TestRejectTrailingJSON(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{})
+
+	tests := []struct {
+		name, path, body string
+	}{
+		{"update two objects", "/update/", `{"id":"c1","type":"counter","delta":1}{"id":"c2","type":"counter","delta":1}`},
+		{"update trailing garbage", "/update/", `{"id":"c1","type":"counter","delta":1} x`},
+		{"value two objects", "/value/", `{"id":"c1","type":"counter"}{"id":"c2","type":"counter"}`},
+		{"updates two arrays", "/updates/", `[{"id":"c1","type":"counter","delta":1}][]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, body := doRequest(t, srv, http.MethodPost, tt.path, tt.body); status != http.StatusBadRequest {
+				t.Errorf("want 400, got %d: %s", status, body)
+			}
+		})
+	}
+	if status, _ := doRequest(t, srv, http.MethodGet, "/value/counter/c1", ""); status != http.StatusNotFound {
+		t.Errorf("rejected metrics must not be stored, got %d", status)
+	}
+
+	// Пробельные символы после объекта допустимы.
+	if status, body := doRequest(t, srv, http.MethodPost, "/update/", "{\"id\":\"c1\",\"type\":\"counter\",\"delta\":1}\n"); status != http.StatusOK {
+		t.Errorf("want 200, got %d: %s", status, body)
+	}
+}
+
+func TestValueLegacyJSON(t *testing.T) {
+	key := []byte("secret")
+	srv := newTestServer(t, &serverStorage{key: key})
+	doRequest(t, srv, http.MethodPost, "/update/counter/PollCount/3", "")
+	doRequest(t, srv, http.MethodPost, "/update/gauge/Alloc/1.5", "")
+
+	if status, body := doRequest(t, srv, http.MethodGet, "/value/counter/PollCount", ""); status != http.StatusOK || body != "3" {
+		t.Errorf("text: unexpected response %d %q", status, body)
+	}
+
+	get := func(path string, accept string) (int, models.Metrics) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var m models.Metrics
+		if resp.StatusCode == http.StatusOK {
+			if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("want JSON, got %q", ct)
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, m
+	}
+
+	status, m := get("/value/counter/PollCount?format=json", "")
+	if status != http.StatusOK || m.Delta == nil || *m.Delta != 3 || !sign.Check(key, m) {
+		t.Errorf("format=json: unexpected %d %+v", status, m)
+	}
+	status, m = get("/value/gauge/Alloc", "application/json")
+	if status != http.StatusOK || m.Value == nil || *m.Value != 1.5 || !sign.Check(key, m) {
+		t.Errorf("Accept: unexpected %d %+v", status, m)
+	}
+	if status, _ := get("/value/gauge/Missing?format=json", ""); status != http.StatusNotFound {
+		t.Errorf("missing: want 404, got %d", status)
+	}
+	if status, _ := get("/value/histogram/Alloc?format=json", ""); status != http.StatusNotImplemented {
+		t.Errorf("unknown type: want 501, got %d", status)
+	}
+}
+
+func TestUpdateSampledCounter(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{})
+
+	status, body := doRequest(t, srv, http.MethodPost, "/update/",
+		`{"id":"Hits","type":"counter","delta":3,"sample_rate":0.25}`)
+	if status != http.StatusOK {
+		t.Fatalf("unexpected response: %d %q", status, body)
+	}
+	if _, body := doRequest(t, srv, http.MethodGet, "/value/counter/Hits", ""); body != "12" {
+		t.Errorf("want upscaled delta 12, got %q", body)
+	}
+
+	for _, rate := range []string{"-0.5", "1.5"} {
+		status, _ := doRequest(t, srv, http.MethodPost, "/update/",
+			`{"id":"Hits","type":"counter","delta":1,"sample_rate":`+rate+`}`)
+		if status != http.StatusBadRequest {
+			t.Errorf("rate %s: want %d, got %d", rate, http.StatusBadRequest, status)
+		}
+	}
+
+	// Агент учитывает каждое увеличение с вероятностью rate и отправляет
+	// пачками, сумма восстановленных сервером приращений должна совпадать
+	// с истинным количеством в пределах статистической погрешности.
+	const (
+		n      = 100000
+		rate   = 0.05
+		report = 1000
+	)
+	rnd := rand.New(rand.NewSource(1))
+	var batch []models.Metrics
+	var sampled int64
+	for i := 1; i <= n; i++ {
+		if rnd.Float64() < rate {
+			sampled++
+		}
+		if i%report == 0 && sampled > 0 {
+			delta := sampled
+			batch = append(batch, models.Metrics{ID: "Sampled", MType: models.Counter, Delta: &delta, SampleRate: rate})
+			sampled = 0
+		}
+	}
+	data, _ := json.Marshal(batch)
+	if status, body := doRequest(t, srv, http.MethodPost, "/updates/", string(data)); status != http.StatusOK {
+		t.Fatalf("unexpected response: %d %q", status, body)
+	}
+	_, body = doRequest(t, srv, http.MethodGet, "/value/counter/Sampled", "")
+	got, err := strconv.ParseInt(body, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Округление каждого приращения добавляет не больше 0.5 на пачку.
+	tolerance := 5*math.Sqrt(n*(1-rate)/rate) + float64(len(batch))/2
+	if math.Abs(float64(got-n)) > tolerance {
+		t.Errorf("want %d±%.0f, got %d", n, tolerance, got)
+	}
+}
+
+func TestGaugePrecision(t *testing.T) {
+	key := []byte("secret")
+	value := 1.23456789
+	m := models.Metrics{ID: "Load", MType: models.Gauge, Value: &value}
+	m.Hash = sign.Hash(key, m)
+	body, _ := json.Marshal(m)
+
+	tests := []struct {
+		name  string
+		scale float64
+		want  float64
+	}{
+		{"full precision by default", 0, 1.23456789},
+		{"three digits", 1000, 1.235},
+		{"integers", 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, &serverStorage{key: key, gaugeScale: tt.scale})
+			if status, resp := doRequest(t, srv, http.MethodPost, "/update/", string(body)); status != http.StatusOK {
+				t.Fatalf("unexpected response: %d %q", status, resp)
+			}
+
+			// Ответ сервера подписан по сохраненному значению.
+			_, resp := doRequest(t, srv, http.MethodPost, "/value/", `{"id":"Load","type":"gauge"}`)
+			var got models.Metrics
+			if err := json.Unmarshal([]byte(resp), &got); err != nil || got.Value == nil {
+				t.Fatalf("unexpected response %q: %v", resp, err)
+			}
+			if *got.Value != tt.want {
+				t.Errorf("want %v, got %v", tt.want, *got.Value)
+			}
+			if !sign.Check(key, got) {
+				t.Errorf("hash does not match stored value: %+v", got)
+			}
+
+			// Вывод совпадает с сохраненным значением при точности до трех знаков.
+			_, resp = doRequest(t, srv, http.MethodGet, "/value/gauge/Load", "")
+			if tt.scale != 0 && resp != fmt.Sprintf("%.3f", tt.want) {
+				t.Errorf("want %.3f displayed, got %q", tt.want, resp)
+			}
+
+			doRequest(t, srv, http.MethodPost, "/update/gauge/Legacy/2.71828", "")
+			if _, resp := doRequest(t, srv, http.MethodPost, "/value/", `{"id":"Legacy","type":"gauge"}`); tt.scale == 1000 && !strings.Contains(resp, `"value":2.718,`) {
+				t.Errorf("legacy update not rounded: %s", resp)
+			}
+		})
+	}
+}
+
+func TestRoundGauge(t *testing.T) {
+	s := &serverStorage{gaugeScale: 100}
+	for _, tt := range []struct{ in, want float64 }{
+		{1.005, 1}, // 1.005 в float64 чуть меньше 1.005
+		{-2.555, -2.56},
+		{1e300, 1e300},
+	} {
+		if got := s.roundGauge(tt.in); got != tt.want {
+			t.Errorf("%v: want %v, got %v", tt.in, tt.want, got)
+		}
+	}
+	if got := s.roundGauge(math.NaN()); !math.IsNaN(got) {
+		t.Errorf("NaN must stay NaN, got %v", got)
+	}
+}
+
+func TestTaggedMetrics(t *testing.T) {
+	key := []byte("secret")
+	srv := newTestServer(t, &serverStorage{key: key})
+
+	signed := func(id string, delta int64, tags map[string]string) models.Metrics {
+		m := models.Metrics{ID: id, MType: models.Counter, Delta: &delta, Tags: tags}
+		m.Hash = sign.Hash(key, m)
+		return m
+	}
+	a := map[string]string{"instance": "a"}
+	b := map[string]string{"instance": "b"}
+	data, _ := json.Marshal([]models.Metrics{
+		signed("PollCount", 1, a),
+		signed("PollCount", 2, b),
+		signed("PollCount", 4, nil),
+	})
+	if status, body := doRequest(t, srv, http.MethodPost, "/updates/", string(data)); status != http.StatusOK {
+		t.Fatalf("unexpected response: %d %q", status, body)
+	}
+
+	// Метрики с разными тегами хранятся отдельно.
+	for tags, want := range map[string]int64{`{"instance":"a"}`: 1, `{"instance":"b"}`: 2, `null`: 4} {
+		_, body := doRequest(t, srv, http.MethodPost, "/value/", `{"id":"PollCount","type":"counter","tags":`+tags+`}`)
+		var m models.Metrics
+		if err := json.Unmarshal([]byte(body), &m); err != nil || m.Delta == nil || *m.Delta != want {
+			t.Errorf("tags %s: want %d, got %q", tags, want, body)
+			continue
+		}
+		if m.ID != "PollCount" || !sign.Check(key, m) {
+			t.Errorf("tags %s: unexpected metric %+v", tags, m)
+		}
+	}
+	if _, body := doRequest(t, srv, http.MethodGet, "/value/counter/PollCount%7Binstance=b%7D", ""); body != "2" {
+		t.Errorf("legacy value by series name: want 2, got %q", body)
+	}
+	if _, body := doRequest(t, srv, http.MethodGet, "/", ""); !strings.Contains(body, "PollCount <code>{instance=a}</code>") {
+		t.Errorf("tags not displayed:\n%s", body)
+	}
+
+	// Теги входят в подпись.
+	forged := signed("PollCount", 1, a)
+	forged.Tags = b
+	data, _ = json.Marshal(forged)
+	if status, _ := doRequest(t, srv, http.MethodPost, "/update/", string(data)); status != http.StatusConflict {
+		t.Errorf("forged tags: want %d, got %d", http.StatusConflict, status)
+	}
+
+	data, _ = json.Marshal(signed("PollCount", 1, map[string]string{"instance": "a,b"}))
+	if status, _ := doRequest(t, srv, http.MethodPost, "/update/", string(data)); status != http.StatusBadRequest {
+		t.Errorf("invalid tags: want %d, got %d", http.StatusBadRequest, status)
+	}
+}
+
+func TestDisabledRoutes(t *testing.T) {
+	requests := []struct {
+		group        string
+		method, path string
+		body         string
+	}{
+		{"info", http.MethodGet, "/", ""},
+		{"reads", http.MethodPost, "/value/", `{"id":"c","type":"counter"}`},
+		{"reads", http.MethodGet, "/value/all", ""},
+		{"reads", http.MethodGet, "/value/counter/c", ""},
+		{"reads", http.MethodGet, "/metrics", ""},
+		{"writes", http.MethodPost, "/update/", `{"id":"c","type":"counter","delta":1}`},
+		{"writes", http.MethodPost, "/updates/", `[{"id":"c","type":"counter","delta":1}]`},
+		{"writes", http.MethodPost, "/update/counter/c/1", ""},
+		{"writes", http.MethodDelete, "/value/gauge/g", ""},
+	}
+	tests := []struct {
+		name     string
+		server   *serverStorage
+		disabled string
+	}{
+		{"all enabled", &serverStorage{}, ""},
+		{"no info", &serverStorage{disableInfo: true}, "info"},
+		{"write only", &serverStorage{disableReads: true}, "reads"},
+		{"read only", &serverStorage{disableWrites: true}, "writes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, tt.server)
+			// Счетчик для чтения создается напрямую, запись может быть отключена.
+			tt.server.db.UpdateCounter(context.Background(), "c", 1)
+			tt.server.db.UpdateGauge(context.Background(), "g", 1)
+			for _, req := range requests {
+				status, _ := doRequest(t, srv, req.method, req.path, req.body)
+				if disabled := req.group == tt.disabled; disabled != (status == http.StatusNotFound) {
+					t.Errorf("%s %s: disabled %v, got status %d", req.method, req.path, disabled, status)
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteMetric(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{})
+	doRequest(t, srv, http.MethodPost, "/update/counter/c/5", "")
+	doRequest(t, srv, http.MethodPost, "/update/gauge/g/1.5", "")
+
+	tests := []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodDelete, "/value/counter/c", http.StatusNoContent},
+		{http.MethodGet, "/value/counter/c", http.StatusNotFound},
+		{http.MethodDelete, "/value/counter/c", http.StatusNotFound},
+		// Датчик с тем же именем, что и удаленный счетчик, не затронут.
+		{http.MethodDelete, "/value/counter/g", http.StatusNotFound},
+		{http.MethodGet, "/value/gauge/g", http.StatusOK},
+		{http.MethodDelete, "/value/gauge/g", http.StatusNoContent},
+		{http.MethodGet, "/value/gauge/g", http.StatusNotFound},
+		{http.MethodDelete, "/value/unknown/g", http.StatusNotImplemented},
+	}
+	for _, tt := range tests {
+		if status, body := doRequest(t, srv, tt.method, tt.path, ""); status != tt.status {
+			t.Errorf("%s %s: want %d, got %d %q", tt.method, tt.path, tt.status, status, body)
+		}
+	}
+
+	// Удаленный счетчик начинается заново.
+	doRequest(t, srv, http.MethodPost, "/update/counter/c/1", "")
+	if _, body := doRequest(t, srv, http.MethodGet, "/value/counter/c", ""); body != "1" {
+		t.Errorf("want recreated counter 1, got %q", body)
+	}
+
+	// С ключом сервера удаление требует ключ администратора.
+	key := []byte("admin")
+	srv = newTestServer(t, &serverStorage{key: []byte("secret"), adminKey: key})
+	doRequest(t, srv, http.MethodPost, "/update/counter/c/5", "")
+	if status, _ := doRequest(t, srv, http.MethodDelete, "/value/counter/c", ""); status != http.StatusUnauthorized {
+		t.Errorf("without admin key: want %d, got %d", http.StatusUnauthorized, status)
+	}
+	req, err := http.NewRequest(http.MethodDelete, srv.URL+"/value/counter/c", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(adminKeyHeader, string(key))
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("with admin key: want %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+}
+
+func TestReportSequences(t *testing.T) {
+	srv := newTestServer(t, &serverStorage{sequences: newReportSequences()})
+
+	send := func(id string, seq int) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/updates/", strings.NewReader(`[{"id":"c","type":"counter","delta":1}]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(models.HeaderReporterID, id)
+		req.Header.Set(models.HeaderSequence, strconv.Itoa(seq))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// У агента a потеряны пачки 3 и 4, повтор пачки 5 пропуском не считается.
+	// Агент b после перезапуска сервера начинает не с первой пачки.
+	for _, seq := range []int{1, 2, 5, 5, 6} {
+		send("a", seq)
+	}
+	send("b", 10)
+	send("b", 11)
+
+	_, body := doRequest(t, srv, http.MethodGet, "/stats", "")
+	var got statsResponse
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Reports == nil || got.Reports.MissedBatches != 2 {
+		t.Errorf("want 2 missed batches, got %s", body)
+	}
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	c := clock.NewFake(time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC))
+	db := store.NewFDB(context.Background())
+	srv := newTestServer(t, &serverStorage{db: db, idempotency: newIdempotencyKeys(time.Minute, c)})
+
+	send := func(key, body string) (int, string, bool) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/updates/", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set(models.HeaderReportKey, key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(respBody), resp.Header.Get(models.HeaderReportReplayed) != ""
+	}
+	counter := func(want int64) {
+		t.Helper()
+		if v, _ := db.Counter(context.Background(), "c"); v != want {
+			t.Errorf("want counter %d, got %d", want, v)
+		}
+	}
+	const batch = `[{"id":"c","type":"counter","delta":1}]`
+
+	// Повтор пачки с тем же ключом получает прежний ответ и не применяется.
+	status, first, replayed := send("k1", batch)
+	if status != http.StatusOK || replayed {
+		t.Fatalf("unexpected first response: %d, %v", status, replayed)
+	}
+	status, second, replayed := send("k1", batch)
+	if status != http.StatusOK || !replayed || second != first {
+		t.Errorf("want replayed response %q, got %d, %v, %q", first, status, replayed, second)
+	}
+	counter(1)
+
+	// Другой ключ и отказ сервера ключ не занимают.
+	send("k2", batch)
+	counter(2)
+	if status, _, _ := send("k3", `[{"id":"c","type":"counter"`); status != http.StatusBadRequest {
+		t.Errorf("want 400, got %d", status)
+	}
+	send("k3", batch)
+	counter(3)
+
+	// После ttl ключ забывается.
+	c.Advance(time.Minute)
+	send("k1", batch)
+	counter(4)
+
+	_, body := doRequest(t, srv, http.MethodGet, "/stats", "")
+	var got statsResponse
+	if err := json.Unmarshal([]byte(body), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Reports == nil || got.Reports.ReplayedBatches != 1 {
+		t.Errorf("want 1 replayed batch, got %s", body)
+	}
+}
+
+func TestIdempotencyKeysEviction(t *testing.T) {
+	k := newIdempotencyKeys(time.Minute, clock.NewFake(time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)))
+	k.max = 2
+	for _, key := range []string{"a", "b"} {
+		k.begin(key)
+		k.finish(key, http.StatusOK, "", nil)
+	}
+	// Обращение к a делает давним b, он и вытесняется.
+	if _, ok := k.begin("a"); ok {
+		t.Error("want a known")
+	}
+	k.begin("c")
+	if _, ok := k.begin("b"); !ok {
+		t.Error("want b evicted")
+	}
+	if e, ok := k.begin("c"); ok || e.done {
+		t.Errorf("want c in progress, got %+v, %v", e, ok)
+	}
+}
+
+// batchStore хранилище с BatchUpdater, записывающее пачки через WithTx.
+type batchStore struct {
+	store.Store
+	batches [][]models.Metrics
+}
+
+func (b *batchStore) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	b.batches = append(b.batches, metrics)
+	return b.WithTx(ctx, func(tx store.Store) error {
+		for _, m := range metrics {
+			if m.Delta != nil {
+				tx.UpdateCounter(ctx, m.ID, *m.Delta)
+			} else {
+				tx.UpdateGauge(ctx, m.ID, *m.Value)
+			}
+		}
+		return nil
+	})
+}
+
+func TestUpdatesBatch(t *testing.T) {
+	ctx := context.Background()
+	db := &batchStore{Store: store.NewFDB(ctx)}
+	srv := newTestServer(t, &serverStorage{db: db, maxCounters: 2, gaugeScale: 10})
+
+	body := `[
+		{"id":"c1","type":"counter","delta":1},
+		{"id":"g","type":"gauge","value":1.26},
+		{"id":"c1","type":"counter","delta":2},
+		{"id":"c2","type":"counter","delta":1},
+		{"id":"c3","type":"counter","delta":1}
+	]`
+	status, resp := doRequest(t, srv, http.MethodPost, "/updates/", body)
+	if status != http.StatusPartialContent || !strings.Contains(resp, "c3") {
+		t.Errorf("want c3 rejected by limit, got %d %s", status, resp)
+	}
+	if len(db.batches) != 1 || len(db.batches[0]) != 4 {
+		t.Fatalf("want one batch of 4 metrics, got %v", db.batches)
+	}
+	if v, _ := db.Counter(ctx, "c1"); v != 3 {
+		t.Errorf("want c1=3, got %d", v)
+	}
+	if v, _ := db.Gauge(ctx, "g"); v != 1.3 {
+		t.Errorf("want rounded gauge 1.3, got %v", v)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-musthave-devops-trainer/internal/clock"
+	"go-musthave-devops-trainer/internal/logger"
+	"go-musthave-devops-trainer/models"
+)
+
+const (
+	// defaultIdempotencyTTL сколько хранится ключ обработанного запроса.
+	defaultIdempotencyTTL = 5 * time.Minute
+	// maxIdempotencyKeys ограничение количества хранимых ключей,
+	// сверх него вытесняются давно использованные.
+	maxIdempotencyKeys = 10000
+	// maxIdempotentBody ограничение размера сохраняемого ответа, ответ
+	// большего размера повтором возвращается без тела.
+	maxIdempotentBody = 64 << 10
+)
+
+// idempotencyKeys запоминает ключи идемпотентности запросов записи
+// (заголовок X-Report-Key) вместе с ответом. Повтор запроса с тем же
+// ключом не применяется повторно: сервер возвращает сохраненный ответ,
+// поэтому агент может повторять отправку пачки, не удваивая счетчики.
+// Ключ запоминается только после успешного ответа (2xx), запрос,
+// завершившийся ошибкой, можно повторить с тем же ключом.
+type idempotencyKeys struct {
+	ttl   time.Duration
+	max   int
+	clock clock.Clock
+
+	mu sync.Mutex
+	// order ключи от недавно использованных к давним.
+	order   *list.List
+	entries map[string]*list.Element
+	// replayed количество повторов, на которые возвращен сохраненный ответ.
+	replayed int64
+}
+
+type idempotencyEntry struct {
+	key     string
+	expires time.Time
+	// done запрос обработан, до этого повтор отклоняется как выполняющийся.
+	done        bool
+	status      int
+	contentType string
+	body        []byte
+}
+
+func newIdempotencyKeys(ttl time.Duration, c clock.Clock) *idempotencyKeys {
+	return &idempotencyKeys{
+		ttl:     ttl,
+		max:     maxIdempotencyKeys,
+		clock:   c,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// begin резервирует ключ за запросом. Если ключ уже известен,
+// возвращает его запись и false.
+func (k *idempotencyKeys) begin(key string) (idempotencyEntry, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := k.clock.Now()
+	if el, ok := k.entries[key]; ok {
+		e := el.Value.(*idempotencyEntry)
+		if now.Before(e.expires) {
+			k.order.MoveToFront(el)
+			return *e, false
+		}
+		k.removeLocked(el)
+	}
+	k.entries[key] = k.order.PushFront(&idempotencyEntry{key: key, expires: now.Add(k.ttl)})
+	for k.order.Len() > k.max {
+		k.removeLocked(k.order.Back())
+	}
+	return idempotencyEntry{}, true
+}
+
+// finish сохраняет ответ на запрос, ключ хранится ttl от этого момента.
+func (k *idempotencyKeys) finish(key string, status int, contentType string, body []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	el, ok := k.entries[key]
+	if !ok {
+		return
+	}
+	e := el.Value.(*idempotencyEntry)
+	e.done = true
+	e.expires = k.clock.Now().Add(k.ttl)
+	e.status = status
+	e.contentType = contentType
+	e.body = body
+}
+
+// forget освобождает ключ запроса, завершившегося ошибкой.
+func (k *idempotencyKeys) forget(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if el, ok := k.entries[key]; ok {
+		k.removeLocked(el)
+	}
+}
+
+func (k *idempotencyKeys) removeLocked(el *list.Element) {
+	k.order.Remove(el)
+	delete(k.entries, el.Value.(*idempotencyEntry).key)
+}
+
+// Replayed количество повторных запросов, которые не были применены.
+func (k *idempotencyKeys) Replayed() int64 {
+	return atomic.LoadInt64(&k.replayed)
+}
+
+// middleware обрабатывает запрос с ключом один раз. Повтор обработанного
+// запроса получает сохраненный ответ с заголовком X-Report-Replayed,
+// повтор выполняющегося - 409 Conflict с кодом in_progress.
+func (k *idempotencyKeys) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(models.HeaderReportKey)
+		if key == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		e, ok := k.begin(key)
+		if !ok {
+			if !e.done {
+				writeError(w, r, http.StatusConflict, errCodeInProgress, "Request with this idempotency key is in progress")
+				return
+			}
+			atomic.AddInt64(&k.replayed, 1)
+			logger.Debugf("server: replay response for idempotency key %s", key)
+			if e.contentType != "" {
+				w.Header().Set("Content-Type", e.contentType)
+			}
+			w.Header().Set(models.HeaderReportReplayed, "true")
+			w.WriteHeader(e.status)
+			_, _ = w.Write(e.body)
+			return
+		}
+
+		rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		completed := false
+		defer func() {
+			// Обработчик прервался паникой, ключ не должен остаться занятым.
+			if !completed {
+				k.forget(key)
+			}
+		}()
+		h.ServeHTTP(rw, r)
+		completed = true
+
+		if rw.status < 200 || rw.status >= 300 {
+			k.forget(key)
+			return
+		}
+		var body []byte
+		if !rw.overflow {
+			body = rw.body.Bytes()
+		}
+		k.finish(key, rw.status, w.Header().Get("Content-Type"), body)
+	})
+}
+
+// recordingWriter запоминает статус и тело ответа, передавая их клиенту.
+type recordingWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	// overflow тело больше maxIdempotentBody и не сохраняется.
+	overflow bool
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	if !w.overflow {
+		if w.body.Len()+len(b) > maxIdempotentBody {
+			w.overflow = true
+			w.body.Reset()
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
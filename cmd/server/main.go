@@ -2,19 +2,27 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"go-musthave-devops-trainer/internal/clock"
+	"go-musthave-devops-trainer/internal/h3"
+	"go-musthave-devops-trainer/internal/logger"
 	"go-musthave-devops-trainer/internal/misc"
+	"go-musthave-devops-trainer/internal/sign"
 	"go-musthave-devops-trainer/internal/store"
 
 	"github.com/jackc/pgx"
@@ -27,77 +35,431 @@ const (
 	defaultRestoreFromFile = true
 	defaultStoreFilename   = "/tmp/devops-metrics-db.json"
 	defaultStoreInterval   = 5 * time.Minute
+	defaultHealthInterval  = 5 * time.Second
+
+	// Допустимые диапазоны длительностей.
+	maxShutdownTimeout = 10 * time.Minute
+	maxStoreInterval   = 24 * time.Hour
+	// maxGaugePrecision больше знаков float64 не хранит.
+	maxGaugePrecision = 15
+)
+
+// Информация о сборке, задается при сборке:
+// go build -ldflags "-X main.buildVersion=v1.0.0 -X main.buildCommit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+var (
+	buildVersion = "N/A"
+	buildCommit  = "N/A"
+	buildDate    = "N/A"
 )
 
 type config struct {
 	address        string
+	tlsCert        string
+	tlsKey         string
+	http3Address   string
 	shudownTimeout time.Duration
+	drainTimeout   time.Duration
+	saveTimeout    time.Duration
 	restoreOnStart bool
+	strictRestore  bool
 	storeInterval  time.Duration
 	storeFile      string
+	gaugeTTL       time.Duration
+	gaugePrecision int
+	backups        int
+	backupMaxAge   time.Duration
 	key            string
+	adminKey       string
+	hashExempt     string
+	legacyHash     bool
+	maxSkew        time.Duration
+	nameTransform  string
 	databaseDSN    string
+	sqlitePath     string
+	consistentRead bool
+	dbOpTimeout    time.Duration
+	cacheTTL       time.Duration
+	idempotencyTTL time.Duration
+	maxCounters    int
+	maxGauges      int
+	warnMetrics    int
+	descriptions   string
+	events         bool
+	disableInfo    bool
+	disableReads   bool
+	disableWrites  bool
+	logLevel       string
+	logFormat      string
+	printConfig    bool
 }
 
 func main() {
 	c := config{}
 
-	flag.StringVar(&c.address, "a", defaultAddress, "address <<HOST:PORT>>")
-	flag.DurationVar(&c.shudownTimeout, "s", defaultShudownTimeout, "timeout for shutdown")
+	flag.StringVar(&c.address, "a", defaultAddress, "address <<HOST:PORT>> or <<unix:/path/to.sock>>")
+	flag.StringVar(&c.tlsCert, "cert", "", "TLS certificate file, with -key the server serves HTTPS")
+	flag.StringVar(&c.tlsKey, "key", "", "TLS private key file, with -cert the server serves HTTPS")
+	flag.StringVar(&c.http3Address, "http3", "", "experimental: also serve HTTP/3 (QUIC) on this UDP address <<HOST:PORT>>, requires -cert and -key and a build with -tags http3")
+	flag.DurationVar(&c.shudownTimeout, "s", defaultShudownTimeout, "timeout for shutdown (0 < s <= 10m), default for drain and save timeouts")
+	flag.DurationVar(&c.drainTimeout, "drain-timeout", 0, "timeout for in-flight requests on shutdown (0 <= t <= 10m, 0 - use -s)")
+	flag.DurationVar(&c.saveTimeout, "save-timeout", 0, "timeout for store save on shutdown, after drain (0 <= t <= 10m, 0 - use -s)")
 	flag.BoolVar(&c.restoreOnStart, "r", defaultRestoreFromFile, "restore data from file on start")
-	flag.DurationVar(&c.storeInterval, "i", defaultStoreInterval, "store interval for collected data")
+	flag.BoolVar(&c.strictRestore, "strict-restore", false, "fail on start if the store file exists but neither it nor its backups can be restored (file storage only)")
+	flag.DurationVar(&c.storeInterval, "i", defaultStoreInterval, "store interval for collected data (0 <= i <= 24h, 0 - save on shutdown only)")
 	flag.StringVar(&c.storeFile, "f", defaultStoreFilename, "filename for store database")
+	flag.DurationVar(&c.gaugeTTL, "gauge-ttl", 0, "remove gauges not updated for this time, counters are never removed (0 - keep all, file storage only)")
+	flag.IntVar(&c.gaugePrecision, "gauge-precision", -1, "round gauges to this number of digits after the decimal point before storing (-1 - full precision)")
+	flag.IntVar(&c.backups, "backups", 1, "number of kept backups of the store file, the last one is always kept")
+	flag.DurationVar(&c.backupMaxAge, "backup-max-age", 0, "remove store file backups older than this, except the last one (0 - no limit)")
 	flag.StringVar(&c.key, "k", "", "key for sha256")
+	flag.StringVar(&c.adminKey, "admin-key", "", "key for admin endpoints in the X-Admin-Key header, must differ from -k (empty - admin API is disabled)")
+	flag.StringVar(&c.hashExempt, "hash-exempt", "", "comma-separated prefixes of metrics accepted without hash (their values can be forged)")
+	flag.BoolVar(&c.legacyHash, "legacy-gauge-hash", false, "also accept gauge hashes of old agents over the value formatted with %f, they do not cover digits after the sixth")
+	flag.DurationVar(&c.maxSkew, "max-skew", 0, "max allowed difference between metric signing time and server time (0 - not checked)")
+	flag.StringVar(&c.nameTransform, "name-transform", "", "comma-separated transforms of metric names before storing: lower, sanitize")
 	flag.StringVar(&c.databaseDSN, "d", "", "Database DSN for PostgreSQL server")
+	flag.StringVar(&c.sqlitePath, "sqlite", "", "path to SQLite database file, used instead of the store file (ignored with -d)")
+	flag.BoolVar(&c.consistentRead, "consistent-reads", false, "read all metrics for info page and /value/all in one REPEATABLE READ transaction (database only)")
+	flag.DurationVar(&c.dbOpTimeout, "db-op-timeout", 0, "timeout of a single database operation, independent of request timeouts (0 - not limited)")
+	flag.DurationVar(&c.cacheTTL, "cache-ttl", 0, "cache metric reads for this time, writes through the server reset the cache (0 - disabled, database only)")
+	flag.DurationVar(&c.idempotencyTTL, "idempotency-ttl", defaultIdempotencyTTL, "remember X-Report-Key of processed updates for this time, repeated requests are not applied again (0 - disabled)")
+	flag.IntVar(&c.maxCounters, "max-counters", 0, "max number of distinct counters (0 - unlimited)")
+	flag.IntVar(&c.maxGauges, "max-gauges", 0, "max number of distinct gauges (0 - unlimited)")
+	flag.IntVar(&c.warnMetrics, "warn-metrics", 0, "warn once when number of distinct metrics reaches this value (0 - disabled)")
+	flag.StringVar(&c.descriptions, "descriptions", "", "JSON file with metric descriptions for the info page")
+	flag.BoolVar(&c.events, "events", false, "enable /events stream of metric changes (Server-Sent Events) for live info page")
+	flag.BoolVar(&c.disableInfo, "disable-info", false, "do not serve the info page on /")
+	flag.BoolVar(&c.disableReads, "disable-reads", false, "do not serve metric reads: /value/, /value/all, /value/{type}/{id}, /metrics and /events")
+	flag.BoolVar(&c.disableWrites, "disable-writes", false, "do not serve metric updates: /update/, /updates/, /update/{type}/{id}/{value} and DELETE /value/{type}/{id}")
+	flag.StringVar(&c.logLevel, "log-level", "info", "log level: debug, info, warn, error")
+	flag.StringVar(&c.logFormat, "log-format", logger.FormatText, "log format: text, json")
+	flag.BoolVar(&c.printConfig, "print-config", false, "print effective config and exit")
 
 	flag.Parse()
 
 	c = config{
 		address:        misc.GetEnvStr("ADDRESS", c.address),
-		shudownTimeout: misc.GetEnvSeconds("SHUTDOWN_TIMEOUT", c.shudownTimeout),
+		tlsCert:        misc.GetEnvStr("TLS_CERT", c.tlsCert),
+		tlsKey:         misc.GetEnvStr("TLS_KEY", c.tlsKey),
+		http3Address:   misc.GetEnvStr("HTTP3_ADDRESS", c.http3Address),
+		shudownTimeout: misc.GetEnvDuration("SHUTDOWN_TIMEOUT", c.shudownTimeout),
+		drainTimeout:   misc.GetEnvDuration("DRAIN_TIMEOUT", c.drainTimeout),
+		saveTimeout:    misc.GetEnvDuration("SAVE_TIMEOUT", c.saveTimeout),
 		restoreOnStart: misc.GetEnvBool("RESTORE", c.restoreOnStart),
-		storeInterval:  misc.GetEnvSeconds("STORE_INTERVAL", c.storeInterval),
+		strictRestore:  misc.GetEnvBool("STRICT_RESTORE", c.strictRestore),
+		storeInterval:  misc.GetEnvDuration("STORE_INTERVAL", c.storeInterval),
 		storeFile:      misc.GetEnvStr("STORE_FILE", c.storeFile),
+		gaugeTTL:       misc.GetEnvDuration("GAUGE_TTL", c.gaugeTTL),
+		gaugePrecision: misc.GetEnvInt("GAUGE_PRECISION", c.gaugePrecision),
+		backups:        misc.GetEnvInt("BACKUPS", c.backups),
+		backupMaxAge:   misc.GetEnvDuration("BACKUP_MAX_AGE", c.backupMaxAge),
 		key:            misc.GetEnvStr("KEY", c.key),
+		adminKey:       misc.GetEnvStr("ADMIN_KEY", c.adminKey),
+		hashExempt:     misc.GetEnvStr("HASH_EXEMPT", c.hashExempt),
+		legacyHash:     misc.GetEnvBool("LEGACY_GAUGE_HASH", c.legacyHash),
+		maxSkew:        misc.GetEnvDuration("MAX_SKEW", c.maxSkew),
+		nameTransform:  misc.GetEnvStr("NAME_TRANSFORM", c.nameTransform),
 		databaseDSN:    misc.GetEnvStr("DATABASE_DSN", c.databaseDSN),
+		sqlitePath:     misc.GetEnvStr("SQLITE_PATH", c.sqlitePath),
+		consistentRead: misc.GetEnvBool("CONSISTENT_READS", c.consistentRead),
+		dbOpTimeout:    misc.GetEnvDuration("DB_OP_TIMEOUT", c.dbOpTimeout),
+		cacheTTL:       misc.GetEnvDuration("CACHE_TTL", c.cacheTTL),
+		idempotencyTTL: misc.GetEnvDuration("IDEMPOTENCY_TTL", c.idempotencyTTL),
+		maxCounters:    misc.GetEnvInt("MAX_COUNTERS", c.maxCounters),
+		maxGauges:      misc.GetEnvInt("MAX_GAUGES", c.maxGauges),
+		warnMetrics:    misc.GetEnvInt("WARN_METRICS", c.warnMetrics),
+		descriptions:   misc.GetEnvStr("DESCRIPTIONS", c.descriptions),
+		events:         misc.GetEnvBool("EVENTS", c.events),
+		disableInfo:    misc.GetEnvBool("DISABLE_INFO", c.disableInfo),
+		disableReads:   misc.GetEnvBool("DISABLE_READS", c.disableReads),
+		disableWrites:  misc.GetEnvBool("DISABLE_WRITES", c.disableWrites),
+		logLevel:       misc.GetEnvStr("LOG_LEVEL", c.logLevel),
+		logFormat:      misc.GetEnvStr("LOG_FORMAT", c.logFormat),
+		printConfig:    c.printConfig,
+	}
+
+	if err := c.Validate(); err != nil {
+		logger.Fatalf("server: %v", err)
+	}
+
+	if c.printConfig {
+		if err := c.Print(os.Stdout); err != nil {
+			logger.Fatalf("server: %v", err)
+		}
+		return
+	}
+
+	if err := logger.Setup(c.logLevel, c.logFormat); err != nil {
+		logger.Fatalf("server: %v", err)
 	}
 
 	if err := c.Run(context.Background()); err != nil {
-		log.Fatalln("server:", err)
+		logger.Fatalf("server: %v", err)
 	}
-	log.Println("server: gracefully stopped")
+	logger.Infof("server: gracefully stopped")
+}
+
+// Validate проверяет допустимость значений конфигурации:
+// таймаут завершения 0 < s <= 10m, таймауты drain и save 0 <= t <= 10m, интервал сохранения 0 <= i <= 24h,
+// допустимое расхождение времени подписи max-skew >= 0, gauge-ttl >= 0, cache-ttl >= 0, db-op-timeout >= 0,
+// idempotency-ttl >= 0,
+// точность датчиков -1 <= gauge-precision <= 15,
+// хранение копий backups >= 0 и backup-max-age >= 0, известные преобразования имен,
+// сертификат и ключ TLS задаются вместе, HTTP/3 только с TLS,
+// ключ администратора отличается от ключа подписи.
+func (c *config) Validate() error {
+	if (c.tlsCert == "") != (c.tlsKey == "") {
+		return errors.New("TLS certificate and key must be set together")
+	}
+	if c.http3Address != "" && c.tlsCert == "" {
+		return errors.New("HTTP/3 requires TLS certificate and key")
+	}
+	if c.shudownTimeout <= 0 || c.shudownTimeout > maxShutdownTimeout {
+		return fmt.Errorf("invalid shutdown timeout %s: must be in (0, %s]", c.shudownTimeout, maxShutdownTimeout)
+	}
+	if c.drainTimeout < 0 || c.drainTimeout > maxShutdownTimeout {
+		return fmt.Errorf("invalid drain timeout %s: must be in [0, %s]", c.drainTimeout, maxShutdownTimeout)
+	}
+	if c.saveTimeout < 0 || c.saveTimeout > maxShutdownTimeout {
+		return fmt.Errorf("invalid save timeout %s: must be in [0, %s]", c.saveTimeout, maxShutdownTimeout)
+	}
+	if c.storeInterval < 0 || c.storeInterval > maxStoreInterval {
+		return fmt.Errorf("invalid store interval %s: must be in [0, %s]", c.storeInterval, maxStoreInterval)
+	}
+	if c.gaugeTTL < 0 {
+		return fmt.Errorf("invalid gauge TTL %s: must not be negative", c.gaugeTTL)
+	}
+	if c.dbOpTimeout < 0 {
+		return fmt.Errorf("invalid database operation timeout %s: must not be negative", c.dbOpTimeout)
+	}
+	if c.cacheTTL < 0 {
+		return fmt.Errorf("invalid cache TTL %s: must not be negative", c.cacheTTL)
+	}
+	if c.idempotencyTTL < 0 {
+		return fmt.Errorf("invalid idempotency TTL %s: must not be negative", c.idempotencyTTL)
+	}
+	if c.gaugePrecision < -1 || c.gaugePrecision > maxGaugePrecision {
+		return fmt.Errorf("invalid gauge precision %d: must be in [-1, %d]", c.gaugePrecision, maxGaugePrecision)
+	}
+	if c.backups < 0 {
+		return fmt.Errorf("invalid number of backups %d: must not be negative", c.backups)
+	}
+	if c.backupMaxAge < 0 {
+		return fmt.Errorf("invalid backup max age %s: must not be negative", c.backupMaxAge)
+	}
+	if c.maxSkew < 0 {
+		return fmt.Errorf("invalid max skew %s: must not be negative", c.maxSkew)
+	}
+	if c.adminKey != "" && c.adminKey == c.key {
+		return errors.New("admin key must differ from the signing key")
+	}
+	if _, err := parseNameTransform(c.nameTransform); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Print выводит итоговую конфигурацию в формате JSON, секреты скрываются.
+func (c *config) Print(w io.Writer) error {
+	dsn := c.databaseDSN
+	if u, err := url.Parse(dsn); err == nil && u.User != nil {
+		dsn = u.Redacted()
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Address         string `json:"address"`
+		TLSCert         string `json:"tls_cert"`
+		TLSKey          string `json:"tls_key"`
+		HTTP3Address    string `json:"http3_address"`
+		ShutdownTimeout string `json:"shutdown_timeout"`
+		DrainTimeout    string `json:"drain_timeout"`
+		SaveTimeout     string `json:"save_timeout"`
+		RestoreOnStart  bool   `json:"restore"`
+		StrictRestore   bool   `json:"strict_restore"`
+		StoreInterval   string `json:"store_interval"`
+		StoreFile       string `json:"store_file"`
+		GaugeTTL        string `json:"gauge_ttl"`
+		GaugePrecision  int    `json:"gauge_precision"`
+		Backups         int    `json:"backups"`
+		BackupMaxAge    string `json:"backup_max_age"`
+		Key             string `json:"key"`
+		AdminKey        string `json:"admin_key"`
+		HashExempt      string `json:"hash_exempt"`
+		LegacyHash      bool   `json:"legacy_gauge_hash"`
+		MaxSkew         string `json:"max_skew"`
+		NameTransform   string `json:"name_transform"`
+		DatabaseDSN     string `json:"database_dsn"`
+		SQLitePath      string `json:"sqlite_path"`
+		ConsistentReads bool   `json:"consistent_reads"`
+		DBOpTimeout     string `json:"db_op_timeout"`
+		CacheTTL        string `json:"cache_ttl"`
+		IdempotencyTTL  string `json:"idempotency_ttl"`
+		MaxCounters     int    `json:"max_counters"`
+		MaxGauges       int    `json:"max_gauges"`
+		WarnMetrics     int    `json:"warn_metrics"`
+		Descriptions    string `json:"descriptions"`
+		Events          bool   `json:"events"`
+		DisableInfo     bool   `json:"disable_info"`
+		DisableReads    bool   `json:"disable_reads"`
+		DisableWrites   bool   `json:"disable_writes"`
+		LogLevel        string `json:"log_level"`
+		LogFormat       string `json:"log_format"`
+	}{
+		Address:         c.address,
+		TLSCert:         c.tlsCert,
+		TLSKey:          c.tlsKey,
+		HTTP3Address:    c.http3Address,
+		ShutdownTimeout: c.shudownTimeout.String(),
+		DrainTimeout:    c.drain().String(),
+		SaveTimeout:     c.save().String(),
+		RestoreOnStart:  c.restoreOnStart,
+		StrictRestore:   c.strictRestore,
+		StoreInterval:   c.storeInterval.String(),
+		StoreFile:       c.storeFile,
+		GaugeTTL:        c.gaugeTTL.String(),
+		GaugePrecision:  c.gaugePrecision,
+		Backups:         c.backups,
+		BackupMaxAge:    c.backupMaxAge.String(),
+		Key:             misc.Redact(c.key),
+		AdminKey:        misc.Redact(c.adminKey),
+		HashExempt:      c.hashExempt,
+		LegacyHash:      c.legacyHash,
+		MaxSkew:         c.maxSkew.String(),
+		NameTransform:   c.nameTransform,
+		DatabaseDSN:     dsn,
+		SQLitePath:      c.sqlitePath,
+		ConsistentReads: c.consistentRead,
+		DBOpTimeout:     c.dbOpTimeout.String(),
+		CacheTTL:        c.cacheTTL.String(),
+		IdempotencyTTL:  c.idempotencyTTL.String(),
+		MaxCounters:     c.maxCounters,
+		MaxGauges:       c.maxGauges,
+		WarnMetrics:     c.warnMetrics,
+		Descriptions:    c.descriptions,
+		Events:          c.events,
+		DisableInfo:     c.disableInfo,
+		DisableReads:    c.disableReads,
+		DisableWrites:   c.disableWrites,
+		LogLevel:        c.logLevel,
+		LogFormat:       c.logFormat,
+	})
 }
 
 func (c *config) Run(ctx context.Context) error {
-	log.Println("server: starting...")
+	logger.Infof("server: starting...")
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
+	descriptions, err := loadDescriptions(c.descriptions)
+	if err != nil {
+		return err
+	}
+	names, err := parseNameTransform(c.nameTransform)
+	if err != nil {
+		return err
+	}
+
+	// Сертификат загружается до запуска, что бы ошибка в нем не
+	// обнаружилась только в горутине Serve.
+	var tlsConfig *tls.Config
+	if c.tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.tlsCert, c.tlsKey)
+		if err != nil {
+			return fmt.Errorf("cannot load TLS certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+
+	network, addr := misc.SplitAddress(c.address)
+	socket := ""
+	if network == "unix" {
+		// Удаляем сокет, оставшийся от предыдущего запуска.
+		socket = addr
+		if err := removeSocket(socket); err != nil {
+			return fmt.Errorf("cannot remove stale socket: %w", err)
+		}
+	}
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return fmt.Errorf("cannot listen %s: %w", c.address, err)
+	}
+	// Serve закрывает listener сам, здесь - на случай ошибки до его запуска.
+	defer listener.Close()
+
+	// Хранилище закрывается в shutdown, после открытия ошибкой запуска
+	// может завершиться только HTTP/3, тогда хранилище закрывается сразу.
 	db, err := c.newStore(ctx)
 	if err != nil {
 		return err
 	}
-	defer db.Close()
+
+	var idempotency *idempotencyKeys
+	if c.idempotencyTTL > 0 {
+		idempotency = newIdempotencyKeys(c.idempotencyTTL, clock.Real())
+	}
 
 	server := &serverStorage{
-		db:  db,
-		key: []byte(c.key),
+		db:              db,
+		key:             []byte(c.key),
+		adminKey:        []byte(c.adminKey),
+		hashExempt:      sign.ParseExempt(c.hashExempt),
+		legacyHash:      c.legacyHash,
+		maxSkew:         c.maxSkew,
+		names:           names,
+		gaugeScale:      c.gaugeScale(),
+		clock:           clock.Real(),
+		maxCounters:     c.maxCounters,
+		maxGauges:       c.maxGauges,
+		warnCardinality: c.warnMetrics,
+		conns:           newConnStats(clock.Real()),
+		sequences:       newReportSequences(),
+		idempotency:     idempotency,
+		descriptions:    descriptions,
+		disableInfo:     c.disableInfo,
+		disableReads:    c.disableReads,
+		disableWrites:   c.disableWrites,
+		events:          c.events,
+		eventsStop:      make(chan struct{}),
+		started:         time.Now(),
 	}
 
 	srv := http.Server{
-		Addr:    c.address,
-		Handler: newRouter(server),
+		Addr:      c.address,
+		Handler:   newRouter(server),
+		ConnState: server.conns.track,
+		TLSConfig: tlsConfig,
 		BaseContext: func(_ net.Listener) context.Context {
 			return ctx
 		},
 	}
+	// Потоки событий не завершаются сами, без этого Shutdown ждал бы их до таймаута.
+	srv.RegisterOnShutdown(func() { close(server.eventsStop) })
+
+	if c.http3Address != "" {
+		h3srv, err := h3.ListenAndServe(c.http3Address, tlsConfig, srv.Handler)
+		if err != nil {
+			db.Close()
+			return fmt.Errorf("cannot listen HTTP/3 %s: %w", c.http3Address, err)
+		}
+		// Соединения HTTP/3 закрываются сразу, без ожидания текущих запросов.
+		srv.RegisterOnShutdown(func() { h3srv.Close() })
+		logger.Infof("server: listen HTTP/3 on %s", c.http3Address)
+	}
 
 	go func() {
 		defer cancel()
-		log.Println("server: listen monitor server on " + c.address)
-		err := srv.ListenAndServe()
+		var err error
+		if tlsConfig != nil {
+			logger.Infof("server: listen monitor server on %s (TLS)", c.address)
+			err = srv.ServeTLS(listener, "", "")
+		} else {
+			logger.Infof("server: listen monitor server on %s", c.address)
+			err = srv.Serve(listener)
+		}
 		if err != http.ErrServerClosed {
-			log.Println("HTTP server ListenAndServe:", err)
+			logger.Errorf("HTTP server Serve: %v", err)
 		}
 	}()
 
@@ -105,41 +467,154 @@ func (c *config) Run(ctx context.Context) error {
 	signal.Notify(termSignal, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
 	select {
 	case sig := <-termSignal:
-		log.Println("server: shutting down... reason:", sig.String())
+		logger.Infof("server: shutting down... reason: %s", sig.String())
 	case <-ctx.Done():
-		log.Println("server: shutting down... reason:", ctx.Err().Error())
+		logger.Infof("server: shutting down... reason: %s", ctx.Err().Error())
+	}
+
+	drainErr, saveErr := shutdown(&srv, socket, db, c.drain(), c.save())
+	if drainErr != nil {
+		return drainErr
 	}
+	return saveErr
+}
+
+var errSaveTimeout = errors.New("store save timed out")
 
-	ctx, cancel = context.WithTimeout(ctx, c.shudownTimeout)
+// shutdown завершает сервер в два этапа с независимыми таймаутами:
+// сначала дожидается обработки текущих запросов (drain), затем закрывает
+// хранилище с сохранением данных (save). Превышение таймаута drain
+// не сокращает время на сохранение. Если сохранение не успело, оно
+// продолжается в фоне, но процесс его уже не ждет.
+// Непустой socket - путь unix-сокета сервера, он удаляется после drain.
+func shutdown(srv *http.Server, socket string, db io.Closer, drain, save time.Duration) (drainErr, saveErr error) {
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
 	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
+	if drainErr = srv.Shutdown(ctx); drainErr != nil {
+		logger.Errorf("server: drain of in-flight requests did not finish in %s: %v", drain, drainErr)
+	}
+	if socket != "" {
+		if err := removeSocket(socket); err != nil {
+			logger.Errorf("server: cannot remove socket: %v", err)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- db.Close() }()
+	timer := time.NewTimer(save)
+	defer timer.Stop()
+	select {
+	case saveErr = <-done:
+		if saveErr != nil {
+			logger.Errorf("server: store save failed: %v", saveErr)
+		}
+	case <-timer.C:
+		saveErr = errSaveTimeout
+		logger.Errorf("server: store save did not finish in %s", save)
+	}
+	return drainErr, saveErr
+}
+
+// removeSocket удаляет unix-сокет по пути path, если он есть. Путь, занятый
+// не сокетом (например, ошибка в -a), не удаляется.
+func removeSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 	return nil
 }
 
+// gaugeScale множитель округления датчиков, 0 - полная точность.
+func (c *config) gaugeScale() float64 {
+	if c.gaugePrecision < 0 {
+		return 0
+	}
+	return math.Pow10(c.gaugePrecision)
+}
+
+// drain таймаут обработки текущих запросов при завершении, по умолчанию -s.
+func (c *config) drain() time.Duration {
+	if c.drainTimeout > 0 {
+		return c.drainTimeout
+	}
+	return c.shudownTimeout
+}
+
+// save таймаут сохранения хранилища при завершении, по умолчанию -s.
+func (c *config) save() time.Duration {
+	if c.saveTimeout > 0 {
+		return c.saveTimeout
+	}
+	return c.shudownTimeout
+}
+
 func (c *config) newStore(ctx context.Context) (storage store.Store, err error) {
 	if c.databaseDSN != "" {
-		rdb, err := newRDBStore(ctx, c.databaseDSN)
+		rdb, err := newRDBStore(ctx, c.databaseDSN, c.consistentRead, c.dbOpTimeout)
 		if err != nil {
 			return nil, fmt.Errorf("cannot create RDB store: %w", err)
 		}
 		if err := rdb.Bootstrap(ctx); err != nil {
 			return nil, fmt.Errorf("cannot bootstrap RDB store: %w", err)
 		}
+		go rdb.Watch(ctx, defaultHealthInterval)
+		if c.gaugeTTL > 0 {
+			logger.Warnf("server: gauge TTL is not supported by database storage, gauges are kept")
+		}
+		if c.cacheTTL > 0 {
+			return store.NewCache(rdb, c.cacheTTL), nil
+		}
 		return rdb, nil
 	}
+	if c.sqlitePath != "" {
+		db, err := store.OpenSQLite(ctx, c.sqlitePath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create SQLite store: %w", err)
+		}
+		if c.gaugeTTL > 0 {
+			logger.Warnf("server: gauge TTL is not supported by database storage, gauges are kept")
+		}
+		if c.cacheTTL > 0 {
+			return store.NewCache(db, c.cacheTTL), nil
+		}
+		return db, nil
+	}
 	if c.storeFile != "" {
-		db := store.NewFDB(ctx,
+		if c.cacheTTL > 0 {
+			logger.Warnf("server: read cache is not used with file storage, it is kept in memory")
+		}
+		// Второй экземпляр с тем же файлом перезаписывал бы чужие данные.
+		lock, err := store.AcquireLock(c.storeFile)
+		if err != nil {
+			return nil, err
+		}
+		db, err := store.OpenFDB(ctx,
+			store.WithLock(lock),
 			store.WithRestoreOnStart(c.restoreOnStart),
+			store.WithStrictRestore(c.strictRestore),
 			store.WithInterval(c.storeInterval),
+			store.WithGaugeTTL(c.gaugeTTL),
+			store.WithBackups(c.backups, c.backupMaxAge),
 			store.WithFile(c.storeFile))
+		if err != nil {
+			return nil, err
+		}
 		return db, nil
 	}
 	return nil, errors.New("unknown storage driver")
 }
 
-func newRDBStore(ctx context.Context, dsn string) (*store.RDB, error) {
+func newRDBStore(ctx context.Context, dsn string, consistentReads bool, opTimeout time.Duration) (*store.RDB, error) {
 	driverConfig := stdlib.DriverConfig{
 		ConnConfig: pgx.ConnConfig{
 			PreferSimpleProtocol: true,
@@ -156,5 +631,7 @@ func newRDBStore(ctx context.Context, dsn string) (*store.RDB, error) {
 		return nil, fmt.Errorf("cannot perform initial ping: %w", err)
 	}
 
-	return store.NewRDB(conn), nil
+	return store.NewRDB(conn,
+		store.WithConsistentReads(consistentReads),
+		store.WithOpTimeout(opTimeout)), nil
 }
@@ -0,0 +1,81 @@
+//go:build http3
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go-musthave-devops-trainer/internal/h3"
+)
+
+func TestRunHTTP3(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, pool := writeTestCert(t, dir)
+
+	// Свободные порты для TCP и UDP.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpAddr := pc.LocalAddr().String()
+	pc.Close()
+
+	c := config{
+		address:        addr,
+		tlsCert:        certFile,
+		tlsKey:         keyFile,
+		http3Address:   udpAddr,
+		shudownTimeout: time.Second,
+		storeFile:      filepath.Join(dir, "db.json"),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+
+	rt, err := h3.NewRoundTripper(&tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: rt, Timeout: time.Second}
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		resp, err = client.Post("https://"+udpAddr+"/update/counter/PollCount/5", "text/plain", nil)
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	resp, err = client.Get("https://" + udpAddr + "/value/counter/PollCount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.ProtoMajor != 3 || strings.TrimSpace(string(body)) != "5" {
+		t.Errorf("unexpected response: %s %q", resp.Proto, body)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// nameTransform преобразование имен метрик перед сохранением, например
+// для приведения имен к виду, допустимому в хранилище или формате выгрузки.
+//
+// Если разные имена после преобразования совпадают, метрики объединяются:
+// приращения счетчиков складываются, у датчиков остается последнее значение.
+// Ограничения на количество метрик считаются по преобразованным именам.
+type nameTransform []func(string) string
+
+// nameTransforms доступные преобразования имен.
+var nameTransforms = map[string]func(string) string{
+	// lower приводит имя к нижнему регистру.
+	"lower": strings.ToLower,
+	// sanitize заменяет символы кроме [A-Za-z0-9_:] на "_".
+	"sanitize": func(id string) string {
+		return strings.Map(func(r rune) rune {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == ':':
+				return r
+			}
+			return '_'
+		}, id)
+	},
+}
+
+// parseNameTransform разбирает список преобразований, разделенных запятой.
+// Преобразования применяются в указанном порядке.
+func parseNameTransform(list string) (nameTransform, error) {
+	var t nameTransform
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		f, ok := nameTransforms[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown name transform %q", name)
+		}
+		t = append(t, f)
+	}
+	return t, nil
+}
+
+func (t nameTransform) apply(id string) string {
+	for _, f := range t {
+		id = f(id)
+	}
+	return id
+}
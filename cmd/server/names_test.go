@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNameTransform(t *testing.T) {
+	tests := []struct {
+		spec string
+		id   string
+		want string
+	}{
+		{"", "Heap.Alloc", "Heap.Alloc"},
+		{"lower", "Heap.Alloc", "heap.alloc"},
+		{"sanitize", "Heap.Alloc-ms/op", "Heap_Alloc_ms_op"},
+		{"sanitize", "ns:metric_1", "ns:metric_1"},
+		{"sanitize, lower", "Heap.Alloc", "heap_alloc"},
+		{"sanitize", "Размер", "______"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec+"/"+tt.id, func(t *testing.T) {
+			names, err := parseNameTransform(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names.apply(tt.id); got != tt.want {
+				t.Errorf("want %q, got %q", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := parseNameTransform("lower,upper"); err == nil {
+		t.Error("error expected for unknown transform")
+	}
+}
+
+func TestNameTransformHandlers(t *testing.T) {
+	names, _ := parseNameTransform("sanitize,lower")
+	srv := newTestServer(t, &serverStorage{names: names})
+
+	// Разные имена, совпадающие после преобразования, объединяются.
+	for _, req := range []struct{ path, body string }{
+		{"/update/", `{"id":"Poll.Count","type":"counter","delta":1}`},
+		{"/updates/", `[{"id":"poll-count","type":"counter","delta":2}]`},
+		{"/update/counter/POLL_COUNT/3", ""},
+		{"/update/", `{"id":"Heap.Alloc","type":"gauge","value":1}`},
+		{"/update/gauge/heap-alloc/2", ""},
+	} {
+		if status, body := doRequest(t, srv, http.MethodPost, req.path, req.body); status != http.StatusOK {
+			t.Fatalf("%s: want 200, got %d: %s", req.path, status, body)
+		}
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/value/counter/poll_count", "6"},
+		{"/value/counter/Poll.Count", "6"},
+		{"/value/gauge/heap_alloc", "2.000"},
+	}
+	for _, tt := range tests {
+		if status, body := doRequest(t, srv, http.MethodGet, tt.path, ""); status != http.StatusOK || body != tt.want {
+			t.Errorf("%s: want %q, got %d %q", tt.path, tt.want, status, body)
+		}
+	}
+	if status, body := doRequest(t, srv, http.MethodPost, "/value/", `{"id":"Heap.Alloc","type":"gauge"}`); status != http.StatusOK ||
+		body != `{"id":"heap_alloc","type":"gauge","value":2}` {
+		t.Errorf("unexpected value: %d %s", status, body)
+	}
+}
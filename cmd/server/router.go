@@ -1,62 +1,190 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
+	"go-musthave-devops-trainer/internal/clock"
+	"go-musthave-devops-trainer/internal/compress"
+	"go-musthave-devops-trainer/internal/logger"
+	"go-musthave-devops-trainer/internal/sign"
 	"go-musthave-devops-trainer/internal/store"
 
 	"github.com/go-chi/chi/v5"
 )
 
 type serverStorage struct {
+	// Результаты обновлений метрик для /stats. Первым полем, что бы
+	// атомарные счетчики были выровнены и на 32-битных платформах.
+	updates updateStats
+
 	sync.Mutex
 	db  store.Store
 	key []byte
+	// Ключ административных методов, отдельный от ключа подписи: он
+	// передается открытым текстом в заголовке.
+	adminKey []byte
+	// Метрики, принимаемые без подписи.
+	hashExempt sign.Exempt
+	// Принимать подпись датчика в прежнем формате (%f).
+	legacyHash bool
+	// Допустимое расхождение времени подписи метрики, 0 - не проверяется.
+	maxSkew time.Duration
+	clock   clock.Clock
+	// Преобразование имен метрик перед сохранением.
+	names nameTransform
+
+	// Множитель округления датчиков перед сохранением (10^точность),
+	// 0 - датчики хранятся с полной точностью float64.
+	gaugeScale float64
+
+	// Ограничения на количество уникальных метрик, 0 - без ограничений.
+	maxCounters int
+	maxGauges   int
+
+	// Порог количества уникальных метрик для предупреждения в лог, 0 - отключено.
+	warnCardinality   int
+	cardinalityWarned bool
+	// Количество уникальных метрик для ограничений и порога.
+	counts seriesCounts
+
+	// Учет соединений и частоты запросов, nil - не ведется.
+	conns *connStats
+	// Учет пропусков в номерах пачек агентов, nil - не ведется.
+	sequences *reportSequences
+	// Ключи идемпотентности обработанных запросов записи, nil - не проверяются.
+	idempotency *idempotencyKeys
+	// Время запуска сервера для /stats.
+	started time.Time
+
+	// Описания метрик для страницы с информацией, nil - не выводятся.
+	descriptions map[string]string
+
+	// Отключенные группы маршрутов: страница с информацией (/),
+	// чтение (/value* и /metrics) и запись (/update* и удаление), отключенные отвечают 404.
+	disableInfo   bool
+	disableReads  bool
+	disableWrites bool
+
+	// Поток изменений метрик /events, страница с информацией обновляется по нему.
+	events bool
+	// Закрывается при завершении сервера, прерывая потоки событий.
+	eventsStop chan struct{}
 }
 
 func newRouter(server *serverStorage) http.Handler {
 	r := chi.NewRouter()
 
-	r.Use(gzipMiddleware)
+	if server.conns != nil {
+		r.Use(server.conns.middleware)
+	}
+	r.Use(compressMiddleware)
 
-	r.Post("/updates/", server.updatesHandler)
-	r.Post("/update/", server.updateHandler)
-	r.Post("/value/", server.valueHandler)
+	r.Group(func(r chi.Router) {
+		r.Use(server.availableMiddleware)
 
-	r.Post("/update/{type}/{id}/{value}", server.updateHandlerLegacy)
-	r.Get("/value/{type}/{id}", server.valueHandlerLegacy)
+		if !server.disableWrites {
+			w := r
+			if server.sequences != nil {
+				w = w.With(server.sequences.middleware)
+			}
+			if server.idempotency != nil {
+				w = w.With(server.idempotency.middleware)
+			}
+			w.Post("/updates/", server.updatesHandler)
+			w.With(server.updates.middleware).Post("/update/", server.updateHandler)
+			w.With(server.updates.middleware).Post(legacyUpdatePattern, server.updateHandlerLegacy)
+			r.With(server.keyedAdminMiddleware).Delete("/value/{type}/{id}", server.deleteHandler)
+		} else {
+			// Чтение и удаление метрики используют один путь, без явного
+			// 404 отключенный метод отвечал бы 405 Method Not Allowed.
+			r.Delete("/value/{type}/{id}", http.NotFound)
+		}
+		if !server.disableReads {
+			r.Post("/value/", server.valueHandler)
+			r.Get("/value/all", server.valueAllHandler)
+			r.Get(legacyValuePattern, server.valueHandlerLegacy)
+			r.Get("/metrics", server.prometheusHandler)
+		} else {
+			r.Get(legacyValuePattern, http.NotFound)
+		}
+	})
+
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(server.adminMiddleware)
+		r.Post("/import", server.importHandler)
+		r.Get("/export", server.exportHandler)
+		r.Post("/compact", server.compactHandler)
+	})
 
-	r.Get("/", server.infoHandler)
+	if !server.disableInfo {
+		r.Get("/", server.infoHandler)
+	}
+	// Поток событий раскрывает значения метрик, как и чтение.
+	if server.events && !server.disableReads {
+		r.Get("/events", server.eventsHandler)
+	}
 
 	r.Get("/ping", server.pingHandler)
+	r.Get("/healthz", server.healthzHandler)
+	r.Get("/version", versionHandler)
+	r.With(server.keyedAdminMiddleware).Get("/stats", server.statsHandler)
 
 	return r
 }
 
-func gzipMiddleware(h http.Handler) http.Handler {
+// availableMiddleware отклоняет запросы, пока хранилище недоступно,
+// что бы клиент повторил их позднее, а не терял данные.
+func (s *serverStorage) availableMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hc, ok := s.db.(store.Health); ok && hc.Degraded() {
+			writeError(w, r, http.StatusServiceUnavailable, errCodeUnavailable, store.ErrUnavailable.Error())
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// compressMiddleware сжимает ответы алгоритмом, выбранным по Accept-Encoding
+// клиента, и распаковывает тела запросов. Поддерживаемые алгоритмы
+// сообщаются в заголовке ответа Accept-Encoding (RFC 7694), по нему
+// агент выбирает алгоритм для своих запросов.
+func compressMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ow := w
+		w.Header().Set("Accept-Encoding", compress.Advertise())
 
-		acceptEncoding := r.Header.Get("Accept-Encoding")
-		supportsGzip := strings.Contains(acceptEncoding, "gzip")
-		if supportsGzip {
-			cw := newCompressWriter(w)
+		if codec, ok := compress.Negotiate(r.Header.Get("Accept-Encoding")); ok && !acceptsEvents(r) {
+			cw := newCompressWriter(w, codec)
 			ow = cw
 			defer cw.Close()
 		}
 
-		contentEncoding := r.Header.Get("Content-Encoding")
-		sendsGzip := strings.Contains(contentEncoding, "gzip")
-		if sendsGzip {
-			cr, err := newCompressReader(r.Body)
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+		contentEncoding := strings.TrimSpace(r.Header.Get("Content-Encoding"))
+		if contentEncoding != "" && !strings.EqualFold(contentEncoding, "identity") {
+			codec, ok := compress.Lookup(contentEncoding)
+			if !ok {
+				writeError(ow, r, http.StatusUnsupportedMediaType, errCodeUnsupportedEncoding, "Unsupported Content-Encoding: "+contentEncoding)
+				return
+			}
+			body, err := readCompressedBody(r.Body, codec, bodyLimit(r))
+			switch {
+			case errors.Is(err, errBodyTooLarge):
+				writeError(ow, r, http.StatusRequestEntityTooLarge, errCodeTooLarge, "Request body is too large")
+				return
+			case err != nil:
+				logger.Debugf("server: cannot decompress request body: %v", err)
+				writeError(ow, r, http.StatusBadRequest, errCodeBadRequest, "Bad "+codec.Name()+" body")
 				return
 			}
-			r.Body = cr
-			defer cr.Close()
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+			r.Header.Del("Content-Encoding")
 		}
 
 		h.ServeHTTP(ow, r)
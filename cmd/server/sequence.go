@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"go-musthave-devops-trainer/internal/logger"
+	"go-musthave-devops-trainer/models"
+)
+
+// maxTrackedReporters ограничение количества отслеживаемых экземпляров
+// агентов: идентификатор меняется при каждом перезапуске агента.
+const maxTrackedReporters = 1024
+
+// reportSequences отслеживает номера пачек агентов (заголовки
+// X-Reporter-Id и X-Report-Sequence) и считает пропущенные номера -
+// пачки, потерянные по пути к серверу. Повтор или уменьшение номера
+// пропуском не считается.
+type reportSequences struct {
+	mu   sync.Mutex
+	last map[string]uint64
+	// missed количество пропущенных пачек.
+	missed int64
+}
+
+func newReportSequences() *reportSequences {
+	return &reportSequences{last: make(map[string]uint64)}
+}
+
+// observe учитывает номер пачки и возвращает количество пропущенных перед ней.
+func (rs *reportSequences) observe(id string, seq uint64) uint64 {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	last, ok := rs.last[id]
+	if !ok && len(rs.last) >= maxTrackedReporters {
+		// Агенты, не приславшие пачек после сброса, отслеживаются заново.
+		rs.last = make(map[string]uint64)
+	}
+	if seq <= last {
+		return 0
+	}
+	rs.last[id] = seq
+	// Первая пачка экземпляра, номера которого еще не видели, может
+	// прийти не с начала, если сервер перезапускался.
+	if !ok {
+		return 0
+	}
+	gap := seq - last - 1
+	atomic.AddInt64(&rs.missed, int64(gap))
+	return gap
+}
+
+// Missed общее количество пропущенных пачек.
+func (rs *reportSequences) Missed() int64 {
+	return atomic.LoadInt64(&rs.missed)
+}
+
+func (rs *reportSequences) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(models.HeaderReporterID)
+		if id != "" {
+			seq, err := strconv.ParseUint(r.Header.Get(models.HeaderSequence), 10, 64)
+			if err == nil {
+				if gap := rs.observe(id, seq); gap > 0 {
+					logger.Warnf("server: %d batches from reporter %s are lost before %d", gap, id, seq)
+				}
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
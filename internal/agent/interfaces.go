@@ -1,13 +1,30 @@
 package agent
 
+import (
+	"context"
+	"time"
+)
+
 // Scope контейнер с репортером замкнутный в своей области видимости.
 type Scope interface {
 	// Counter возвращает счетчик с соответствующим именем.
 	Counter(name string) Counter
 
+	// SampledCounter возвращает счетчик, учитывающий только долю rate
+	// увеличений (0 < rate <= 1), см. SampledStatsReporter.
+	// Доля задается при первом обращении.
+	SampledCounter(name string, rate float64) Counter
+
 	// Gauge возвращает датчик с соответствющим именем.
 	Gauge(name string) Gauge
 
+	// IntGauge возвращает целочисленный датчик с соответствующим именем.
+	IntGauge(name string) IntGauge
+
+	// Histogram возвращает гистограмму с соответствующим именем.
+	// Границы корзин задаются при первом обращении.
+	Histogram(name string, buckets []float64) Histogram
+
 	// Tagged возвращает дочерний scope с указанными тегами.
 	Tagged(tags map[string]string) Scope
 }
@@ -18,6 +35,26 @@ type ReportableScope interface {
 
 	// Report отправляет метрики в репортер.
 	Report()
+
+	// ReportInterval возвращает интервал автоматической отправки.
+	ReportInterval() time.Duration
+
+	// SetReportInterval меняет интервал автоматической отправки, 0 - отключает ее.
+	SetReportInterval(interval time.Duration)
+
+	// Pause приостанавливает автоматическую отправку, накопленные
+	// значения сохраняются до Resume.
+	Pause()
+
+	// Resume возобновляет автоматическую отправку.
+	Resume()
+
+	// Paused сообщает, приостановлена ли отправка.
+	Paused() bool
+
+	// ReportPanics количество автоматических отправок, прерванных паникой
+	// репортера, включая учтенные им самим (см. PanicCounter).
+	ReportPanics() int64
 }
 
 // StatsReporter интерфейс для репортера.
@@ -37,6 +74,50 @@ type StatsReporter interface {
 		tags map[string]string,
 		value float64,
 	)
+
+	// ReportIntGauge отправляет значения целочисленных датчиков без потери точности.
+	ReportIntGauge(
+		name string,
+		tags map[string]string,
+		value int64,
+	)
+}
+
+// ContextFlusher репортер, отправку которого можно прервать. Scope
+// использует FlushContext вместо Flush, если репортер его поддерживает,
+// и отменяет контекст, если отправка не завершилась за CloseTimeout
+// после вызова Close.
+type ContextFlusher interface {
+	FlushContext(ctx context.Context)
+}
+
+// PanicCounter репортер, который отправляет метрики в своей горутине и
+// сам восстанавливается после паники. Scope добавляет его счетчик к ReportPanics.
+type PanicCounter interface {
+	ReportPanics() int64
+}
+
+// TimedStatsReporter репортер, которому кроме значения передается время
+// его последнего изменения. Scope использует эти методы вместо методов
+// StatsReporter, если репортер их поддерживает.
+type TimedStatsReporter interface {
+	StatsReporter
+
+	ReportCounterAt(name string, tags map[string]string, value int64, at time.Time)
+	ReportGaugeAt(name string, tags map[string]string, value float64, at time.Time)
+	ReportIntGaugeAt(name string, tags map[string]string, value int64, at time.Time)
+}
+
+// SampledStatsReporter репортер, передающий серверу долю учтенных
+// увеличений счетчика, что бы сервер восстановил полное значение
+// делением на нее. Для репортеров без этого метода scope восстанавливает
+// значение сам. Восстановленное значение - оценка: при доле rate и N
+// увеличениях на 1 ее относительная погрешность около sqrt((1-rate)/(rate*N)),
+// то есть для редких счетчиков выборка не подходит.
+type SampledStatsReporter interface {
+	StatsReporter
+
+	ReportSampledCounter(name string, tags map[string]string, value int64, rate float64, at time.Time)
 }
 
 // Counter интерфейс для выдачи метрик типа Счетчик.
@@ -51,13 +132,39 @@ type Gauge interface {
 	Update(value float64)
 }
 
+// IntGauge интерфейс для датчиков с большими целыми значениями
+// (байты, наносекунды), которые теряют точность в float64 выше 2^53.
+type IntGauge interface {
+	// Update обновить текущее значение датчика.
+	// Значения выше math.MaxInt64 ограничиваются им.
+	Update(value uint64)
+}
+
+// Histogram интерфейс для выдачи распределений значений.
+type Histogram interface {
+	// RecordValue учесть значение в соответствующей корзине.
+	RecordValue(value float64)
+
+	// RecordDuration учесть длительность (в секундах), для таймеров.
+	RecordDuration(value time.Duration)
+}
+
 // Snapshot создать снимок текущих значений.
+// Снимок не влияет на отправку метрик репортеру и наоборот:
+// датчик, обновленный после последней отправки, будет отправлен
+// независимо от того, попадал ли он в снимки.
 type Snapshot interface {
 	// Counters returns a snapshot of all counter summations since last report execution.
 	Counters() map[string]CounterSnapshot
 
-	// Gauges returns a snapshot of gauge last values since last report execution.
+	// Gauges returns a snapshot of gauge last values, whether they were reported or not.
 	Gauges() map[string]GaugeSnapshot
+
+	// IntGauges returns a snapshot of integer gauge last values, whether they were reported or not.
+	IntGauges() map[string]IntGaugeSnapshot
+
+	// Histograms returns a snapshot of histogram bucket counts.
+	Histograms() map[string]HistogramSnapshot
 }
 
 // CounterSnapshot создать снимок счетчика.
@@ -83,3 +190,31 @@ type GaugeSnapshot interface {
 	// Value returns the value.
 	Value() float64
 }
+
+// IntGaugeSnapshot создать снимок целочисленного датчика.
+type IntGaugeSnapshot interface {
+	// Name returns the name.
+	Name() string
+
+	// Tags returns the tags.
+	Tags() map[string]string
+
+	// Value returns the value.
+	Value() int64
+}
+
+// HistogramSnapshot создать снимок гистограммы.
+type HistogramSnapshot interface {
+	// Name returns the name.
+	Name() string
+
+	// Tags returns the tags.
+	Tags() map[string]string
+
+	// Buckets returns the upper bounds of the buckets.
+	Buckets() []float64
+
+	// Counts returns the number of values in each bucket,
+	// the last one counts values above the highest bound.
+	Counts() []int64
+}
@@ -0,0 +1,225 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go-musthave-devops-trainer/internal/logger"
+	"go-musthave-devops-trainer/models"
+)
+
+const (
+	defaultObjectInterval   = time.Minute
+	defaultObjectMaxMetrics = 10000
+	defaultObjectRegion     = "us-east-1"
+)
+
+// objectStoreReporter складывает метрики в S3 совместимое хранилище.
+// Что бы не плодить мелкие объекты, метрики копятся между вызовами
+// Flush и выгружаются одним объектом раз в interval или при
+// накоплении maxMetrics метрик.
+type objectStoreReporter struct {
+	endpoint   string
+	bucket     string
+	prefix     string
+	region     string
+	accessKey  string
+	secretKey  string
+	interval   time.Duration
+	maxMetrics int
+	client     *http.Client
+
+	metrics   []models.Metrics
+	lastWrite time.Time
+	now       func() time.Time
+}
+
+type ObjectStoreOption func(*objectStoreReporter)
+
+// WithObjectCredentials ключи доступа для подписи запросов (AWS SigV4).
+func WithObjectCredentials(accessKey, secretKey string) ObjectStoreOption {
+	return func(r *objectStoreReporter) {
+		r.accessKey = accessKey
+		r.secretKey = secretKey
+	}
+}
+
+func WithObjectRegion(region string) ObjectStoreOption {
+	return func(r *objectStoreReporter) {
+		r.region = region
+	}
+}
+
+// WithObjectPrefix префикс имен объектов, например "metrics/".
+func WithObjectPrefix(prefix string) ObjectStoreOption {
+	return func(r *objectStoreReporter) {
+		r.prefix = prefix
+	}
+}
+
+// WithObjectInterval как часто выгружать накопленные метрики.
+func WithObjectInterval(interval time.Duration) ObjectStoreOption {
+	return func(r *objectStoreReporter) {
+		r.interval = interval
+	}
+}
+
+// WithObjectMaxMetrics максимальное количество метрик в одном объекте.
+func WithObjectMaxMetrics(n int) ObjectStoreOption {
+	return func(r *objectStoreReporter) {
+		r.maxMetrics = n
+	}
+}
+
+// NewObjectStoreReporter создает репортер, записывающий метрики объектами
+// в бакет bucket по адресу endpoint (path-style, например http://localhost:9000).
+func NewObjectStoreReporter(endpoint, bucket string, opts ...ObjectStoreOption) StatsReporter {
+	r := &objectStoreReporter{
+		endpoint:   strings.TrimSuffix(endpoint, "/"),
+		bucket:     bucket,
+		region:     defaultObjectRegion,
+		interval:   defaultObjectInterval,
+		maxMetrics: defaultObjectMaxMetrics,
+		client:     &http.Client{},
+		now:        time.Now,
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.lastWrite = r.now()
+	return r
+}
+
+func (r *objectStoreReporter) ReportCounter(name string, tags map[string]string, delta int64) {
+	r.metrics = append(r.metrics, models.Metrics{ID: name, MType: models.Counter, Delta: &delta})
+}
+
+func (r *objectStoreReporter) ReportGauge(name string, tags map[string]string, value float64) {
+	r.metrics = append(r.metrics, models.Metrics{ID: name, MType: models.Gauge, Value: &value})
+}
+
+func (r *objectStoreReporter) ReportIntGauge(name string, tags map[string]string, value int64) {
+	r.metrics = append(r.metrics, models.Metrics{ID: name, MType: models.Gauge, Delta: &value})
+}
+
+// Flush выгружает накопленные метрики, если пришло время очередного
+// объекта или их набралось достаточно.
+func (r *objectStoreReporter) Flush() {
+	if len(r.metrics) == 0 {
+		return
+	}
+	if len(r.metrics) < r.maxMetrics && r.now().Sub(r.lastWrite) < r.interval {
+		return
+	}
+	r.write()
+}
+
+// Close выгружает все оставшиеся метрики.
+func (r *objectStoreReporter) Close() error {
+	if len(r.metrics) == 0 {
+		return nil
+	}
+	return r.write()
+}
+
+func (r *objectStoreReporter) write() error {
+	metrics := r.metrics
+	r.metrics = nil
+	now := r.now()
+	r.lastWrite = now
+
+	body, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+	key := r.prefix + now.UTC().Format("20060102T150405.000000000Z") + ".json"
+	if err := r.put(key, body, now); err != nil {
+		logger.Errorf("object store reporter: %v", err)
+		return err
+	}
+	logger.Debugf("object store reporter: %d metrics written to %s", len(metrics), key)
+	return nil
+}
+
+func (r *objectStoreReporter) put(key string, body []byte, now time.Time) error {
+	u, err := url.Parse(r.endpoint + "/" + r.bucket + "/" + key)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if r.accessKey != "" {
+		r.sign(req, body, now)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot put object %s, status: %d", key, resp.StatusCode)
+	}
+	return nil
+}
+
+// sign подписывает запрос по схеме AWS Signature Version 4.
+func (r *objectStoreReporter) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + r.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+r.secretKey), date)
+	key = hmacSHA256(key, r.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		r.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,108 @@
+package agent
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-musthave-devops-trainer/models"
+)
+
+type mockS3 struct {
+	sync.Mutex
+	objects map[string][]byte
+	auth    []string
+}
+
+func (m *mockS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	m.Lock()
+	defer m.Unlock()
+	m.objects[r.URL.Path] = body
+	m.auth = append(m.auth, r.Header.Get("Authorization"))
+}
+
+func TestObjectStoreReporter(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(s3)
+	defer srv.Close()
+
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	r := NewObjectStoreReporter(srv.URL, "metrics",
+		WithObjectCredentials("AKID", "SECRET"),
+		WithObjectPrefix("agent/"),
+		WithObjectInterval(time.Minute),
+	).(*objectStoreReporter)
+	r.now = func() time.Time { return now }
+	r.lastWrite = now
+
+	// Несколько сбросов в пределах интервала собираются в один объект.
+	r.ReportCounter("PollCount", nil, 1)
+	r.Flush()
+	now = now.Add(10 * time.Second)
+	r.ReportGauge("Alloc", nil, 1.5)
+	r.Flush()
+	if len(s3.objects) != 0 {
+		t.Fatalf("objects written before interval: %v", s3.objects)
+	}
+
+	now = now.Add(time.Minute)
+	r.ReportCounter("PollCount", nil, 2)
+	r.Flush()
+	if len(s3.objects) != 1 {
+		t.Fatalf("want 1 object, got %d", len(s3.objects))
+	}
+
+	body, ok := s3.objects["/metrics/agent/20220501T120110.000000000Z.json"]
+	if !ok {
+		t.Fatalf("unexpected object names: %v", s3.objects)
+	}
+	var metrics []models.Metrics
+	if err := json.Unmarshal(body, &metrics); err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 3 || metrics[0].ID != "PollCount" || metrics[1].ID != "Alloc" || *metrics[2].Delta != 2 {
+		t.Errorf("unexpected batch: %s", body)
+	}
+	if auth := s3.auth[0]; !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/20220501/us-east-1/s3/aws4_request, ") {
+		t.Errorf("unexpected authorization: %q", auth)
+	}
+
+	// Оставшиеся метрики выгружаются при закрытии.
+	now = now.Add(time.Second)
+	r.ReportGauge("Alloc", nil, 2.5)
+	r.Flush()
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s3.objects) != 2 {
+		t.Errorf("want 2 objects after close, got %d", len(s3.objects))
+	}
+}
+
+func TestObjectStoreReporterMaxMetrics(t *testing.T) {
+	s3 := &mockS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(s3)
+	defer srv.Close()
+
+	r := NewObjectStoreReporter(srv.URL, "metrics", WithObjectMaxMetrics(2), WithObjectInterval(time.Hour))
+	r.ReportCounter("c1", nil, 1)
+	r.Flush()
+	if len(s3.objects) != 0 {
+		t.Fatal("object written before limit")
+	}
+	r.ReportCounter("c2", nil, 1)
+	r.Flush()
+	if len(s3.objects) != 1 {
+		t.Errorf("want object written at limit, got %d", len(s3.objects))
+	}
+}
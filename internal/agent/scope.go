@@ -1,33 +1,73 @@
 package agent
 
 import (
+	"context"
 	"io"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"go-musthave-devops-trainer/internal/clock"
+	"go-musthave-devops-trainer/internal/logger"
 )
 
 // DefaultSeparator разделитель по умолчанию.
 const DefaultSeparator = "."
 
 type scope struct {
+	// reportPanics количество отправок, прерванных паникой репортера.
+	// Первое поле, что бы атомарные операции были выровнены на 32-битных платформах.
+	reportPanics int64
+
 	prefix    string
 	reporter  StatsReporter
 	separator string
 	tags      map[string]string
+	clock     clock.Clock
 
 	registry *scopeRegistry
 	status   scopeStatus
 
+	// Интервал отправки корневой области видимости.
+	im          sync.Mutex
+	interval    time.Duration
+	loopStarted bool
+	intervalCh  chan intervalChange
+	// Завершение горутины отправки, Close дожидается его.
+	loops sync.WaitGroup
+	// Контекст отправки, отменяется через closeTimeout после начала Close.
+	flushCtx     context.Context
+	cancelFlush  context.CancelFunc
+	closeTimeout time.Duration
+
 	cm sync.Mutex
 	gm sync.Mutex
+	hm sync.Mutex
+
+	counters   map[string]*counter
+	gauges     map[string]*gauge
+	intGauges  map[string]*intGauge
+	histograms map[string]*histogram
+
+	// Тип, под которым зарегистрировано имя метрики, см. claim.
+	km     sync.Mutex
+	kinds  map[string]string
+	warned map[string]bool
+}
 
-	counters map[string]*counter
-	gauges   map[string]*gauge
+// intervalChange запрос на смену интервала, done закрывается
+// после перезапуска тикера.
+type intervalChange struct {
+	interval time.Duration
+	done     chan struct{}
 }
 
 type scopeStatus struct {
 	sync.Mutex
 	closed bool
+	paused bool
 	quit   chan struct{}
 }
 
@@ -42,6 +82,11 @@ type ScopeOptions struct {
 	Prefix    string
 	Reporter  StatsReporter
 	Separator string
+	// Clock часы для тикера отправки, по умолчанию системные.
+	Clock clock.Clock
+	// CloseTimeout сколько Close ждет завершения текущей отправки,
+	// после чего прерывает ее (см. ContextFlusher), 0 - ждет без ограничения.
+	CloseTimeout time.Duration
 }
 
 // NewRootScope создать область видимости для сбора метрик.
@@ -57,11 +102,15 @@ func newRootScope(opts ScopeOptions, reportInterval time.Duration) *scope {
 	if opts.Separator == "" {
 		opts.Separator = DefaultSeparator
 	}
+	if opts.Clock == nil {
+		opts.Clock = clock.Real()
+	}
 
 	s := &scope{
 		prefix:    opts.Prefix,
 		reporter:  opts.Reporter,
 		separator: opts.Separator,
+		clock:     opts.Clock,
 
 		registry: &scopeRegistry{
 			subscopes: make(map[string]*scope),
@@ -72,26 +121,56 @@ func newRootScope(opts ScopeOptions, reportInterval time.Duration) *scope {
 			quit:   make(chan struct{}, 1),
 		},
 
-		counters: make(map[string]*counter),
-		gauges:   make(map[string]*gauge),
+		interval:   reportInterval,
+		intervalCh: make(chan intervalChange),
+
+		counters:   make(map[string]*counter),
+		gauges:     make(map[string]*gauge),
+		intGauges:  make(map[string]*intGauge),
+		histograms: make(map[string]*histogram),
+		kinds:      make(map[string]string),
+		warned:     make(map[string]bool),
 	}
 
+	s.flushCtx, s.cancelFlush = context.WithCancel(context.Background())
+	s.closeTimeout = opts.CloseTimeout
 	s.tags = s.copyMap(opts.Tags)
 	s.registry.subscopes[KeyMap(s.prefix, s.tags)] = s
 
 	if reportInterval > 0 {
+		s.loopStarted = true
+		s.loops.Add(1)
 		go s.reportLoop(reportInterval)
 	}
 	return s
 }
 
 func (s *scope) reportLoop(interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	defer s.loops.Done()
+	var ticker clock.Ticker
+	var tick <-chan time.Time
+	reset := func(interval time.Duration) {
+		if ticker != nil {
+			ticker.Stop()
+			ticker, tick = nil, nil
+		}
+		if interval > 0 {
+			ticker = s.clock.NewTicker(interval)
+			tick = ticker.C()
+		}
+	}
+	reset(interval)
+	defer reset(0)
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-tick:
+		case change := <-s.intervalCh:
+			// Накопленные метрики живут в scope и репортере,
+			// поэтому перезапуск тикера их не теряет.
+			reset(change.interval)
+			close(change.done)
+			continue
 		case <-s.status.quit:
 			return
 		}
@@ -99,42 +178,142 @@ func (s *scope) reportLoop(interval time.Duration) {
 	}
 }
 
+// ReportInterval текущий интервал автоматической отправки.
+func (s *scope) ReportInterval() time.Duration {
+	s.im.Lock()
+	defer s.im.Unlock()
+	return s.interval
+}
+
+// SetReportInterval меняет интервал автоматической отправки на лету,
+// 0 - отключает ее. Метод возвращается после перезапуска тикера.
+// Действует только для корневой области видимости.
+func (s *scope) SetReportInterval(interval time.Duration) {
+	s.im.Lock()
+	defer s.im.Unlock()
+	if s.intervalCh == nil {
+		return
+	}
+	s.status.Lock()
+	closed := s.status.closed
+	s.status.Unlock()
+	if closed {
+		return
+	}
+
+	s.interval = interval
+	if !s.loopStarted {
+		if interval <= 0 {
+			return
+		}
+		s.loopStarted = true
+		s.loops.Add(1)
+		go s.reportLoop(0)
+	}
+
+	change := intervalChange{interval: interval, done: make(chan struct{})}
+	select {
+	case s.intervalCh <- change:
+		<-change.done
+	case <-s.status.quit:
+	}
+}
+
+// Pause приостанавливает автоматическую отправку. Счетчики продолжают
+// накапливать приращения, датчики хранят последние значения, поэтому
+// после Resume ничего не теряется. Report и Close отправляют данные
+// и во время паузы. Действует только для корневой области видимости.
+func (s *scope) Pause() {
+	s.status.Lock()
+	defer s.status.Unlock()
+	s.status.paused = true
+}
+
+func (s *scope) Resume() {
+	s.status.Lock()
+	defer s.status.Unlock()
+	s.status.paused = false
+}
+
+func (s *scope) Paused() bool {
+	s.status.Lock()
+	defer s.status.Unlock()
+	return s.status.paused
+}
+
 func (s *scope) Report() {
-	s.reportLoopRun()
+	s.status.Lock()
+	defer s.status.Unlock()
+	if s.status.closed {
+		return
+	}
+	s.reportRegistryWithLock()
 }
 
+// reportLoopRun автоматическая отправка. Паника репортера не должна
+// останавливать горутину отправки: агент продолжал бы работать, ничего
+// не отправляя. Паника записывается в лог и учитывается в ReportPanics,
+// следующая отправка выполняется по расписанию.
 func (s *scope) reportLoopRun() {
 	s.status.Lock()
 	defer s.status.Unlock()
-	if s.status.closed {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&s.reportPanics, 1)
+			logger.Errorf("agent: report panicked: %v\n%s", r, debug.Stack())
+		}
+	}()
+	if s.status.closed || s.status.paused {
 		return
 	}
 	s.reportRegistryWithLock()
 }
 
+// ReportPanics количество автоматических отправок, прерванных паникой.
+func (s *scope) ReportPanics() int64 {
+	n := atomic.LoadInt64(&s.reportPanics)
+	if pc, ok := s.reporter.(PanicCounter); ok {
+		n += pc.ReportPanics()
+	}
+	return n
+}
+
+// reportRegistryWithLock блокировки снимаются через defer, что бы
+// после паники репортера (см. reportLoopRun) scope оставался рабочим.
 func (s *scope) reportRegistryWithLock() {
 	s.registry.Lock()
+	defer s.registry.Unlock()
 	if s.reporter != nil {
 		for _, ss := range s.registry.subscopes {
-			ss.report(s.reporter)
+			ss.report(s.flushCtx, s.reporter)
 		}
 	}
-	s.registry.Unlock()
 }
 
-func (s *scope) report(r StatsReporter) {
-	s.cm.Lock()
-	for name, counter := range s.counters {
-		counter.report(s.fullyQualifiedName(name), s.tags, r)
-	}
-	s.cm.Unlock()
+func (s *scope) report(ctx context.Context, r StatsReporter) {
+	func() {
+		s.cm.Lock()
+		defer s.cm.Unlock()
+		for name, counter := range s.counters {
+			counter.report(s.fullyQualifiedName(name), s.tags, r)
+		}
+	}()
 
-	s.gm.Lock()
-	for name, gauge := range s.gauges {
-		gauge.report(s.fullyQualifiedName(name), s.tags, r)
-	}
-	s.gm.Unlock()
+	func() {
+		s.gm.Lock()
+		defer s.gm.Unlock()
+		for name, gauge := range s.gauges {
+			gauge.report(s.fullyQualifiedName(name), s.tags, r)
+		}
+		for name, gauge := range s.intGauges {
+			gauge.report(s.fullyQualifiedName(name), s.tags, r)
+		}
+	}()
 
+	if cf, ok := r.(ContextFlusher); ok {
+		cf.FlushContext(ctx)
+		return
+	}
 	r.Flush()
 }
 
@@ -149,11 +328,33 @@ func (s *scope) Counter(name string) Counter {
 }
 
 func (s *scope) counter(name string) Counter {
+	return s.sampledCounter(name, 1)
+}
+
+// SampledCounter доля вне (0, 1] считается равной 1, то есть
+// учитываются все увеличения.
+func (s *scope) SampledCounter(name string, rate float64) Counter {
+	if rate <= 0 || rate > 1 {
+		rate = 1
+	}
+	s.cm.Lock()
+	val, ok := s.counters[name]
+	s.cm.Unlock()
+	if !ok {
+		return s.sampledCounter(name, rate)
+	}
+	return val
+}
+
+func (s *scope) sampledCounter(name string, rate float64) Counter {
+	if !s.claim(name, kindCounter) {
+		return noopCounter{}
+	}
 	s.cm.Lock()
 	defer s.cm.Unlock()
 	val, ok := s.counters[name]
 	if !ok {
-		val = newCounter()
+		val = newSampledCounter(s.clock, rate)
 		s.counters[name] = val
 	}
 	return val
@@ -170,16 +371,78 @@ func (s *scope) Gauge(name string) Gauge {
 }
 
 func (s *scope) gauge(name string) Gauge {
+	if !s.claim(name, kindGauge) {
+		return noopGauge{}
+	}
 	s.gm.Lock()
 	defer s.gm.Unlock()
 	val, ok := s.gauges[name]
 	if !ok {
-		val = newGauge()
+		val = newGauge(s.clock)
 		s.gauges[name] = val
 	}
 	return val
 }
 
+func (s *scope) IntGauge(name string) IntGauge {
+	if !s.claim(name, kindIntGauge) {
+		return noopIntGauge{}
+	}
+	s.gm.Lock()
+	defer s.gm.Unlock()
+	val, ok := s.intGauges[name]
+	if !ok {
+		val = newIntGauge(s.clock)
+		s.intGauges[name] = val
+	}
+	return val
+}
+
+const (
+	kindCounter  = "counter"
+	kindGauge    = "gauge"
+	kindIntGauge = "int gauge"
+)
+
+// claim закрепляет имя метрики за типом при первой регистрации.
+// Сервер хранит метрики по имени, поэтому одно имя под разными типами
+// (в том числе датчик и целочисленный датчик, которые отправляются
+// одним типом gauge) затирало бы значения друг друга. Повторная
+// регистрация под другим типом отклоняется: вызывающий получает
+// метрику-заглушку, которая не отправляется, а в лог один раз пишется
+// предупреждение.
+func (s *scope) claim(name, kind string) bool {
+	s.km.Lock()
+	defer s.km.Unlock()
+	prev, ok := s.kinds[name]
+	if !ok {
+		s.kinds[name] = kind
+		return true
+	}
+	if prev == kind {
+		return true
+	}
+	if key := kind + ":" + name; !s.warned[key] {
+		s.warned[key] = true
+		logger.Warnf("agent: metric %q is already registered as %s, %s with the same name is ignored",
+			s.fullyQualifiedName(name), prev, kind)
+	}
+	return false
+}
+
+// Histogram гистограммы пока не отправляются репортеру,
+// их распределения доступны только через Snapshot.
+func (s *scope) Histogram(name string, buckets []float64) Histogram {
+	s.hm.Lock()
+	defer s.hm.Unlock()
+	val, ok := s.histograms[name]
+	if !ok {
+		val = newHistogram(buckets)
+		s.histograms[name] = val
+	}
+	return val
+}
+
 func (s *scope) Tagged(tags map[string]string) Scope {
 	tags = s.copyMap(tags)
 	return s.subscope(s.prefix, tags)
@@ -218,9 +481,15 @@ func (s *scope) newSubscope(prefix string, immutableTags map[string]string, key
 		reporter:  s.reporter,
 		separator: s.separator,
 		tags:      immutableTags,
-
-		counters: make(map[string]*counter),
-		gauges:   make(map[string]*gauge),
+		clock:     s.clock,
+		flushCtx:  s.flushCtx,
+
+		counters:   make(map[string]*counter),
+		gauges:     make(map[string]*gauge),
+		intGauges:  make(map[string]*intGauge),
+		histograms: make(map[string]*histogram),
+		kinds:      make(map[string]string),
+		warned:     make(map[string]bool),
 	}
 
 	s.registry.subscopes[key] = subscope
@@ -228,11 +497,21 @@ func (s *scope) newSubscope(prefix string, immutableTags map[string]string, key
 }
 
 func (s *scope) Snapshot() Snapshot {
+	return s.SnapshotMatching("", nil)
+}
+
+// SnapshotMatching создать снимок только тех метрик, полное имя которых
+// начинается с prefix, а теги содержат все пары из tags. Не подходящие
+// области видимости и метрики пропускаются без копирования.
+func (s *scope) SnapshotMatching(prefix string, tags map[string]string) Snapshot {
 	snap := newSnapshot()
 
 	s.registry.Lock()
 	for _, ss := range s.registry.subscopes {
-		tags := make(map[string]string, len(s.tags))
+		if !containsTags(ss.tags, tags) {
+			continue
+		}
+		tags := make(map[string]string, len(ss.tags))
 		for k, v := range ss.tags {
 			tags[k] = v
 		}
@@ -240,6 +519,9 @@ func (s *scope) Snapshot() Snapshot {
 		ss.cm.Lock()
 		for key, c := range ss.counters {
 			name := ss.fullyQualifiedName(key)
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
 			id := KeyMap(name, tags)
 			snap.counters[id] = &counterSnapshot{
 				name:  name,
@@ -251,6 +533,9 @@ func (s *scope) Snapshot() Snapshot {
 		ss.gm.Lock()
 		for key, g := range ss.gauges {
 			name := ss.fullyQualifiedName(key)
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
 			id := KeyMap(name, tags)
 			snap.gauges[id] = &gaugeSnapshot{
 				name:  name,
@@ -258,14 +543,61 @@ func (s *scope) Snapshot() Snapshot {
 				value: g.snapshot(),
 			}
 		}
+		for key, g := range ss.intGauges {
+			name := ss.fullyQualifiedName(key)
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			id := KeyMap(name, tags)
+			snap.intGauges[id] = &intGaugeSnapshot{
+				name:  name,
+				tags:  tags,
+				value: g.snapshot(),
+			}
+		}
 		ss.gm.Unlock()
+		ss.hm.Lock()
+		for key, h := range ss.histograms {
+			name := ss.fullyQualifiedName(key)
+			if !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			id := KeyMap(name, tags)
+			snap.histograms[id] = &histogramSnapshot{
+				name:    name,
+				tags:    tags,
+				buckets: h.buckets,
+				counts:  h.snapshot(),
+			}
+		}
+		ss.hm.Unlock()
 	}
 	s.registry.Unlock()
 
 	return snap
 }
 
+// containsTags проверяет, что tags содержит все пары из want.
+func containsTags(tags, want map[string]string) bool {
+	for k, v := range want {
+		if tv, ok := tags[k]; !ok || tv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Close отправляет оставшиеся данные и возвращается после завершения
+// горутины отправки и закрытия репортера. Если это занимает больше
+// CloseTimeout, отправка прерывается.
 func (s *scope) Close() error {
+	if s.closeTimeout > 0 && s.cancelFlush != nil {
+		timer := time.AfterFunc(s.closeTimeout, func() {
+			logger.Warnf("agent: report is not finished in %s, cancelled", s.closeTimeout)
+			s.cancelFlush()
+		})
+		defer timer.Stop()
+	}
 	s.status.Lock()
 
 	if s.status.closed {
@@ -278,7 +610,11 @@ func (s *scope) Close() error {
 	s.reportRegistryWithLock()
 
 	s.status.Unlock()
+	s.loops.Wait()
 
+	if s.cancelFlush != nil {
+		defer s.cancelFlush()
+	}
 	if closer, ok := s.reporter.(io.Closer); ok {
 		return closer.Close()
 	}
@@ -322,14 +658,18 @@ func mergeRightTags(tagsLeft, tagsRight map[string]string) map[string]string {
 }
 
 type snapshot struct {
-	counters map[string]CounterSnapshot
-	gauges   map[string]GaugeSnapshot
+	counters   map[string]CounterSnapshot
+	gauges     map[string]GaugeSnapshot
+	intGauges  map[string]IntGaugeSnapshot
+	histograms map[string]HistogramSnapshot
 }
 
 func newSnapshot() *snapshot {
 	return &snapshot{
-		counters: make(map[string]CounterSnapshot),
-		gauges:   make(map[string]GaugeSnapshot),
+		counters:   make(map[string]CounterSnapshot),
+		gauges:     make(map[string]GaugeSnapshot),
+		intGauges:  make(map[string]IntGaugeSnapshot),
+		histograms: make(map[string]HistogramSnapshot),
 	}
 }
 
@@ -341,6 +681,14 @@ func (s *snapshot) Gauges() map[string]GaugeSnapshot {
 	return s.gauges
 }
 
+func (s *snapshot) IntGauges() map[string]IntGaugeSnapshot {
+	return s.intGauges
+}
+
+func (s *snapshot) Histograms() map[string]HistogramSnapshot {
+	return s.histograms
+}
+
 type counterSnapshot struct {
 	name  string
 	tags  map[string]string
@@ -376,3 +724,44 @@ func (s *gaugeSnapshot) Tags() map[string]string {
 func (s *gaugeSnapshot) Value() float64 {
 	return s.value
 }
+
+type intGaugeSnapshot struct {
+	name  string
+	tags  map[string]string
+	value int64
+}
+
+func (s *intGaugeSnapshot) Name() string {
+	return s.name
+}
+
+func (s *intGaugeSnapshot) Tags() map[string]string {
+	return s.tags
+}
+
+func (s *intGaugeSnapshot) Value() int64 {
+	return s.value
+}
+
+type histogramSnapshot struct {
+	name    string
+	tags    map[string]string
+	buckets []float64
+	counts  []int64
+}
+
+func (s *histogramSnapshot) Name() string {
+	return s.name
+}
+
+func (s *histogramSnapshot) Tags() map[string]string {
+	return s.tags
+}
+
+func (s *histogramSnapshot) Buckets() []float64 {
+	return s.buckets
+}
+
+func (s *histogramSnapshot) Counts() []int64 {
+	return s.counts
+}
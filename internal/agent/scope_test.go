@@ -0,0 +1,679 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go-musthave-devops-trainer/internal/clock"
+	"go-musthave-devops-trainer/internal/logger"
+)
+
+func TestSnapshotHistograms(t *testing.T) {
+	s := newRootScope(ScopeOptions{Prefix: "app"}, 0)
+	defer s.Close()
+
+	h := s.Histogram("latency", []float64{0.5, 0.1, 1})
+	h.RecordValue(0.05)
+	h.RecordValue(0.1)
+	h.RecordValue(0.3)
+	h.RecordDuration(700 * time.Millisecond)
+	h.RecordValue(5)
+
+	s.Counter("requests").Inc(5)
+	s.Gauge("load").Update(0.7)
+
+	snap := s.Snapshot()
+	hs, ok := snap.Histograms()["app.latency+"]
+	if !ok {
+		t.Fatalf("histogram not captured: %v", snap.Histograms())
+	}
+	if hs.Name() != "app.latency" {
+		t.Errorf("unexpected name: %s", hs.Name())
+	}
+	if want := []float64{0.1, 0.5, 1}; !reflect.DeepEqual(hs.Buckets(), want) {
+		t.Errorf("want buckets %v, got %v", want, hs.Buckets())
+	}
+	if want := []int64{2, 1, 1, 1}; !reflect.DeepEqual(hs.Counts(), want) {
+		t.Errorf("want counts %v, got %v", want, hs.Counts())
+	}
+
+	// Снимок не меняется при последующих записях.
+	h.RecordValue(0.01)
+	if hs.Counts()[0] != 2 {
+		t.Errorf("snapshot mutated: %v", hs.Counts())
+	}
+
+	if c := snap.Counters()["app.requests+"]; c == nil || c.Value() != 5 {
+		t.Errorf("counter not captured: %v", snap.Counters())
+	}
+	if g := snap.Gauges()["app.load+"]; g == nil || g.Value() != 0.7 {
+		t.Errorf("gauge not captured: %v", snap.Gauges())
+	}
+}
+
+type recordingReporter struct {
+	counters  map[string]int64
+	gauges    map[string]float64
+	intGauges map[string]int64
+	flushes   int
+}
+
+func newRecordingReporter() *recordingReporter {
+	return &recordingReporter{
+		counters:  make(map[string]int64),
+		gauges:    make(map[string]float64),
+		intGauges: make(map[string]int64),
+	}
+}
+
+func (r *recordingReporter) ReportCounter(name string, tags map[string]string, value int64) {
+	r.counters[name] += value
+}
+
+func (r *recordingReporter) ReportGauge(name string, tags map[string]string, value float64) {
+	r.gauges[name] = value
+}
+
+func (r *recordingReporter) ReportIntGauge(name string, tags map[string]string, value int64) {
+	r.intGauges[name] = value
+}
+
+func (r *recordingReporter) Flush() {
+	r.flushes++
+}
+
+func TestIntGaugePrecision(t *testing.T) {
+	r := newRecordingReporter()
+	s := newRootScope(ScopeOptions{Reporter: r}, 0)
+	defer s.Close()
+
+	const value = uint64(1<<53 + 1)
+	s.IntGauge("TotalAlloc").Update(value)
+	s.Report()
+
+	if got := r.intGauges["TotalAlloc"]; got != int64(value) {
+		t.Errorf("want %d, got %d", value, got)
+	}
+	if uint64(float64(value)) == value {
+		t.Fatal("value must not be representable in float64")
+	}
+}
+
+type notifyReporter struct {
+	*recordingReporter
+	flushed chan struct{}
+}
+
+func (r *notifyReporter) Flush() {
+	r.recordingReporter.Flush()
+	r.flushed <- struct{}{}
+}
+
+func waitTickers(t *testing.T, c *clock.Fake, n int) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if c.Tickers() == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("want %d tickers, got %d", n, c.Tickers())
+}
+
+func TestReportLoopFakeClock(t *testing.T) {
+	c := clock.NewFake(time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC))
+	r := &notifyReporter{recordingReporter: newRecordingReporter(), flushed: make(chan struct{})}
+	s := newRootScope(ScopeOptions{Reporter: r, Clock: c}, time.Second)
+	waitTickers(t, c, 1)
+
+	counter := s.Counter("PollCount")
+	for i := int64(1); i <= 3; i++ {
+		counter.Inc(1)
+		c.Advance(time.Second)
+		select {
+		case <-r.flushed:
+		case <-time.After(time.Second):
+			t.Fatalf("tick %d: no report", i)
+		}
+		if got := r.counters["PollCount"]; got != i {
+			t.Errorf("tick %d: want %d, got %d", i, i, got)
+		}
+	}
+
+	c.Advance(500 * time.Millisecond)
+	select {
+	case <-r.flushed:
+		t.Error("report before interval elapsed")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Close отправляет оставшиеся данные и останавливает тикер.
+	go func() { <-r.flushed }()
+	s.Close()
+	waitTickers(t, c, 0)
+}
+
+func TestSnapshotMatching(t *testing.T) {
+	s := newRootScope(ScopeOptions{Prefix: "app", Tags: map[string]string{"host": "h1"}}, 0)
+	defer s.Close()
+
+	s.Counter("mem.polls").Inc(1)
+	s.Gauge("mem.alloc").Update(1)
+	s.Gauge("cpu.load").Update(1)
+	s.Tagged(map[string]string{"disk": "sda"}).Gauge("mem.cache").Update(1)
+	s.Tagged(map[string]string{"disk": "sdb"}).Histogram("mem.latency", []float64{1}).RecordValue(1)
+
+	names := func(snap Snapshot) []string {
+		var names []string
+		for _, c := range snap.Counters() {
+			names = append(names, c.Name())
+		}
+		for _, g := range snap.Gauges() {
+			names = append(names, g.Name())
+		}
+		for _, h := range snap.Histograms() {
+			names = append(names, h.Name())
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	tests := []struct {
+		name   string
+		prefix string
+		tags   map[string]string
+		want   []string
+	}{
+		{"all", "", nil, []string{"app.cpu.load", "app.mem.alloc", "app.mem.cache", "app.mem.latency", "app.mem.polls"}},
+		{"prefix", "app.mem.", nil, []string{"app.mem.alloc", "app.mem.cache", "app.mem.latency", "app.mem.polls"}},
+		{"tags", "", map[string]string{"disk": "sda"}, []string{"app.mem.cache"}},
+		{"inherited tags", "app.cpu", map[string]string{"host": "h1"}, []string{"app.cpu.load"}},
+		{"prefix and tags", "app.mem.l", map[string]string{"disk": "sdb"}, []string{"app.mem.latency"}},
+		{"no match", "", map[string]string{"host": "h2"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := names(s.SnapshotMatching(tt.prefix, tt.tags)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSnapshotAndReportIndependent(t *testing.T) {
+	r := newRecordingReporter()
+	s := newRootScope(ScopeOptions{Reporter: r}, 0)
+	defer s.Close()
+
+	g := s.Gauge("Alloc")
+	ig := s.IntGauge("TotalAlloc")
+	c := s.Counter("PollCount")
+
+	// Снимок не сбрасывает флаг отправки.
+	g.Update(1.5)
+	ig.Update(10)
+	c.Inc(2)
+	snap := s.Snapshot()
+	if v := snap.Gauges()["Alloc+"].Value(); v != 1.5 {
+		t.Errorf("snapshot gauge: want 1.5, got %v", v)
+	}
+	if v := snap.IntGauges()["TotalAlloc+"].Value(); v != 10 {
+		t.Errorf("snapshot int gauge: want 10, got %v", v)
+	}
+	if v := snap.Counters()["PollCount+"].Value(); v != 2 {
+		t.Errorf("snapshot counter: want 2, got %v", v)
+	}
+	s.Report()
+	if r.gauges["Alloc"] != 1.5 || r.intGauges["TotalAlloc"] != 10 || r.counters["PollCount"] != 2 {
+		t.Fatalf("snapshotted values must be reported: %+v", r)
+	}
+
+	// Отправка не скрывает последние значения датчиков от снимка.
+	snap = s.Snapshot()
+	if v := snap.Gauges()["Alloc+"].Value(); v != 1.5 {
+		t.Errorf("gauge after report: want 1.5, got %v", v)
+	}
+	if v := snap.IntGauges()["TotalAlloc+"].Value(); v != 10 {
+		t.Errorf("int gauge after report: want 10, got %v", v)
+	}
+	if v := snap.Counters()["PollCount+"].Value(); v != 0 {
+		t.Errorf("counter after report: want 0, got %v", v)
+	}
+
+	// Без обновлений повторная отправка не происходит, даже после снимков.
+	delete(r.gauges, "Alloc")
+	delete(r.intGauges, "TotalAlloc")
+	s.Snapshot()
+	s.Report()
+	if _, ok := r.gauges["Alloc"]; ok {
+		t.Error("not updated gauge must not be reported again")
+	}
+	if _, ok := r.intGauges["TotalAlloc"]; ok {
+		t.Error("not updated int gauge must not be reported again")
+	}
+
+	g.Update(2.5)
+	s.Snapshot()
+	s.Report()
+	if r.gauges["Alloc"] != 2.5 {
+		t.Errorf("updated gauge must be reported, got %v", r.gauges["Alloc"])
+	}
+}
+
+func TestSetReportInterval(t *testing.T) {
+	c := clock.NewFake(time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC))
+	r := &notifyReporter{recordingReporter: newRecordingReporter(), flushed: make(chan struct{})}
+	s := newRootScope(ScopeOptions{Reporter: r, Clock: c}, time.Second)
+	waitTickers(t, c, 1)
+
+	expectFlush := func(want bool) {
+		t.Helper()
+		select {
+		case <-r.flushed:
+			if !want {
+				t.Fatal("unexpected report")
+			}
+		case <-time.After(20 * time.Millisecond):
+			if want {
+				t.Fatal("report expected")
+			}
+		}
+	}
+
+	counter := s.Counter("PollCount")
+	counter.Inc(1)
+	c.Advance(time.Second)
+	expectFlush(true)
+
+	// Накопленное до смены интервала не теряется.
+	counter.Inc(2)
+	s.SetReportInterval(5 * time.Second)
+	if got := s.ReportInterval(); got != 5*time.Second {
+		t.Errorf("want 5s, got %s", got)
+	}
+	waitTickers(t, c, 1)
+	c.Advance(time.Second)
+	expectFlush(false)
+	c.Advance(4 * time.Second)
+	expectFlush(true)
+	if got := r.counters["PollCount"]; got != 3 {
+		t.Errorf("want 3, got %d", got)
+	}
+
+	s.SetReportInterval(0)
+	waitTickers(t, c, 0)
+	c.Advance(time.Minute)
+	expectFlush(false)
+
+	go func() { <-r.flushed }()
+	s.Close()
+	s.SetReportInterval(time.Second)
+	if n := c.Tickers(); n != 0 {
+		t.Errorf("closed scope must not report, got %d tickers", n)
+	}
+}
+
+func TestSetReportIntervalStartsLoop(t *testing.T) {
+	c := clock.NewFake(time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC))
+	r := &notifyReporter{recordingReporter: newRecordingReporter(), flushed: make(chan struct{})}
+	s := newRootScope(ScopeOptions{Reporter: r, Clock: c}, 0)
+
+	s.SetReportInterval(time.Second)
+	if n := c.Tickers(); n != 1 {
+		t.Fatalf("want ticker started, got %d", n)
+	}
+	s.Counter("PollCount").Inc(1)
+	c.Advance(time.Second)
+	select {
+	case <-r.flushed:
+	case <-time.After(time.Second):
+		t.Fatal("report expected")
+	}
+
+	go func() { <-r.flushed }()
+	s.Close()
+}
+
+func TestPauseResume(t *testing.T) {
+	c := clock.NewFake(time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC))
+	r := &notifyReporter{recordingReporter: newRecordingReporter(), flushed: make(chan struct{})}
+	s := newRootScope(ScopeOptions{Reporter: r, Clock: c}, time.Second)
+	waitTickers(t, c, 1)
+
+	expectFlush := func(want bool) {
+		t.Helper()
+		select {
+		case <-r.flushed:
+			if !want {
+				t.Fatal("unexpected report")
+			}
+		case <-time.After(20 * time.Millisecond):
+			if want {
+				t.Fatal("report expected")
+			}
+		}
+	}
+
+	counter := s.Counter("PollCount")
+	gauge := s.Gauge("Alloc")
+	counter.Inc(1)
+	c.Advance(time.Second)
+	expectFlush(true)
+
+	s.Pause()
+	if !s.Paused() {
+		t.Fatal("scope must be paused")
+	}
+	for i := 0; i < 3; i++ {
+		counter.Inc(1)
+		gauge.Update(float64(i))
+		c.Advance(time.Second)
+		expectFlush(false)
+	}
+
+	// Накопленное за время паузы отправляется после возобновления.
+	s.Resume()
+	c.Advance(time.Second)
+	expectFlush(true)
+	if got := r.counters["PollCount"]; got != 4 {
+		t.Errorf("want counter 4, got %d", got)
+	}
+	if got := r.gauges["Alloc"]; got != 2 {
+		t.Errorf("want gauge 2, got %v", got)
+	}
+
+	go func() { <-r.flushed }()
+	s.Close()
+}
+
+func TestTypeFlipRejected(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := logger.New(&buf, logger.LevelInfo, logger.FormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.SetDefault(logger.SetDefault(l))
+
+	r := newRecordingReporter()
+	s := newRootScope(ScopeOptions{Prefix: "app", Reporter: r}, 0)
+
+	s.Counter("foo").Inc(1)
+	s.Gauge("foo").Update(42)
+	s.Gauge("foo").Update(43)
+	s.IntGauge("foo").Update(44)
+	s.Gauge("bar").Update(1)
+	s.IntGauge("bar").Update(2)
+	s.Report()
+
+	if got := r.counters["app.foo"]; got != 1 {
+		t.Errorf("counter must keep working, got %d", got)
+	}
+	if _, ok := r.gauges["app.foo"]; ok {
+		t.Error("gauge with counter name must not be reported")
+	}
+	if _, ok := r.intGauges["app.foo"]; ok {
+		t.Error("int gauge with counter name must not be reported")
+	}
+	if _, ok := r.intGauges["app.bar"]; ok || r.gauges["app.bar"] != 1 {
+		t.Errorf("first registered type must win: %v %v", r.gauges, r.intGauges)
+	}
+
+	out := buf.String()
+	if n := strings.Count(out, `metric "app.foo" is already registered as counter, gauge`); n != 1 {
+		t.Errorf("want one warning for gauge, got %d:\n%s", n, out)
+	}
+	if !strings.Contains(out, `metric "app.bar" is already registered as gauge, int gauge`) {
+		t.Errorf("warning expected for int gauge:\n%s", out)
+	}
+}
+
+type timedReporter struct {
+	*recordingReporter
+	observed map[string]time.Time
+}
+
+func (r *timedReporter) ReportCounterAt(name string, tags map[string]string, value int64, at time.Time) {
+	r.ReportCounter(name, tags, value)
+	r.observed[name] = at
+}
+
+func (r *timedReporter) ReportGaugeAt(name string, tags map[string]string, value float64, at time.Time) {
+	r.ReportGauge(name, tags, value)
+	r.observed[name] = at
+}
+
+func (r *timedReporter) ReportIntGaugeAt(name string, tags map[string]string, value int64, at time.Time) {
+	r.ReportIntGauge(name, tags, value)
+	r.observed[name] = at
+}
+
+func TestObservedTime(t *testing.T) {
+	start := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	c := clock.NewFake(start)
+	r := &timedReporter{recordingReporter: newRecordingReporter(), observed: make(map[string]time.Time)}
+	s := newRootScope(ScopeOptions{Reporter: r, Clock: c}, 0)
+	defer s.Close()
+
+	s.Counter("PollCount").Inc(1)
+	c.Advance(time.Second)
+	s.Gauge("Alloc").Update(1)
+	c.Advance(time.Second)
+	s.IntGauge("LastGC").Update(1)
+	c.Advance(time.Second)
+	s.Report()
+
+	want := map[string]time.Time{
+		"PollCount": start,
+		"Alloc":     start.Add(time.Second),
+		"LastGC":    start.Add(2 * time.Second),
+	}
+	for name, at := range want {
+		if got := r.observed[name]; !got.Equal(at) {
+			t.Errorf("%s: want %v, got %v", name, at, got)
+		}
+	}
+}
+
+// blockingReporter отправляет пачку до отмены контекста.
+type blockingReporter struct {
+	*recordingReporter
+	started chan struct{}
+	errs    chan error
+}
+
+func (r *blockingReporter) FlushContext(ctx context.Context) {
+	r.started <- struct{}{}
+	<-ctx.Done()
+	r.errs <- ctx.Err()
+}
+
+func TestCloseCancelsFlush(t *testing.T) {
+	r := &blockingReporter{
+		recordingReporter: newRecordingReporter(),
+		started:           make(chan struct{}, 2),
+		errs:              make(chan error, 2),
+	}
+	s := newRootScope(ScopeOptions{Reporter: r, CloseTimeout: 20 * time.Millisecond}, 0)
+	s.Counter("PollCount").Inc(1)
+
+	go s.Report()
+	<-r.started
+
+	start := time.Now()
+	closed := make(chan struct{})
+	go func() {
+		s.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close is blocked by in-flight flush")
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("flush cancelled before timeout: %s", elapsed)
+	}
+	if err := <-r.errs; !errors.Is(err, context.Canceled) {
+		t.Errorf("want context.Canceled, got %v", err)
+	}
+	if r.flushes != 0 {
+		t.Errorf("Flush must not be used with ContextFlusher, got %d", r.flushes)
+	}
+}
+
+type sampledReporter struct {
+	*recordingReporter
+	rates map[string]float64
+}
+
+func (r *sampledReporter) ReportSampledCounter(name string, tags map[string]string, value int64, rate float64, at time.Time) {
+	r.counters[name] += value
+	r.rates[name] = rate
+}
+
+func TestSampledCounter(t *testing.T) {
+	const (
+		n    = 100000
+		rate = 0.1
+	)
+	// Допустимое отклонение оценки - пять стандартных отклонений.
+	tolerance := 5 * math.Sqrt(n*(1-rate)/rate)
+
+	t.Run("upscaled by scope", func(t *testing.T) {
+		r := newRecordingReporter()
+		s := newRootScope(ScopeOptions{Reporter: r}, 0)
+		defer s.Close()
+
+		c := s.SampledCounter("hits", rate)
+		for i := 0; i < n; i++ {
+			c.Inc(1)
+		}
+		s.Report()
+		if got := r.counters["hits"]; math.Abs(float64(got-n)) > tolerance {
+			t.Errorf("want %d±%.0f, got %d", n, tolerance, got)
+		}
+	})
+
+	t.Run("rate passed to reporter", func(t *testing.T) {
+		r := &sampledReporter{recordingReporter: newRecordingReporter(), rates: make(map[string]float64)}
+		s := newRootScope(ScopeOptions{Reporter: r}, 0)
+		defer s.Close()
+
+		c := s.SampledCounter("hits", rate)
+		for i := 0; i < n; i++ {
+			c.Inc(1)
+		}
+		s.Counter("plain").Inc(3)
+		s.Report()
+		if r.rates["hits"] != rate {
+			t.Errorf("want rate %v, got %v", rate, r.rates["hits"])
+		}
+		if got := r.counters["hits"]; math.Abs(float64(got)-n*rate) > tolerance*rate {
+			t.Errorf("want about %.0f sampled increments, got %d", n*rate, got)
+		}
+		if _, ok := r.rates["plain"]; ok || r.counters["plain"] != 3 {
+			t.Errorf("plain counter must not be sampled: %v, %v", r.rates, r.counters)
+		}
+	})
+
+	t.Run("invalid rate", func(t *testing.T) {
+		r := newRecordingReporter()
+		s := newRootScope(ScopeOptions{Reporter: r}, 0)
+		defer s.Close()
+
+		c := s.SampledCounter("all", 1.5)
+		for i := 0; i < 10; i++ {
+			c.Inc(1)
+		}
+		s.Report()
+		if r.counters["all"] != 10 {
+			t.Errorf("want all increments, got %d", r.counters["all"])
+		}
+	})
+}
+
+// panickingReporter паникует при первой отправке счетчика и при
+// второй отправке пачки, calls получает имя каждого вызова перед паникой.
+type panickingReporter struct {
+	*recordingReporter
+	calls    chan string
+	reported bool
+}
+
+func (r *panickingReporter) ReportCounter(name string, tags map[string]string, value int64) {
+	if !r.reported {
+		r.reported = true
+		r.calls <- "counter"
+		panic("broken counter")
+	}
+	r.recordingReporter.ReportCounter(name, tags, value)
+}
+
+func (r *panickingReporter) Flush() {
+	r.recordingReporter.Flush()
+	r.calls <- "flush"
+	if r.flushes == 1 {
+		panic("broken flush")
+	}
+}
+
+func TestReportLoopSurvivesPanic(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := logger.New(&buf, logger.LevelInfo, logger.FormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.SetDefault(logger.SetDefault(l))
+
+	c := clock.NewFake(time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC))
+	r := &panickingReporter{recordingReporter: newRecordingReporter(), calls: make(chan string)}
+	s := newRootScope(ScopeOptions{Reporter: r, Clock: c}, time.Second)
+	waitTickers(t, c, 1)
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-r.calls:
+			if got != want {
+				t.Fatalf("want %s, got %s", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("want %s, reporting stopped", want)
+		}
+	}
+
+	counter := s.Counter("PollCount")
+	counter.Inc(1)
+	c.Advance(time.Second)
+	expect("counter")
+	c.Advance(time.Second)
+	expect("flush")
+	c.Advance(time.Second)
+	expect("flush")
+
+	if got := s.ReportPanics(); got != 2 {
+		t.Errorf("want 2 panics, got %d", got)
+	}
+	if !strings.Contains(buf.String(), "report panicked: broken flush") {
+		t.Errorf("panic is not logged:\n%s", buf.String())
+	}
+
+	// Блокировки, взятые до паники, освобождены: метрики обновляются.
+	counter.Inc(1)
+	s.Gauge("Alloc").Update(1)
+	c.Advance(time.Second)
+	expect("flush")
+	if got := r.counters["PollCount"]; got == 0 {
+		t.Error("counter is not reported after panic")
+	}
+
+	go func() { <-r.calls }()
+	s.Close()
+}
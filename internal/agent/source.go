@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MetricSource дополнительный источник датчиков агента. Collect
+// вызывается с интервалом опроса и возвращает текущие значения по именам.
+// Если часть значений прочитать не удалось, Collect возвращает
+// прочитанные значения вместе с ошибкой.
+type MetricSource interface {
+	Collect(ctx context.Context) (map[string]float64, error)
+}
+
+// SourceFactory создает источник по параметру из конфигурации.
+type SourceFactory func(arg string) (MetricSource, error)
+
+var (
+	sourcesMu sync.RWMutex
+	sources   = make(map[string]SourceFactory)
+)
+
+// RegisterSource регистрирует вид источника, источники этого вида
+// задаются в конфигурации как "kind:arg". Повторная регистрация
+// заменяет прежнюю.
+func RegisterSource(kind string, factory SourceFactory) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	sources[kind] = factory
+}
+
+// SourceKinds зарегистрированные виды источников.
+func SourceKinds() []string {
+	sourcesMu.RLock()
+	defer sourcesMu.RUnlock()
+	kinds := make([]string, 0, len(sources))
+	for kind := range sources {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// NewSource создает источник по описанию "kind:arg".
+func NewSource(spec string) (MetricSource, error) {
+	kind, arg, ok := strings.Cut(spec, ":")
+	if !ok || arg == "" {
+		return nil, fmt.Errorf("invalid metric source %q: want kind:arg", spec)
+	}
+	sourcesMu.RLock()
+	factory, ok := sources[kind]
+	sourcesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown metric source kind %q, known: %s", kind, strings.Join(SourceKinds(), ", "))
+	}
+	return factory(arg)
+}
+
+func init() {
+	RegisterSource("file", func(path string) (MetricSource, error) {
+		return NewFileGaugeSource(path), nil
+	})
+}
+
+// FileGaugeSource читает датчики из файла строками "имя=значение" при
+// каждом опросе, поэтому изменения файла подхватываются без перезапуска.
+// Пустые строки и строки, начинающиеся с #, пропускаются.
+type FileGaugeSource struct {
+	path string
+}
+
+func NewFileGaugeSource(path string) *FileGaugeSource {
+	return &FileGaugeSource{path: path}
+}
+
+// Collect читает файл целиком. Некорректные строки пропускаются,
+// ошибка сообщает о первой из них.
+func (s *FileGaugeSource) Collect(ctx context.Context) (map[string]float64, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]float64)
+	var firstErr error
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if !ok || name == "" || err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s:%d: invalid line %q", s.path, n, line)
+			}
+			continue
+		}
+		values[name] = v
+	}
+	if err := sc.Err(); err != nil {
+		return values, err
+	}
+	return values, firstErr
+}
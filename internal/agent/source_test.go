@@ -0,0 +1,55 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileGaugeSource(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "gauges")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src, err := NewSource("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := src.Collect(ctx); err == nil {
+		t.Error("want error for missing file")
+	}
+
+	write("# queue\nQueueLength = 3\n\nTemperature=36.6\n")
+	got, err := src.Collect(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]float64{"QueueLength": 3, "Temperature": 36.6}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	// Изменения файла видны при следующем опросе, некорректные строки пропускаются.
+	write("QueueLength=5\nbroken\nLoad=abc\nUsers=1e3\n")
+	got, err = src.Collect(ctx)
+	if err == nil {
+		t.Error("want error for invalid lines")
+	}
+	if want := map[string]float64{"QueueLength": 5, "Users": 1000}; !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestNewSource(t *testing.T) {
+	for _, spec := range []string{"", "file", "file:", "exec:/bin/true"} {
+		if _, err := NewSource(spec); err == nil {
+			t.Errorf("%q: want error", spec)
+		}
+	}
+}
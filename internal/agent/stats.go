@@ -2,20 +2,55 @@ package agent
 
 import (
 	"math"
+	"math/rand"
+	"sort"
 	"sync/atomic"
+	"time"
+
+	"go-musthave-devops-trainer/internal/clock"
 )
 
+// observed время последнего изменения метрики (unix, наносекунды),
+// передается репортерам, поддерживающим TimedStatsReporter.
+type observed struct {
+	at    int64
+	clock clock.Clock
+}
+
+func (o *observed) touch() {
+	atomic.StoreInt64(&o.at, o.clock.Now().UnixNano())
+}
+
+func (o *observed) time() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&o.at))
+}
+
 type counter struct {
 	prev int64
 	curr int64
+	// rate доля учитываемых увеличений, 1 - учитываются все.
+	rate float64
+	observed
 }
 
-func newCounter() *counter {
-	return &counter{}
+func newCounter(c clock.Clock) *counter {
+	return newSampledCounter(c, 1)
+}
+
+func newSampledCounter(c clock.Clock, rate float64) *counter {
+	return &counter{rate: rate, observed: observed{clock: c}}
+}
+
+func (c *counter) sampled() bool {
+	return c.rate < 1
 }
 
 func (c *counter) Inc(v int64) {
+	if c.sampled() && rand.Float64() >= c.rate {
+		return
+	}
 	atomic.AddInt64(&c.curr, v)
+	c.touch()
 }
 
 func (c *counter) report(name string, tags map[string]string, r StatsReporter) {
@@ -23,6 +58,17 @@ func (c *counter) report(name string, tags map[string]string, r StatsReporter) {
 	if delta == 0 {
 		return
 	}
+	if c.sampled() {
+		if sr, ok := r.(SampledStatsReporter); ok {
+			sr.ReportSampledCounter(name, tags, delta, c.rate, c.time())
+			return
+		}
+		delta = c.upscale(delta)
+	}
+	if tr, ok := r.(TimedStatsReporter); ok {
+		tr.ReportCounterAt(name, tags, delta, c.time())
+		return
+	}
 	r.ReportCounter(name, tags, delta)
 }
 
@@ -36,26 +82,44 @@ func (c *counter) value() int64 {
 	return curr - prev
 }
 
+// snapshot для счетчика с выборкой возвращает оценку полного значения.
 func (c *counter) snapshot() int64 {
-	return atomic.LoadInt64(&c.curr) - atomic.LoadInt64(&c.prev)
+	return c.upscale(atomic.LoadInt64(&c.curr) - atomic.LoadInt64(&c.prev))
+}
+
+// upscale оценка полного значения по учтенной доле увеличений.
+func (c *counter) upscale(v int64) int64 {
+	if !c.sampled() {
+		return v
+	}
+	return int64(math.Round(float64(v) / c.rate))
 }
 
 type gauge struct {
 	updated uint64
 	curr    uint64
+	observed
 }
 
-func newGauge() *gauge {
-	return &gauge{}
+func newGauge(c clock.Clock) *gauge {
+	return &gauge{observed: observed{clock: c}}
 }
 
 func (g *gauge) Update(v float64) {
 	atomic.StoreUint64(&g.curr, math.Float64bits(v))
+	g.touch()
 	atomic.StoreUint64(&g.updated, 1)
 }
 
+// report отправляет значение, если датчик обновлялся после предыдущей
+// отправки. Флаг updated использует только report, snapshot его не
+// сбрасывает, поэтому снимки не мешают отправке и наоборот.
 func (g *gauge) report(name string, tags map[string]string, r StatsReporter) {
 	if atomic.SwapUint64(&g.updated, 0) == 1 {
+		if tr, ok := r.(TimedStatsReporter); ok {
+			tr.ReportGaugeAt(name, tags, g.value(), g.time())
+			return
+		}
 		r.ReportGauge(name, tags, g.value())
 	}
 }
@@ -67,3 +131,82 @@ func (g *gauge) value() float64 {
 func (g *gauge) snapshot() float64 {
 	return math.Float64frombits(atomic.LoadUint64(&g.curr))
 }
+
+type intGauge struct {
+	updated uint64
+	curr    int64
+	observed
+}
+
+func newIntGauge(c clock.Clock) *intGauge {
+	return &intGauge{observed: observed{clock: c}}
+}
+
+func (g *intGauge) Update(v uint64) {
+	if v > math.MaxInt64 {
+		v = math.MaxInt64
+	}
+	atomic.StoreInt64(&g.curr, int64(v))
+	g.touch()
+	atomic.StoreUint64(&g.updated, 1)
+}
+
+func (g *intGauge) report(name string, tags map[string]string, r StatsReporter) {
+	if atomic.SwapUint64(&g.updated, 0) == 1 {
+		if tr, ok := r.(TimedStatsReporter); ok {
+			tr.ReportIntGaugeAt(name, tags, g.snapshot(), g.time())
+			return
+		}
+		r.ReportIntGauge(name, tags, g.snapshot())
+	}
+}
+
+func (g *intGauge) snapshot() int64 {
+	return atomic.LoadInt64(&g.curr)
+}
+
+type histogram struct {
+	buckets []float64
+	counts  []int64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	b := make([]float64, len(buckets))
+	copy(b, buckets)
+	sort.Float64s(b)
+	return &histogram{
+		buckets: b,
+		counts:  make([]int64, len(b)+1),
+	}
+}
+
+func (h *histogram) RecordValue(v float64) {
+	// Верхняя граница корзины включается в корзину.
+	idx := sort.SearchFloat64s(h.buckets, v)
+	atomic.AddInt64(&h.counts[idx], 1)
+}
+
+func (h *histogram) RecordDuration(d time.Duration) {
+	h.RecordValue(d.Seconds())
+}
+
+func (h *histogram) snapshot() []int64 {
+	counts := make([]int64, len(h.counts))
+	for i := range h.counts {
+		counts[i] = atomic.LoadInt64(&h.counts[i])
+	}
+	return counts
+}
+
+// Заглушки для метрик, отклоненных при регистрации (см. scope.claim).
+type noopCounter struct{}
+
+func (noopCounter) Inc(delta int64) {}
+
+type noopGauge struct{}
+
+func (noopGauge) Update(value float64) {}
+
+type noopIntGauge struct{}
+
+func (noopIntGauge) Update(value uint64) {}
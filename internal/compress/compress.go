@@ -0,0 +1,191 @@
+// Package compress алгоритмы сжатия HTTP тел (Content-Encoding)
+// и выбор алгоритма по заголовку Accept-Encoding.
+package compress
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec алгоритм сжатия, Name - его имя в Content-Encoding.
+type Codec interface {
+	Name() string
+	NewWriter(w io.Writer) (Writer, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// Writer сжимающий поток. Flush отправляет накопленные данные,
+// не завершая поток.
+type Writer interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// Default алгоритм по умолчанию, в том числе для "*" в Accept-Encoding.
+const Default = "gzip"
+
+var (
+	codecs = make(map[string]Codec)
+	// order порядок регистрации, он же порядок в Advertise.
+	order []string
+)
+
+func init() {
+	Register(gzipCodec{})
+	Register(zstdCodec{})
+	Register(deflateCodec{})
+}
+
+// Register добавляет алгоритм, вызывается при инициализации пакетов.
+func Register(c Codec) {
+	if _, ok := codecs[c.Name()]; !ok {
+		order = append(order, c.Name())
+	}
+	codecs[c.Name()] = c
+}
+
+// Lookup алгоритм по имени из Content-Encoding.
+func Lookup(name string) (Codec, bool) {
+	c, ok := codecs[strings.ToLower(strings.TrimSpace(name))]
+	return c, ok
+}
+
+// Advertise список поддерживаемых алгоритмов для заголовка Accept-Encoding.
+func Advertise() string {
+	return strings.Join(order, ", ")
+}
+
+// Negotiate выбирает алгоритм по заголовку Accept-Encoding: с наибольшим
+// q среди поддерживаемых, при равных q - указанный раньше. Алгоритмы
+// с q=0 исключаются, "*" означает алгоритм по умолчанию. Если лучший
+// вариант - identity или подходящих нет, возвращает false.
+func Negotiate(acceptEncoding string) (Codec, bool) {
+	var (
+		best  Codec
+		bestQ float64
+	)
+	identityQ := -1.0
+	parts := strings.Split(acceptEncoding, ",")
+	// "*" не относится к алгоритмам, указанным явно, в том числе с q=0.
+	explicit := make(map[string]bool, len(parts))
+	for _, part := range parts {
+		if name, _, ok := parseCoding(part); ok {
+			explicit[name] = true
+		}
+	}
+	for _, part := range parts {
+		name, q, ok := parseCoding(part)
+		if !ok || q <= 0 {
+			continue
+		}
+		if name == "identity" {
+			if q > identityQ {
+				identityQ = q
+			}
+			continue
+		}
+		if name == "*" {
+			if explicit[Default] {
+				continue
+			}
+			name = Default
+		}
+		c, ok := codecs[name]
+		if !ok || q <= bestQ {
+			continue
+		}
+		best, bestQ = c, q
+	}
+	if best == nil || identityQ > bestQ {
+		return nil, false
+	}
+	return best, true
+}
+
+// parseCoding разбирает элемент Accept-Encoding вида "gzip;q=0.5".
+func parseCoding(part string) (string, float64, bool) {
+	params := strings.Split(part, ";")
+	name := strings.ToLower(strings.TrimSpace(params[0]))
+	if name == "" {
+		return "", 0, false
+	}
+	q := 1.0
+	for _, p := range params[1:] {
+		k, v, found := strings.Cut(strings.TrimSpace(p), "=")
+		if !found || strings.TrimSpace(k) != "q" {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			return "", 0, false
+		}
+		q = parsed
+	}
+	return name, q, true
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) NewWriter(w io.Writer) (Writer, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// deflateCodec "deflate" в HTTP - это формат zlib (RFC 1950).
+type deflateCodec struct{}
+
+func (deflateCodec) Name() string { return "deflate" }
+
+func (deflateCodec) NewWriter(w io.Writer) (Writer, error) {
+	return zlib.NewWriter(w), nil
+}
+
+func (deflateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return zlib.NewReader(r)
+}
+
+// zstdMaxWindow ограничение окна распаковки, что бы поток
+// не мог потребовать выделения большого объема памяти.
+const zstdMaxWindow = 8 << 20
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string { return "zstd" }
+
+func (zstdCodec) NewWriter(w io.Writer) (Writer, error) {
+	e, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r,
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderMaxWindow(zstdMaxWindow))
+	if err != nil {
+		return nil, err
+	}
+	return zstdReader{d}, nil
+}
+
+// zstdReader приводит Close декодера к io.Closer.
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (r zstdReader) Close() error {
+	r.Decoder.Close()
+	return nil
+}
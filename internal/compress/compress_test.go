@@ -0,0 +1,86 @@
+package compress
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	data := strings.Repeat(`{"id":"Alloc","type":"gauge","value":1.5}`, 100)
+	for _, name := range []string{"gzip", "deflate", "zstd"} {
+		t.Run(name, func(t *testing.T) {
+			c, ok := Lookup(name)
+			if !ok {
+				t.Fatalf("%s is not registered", name)
+			}
+			var buf bytes.Buffer
+			w, err := c.NewWriter(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(w, data); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if buf.Len() >= len(data) {
+				t.Errorf("no compression: %d >= %d", buf.Len(), len(data))
+			}
+
+			r, err := c.NewReader(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != data {
+				t.Error("data mismatch after round trip")
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string // "" - без сжатия
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"zstd", "zstd"},
+		{"deflate", "deflate"},
+		{"br", ""},
+		// При равных q выбирается указанный раньше.
+		{"zstd, gzip, deflate", "zstd"},
+		{"deflate, gzip", "deflate"},
+		{"gzip;q=0.5, zstd;q=0.8, deflate;q=0.1", "zstd"},
+		{"br, deflate;q=0.9", "deflate"},
+		{"gzip;q=0, zstd;q=0", ""},
+		{"*", "gzip"},
+		{"gzip;q=0, *", ""},
+		{"zstd;q=0.5, *", "gzip"},
+		{"identity, gzip;q=0.5", ""},
+		{"identity;q=0.1, gzip", "gzip"},
+		{"GZIP ; Q=1", "gzip"},
+		{"gzip;q=2, deflate", "deflate"},
+		{"gzip;q=x", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			c, ok := Negotiate(tt.accept)
+			got := ""
+			if ok {
+				got = c.Name()
+			}
+			if got != tt.want {
+				t.Errorf("want %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !http3
+
+package h3
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+)
+
+// Enabled программа собрана с поддержкой HTTP/3.
+const Enabled = false
+
+// NewRoundTripper без тега http3 всегда возвращает ErrDisabled.
+func NewRoundTripper(tlsConf *tls.Config) (http.RoundTripper, error) {
+	return nil, ErrDisabled
+}
+
+// ListenAndServe без тега http3 всегда возвращает ErrDisabled.
+func ListenAndServe(addr string, tlsConf *tls.Config, handler http.Handler) (io.Closer, error) {
+	return nil, ErrDisabled
+}
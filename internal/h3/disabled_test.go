@@ -0,0 +1,17 @@
+//go:build !http3
+
+package h3
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDisabled(t *testing.T) {
+	if _, err := NewRoundTripper(nil); !errors.Is(err, ErrDisabled) {
+		t.Errorf("want ErrDisabled, got %v", err)
+	}
+	if _, err := ListenAndServe("127.0.0.1:0", nil, nil); !errors.Is(err, ErrDisabled) {
+		t.Errorf("want ErrDisabled, got %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+// Package h3 экспериментальный транспорт HTTP/3 (QUIC) для отправки
+// метрик. Библиотека QUIC собирается только с тегом http3 и только
+// поддерживаемыми ею версиями Go (1.18, 1.19), без тега функции пакета
+// возвращают ErrDisabled.
+package h3
+
+import "errors"
+
+// ErrDisabled программа собрана без поддержки HTTP/3.
+var ErrDisabled = errors.New("HTTP/3 is not supported: build with -tags http3")
@@ -0,0 +1,51 @@
+//go:build http3
+
+package h3
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/lucas-clemente/quic-go/http3"
+)
+
+// Enabled программа собрана с поддержкой HTTP/3.
+const Enabled = true
+
+// NewRoundTripper транспорт HTTP/3 для http.Client, tlsConf - настройки
+// проверки сервера, nil - системные корневые сертификаты.
+func NewRoundTripper(tlsConf *tls.Config) (http.RoundTripper, error) {
+	return &http3.RoundTripper{TLSClientConfig: tlsConf}, nil
+}
+
+// ListenAndServe обслуживает HTTP/3 на UDP адресе addr. Порт занимается
+// до возврата, поэтому ошибка занятого порта возвращается сразу.
+// Close закрывает сервер вместе с текущими соединениями.
+func ListenAndServe(addr string, tlsConf *tls.Config, handler http.Handler) (io.Closer, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &server{
+		srv:  &http3.Server{TLSConfig: tlsConf, Handler: handler},
+		conn: conn,
+	}
+	go func() { _ = s.srv.Serve(conn) }()
+	return s, nil
+}
+
+type server struct {
+	srv  *http3.Server
+	conn net.PacketConn
+}
+
+// Close закрывает сервер и сокет, quic-go не закрывает переданный ему сокет сам.
+func (s *server) Close() error {
+	err := s.srv.Close()
+	if cerr := s.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
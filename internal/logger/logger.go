@@ -0,0 +1,169 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel разбирает уровень логирования по имени.
+func ParseLevel(name string) (Level, error) {
+	for level, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level: %q", name)
+}
+
+// Logger простейший логгер с уровнями и выводом в текстовом или JSON формате.
+type Logger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	level  Level
+	asJSON bool
+}
+
+func New(out io.Writer, level Level, format string) (*Logger, error) {
+	switch format {
+	case FormatText, FormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown log format: %q", format)
+	}
+	return &Logger{
+		out:    out,
+		level:  level,
+		asJSON: format == FormatJSON,
+	}, nil
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, format, args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, format, args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, format, args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args...)
+}
+
+type record struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+}
+
+func (l *Logger) logf(level Level, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+	msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	now := time.Now()
+
+	var line []byte
+	if l.asJSON {
+		line, _ = json.Marshal(&record{
+			Time:  now.Format(time.RFC3339Nano),
+			Level: level.String(),
+			Msg:   msg,
+		})
+	} else {
+		line = []byte(now.Format("2006/01/02 15:04:05") + " " + strings.ToUpper(level.String()) + " " + msg)
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(line)
+}
+
+var (
+	stdMu sync.RWMutex
+	std   = &Logger{out: os.Stderr, level: LevelInfo}
+)
+
+// Setup настраивает логгер по умолчанию.
+func Setup(level, format string) error {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	l, err := New(os.Stderr, lvl, format)
+	if err != nil {
+		return err
+	}
+	SetDefault(l)
+	return nil
+}
+
+// SetDefault заменяет логгер по умолчанию и возвращает предыдущий.
+func SetDefault(l *Logger) *Logger {
+	stdMu.Lock()
+	defer stdMu.Unlock()
+	prev := std
+	std = l
+	return prev
+}
+
+func Default() *Logger {
+	stdMu.RLock()
+	defer stdMu.RUnlock()
+	return std
+}
+
+func Debugf(format string, args ...interface{}) {
+	Default().logf(LevelDebug, format, args...)
+}
+
+func Infof(format string, args ...interface{}) {
+	Default().logf(LevelInfo, format, args...)
+}
+
+func Warnf(format string, args ...interface{}) {
+	Default().logf(LevelWarn, format, args...)
+}
+
+func Errorf(format string, args ...interface{}) {
+	Default().logf(LevelError, format, args...)
+}
+
+// Fatalf логирует ошибку и завершает приложение.
+func Fatalf(format string, args ...interface{}) {
+	Default().logf(LevelError, format, args...)
+	os.Exit(1)
+}
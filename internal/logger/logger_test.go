@@ -0,0 +1,68 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLevelFiltering(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(&buf, LevelWarn, FormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Debugf("debug message")
+	l.Infof("info message")
+	l.Warnf("warn message")
+	l.Errorf("error message\n")
+
+	out := buf.String()
+	for _, msg := range []string{"debug message", "info message"} {
+		if strings.Contains(out, msg) {
+			t.Errorf("%q must be filtered out", msg)
+		}
+	}
+	for _, msg := range []string{"WARN warn message\n", "ERROR error message\n"} {
+		if !strings.Contains(out, msg) {
+			t.Errorf("%q expected in output:\n%s", msg, out)
+		}
+	}
+	if n := strings.Count(out, "\n"); n != 2 {
+		t.Errorf("want 2 lines, got %d", n)
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(&buf, LevelDebug, FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Infof("storage: db saved on: %d", 42)
+
+	var rec map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatalf("output is not JSON: %v, %s", err, buf.String())
+	}
+	if rec["level"] != "info" || rec["msg"] != "storage: db saved on: 42" || rec["time"] == "" {
+		t.Errorf("unexpected record: %v", rec)
+	}
+	if len(rec) != 3 {
+		t.Errorf("unexpected fields: %v", rec)
+	}
+}
+
+func TestParse(t *testing.T) {
+	if l, err := ParseLevel("DEBUG"); err != nil || l != LevelDebug {
+		t.Errorf("want debug, got %v, %v", l, err)
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("unknown level accepted")
+	}
+	if _, err := New(&bytes.Buffer{}, LevelInfo, "xml"); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
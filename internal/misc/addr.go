@@ -0,0 +1,15 @@
+package misc
+
+import "strings"
+
+// UnixPrefix префикс адреса, указывающий на unix domain socket.
+const UnixPrefix = "unix:"
+
+// SplitAddress разбирает адрес вида "host:port" или "unix:/path/to.sock"
+// и возвращает сеть и адрес в формате, пригодном для net.Dial/net.Listen.
+func SplitAddress(address string) (network, addr string) {
+	if strings.HasPrefix(address, UnixPrefix) {
+		return "unix", strings.TrimPrefix(address, UnixPrefix)
+	}
+	return "tcp", address
+}
@@ -4,6 +4,8 @@ import (
 	"os"
 	"strconv"
 	"time"
+
+	"go-musthave-devops-trainer/internal/logger"
 )
 
 func GetEnvStr(env, def string) string {
@@ -13,6 +15,8 @@ func GetEnvStr(env, def string) string {
 	return def
 }
 
+// GetEnvSeconds интервал в секундах (число, возможно дробное).
+// Оставлена для совместимости, используйте GetEnvDuration.
 func GetEnvSeconds(env string, def time.Duration) time.Duration {
 	if value, err := strconv.ParseFloat(os.Getenv(env), 64); err == nil {
 		return time.Duration(value * float64(time.Second))
@@ -20,9 +24,50 @@ func GetEnvSeconds(env string, def time.Duration) time.Duration {
 	return def
 }
 
+// GetEnvDuration интервал в формате time.ParseDuration ("30s", "1m30s").
+// Число без единиц, как и в GetEnvSeconds, считается секундами.
+// Некорректное значение заменяется значением по умолчанию с предупреждением в лог.
+func GetEnvDuration(env string, def time.Duration) time.Duration {
+	value := os.Getenv(env)
+	if value == "" {
+		return def
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return d
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	logger.Warnf("env %s: invalid duration %q, using %s", env, value, def)
+	return def
+}
+
+// GetEnvInt целое число, некорректное значение заменяется значением
+// по умолчанию с предупреждением в лог.
+func GetEnvInt(env string, def int) int {
+	value := os.Getenv(env)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		logger.Warnf("env %s: invalid integer %q, using %d", env, value, def)
+		return def
+	}
+	return n
+}
+
 func GetEnvBool(env string, def bool) bool {
 	if value, err := strconv.ParseBool(os.Getenv(env)); err == nil {
 		return value
 	}
 	return def
 }
+
+// Redact скрывает значение секрета, оставляя признак того, что он задан.
+func Redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "[REDACTED]"
+}
@@ -0,0 +1,48 @@
+package misc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetEnvDuration(t *testing.T) {
+	const def = 5 * time.Minute
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", def},
+		{"30s", 30 * time.Second},
+		{"1m30s", 90 * time.Second},
+		{"0", 0},
+		{"2.5", 2500 * time.Millisecond},
+		{"30 s", def},
+		{"abc", def},
+		{"10x", def},
+	}
+	for _, tt := range tests {
+		t.Setenv("TEST_DURATION", tt.value)
+		if got := GetEnvDuration("TEST_DURATION", def); got != tt.want {
+			t.Errorf("%q: want %s, got %s", tt.value, tt.want, got)
+		}
+	}
+}
+
+func TestGetEnvInt(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 7},
+		{"10", 10},
+		{"-1", -1},
+		{"1.5", 7},
+		{"ten", 7},
+	}
+	for _, tt := range tests {
+		t.Setenv("TEST_INT", tt.value)
+		if got := GetEnvInt("TEST_INT", 7); got != tt.want {
+			t.Errorf("%q: want %d, got %d", tt.value, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package sign
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-musthave-devops-trainer/models"
+)
+
+// Data строка, от которой считается хеш метрики. Используется и агентом,
+// и сервером, что бы подписываемое и проверяемое значение всегда совпадали.
+// Целочисленные датчики передают значение в поле delta. Значение датчика
+// записывается без потери точности (кратчайшее представление, однозначно
+// восстанавливающее float64), что бы подпись покрывала его целиком.
+// Время подписи, время измерения, доля выборки и теги добавляются, только если заданы,
+// что бы подписи метрик без них не изменились.
+func Data(m models.Metrics) string {
+	return data(m, func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) })
+}
+
+// LegacyData строка подписи в прежней схеме, где значение датчика
+// записывалось как %f (6 знаков после точки). Так подписывают метрики
+// агенты предыдущих версий и автотесты курса.
+func LegacyData(m models.Metrics) string {
+	return data(m, func(v float64) string { return fmt.Sprintf("%f", v) })
+}
+
+func data(m models.Metrics, gauge func(float64) string) string {
+	var data string
+	if m.MType == models.Counter || m.Value == nil {
+		data = fmt.Sprintf("%s:%s:%d", m.ID, m.MType, *m.Delta)
+	} else {
+		data = m.ID + ":" + m.MType + ":" + gauge(*m.Value)
+	}
+	if m.SignedAt != 0 {
+		data += fmt.Sprintf(":%d", m.SignedAt)
+	}
+	if m.ObservedAt != 0 {
+		data += fmt.Sprintf(":observed:%d", m.ObservedAt)
+	}
+	if m.SampleRate != 0 {
+		data += fmt.Sprintf(":rate:%g", m.SampleRate)
+	}
+	if len(m.Tags) > 0 {
+		data += ":tags:" + models.JoinTags(m.Tags)
+	}
+	return data
+}
+
+// Hash считает подпись метрики, при пустом ключе подпись не нужна.
+func Hash(key []byte, m models.Metrics) string {
+	return hash(key, Data(m))
+}
+
+// LegacyHash считает подпись метрики по LegacyData.
+func LegacyHash(key []byte, m models.Metrics) string {
+	return hash(key, LegacyData(m))
+}
+
+func hash(key []byte, data string) string {
+	if len(key) == 0 {
+		return ""
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// Check проверяет подпись метрики, при пустом ключе проверка не выполняется.
+func Check(key []byte, m models.Metrics) bool {
+	if len(key) == 0 {
+		return true
+	}
+	return hmac.Equal([]byte(Hash(key, m)), []byte(m.Hash))
+}
+
+// CheckLegacy проверяет подпись датчика в прежней схеме (см. LegacyData).
+// Такая подпись не покрывает знаки значения после шестого.
+// Для счетчиков схемы совпадают, поэтому для них всегда false.
+func CheckLegacy(key []byte, m models.Metrics) bool {
+	if len(key) == 0 {
+		return true
+	}
+	if m.MType == models.Counter || m.Value == nil {
+		return false
+	}
+	return hmac.Equal([]byte(LegacyHash(key, m)), []byte(m.Hash))
+}
+
+// InWindow проверяет, что метрика подписана не далее window от now
+// в любую сторону, допуская расхождение часов агента и сервера.
+// Метрики вне окна считаются повторно отправленными (replay).
+// При нулевом window проверка не выполняется.
+//
+// Повтор метрики в пределах окна этой проверкой не обнаруживается.
+func InWindow(m models.Metrics, now time.Time, window time.Duration) bool {
+	if window <= 0 {
+		return true
+	}
+	if m.SignedAt == 0 {
+		return false
+	}
+	skew := now.Sub(time.Unix(m.SignedAt, 0))
+	return skew <= window && skew >= -window
+}
+
+// Exempt префиксы имен метрик, которые передаются без подписи.
+//
+// Подпись таких метрик не проверяется, поэтому любой, кто может достучаться
+// до сервера, может их подменить. Исключать стоит только метрики, подмена
+// которых не критична.
+type Exempt []string
+
+// ParseExempt разбирает список префиксов, разделенных запятой.
+func ParseExempt(list string) Exempt {
+	var e Exempt
+	for _, prefix := range strings.Split(list, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			e = append(e, prefix)
+		}
+	}
+	return e
+}
+
+// Match проверяет, что метрика исключена из подписи.
+func (e Exempt) Match(id string) bool {
+	for _, prefix := range e {
+		if strings.HasPrefix(id, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// String возвращает список префиксов в формате ParseExempt.
+func (e Exempt) String() string {
+	return strings.Join(e, ",")
+}
@@ -0,0 +1,63 @@
+package sign
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"go-musthave-devops-trainer/models"
+)
+
+func TestHashGaugePrecision(t *testing.T) {
+	key := []byte("secret")
+	values := []float64{0.1234567, 1e-9, 123456789.987654321, math.Pi, math.SmallestNonzeroFloat64, math.MaxFloat64, -0.0000001}
+	for _, v := range values {
+		v := v
+		m := models.Metrics{ID: "g", MType: models.Gauge, Value: &v}
+		m.Hash = Hash(key, m)
+
+		// Подпись проверяется после передачи в JSON, как на сервере.
+		body, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got models.Metrics
+		if err := json.Unmarshal(body, &got); err != nil {
+			t.Fatal(err)
+		}
+		if !Check(key, got) {
+			t.Errorf("%v: hash mismatch after round trip, data %q", v, Data(got))
+		}
+
+		// Подпись меняется даже при минимальном изменении значения.
+		changed := math.Nextafter(v, math.Inf(1))
+		got.Value = &changed
+		if Check(key, got) {
+			t.Errorf("%v: hash does not cover %v", v, changed)
+		}
+	}
+}
+
+func TestCheckLegacy(t *testing.T) {
+	key := []byte("secret")
+	v := 0.1234567
+	m := models.Metrics{ID: "Alloc", MType: models.Gauge, Value: &v}
+	if got, want := LegacyData(m), "Alloc:gauge:0.123457"; got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+	m.Hash = LegacyHash(key, m)
+	if Check(key, m) || !CheckLegacy(key, m) {
+		t.Error("legacy signature must be accepted by CheckLegacy only")
+	}
+	m.Hash = Hash(key, m)
+	if CheckLegacy(key, m) {
+		t.Error("exact signature is not a legacy one")
+	}
+
+	d := int64(1)
+	c := models.Metrics{ID: "PollCount", MType: models.Counter, Delta: &d}
+	c.Hash = Hash(key, c)
+	if CheckLegacy(key, c) {
+		t.Error("counters have no legacy signature")
+	}
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go-musthave-devops-trainer/internal/logger"
+)
+
+// backupName имя резервной копии: последняя копия - file.bak,
+// более старые - file.bak.1, file.bak.2 и т.д.
+func backupName(filename string, n int) string {
+	if n == 0 {
+		return filename + ".bak"
+	}
+	return fmt.Sprintf("%s.bak.%d", filename, n)
+}
+
+// rotateBackups сдвигает резервные копии на одну позицию и делает
+// текущий файл последней копией. Самая старая копия перезаписывается.
+// Текущий файл не перемещается, а связывается с копией жесткой ссылкой
+// (или копируется), что бы до замены новым (см. writeFileAtomic)
+// файл существовал всегда.
+func (f *FDB) rotateBackups() {
+	for i := f.backups - 1; i > 0; i-- {
+		if err := os.Rename(backupName(f.filename, i-1), backupName(f.filename, i)); err != nil && !os.IsNotExist(err) {
+			logger.Warnf("storage: cannot rotate backup: %v", err)
+		}
+	}
+	last := backupName(f.filename, 0)
+	if err := os.Remove(last); err != nil && !os.IsNotExist(err) {
+		logger.Warnf("storage: cannot create backup: %v", err)
+		return
+	}
+	if err := os.Link(f.filename, last); err == nil || os.IsNotExist(err) {
+		return
+	}
+	// Файловая система без жестких ссылок.
+	if err := copyFile(f.filename, last); err != nil && !os.IsNotExist(err) {
+		logger.Warnf("storage: cannot create backup: %v", err)
+	}
+}
+
+// copyFile копирует файл src в dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// pruneBackups удаляет копии сверх заданного количества (например,
+// оставшиеся после его уменьшения) и старше максимального возраста.
+// Последняя копия file.bak не удаляется.
+func (f *FDB) pruneBackups() {
+	now := f.clock.Now()
+	f.removeBackups(func(n int, info fs.FileInfo) bool {
+		if n >= f.backups {
+			return true
+		}
+		return f.backupMaxAge > 0 && now.Sub(info.ModTime()) > f.backupMaxAge
+	})
+}
+
+// removeBackups удаляет копии file.bak.N, для которых stale возвращает true.
+func (f *FDB) removeBackups(stale func(n int, info fs.FileInfo) bool) {
+	dir, base := filepath.Split(f.filename)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logger.Warnf("storage: cannot list backups: %v", err)
+		return
+	}
+	prefix := base + ".bak."
+	for _, e := range entries {
+		suffix := strings.TrimPrefix(e.Name(), prefix)
+		if suffix == e.Name() || e.IsDir() {
+			continue
+		}
+		n, err := strconv.Atoi(suffix)
+		if err != nil || n < 1 {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || !stale(n, info) {
+			continue
+		}
+		name := filepath.Join(dir, e.Name())
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			logger.Warnf("storage: cannot remove backup: %v", err)
+			continue
+		}
+		logger.Debugf("storage: backup removed: %s", name)
+	}
+}
@@ -0,0 +1,384 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go-musthave-devops-trainer/internal/clock"
+	"go-musthave-devops-trainer/models"
+)
+
+// Cache кеширует чтение метрик и снимка всех метрик (Snapshot) поверх
+// другого хранилища, обычно RDB. Запись проходит в хранилище и сбрасывает
+// кеш: обновленную метрику и снимок целиком. Записи, сделанные в обход
+// Cache, видны после истечения ttl.
+//
+// Cache передает хранилищу необязательные интерфейсы, реализуемые RDB:
+// Health, Notifier, Snapshotter, Compactor, Importer, BatchUpdater
+// и CardinalityChecker.
+type Cache struct {
+	next  Store
+	ttl   time.Duration
+	clock clock.Clock
+
+	mu      sync.Mutex
+	metrics map[cacheKey]cacheEntry
+	dump    *Dump
+	dumpExp time.Time
+	// gen увеличивается при каждом сбросе, значение, прочитанное
+	// до сброса, в кеш не попадает.
+	gen uint64
+}
+
+type cacheKey struct {
+	mtype, id string
+}
+
+type cacheEntry struct {
+	m       models.Metrics
+	ok      bool
+	expires time.Time
+}
+
+var (
+	_ Store        = (*Cache)(nil)
+	_ Health       = (*Cache)(nil)
+	_ Notifier     = (*Cache)(nil)
+	_ Snapshotter  = (*Cache)(nil)
+	_ Compactor    = (*Cache)(nil)
+	_ Importer     = (*Cache)(nil)
+	_ BatchUpdater = (*Cache)(nil)
+
+	_ CardinalityChecker = (*Cache)(nil)
+)
+
+type cacheOption func(*Cache)
+
+// WithCacheClock источник времени для истечения записей кеша.
+func WithCacheClock(c clock.Clock) cacheOption {
+	return func(cache *Cache) {
+		cache.clock = c
+	}
+}
+
+// NewCache кеш чтения поверх next, записи хранятся не дольше ttl.
+func NewCache(next Store, ttl time.Duration, opts ...cacheOption) *Cache {
+	c := &Cache{
+		next:    next,
+		ttl:     ttl,
+		clock:   clock.Real(),
+		metrics: make(map[cacheKey]cacheEntry),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// lookup метрика из кеша и поколение кеша на момент чтения.
+func (c *Cache) lookup(key cacheKey) (cacheEntry, bool, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.metrics[key]
+	if ok && !c.clock.Now().Before(e.expires) {
+		delete(c.metrics, key)
+		ok = false
+	}
+	return e, ok, c.gen
+}
+
+func (c *Cache) store(key cacheKey, gen uint64, m models.Metrics, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+	c.metrics[key] = cacheEntry{m: m, ok: ok, expires: c.clock.Now().Add(c.ttl)}
+}
+
+// invalidate сбрасывает метрику и снимок.
+func (c *Cache) invalidate(mtype, id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	delete(c.metrics, cacheKey{mtype, id})
+	c.dump = nil
+}
+
+// purge сбрасывает кеш целиком.
+func (c *Cache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.metrics = make(map[cacheKey]cacheEntry)
+	c.dump = nil
+}
+
+func (c *Cache) Get(ctx context.Context, mtype, id string) (models.Metrics, bool, error) {
+	key := cacheKey{mtype, id}
+	e, hit, gen := c.lookup(key)
+	if hit {
+		return cloneMetric(e.m), e.ok, nil
+	}
+	m, ok, err := c.next.Get(ctx, mtype, id)
+	if err != nil {
+		return m, ok, err
+	}
+	c.store(key, gen, cloneMetric(m), ok)
+	return m, ok, nil
+}
+
+// cloneMetric копия метрики, значения которой не разделяются с кешем.
+func cloneMetric(m models.Metrics) models.Metrics {
+	if m.Delta != nil {
+		delta := *m.Delta
+		m.Delta = &delta
+	}
+	if m.Value != nil {
+		value := *m.Value
+		m.Value = &value
+	}
+	return m
+}
+
+func (c *Cache) Exists(ctx context.Context, mtype, id string) (bool, error) {
+	if e, hit, _ := c.lookup(cacheKey{mtype, id}); hit {
+		return e.ok, nil
+	}
+	return c.next.Exists(ctx, mtype, id)
+}
+
+func (c *Cache) Counter(ctx context.Context, id string) (int64, bool) {
+	m, ok, err := c.Get(ctx, models.Counter, id)
+	if err != nil || !ok || m.Delta == nil {
+		return 0, false
+	}
+	return *m.Delta, true
+}
+
+func (c *Cache) Gauge(ctx context.Context, id string) (float64, bool) {
+	m, ok, err := c.Get(ctx, models.Gauge, id)
+	if err != nil || !ok || m.Value == nil {
+		return 0, false
+	}
+	return *m.Value, true
+}
+
+func (c *Cache) UpdateCounter(ctx context.Context, id string, delta int64) int {
+	defer c.invalidate(models.Counter, id)
+	return c.next.UpdateCounter(ctx, id, delta)
+}
+
+func (c *Cache) IncrAndGet(ctx context.Context, id string, delta int64) (int64, error) {
+	defer c.invalidate(models.Counter, id)
+	return c.next.IncrAndGet(ctx, id, delta)
+}
+
+func (c *Cache) UpdateGauge(ctx context.Context, id string, value float64) int {
+	defer c.invalidate(models.Gauge, id)
+	return c.next.UpdateGauge(ctx, id, value)
+}
+
+func (c *Cache) DeleteCounter(ctx context.Context, id string) bool {
+	defer c.invalidate(models.Counter, id)
+	return c.next.DeleteCounter(ctx, id)
+}
+
+func (c *Cache) DeleteGauge(ctx context.Context, id string) bool {
+	defer c.invalidate(models.Gauge, id)
+	return c.next.DeleteGauge(ctx, id)
+}
+
+// UpdateBatch записывает пачку в хранилище, при отсутствии у него
+// BatchUpdater - по одной метрике в WithTx. Кеш сбрасывается целиком.
+func (c *Cache) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	defer c.purge()
+	if b, ok := c.next.(BatchUpdater); ok {
+		return b.UpdateBatch(ctx, metrics)
+	}
+	return c.next.WithTx(ctx, func(tx Store) error {
+		for _, m := range metrics {
+			switch {
+			case m.MType == models.Counter && m.Delta != nil:
+				tx.UpdateCounter(ctx, m.ID, *m.Delta)
+			case m.MType == models.Gauge && m.Value != nil:
+				tx.UpdateGauge(ctx, m.ID, *m.Value)
+			default:
+				return fmt.Errorf("%w: %s %q", ErrUnknownType, m.MType, m.ID)
+			}
+		}
+		return nil
+	})
+}
+
+// Snapshot снимок из кеша или хранилища. Если хранилище не реализует
+// Snapshotter, снимок собирается обходом MapOrdered*.
+func (c *Cache) Snapshot(ctx context.Context) (Dump, error) {
+	c.mu.Lock()
+	if c.dump != nil && c.clock.Now().Before(c.dumpExp) {
+		d := copyDump(*c.dump)
+		c.mu.Unlock()
+		return d, nil
+	}
+	gen := c.gen
+	c.mu.Unlock()
+
+	var d Dump
+	if sn, ok := c.next.(Snapshotter); ok {
+		var err error
+		if d, err = sn.Snapshot(ctx); err != nil {
+			return Dump{}, err
+		}
+	} else {
+		d = Dump{Counters: make(map[string]int64), Gauges: make(map[string]float64)}
+		c.next.MapOrderedCounter(ctx, func(k string, v int64) { d.Counters[k] = v })
+		c.next.MapOrderedGauge(ctx, func(k string, v float64) { d.Gauges[k] = v })
+	}
+
+	c.mu.Lock()
+	if gen == c.gen {
+		cached := copyDump(d)
+		c.dump = &cached
+		c.dumpExp = c.clock.Now().Add(c.ttl)
+	}
+	c.mu.Unlock()
+	return d, nil
+}
+
+func copyDump(d Dump) Dump {
+	cp := Dump{
+		Counters: make(map[string]int64, len(d.Counters)),
+		Gauges:   make(map[string]float64, len(d.Gauges)),
+	}
+	for k, v := range d.Counters {
+		cp.Counters[k] = v
+	}
+	for k, v := range d.Gauges {
+		cp.Gauges[k] = v
+	}
+	return cp
+}
+
+// MapOrderedCounter обходит счетчики из снимка, если хранилище
+// реализует Snapshotter, иначе передает вызов хранилищу.
+func (c *Cache) MapOrderedCounter(ctx context.Context, f func(k string, v int64)) {
+	if _, ok := c.next.(Snapshotter); !ok {
+		c.next.MapOrderedCounter(ctx, f)
+		return
+	}
+	d, err := c.Snapshot(ctx)
+	if err != nil {
+		return
+	}
+	keys := make([]string, 0, len(d.Counters))
+	for k := range d.Counters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		f(k, d.Counters[k])
+	}
+}
+
+// MapOrderedGauge обходит датчики, аналогично MapOrderedCounter.
+func (c *Cache) MapOrderedGauge(ctx context.Context, f func(k string, v float64)) {
+	if _, ok := c.next.(Snapshotter); !ok {
+		c.next.MapOrderedGauge(ctx, f)
+		return
+	}
+	d, err := c.Snapshot(ctx)
+	if err != nil {
+		return
+	}
+	keys := make([]string, 0, len(d.Gauges))
+	for k := range d.Gauges {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		f(k, d.Gauges[k])
+	}
+}
+
+func (c *Cache) CountCounters(ctx context.Context) int {
+	return c.next.CountCounters(ctx)
+}
+
+func (c *Cache) CountGauges(ctx context.Context) int {
+	return c.next.CountGauges(ctx)
+}
+
+// Count не кешируется: количество проверяется перед записью новых метрик.
+func (c *Cache) Count(ctx context.Context, mtype string) (int, error) {
+	if cc, ok := c.next.(CardinalityChecker); ok {
+		return cc.Count(ctx, mtype)
+	}
+	if mtype == models.Counter {
+		return c.next.CountCounters(ctx), nil
+	}
+	return c.next.CountGauges(ctx), nil
+}
+
+func (c *Cache) Timestamp(ctx context.Context, layout string) string {
+	return c.next.Timestamp(ctx, layout)
+}
+
+func (c *Cache) UpdateCount(ctx context.Context) int {
+	return c.next.UpdateCount(ctx)
+}
+
+func (c *Cache) Ping(ctx context.Context) error {
+	return c.next.Ping(ctx)
+}
+
+// WithTx выполняет fn в транзакции хранилища без кеша,
+// после нее кеш сбрасывается целиком.
+func (c *Cache) WithTx(ctx context.Context, fn func(tx Store) error) error {
+	defer c.purge()
+	return c.next.WithTx(ctx, fn)
+}
+
+func (c *Cache) Close() error {
+	c.purge()
+	return c.next.Close()
+}
+
+func (c *Cache) Degraded() bool {
+	if hc, ok := c.next.(Health); ok {
+		return hc.Degraded()
+	}
+	return false
+}
+
+// Subscribe подписка на события хранилища. Если хранилище их
+// не поддерживает, канал закрывается после отмены ctx без событий.
+func (c *Cache) Subscribe(ctx context.Context) <-chan MetricChange {
+	if n, ok := c.next.(Notifier); ok {
+		return n.Subscribe(ctx)
+	}
+	ch := make(chan MetricChange)
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch
+}
+
+func (c *Cache) Compact(ctx context.Context) error {
+	if cp, ok := c.next.(Compactor); ok {
+		return cp.Compact(ctx)
+	}
+	return ErrNotSupported
+}
+
+func (c *Cache) Import(ctx context.Context, d Dump, replace bool) error {
+	im, ok := c.next.(Importer)
+	if !ok {
+		return ErrNotSupported
+	}
+	defer c.purge()
+	return im.Import(ctx, d, replace)
+}
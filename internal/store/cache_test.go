@@ -0,0 +1,101 @@
+package store
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go-musthave-devops-trainer/internal/clock"
+	"go-musthave-devops-trainer/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	r, mock := newMockRDB(t)
+	c := clock.NewFake(time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC))
+	cache := NewCache(r, time.Minute, WithCacheClock(c))
+
+	expectGet := func(value float64) {
+		mock.ExpectQuery(`SELECT value FROM metrics WHERE id = \$1 AND type = \$2`).
+			WithArgs("Alloc", models.Gauge).
+			WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow(value))
+	}
+	gauge := func(want float64) {
+		t.Helper()
+		if v, ok := cache.Gauge(ctx, "Alloc"); !ok || v != want {
+			t.Errorf("want %v, got %v, %v", want, v, ok)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Повторное чтение не обращается к базе, лишний запрос провалил бы мок.
+	expectGet(1.5)
+	gauge(1.5)
+	gauge(1.5)
+	m, ok, err := cache.Get(ctx, models.Gauge, "Alloc")
+	if err != nil || !ok || *m.Value != 1.5 {
+		t.Errorf("unexpected cached metric: %+v, %v, %v", m, ok, err)
+	}
+	*m.Value = 100
+	gauge(1.5)
+
+	// Запись сбрасывает кеш.
+	mock.ExpectQuery(`SELECT value FROM metrics WHERE id = \$1;`).
+		WithArgs("Alloc").
+		WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow(1.5))
+	mock.ExpectQuery(`INSERT INTO metrics`).
+		WithArgs("Alloc", 2.5).
+		WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow(2.5))
+	cache.UpdateGauge(ctx, "Alloc", 2.5)
+	expectGet(2.5)
+	gauge(2.5)
+
+	// Запись истекает через ttl.
+	c.Advance(30 * time.Second)
+	gauge(2.5)
+	c.Advance(30 * time.Second)
+	expectGet(3.5)
+	gauge(3.5)
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	ctx := context.Background()
+	r, mock := newMockRDB(t)
+	c := clock.NewFake(time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC))
+	cache := NewCache(r, time.Minute, WithCacheClock(c))
+
+	expectSnapshot := func(delta int64) {
+		mock.ExpectQuery(`SELECT id, delta FROM metrics WHERE type = 'counter'`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "delta"}).AddRow("PollCount", delta))
+		mock.ExpectQuery(`SELECT id, value FROM metrics WHERE type = 'gauge'`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "value"}))
+	}
+	snapshot := func(want int64) {
+		t.Helper()
+		d, err := cache.Snapshot(ctx)
+		if err != nil || d.Counters["PollCount"] != want {
+			t.Errorf("want PollCount=%d, got %+v, %v", want, d, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	expectSnapshot(1)
+	snapshot(1)
+	snapshot(1)
+
+	mock.ExpectQuery(`INSERT INTO metrics`).
+		WillReturnRows(sqlmock.NewRows([]string{"delta"}).AddRow(int64(2)))
+	cache.UpdateCounter(ctx, "PollCount", 1)
+	expectSnapshot(2)
+	snapshot(2)
+
+	c.Advance(time.Minute)
+	expectSnapshot(3)
+	snapshot(3)
+}
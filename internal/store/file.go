@@ -1,20 +1,29 @@
 package store
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/fs"
-	"log"
 	"os"
 	"path/filepath"
 	"sort"
 	"sync"
 	"time"
+
+	"go-musthave-devops-trainer/internal/clock"
+	"go-musthave-devops-trainer/internal/logger"
+	"go-musthave-devops-trainer/models"
 )
 
 type FDB struct {
 	filename string
+	clock    clock.Clock
 
 	sync.Mutex
 	counters    map[string]int64
@@ -22,11 +31,41 @@ type FDB struct {
 	updateCount int
 	tstamp      time.Time
 	close       func() error
+
+	// Статистика сохранений, помогает подобрать STORE_INTERVAL.
+	pendingWrites    int
+	saveCount        int
+	lastSaveDuration time.Duration
+
+	// Время последнего обновления каждой метрики, в том числе без
+	// изменения значения. На диск не сохраняется, поэтому после
+	// перезапуска известно только для обновленных метрик.
+	updated map[metricKey]time.Time
+	// Время измерения метрик агентом, так же не сохраняется на диск.
+	observed map[metricKey]time.Time
+
+	// Подписчики на изменения метрик, см. Subscribe.
+	subscribers map[chan MetricChange]struct{}
+
+	// Хранение резервных копий файла, см. WithBackups.
+	backups      int
+	backupMaxAge time.Duration
+}
+
+// subscriberBuffer размер буфера канала подписчика.
+const subscriberBuffer = 64
+
+type metricKey struct {
+	mtype string
+	id    string
 }
 
 type args struct {
+	lock           *FileLock
 	restoreOnStart bool
+	strictRestore  bool
 	storeInterval  time.Duration
+	gaugeTTL       time.Duration
 }
 
 type option func(*FDB, *args)
@@ -37,22 +76,90 @@ func WithRestoreOnStart(restoreOnStart bool) option {
 	}
 }
 
+// WithStrictRestore при восстановлении (WithRestoreOnStart) считает ошибкой
+// файл, из которого и из резервных копий которого не удалось загрузить
+// данные: OpenFDB возвращает ErrRestore. Отсутствие файла или пустой
+// файл ошибкой не считаются, это первый запуск.
+func WithStrictRestore(strict bool) option {
+	return func(db *FDB, a *args) {
+		a.strictRestore = strict
+	}
+}
+
+// WithInterval интервал автосохранения, 0 - сохранение только при завершении работы.
 func WithInterval(interval time.Duration) option {
 	return func(db *FDB, a *args) {
 		a.storeInterval = interval
 	}
 }
 
+// WithGaugeTTL удаляет датчики, не обновлявшиеся дольше ttl, 0 - не удалять.
+// Счетчики хранятся бессрочно независимо от ttl.
+func WithGaugeTTL(ttl time.Duration) option {
+	return func(db *FDB, a *args) {
+		a.gaugeTTL = ttl
+	}
+}
+
+// WithBackups количество хранимых резервных копий файла (не меньше одной)
+// и их максимальный возраст, 0 - без ограничения. Лишние и устаревшие
+// копии удаляются при каждом сохранении, последняя копия хранится всегда.
+func WithBackups(count int, maxAge time.Duration) option {
+	return func(db *FDB, a *args) {
+		if count < 1 {
+			count = 1
+		}
+		db.backups = count
+		db.backupMaxAge = maxAge
+	}
+}
+
+// WithLock блокировка файла хранилища (см. AcquireLock), освобождается
+// после сохранения данных при закрытии.
+func WithLock(lock *FileLock) option {
+	return func(db *FDB, a *args) {
+		a.lock = lock
+	}
+}
+
 func WithFile(filename string) option {
 	return func(db *FDB, a *args) {
 		db.filename = filename
 	}
 }
 
+// WithClock часы для временных меток и интервала сохранения.
+func WithClock(c clock.Clock) option {
+	return func(db *FDB, a *args) {
+		db.clock = c
+	}
+}
+
+// ErrRestore данные не удалось восстановить из существующего файла, см. WithStrictRestore.
+var ErrRestore = errors.New("cannot restore storage")
+
+// NewFDB хранилище в памяти с сохранением в файл, если он задан.
+// Ошибки открытия файла приводят к панике, см. OpenFDB.
 func NewFDB(ctx context.Context, opts ...option) *FDB {
+	db, err := OpenFDB(ctx, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+// OpenFDB аналог NewFDB, возвращающий ошибки открытия файла и строгого
+// восстановления. При ошибке блокировка из WithLock освобождается.
+func OpenFDB(ctx context.Context, opts ...option) (*FDB, error) {
 	db := &FDB{
+		clock:    clock.Real(),
 		counters: make(map[string]int64),
 		gauges:   make(map[string]float64),
+		updated:  make(map[metricKey]time.Time),
+		observed: make(map[metricKey]time.Time),
+
+		subscribers: make(map[chan MetricChange]struct{}),
+		backups:     1,
 	}
 
 	args := &args{}
@@ -61,41 +168,66 @@ func NewFDB(ctx context.Context, opts ...option) *FDB {
 	}
 
 	if db.filename == "" {
-		return db
+		if args.gaugeTTL > 0 {
+			go db.pruneLoop(ctx, args.gaugeTTL)
+		}
+		return db, nil
 	}
 
+	// Пустой файл тоже означает первый запуск: ensureDir создает его
+	// при открытии, и процесс мог завершиться до первого сохранения.
+	info, errStat := os.Stat(db.filename)
+	firstRun := errors.Is(errStat, fs.ErrNotExist) || (errStat == nil && info.Size() == 0)
 	if err := ensureDir(db.filename); err != nil {
-		panic(err)
+		_ = args.lock.Release()
+		return nil, err
 	}
-	log.Println("storage: db filename:", db.filename)
+	logger.Infof("storage: db filename: %s", db.filename)
 
 	if args.restoreOnStart {
-		if err := db.load(); err != nil {
-			log.Println("storage: fail on loading:", err)
-		}
-		if !db.tstamp.IsZero() {
-			log.Println("storage: db loaded with:", db.tstamp)
+		switch err := db.load(); {
+		case err == nil:
+			if !db.tstamp.IsZero() {
+				logger.Infof("storage: db loaded with: %s", db.tstamp)
+			}
+		case firstRun:
+			logger.Infof("storage: %s not found, starting with empty storage", db.filename)
+		case args.strictRestore:
+			_ = args.lock.Release()
+			return nil, fmt.Errorf("%w from %s: %v", ErrRestore, db.filename, err)
+		default:
+			logger.Errorf("storage: fail on loading: %v", err)
 		}
 	}
 
 	ctx, cancel := context.WithCancel(ctx)
+	// Удаление останавливается при закрытии, что бы не менять сохраненные данные.
+	if args.gaugeTTL > 0 {
+		go db.pruneLoop(ctx, args.gaugeTTL)
+	}
 
-	// Ограничим минимальный интервал в 1 секунду.
-	// Просто что бы показать, что можем.
-	// Если примем меньше, то отключаем автосохранение.
-	if args.storeInterval >= time.Second {
+	// Нулевой интервал означает сохранение только при завершении работы.
+	switch {
+	case args.storeInterval > 0:
 		go db.run(ctx, args.storeInterval)
+	case args.storeInterval == 0:
+		logger.Infof("storage: store interval is 0, data is saved on shutdown only")
+	default:
+		logger.Warnf("storage: negative store interval %s, autosave disabled, data is saved on shutdown only", args.storeInterval)
 	}
 
 	// При завершении, сохраняем данные на диск.
 	db.close = func() error {
-		log.Println("storage: shutting down...")
+		logger.Infof("storage: shutting down...")
 		cancel()
 		_, _ = db.save()
-		log.Println("storage: done")
+		if err := args.lock.Release(); err != nil {
+			logger.Warnf("storage: cannot release lock: %v", err)
+		}
+		logger.Infof("storage: done")
 		return nil
 	}
-	return db
+	return db, nil
 }
 
 func ensureDir(fileName string) error {
@@ -121,18 +253,51 @@ func (f *FDB) Close() error {
 func (f *FDB) UpdateCounter(ctx context.Context, id string, delta int64) int {
 	f.Lock()
 	defer f.Unlock()
-	f.tstamp = time.Now()
+	now := f.clock.Now()
+	f.updated[metricKey{models.Counter, id}] = now
+	// Нулевое приращение не меняет данные и не должно вызывать сохранение.
+	if _, ok := f.counters[id]; ok && delta == 0 {
+		return f.updateCount
+	}
+	f.tstamp = now
 	f.counters[id] = f.counters[id] + delta
 	f.updateCount++
+	f.pendingWrites++
+	f.notifyCounter(id, f.counters[id], now)
 	return f.updateCount
 }
 
+func (f *FDB) IncrAndGet(ctx context.Context, id string, delta int64) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+	now := f.clock.Now()
+	f.updated[metricKey{models.Counter, id}] = now
+	total, ok := f.counters[id]
+	if ok && delta == 0 {
+		return total, nil
+	}
+	total += delta
+	f.tstamp = now
+	f.counters[id] = total
+	f.updateCount++
+	f.pendingWrites++
+	f.notifyCounter(id, total, now)
+	return total, nil
+}
+
 func (f *FDB) UpdateGauge(ctx context.Context, id string, value float64) int {
 	f.Lock()
 	defer f.Unlock()
-	f.tstamp = time.Now()
+	now := f.clock.Now()
+	f.updated[metricKey{models.Gauge, id}] = now
+	if prev, ok := f.gauges[id]; ok && prev == value {
+		return f.updateCount
+	}
+	f.tstamp = now
 	f.gauges[id] = value
 	f.updateCount++
+	f.pendingWrites++
+	f.notifyGauge(id, value, now)
 	return f.updateCount
 }
 
@@ -150,6 +315,55 @@ func (f *FDB) Gauge(ctx context.Context, id string) (float64, bool) {
 	return v, ok
 }
 
+func (f *FDB) Get(ctx context.Context, mtype, id string) (models.Metrics, bool, error) {
+	m := models.Metrics{ID: id, MType: mtype}
+	f.Lock()
+	defer f.Unlock()
+	switch mtype {
+	case models.Counter:
+		delta, ok := f.counters[id]
+		if !ok {
+			return m, false, nil
+		}
+		m.Delta = &delta
+	case models.Gauge:
+		value, ok := f.gauges[id]
+		if !ok {
+			return m, false, nil
+		}
+		m.Value = &value
+	default:
+		return m, false, ErrUnknownType
+	}
+	return m, true, nil
+}
+
+func (f *FDB) Exists(ctx context.Context, mtype, id string) (bool, error) {
+	f.Lock()
+	defer f.Unlock()
+	switch mtype {
+	case models.Counter:
+		_, ok := f.counters[id]
+		return ok, nil
+	case models.Gauge:
+		_, ok := f.gauges[id]
+		return ok, nil
+	}
+	return false, ErrUnknownType
+}
+
+func (f *FDB) CountCounters(ctx context.Context) int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.counters)
+}
+
+func (f *FDB) CountGauges(ctx context.Context) int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.gauges)
+}
+
 func (f *FDB) Timestamp(ctx context.Context, layout string) string {
 	f.Lock()
 	defer f.Unlock()
@@ -168,6 +382,149 @@ func (f *FDB) UpdateCount(ctx context.Context) int {
 	return f.updateCount
 }
 
+// LastUpdated время последнего обновления метрики.
+func (f *FDB) LastUpdated(ctx context.Context, mtype, id string) (time.Time, bool) {
+	f.Lock()
+	defer f.Unlock()
+	t, ok := f.updated[metricKey{mtype, id}]
+	return t, ok
+}
+
+// SetObserved запоминает время измерения метрики агентом.
+func (f *FDB) SetObserved(ctx context.Context, mtype, id string, at time.Time) {
+	f.Lock()
+	defer f.Unlock()
+	f.observed[metricKey{mtype, id}] = at
+}
+
+// Observed время измерения метрики, если агент его передавал.
+func (f *FDB) Observed(ctx context.Context, mtype, id string) (time.Time, bool) {
+	f.Lock()
+	defer f.Unlock()
+	t, ok := f.observed[metricKey{mtype, id}]
+	return t, ok
+}
+
+// WithTx выполняет fn под блокировкой хранилища над копией данных,
+// которая заменяет текущие данные, только если fn завершилась без ошибки.
+// Остальные запросы ждут окончания транзакции, копирование занимает
+// время, пропорциональное количеству метрик. События подписчикам
+// рассылаются после фиксации, по одному на измененную метрику.
+func (f *FDB) WithTx(ctx context.Context, fn func(tx Store) error) error {
+	f.Lock()
+	defer f.Unlock()
+	tx := f.txCopy()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	f.commit(tx)
+	return nil
+}
+
+// txCopy копия данных для транзакции, без файла и подписчиков.
+// Вызывается под блокировкой FDB.
+func (f *FDB) txCopy() *FDB {
+	tx := &FDB{
+		clock:       f.clock,
+		counters:    make(map[string]int64, len(f.counters)),
+		gauges:      make(map[string]float64, len(f.gauges)),
+		updateCount: f.updateCount,
+		tstamp:      f.tstamp,
+		updated:     make(map[metricKey]time.Time, len(f.updated)),
+		observed:    make(map[metricKey]time.Time, len(f.observed)),
+		subscribers: make(map[chan MetricChange]struct{}),
+		backups:     f.backups,
+	}
+	for k, v := range f.counters {
+		tx.counters[k] = v
+	}
+	for k, v := range f.gauges {
+		tx.gauges[k] = v
+	}
+	for k, v := range f.updated {
+		tx.updated[k] = v
+	}
+	for k, v := range f.observed {
+		tx.observed[k] = v
+	}
+	return tx
+}
+
+// commit применяет данные транзакции. Вызывается под блокировкой FDB.
+func (f *FDB) commit(tx *FDB) {
+	for id, v := range tx.counters {
+		if prev, ok := f.counters[id]; !ok || prev != v {
+			f.notifyCounter(id, v, tx.tstamp)
+		}
+	}
+	for id, v := range tx.gauges {
+		if prev, ok := f.gauges[id]; !ok || prev != v {
+			f.notifyGauge(id, v, tx.tstamp)
+		}
+	}
+	f.counters, f.gauges = tx.counters, tx.gauges
+	f.updated, f.observed = tx.updated, tx.observed
+	f.updateCount, f.tstamp = tx.updateCount, tx.tstamp
+	f.pendingWrites += tx.pendingWrites
+}
+
+// Subscribe подписывает на изменения метрик (см. Notifier).
+// События рассылаются только при изменении значения.
+func (f *FDB) Subscribe(ctx context.Context) <-chan MetricChange {
+	ch := make(chan MetricChange, subscriberBuffer)
+	f.Lock()
+	f.subscribers[ch] = struct{}{}
+	f.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		f.Lock()
+		delete(f.subscribers, ch)
+		f.Unlock()
+		close(ch)
+	}()
+	return ch
+}
+
+func (f *FDB) notifyCounter(id string, total int64, at time.Time) {
+	f.notify(MetricChange{Metric: models.Metrics{ID: id, MType: models.Counter, Delta: &total}, At: at})
+}
+
+func (f *FDB) notifyGauge(id string, value float64, at time.Time) {
+	f.notify(MetricChange{Metric: models.Metrics{ID: id, MType: models.Gauge, Value: &value}, At: at})
+}
+
+// notify вызывается под блокировкой FDB и не ждет подписчиков.
+func (f *FDB) notify(c MetricChange) {
+	for ch := range f.subscribers {
+		select {
+		case ch <- c:
+		default:
+		}
+	}
+}
+
+// PendingWrites количество обновлений с момента последнего сохранения.
+func (f *FDB) PendingWrites() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.pendingWrites
+}
+
+// LastSaveDuration длительность последнего успешного сохранения.
+func (f *FDB) LastSaveDuration() time.Duration {
+	f.Lock()
+	defer f.Unlock()
+	return f.lastSaveDuration
+}
+
+// SaveCount количество успешных сохранений на диск.
+func (f *FDB) SaveCount() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.saveCount
+}
+
 func (f *FDB) MapOrderedCounter(ctx context.Context, fun func(k string, v int64)) {
 	f.Lock()
 	defer f.Unlock()
@@ -199,39 +556,245 @@ func (f *FDB) MapOrderedGauge(ctx context.Context, fun func(k string, v float64)
 }
 
 func (f *FDB) save() (time.Time, error) {
-	jsonBody, timestamp, err := f.marshal()
+	start := f.clock.Now()
+	jsonBody, timestamp, pending, err := f.marshal()
 	if err != nil || len(jsonBody) == 0 {
 		return timestamp, err
 	}
-	err = os.WriteFile(f.filename, jsonBody, os.ModePerm)
+	err = writeFileAtomic(f.filename, func(w io.Writer) error {
+		_, err := w.Write(jsonBody)
+		return err
+	}, func() {
+		// Предыдущую версию оставляем в качестве резервной копии.
+		f.rotateBackups()
+	})
 	if err != nil {
 		return timestamp, err
 	}
-	log.Println("storage: db saved on:", timestamp)
+	f.pruneBackups()
+
+	f.Lock()
+	// Обновления, пришедшие во время записи, остаются ожидающими.
+	f.pendingWrites -= pending
+	f.saveCount++
+	f.lastSaveDuration = f.clock.Now().Sub(start)
+	f.Unlock()
+
+	logger.Debugf("storage: db saved on: %s", timestamp)
 	return timestamp, nil
 }
 
-func (f *FDB) marshal() ([]byte, time.Time, error) {
+// writeFileAtomic записывает файл через временный файл в том же каталоге:
+// данные сбрасываются на диск (fsync), после чего временный файл
+// переименовывается в filename. Если запись прервана, filename остается
+// прежним, а не записанным наполовину. beforeRename вызывается после
+// успешной записи, перед заменой файла, и не должен удалять filename:
+// переименование должно быть единственным шагом, заменяющим файл.
+func writeFileAtomic(filename string, write func(w io.Writer) error, beforeRename func()) (err error) {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, base+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if err = write(tmp); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(0o644); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if beforeRename != nil {
+		beforeRename()
+	}
+	if err = os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	// Переименование сохраняется на диске после fsync каталога.
+	// Не все системы это поддерживают, ошибка не критична.
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+func (f *FDB) marshal() ([]byte, time.Time, int, error) {
 	f.Lock()
 	defer f.Unlock()
-	jsonBody, err := json.MarshalIndent(f, "", "  ")
-	return jsonBody, f.tstamp, err
+	data, err := json.Marshal(f)
+	if err != nil {
+		return nil, f.tstamp, 0, err
+	}
+	jsonBody, err := encodeEnvelope(data)
+	return jsonBody, f.tstamp, f.pendingWrites, err
 }
 
+// load загружает данные из файла, а при его повреждении из резервных
+// копий, начиная с последней.
 func (f *FDB) load() error {
-	jsonBody, err := os.ReadFile(f.filename)
+	err := f.loadFile(f.filename)
+	if err == nil {
+		return nil
+	}
+	logger.Warnf("storage: fail on loading, trying backup: %v", err)
+	var errBackup error
+	for i := 0; i < f.backups; i++ {
+		name := backupName(f.filename, i)
+		if errBackup = f.loadFile(name); errBackup == nil {
+			logger.Infof("storage: loaded from backup %s", name)
+			return nil
+		}
+	}
+	return fmt.Errorf("%w, backup: %v", err, errBackup)
+}
+
+func (f *FDB) loadFile(filename string) error {
+	jsonBody, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	data, err := decodeEnvelope(jsonBody)
 	if err != nil {
 		return err
 	}
 
 	f.Lock()
 	defer f.Unlock()
-	if err := json.Unmarshal(jsonBody, f); err != nil {
+	if err := json.Unmarshal(data, f); err != nil {
 		return err
 	}
 	return nil
 }
 
+// DecodeDump проверяет и разбирает содержимое файла хранилища.
+func DecodeDump(jsonBody []byte) (Dump, error) {
+	data, err := decodeEnvelope(jsonBody)
+	if err != nil {
+		return Dump{}, err
+	}
+	var db fileDB
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&db); err != nil {
+		return Dump{}, err
+	}
+	return Dump{Counters: db.Counters, Gauges: db.Gauges}, nil
+}
+
+// EncodeDump кодирует метрики в формате файла хранилища, вместе
+// с количеством обновлений и временем последнего из них.
+func EncodeDump(d Dump, updateCount int, tstamp time.Time) ([]byte, error) {
+	data, err := json.Marshal(&fileDB{
+		Counters:    d.Counters,
+		Gauges:      d.Gauges,
+		UpdateCount: updateCount,
+		Tstamp:      tstamp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return encodeEnvelope(data)
+}
+
+func (f *FDB) Import(ctx context.Context, d Dump, replace bool) error {
+	f.Lock()
+	defer f.Unlock()
+	now := f.clock.Now()
+	if replace {
+		f.counters = make(map[string]int64)
+		f.gauges = make(map[string]float64)
+		f.updated = make(map[metricKey]time.Time)
+		f.observed = make(map[metricKey]time.Time)
+	}
+	for id, v := range d.Counters {
+		f.counters[id] = v
+		f.updated[metricKey{models.Counter, id}] = now
+		f.notifyCounter(id, v, now)
+	}
+	for id, v := range d.Gauges {
+		f.gauges[id] = v
+		f.updated[metricKey{models.Gauge, id}] = now
+		f.notifyGauge(id, v, now)
+	}
+	f.tstamp = now
+	f.updateCount++
+	f.pendingWrites += len(d.Counters) + len(d.Gauges)
+	return nil
+}
+
+// Compact сохраняет текущие данные и удаляет резервные копии файла.
+// Без файла хранилища ничего не делает.
+func (f *FDB) Compact(ctx context.Context) error {
+	if f.filename == "" {
+		return nil
+	}
+	if _, err := f.save(); err != nil {
+		return fmt.Errorf("cannot save: %w", err)
+	}
+	if err := os.Remove(backupName(f.filename, 0)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove backup: %w", err)
+	}
+	f.removeBackups(func(int, fs.FileInfo) bool { return true })
+	return nil
+}
+
+var errChecksum = errors.New("checksum mismatch")
+
+// fileEnvelope формат файла: данные и контрольная сумма от их
+// компактного JSON представления. Отступы на сумму не влияют.
+type fileEnvelope struct {
+	Checksum string          `json:"checksum"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// encodeEnvelope добавляет к данным контрольную сумму.
+func encodeEnvelope(data []byte) ([]byte, error) {
+	return json.MarshalIndent(&fileEnvelope{
+		Checksum: checksum(data),
+		Data:     data,
+	}, "", "  ")
+}
+
+// decodeEnvelope проверяет контрольную сумму и возвращает данные.
+// Файлы старого формата (без контрольной суммы) принимаются как есть.
+func decodeEnvelope(jsonBody []byte) ([]byte, error) {
+	var env fileEnvelope
+	if err := json.Unmarshal(jsonBody, &env); err != nil {
+		return nil, err
+	}
+	if len(env.Data) == 0 {
+		return jsonBody, nil
+	}
+
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, env.Data); err != nil {
+		return nil, err
+	}
+	if checksum(buf.Bytes()) != env.Checksum {
+		return nil, errChecksum
+	}
+	return env.Data, nil
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
 // Создаем вспомогательную структуру. В первую очередь для того, что бы
 // не открывать интерфес DB и не делать поля DB экспортируемыми
 // для спокойствия линтера.
@@ -279,15 +842,15 @@ func (f *FDB) UnmarshalJSON(data []byte) error {
 // У каждого их подходов свои особенности.
 // Их можно обсудить сразу, а можно оставить на усмотрение ментора.
 func (f *FDB) run(ctx context.Context, interval time.Duration) {
-	log.Println("storage: apply safe interval:", interval)
+	logger.Infof("storage: apply safe interval: %s", interval)
 
 	lastSaved := f.timestamp()
-	ticker := time.NewTicker(interval)
+	ticker := f.clock.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-ticker.C():
 		case <-ctx.Done():
 			return
 		}
@@ -298,12 +861,93 @@ func (f *FDB) run(ctx context.Context, interval time.Duration) {
 		var err error
 		lastSaved, err = f.save()
 		if err != nil {
-			log.Println(err)
+			logger.Errorf("storage: %v", err)
+		}
+	}
+}
+
+func (f *FDB) DeleteCounter(ctx context.Context, id string) bool {
+	return f.delete(models.Counter, id)
+}
+
+func (f *FDB) DeleteGauge(ctx context.Context, id string) bool {
+	return f.delete(models.Gauge, id)
+}
+
+// delete удаляет метрику вместе со временем обновления и измерения.
+func (f *FDB) delete(mtype, id string) bool {
+	f.Lock()
+	defer f.Unlock()
+	var ok bool
+	if mtype == models.Counter {
+		_, ok = f.counters[id]
+		delete(f.counters, id)
+	} else {
+		_, ok = f.gauges[id]
+		delete(f.gauges, id)
+	}
+	if !ok {
+		return false
+	}
+	k := metricKey{mtype, id}
+	delete(f.updated, k)
+	delete(f.observed, k)
+	f.tstamp = f.clock.Now()
+	f.updateCount++
+	f.pendingWrites++
+	return true
+}
+
+// PruneGauges удаляет датчики, не обновлявшиеся с момента before, и
+// возвращает их количество. Время обновления не сохраняется на диск,
+// поэтому для восстановленных из файла датчиков отсчет начинается
+// с первой проверки. Счетчики не удаляются (см. GaugePruner).
+func (f *FDB) PruneGauges(ctx context.Context, before time.Time) int {
+	f.Lock()
+	defer f.Unlock()
+	now := f.clock.Now()
+	pruned := 0
+	for id := range f.gauges {
+		k := metricKey{models.Gauge, id}
+		t, ok := f.updated[k]
+		if !ok {
+			f.updated[k] = now
+			continue
+		}
+		if !t.Before(before) {
+			continue
+		}
+		delete(f.gauges, id)
+		delete(f.updated, k)
+		delete(f.observed, k)
+		pruned++
+	}
+	if pruned > 0 {
+		f.tstamp = now
+		f.updateCount++
+		f.pendingWrites += pruned
+	}
+	return pruned
+}
+
+// pruneLoop проверяет датчики с периодом в половину ttl, поэтому
+// датчик удаляется не позднее чем через 1.5 ttl после обновления.
+func (f *FDB) pruneLoop(ctx context.Context, ttl time.Duration) {
+	ticker := f.clock.NewTicker(ttl / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-ctx.Done():
+			return
+		}
+		if n := f.PruneGauges(ctx, f.clock.Now().Add(-ttl)); n > 0 {
+			logger.Infof("storage: %d stale gauges pruned", n)
 		}
 	}
 }
 
 func (f *FDB) Ping(context.Context) error {
-	log.Println("file ping not impelemnted")
+	logger.Warnf("file ping not impelemnted")
 	return errors.New("not implemented")
 }
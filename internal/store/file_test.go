@@ -0,0 +1,929 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-musthave-devops-trainer/internal/clock"
+	"go-musthave-devops-trainer/internal/logger"
+	"go-musthave-devops-trainer/models"
+)
+
+func TestFDBCardinality(t *testing.T) {
+	ctx := context.Background()
+	db := NewFDB(ctx)
+
+	db.UpdateCounter(ctx, "c1", 1)
+	db.UpdateCounter(ctx, "c1", 1)
+	db.UpdateCounter(ctx, "c2", 1)
+	db.UpdateGauge(ctx, "g1", 1)
+
+	if n := db.CountCounters(ctx); n != 2 {
+		t.Errorf("want 2 counters, got %d", n)
+	}
+	if n := db.CountGauges(ctx); n != 1 {
+		t.Errorf("want 1 gauge, got %d", n)
+	}
+}
+
+func TestFDBChecksum(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "db.json")
+
+	db := NewFDB(ctx, WithFile(filename))
+	db.UpdateCounter(ctx, "c", 1)
+	if _, err := db.save(); err != nil {
+		t.Fatal(err)
+	}
+	db.UpdateCounter(ctx, "c", 1)
+	if _, err := db.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	jsonBody, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeEnvelope(jsonBody); err != nil {
+		t.Fatalf("valid file rejected: %v", err)
+	}
+
+	corrupted := strings.Replace(string(jsonBody), `"c": 2`, `"c": 3`, 1)
+	if corrupted == string(jsonBody) {
+		t.Fatalf("nothing to corrupt in:\n%s", jsonBody)
+	}
+	if _, err := decodeEnvelope([]byte(corrupted)); !errors.Is(err, errChecksum) {
+		t.Fatalf("want checksum error, got %v", err)
+	}
+	if err := os.WriteFile(filename, []byte(corrupted), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Поврежденный файл не загружается, используется резервная копия.
+	restored := NewFDB(ctx, WithFile(filename), WithRestoreOnStart(true))
+	if v, ok := restored.Counter(ctx, "c"); !ok || v != 1 {
+		t.Errorf("want counter restored from backup 1, got %d, %v", v, ok)
+	}
+}
+
+func TestFDBAtomicSave(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "db.json")
+
+	db := NewFDB(ctx, WithFile(filename))
+	db.UpdateCounter(ctx, "c", 1)
+	if _, err := db.save(); err != nil {
+		t.Fatal(err)
+	}
+	valid, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Процесс завершается посреди записи: записана половина данных.
+	errCrash := errors.New("killed")
+	err = writeFileAtomic(filename, func(w io.Writer) error {
+		if _, err := w.Write(valid[:len(valid)/2]); err != nil {
+			return err
+		}
+		return errCrash
+	}, func() {
+		t.Error("file must not be replaced after failed write")
+	})
+	if !errors.Is(err, errCrash) {
+		t.Fatalf("want crash error, got %v", err)
+	}
+
+	got, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, valid) {
+		t.Errorf("previous file is changed:\n%s", got)
+	}
+	restored := NewFDB(ctx, WithFile(filename), WithRestoreOnStart(true))
+	if v, ok := restored.Counter(ctx, "c"); !ok || v != 1 {
+		t.Errorf("want counter 1 after interrupted save, got %d, %v", v, ok)
+	}
+
+	db.UpdateCounter(ctx, "c", 1)
+	if _, err := db.save(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.Contains(e.Name(), ".tmp") {
+			t.Errorf("temporary file is left: %s", e.Name())
+		}
+	}
+	if info, err := os.Stat(filename); err != nil || info.Mode().Perm() != 0o644 {
+		t.Errorf("unexpected file mode: %v, %v", info, err)
+	}
+}
+
+func TestFDBLoadLegacyFormat(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "db.json")
+	legacy := `{"counters":{"c":5},"gauges":{"g":1.5},"update_count":2}`
+	if err := os.WriteFile(filename, []byte(legacy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	db := NewFDB(ctx, WithFile(filename), WithRestoreOnStart(true))
+	if v, ok := db.Counter(ctx, "c"); !ok || v != 5 {
+		t.Errorf("want counter 5, got %d, %v", v, ok)
+	}
+	if v, ok := db.Gauge(ctx, "g"); !ok || v != 1.5 {
+		t.Errorf("want gauge 1.5, got %f, %v", v, ok)
+	}
+}
+
+func TestFDBGet(t *testing.T) {
+	ctx := context.Background()
+	db := NewFDB(ctx)
+	db.UpdateCounter(ctx, "PollCount", 3)
+	db.UpdateGauge(ctx, "Alloc", 1.5)
+
+	m, ok, err := db.Get(ctx, models.Counter, "PollCount")
+	if err != nil || !ok || m.Delta == nil || *m.Delta != 3 || m.Value != nil {
+		t.Errorf("unexpected counter: %+v, %v, %v", m, ok, err)
+	}
+	m, ok, err = db.Get(ctx, models.Gauge, "Alloc")
+	if err != nil || !ok || m.Value == nil || *m.Value != 1.5 || m.Delta != nil {
+		t.Errorf("unexpected gauge: %+v, %v, %v", m, ok, err)
+	}
+	if _, ok, err = db.Get(ctx, models.Gauge, "PollCount"); ok || err != nil {
+		t.Errorf("missing gauge found: %v, %v", ok, err)
+	}
+	if _, _, err = db.Get(ctx, "histogram", "Alloc"); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("want ErrUnknownType, got %v", err)
+	}
+}
+
+func TestFDBIncrAndGet(t *testing.T) {
+	ctx := context.Background()
+	f := NewFDB(ctx)
+
+	const workers, incs = 8, 100
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		seen = make(map[int64]bool)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < incs; j++ {
+				total, err := f.IncrAndGet(ctx, "PollCount", 1)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				seen[total] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Каждый вызов должен вернуть свое, уникальное значение.
+	for n := int64(1); n <= workers*incs; n++ {
+		if !seen[n] {
+			t.Fatalf("total %d was never returned", n)
+		}
+	}
+	if v, _ := f.Counter(ctx, "PollCount"); v != workers*incs {
+		t.Errorf("want %d, got %d", workers*incs, v)
+	}
+}
+
+func TestFDBSaveStats(t *testing.T) {
+	ctx := context.Background()
+	db := NewFDB(ctx, WithFile(filepath.Join(t.TempDir(), "db.json")))
+
+	db.UpdateCounter(ctx, "c", 1)
+	db.UpdateGauge(ctx, "g", 1)
+	if n := db.PendingWrites(); n != 2 {
+		t.Errorf("want 2 pending writes, got %d", n)
+	}
+	if n := db.SaveCount(); n != 0 {
+		t.Errorf("want no saves, got %d", n)
+	}
+
+	if _, err := db.save(); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.PendingWrites(); n != 0 {
+		t.Errorf("want no pending writes after save, got %d", n)
+	}
+	if n := db.SaveCount(); n != 1 {
+		t.Errorf("want 1 save, got %d", n)
+	}
+	if d := db.LastSaveDuration(); d <= 0 {
+		t.Errorf("want positive save duration, got %s", d)
+	}
+
+	db.UpdateCounter(ctx, "c", 1)
+	if n := db.PendingWrites(); n != 1 {
+		t.Errorf("want 1 pending write, got %d", n)
+	}
+}
+
+func TestFDBLastUpdated(t *testing.T) {
+	ctx := context.Background()
+	db := NewFDB(ctx)
+
+	if _, ok := db.LastUpdated(ctx, models.Counter, "c"); ok {
+		t.Fatal("unexpected timestamp of unknown metric")
+	}
+	db.UpdateCounter(ctx, "c", 1)
+	first, ok := db.LastUpdated(ctx, models.Counter, "c")
+	if !ok {
+		t.Fatal("timestamp expected")
+	}
+	if _, ok := db.LastUpdated(ctx, models.Gauge, "c"); ok {
+		t.Error("timestamp must be tracked per type")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	db.UpdateCounter(ctx, "c", 1)
+	if second, _ := db.LastUpdated(ctx, models.Counter, "c"); !second.After(first) {
+		t.Errorf("timestamp must move forward: %s, %s", first, second)
+	}
+}
+
+func TestFDBNoopUpdate(t *testing.T) {
+	ctx := context.Background()
+	db := NewFDB(ctx, WithFile(filepath.Join(t.TempDir(), "db.json")))
+
+	db.UpdateGauge(ctx, "g", 1.5)
+	db.UpdateCounter(ctx, "c", 0) // новый счетчик записывается даже с нулевым значением
+	if _, err := db.save(); err != nil {
+		t.Fatal(err)
+	}
+	saved := db.timestamp()
+	count := db.UpdateCount(ctx)
+
+	time.Sleep(time.Millisecond)
+	db.UpdateGauge(ctx, "g", 1.5)
+	db.UpdateCounter(ctx, "c", 0)
+
+	// run сохраняет данные только при изменении timestamp.
+	if ts := db.timestamp(); !ts.Equal(saved) {
+		t.Errorf("no-op update must not bump timestamp: %s, %s", saved, ts)
+	}
+	if n := db.UpdateCount(ctx); n != count {
+		t.Errorf("no-op update must not bump update count: %d, %d", count, n)
+	}
+	if n := db.PendingWrites(); n != 0 {
+		t.Errorf("want no pending writes, got %d", n)
+	}
+
+	db.UpdateGauge(ctx, "g", 2.5)
+	if ts := db.timestamp(); ts.Equal(saved) {
+		t.Error("changed gauge must bump timestamp")
+	}
+}
+
+func TestFDBFakeClock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := clock.NewFake(time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC))
+	db := NewFDB(ctx,
+		WithClock(c),
+		WithInterval(time.Second),
+		WithFile(filepath.Join(t.TempDir(), "db.json")))
+
+	for i := 0; i < 100 && c.Tickers() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	waitSaves := func(n int) {
+		t.Helper()
+		for i := 0; i < 100 && db.SaveCount() != n; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		if got := db.SaveCount(); got != n {
+			t.Fatalf("want %d saves, got %d", n, got)
+		}
+	}
+
+	db.UpdateCounter(ctx, "c", 1)
+	if ts, _ := db.LastUpdated(ctx, models.Counter, "c"); !ts.Equal(c.Now()) {
+		t.Errorf("timestamp must come from the clock: %s", ts)
+	}
+	c.Advance(time.Second)
+	waitSaves(1)
+
+	// Без изменений данные не сохраняются.
+	c.Advance(time.Second)
+	db.UpdateCounter(ctx, "c", 1)
+	c.Advance(time.Second)
+	waitSaves(2)
+}
+
+func TestFDBStoreInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		autosave bool
+		log      string
+	}{
+		{"sub-second", 500 * time.Millisecond, true, "apply safe interval: 500ms"},
+		{"normal", time.Minute, true, "apply safe interval: 1m0s"},
+		{"zero", 0, false, "saved on shutdown only"},
+		{"negative", -time.Second, false, "WARN storage: negative store interval"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf syncBuffer
+			l, err := logger.New(&buf, logger.LevelInfo, logger.FormatText)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer logger.SetDefault(logger.SetDefault(l))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			c := clock.NewFake(time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC))
+			db := NewFDB(ctx, WithClock(c), WithInterval(tt.interval),
+				WithFile(filepath.Join(t.TempDir(), "db.json")))
+
+			want := 0
+			if tt.autosave {
+				want = 1
+				for i := 0; i < 100 && c.Tickers() == 0; i++ {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			db.UpdateCounter(ctx, "c", 1)
+			c.Advance(tt.interval)
+			for i := 0; i < 100 && db.SaveCount() != want; i++ {
+				time.Sleep(time.Millisecond)
+			}
+			if n := db.SaveCount(); n != want {
+				t.Errorf("want %d saves, got %d", want, n)
+			}
+			if !strings.Contains(buf.String(), tt.log) {
+				t.Errorf("want log %q, got:\n%s", tt.log, buf.String())
+			}
+
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if n := db.SaveCount(); n != want+1 {
+				t.Errorf("want save on close, got %d saves", n)
+			}
+		})
+	}
+}
+
+// syncBuffer буфер для логов, которые пишутся из фоновых горутин.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestFDBImport(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "db.json")
+	src := NewFDB(ctx, WithFile(filename))
+	src.UpdateCounter(ctx, "c1", 10)
+	src.UpdateGauge(ctx, "g1", 1.5)
+	if _, err := src.save(); err != nil {
+		t.Fatal(err)
+	}
+	jsonBody, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump, err := DecodeDump(jsonBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newDB := func() *FDB {
+		db := NewFDB(ctx)
+		db.UpdateCounter(ctx, "c1", 1)
+		db.UpdateCounter(ctx, "c2", 2)
+		return db
+	}
+
+	t.Run("merge", func(t *testing.T) {
+		db := newDB()
+		if err := db.Import(ctx, dump, false); err != nil {
+			t.Fatal(err)
+		}
+		if v, _ := db.Counter(ctx, "c1"); v != 10 {
+			t.Errorf("imported counter must be overwritten, got %d", v)
+		}
+		if v, ok := db.Counter(ctx, "c2"); !ok || v != 2 {
+			t.Errorf("other counters must be kept, got %d, %v", v, ok)
+		}
+		if v, _ := db.Gauge(ctx, "g1"); v != 1.5 {
+			t.Errorf("want imported gauge, got %v", v)
+		}
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		db := newDB()
+		if err := db.Import(ctx, dump, true); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := db.Counter(ctx, "c2"); ok {
+			t.Error("counters missing from the file must be removed")
+		}
+		if v, _ := db.Counter(ctx, "c1"); v != 10 {
+			t.Errorf("want imported counter, got %d", v)
+		}
+	})
+}
+
+func TestDecodeDumpInvalid(t *testing.T) {
+	for _, data := range []string{
+		`not json`,
+		`{"foo": 1}`,
+		`{"checksum": "bad", "data": {"counters": {"c": 1}}}`,
+		`{"counters": {"c": "one"}}`,
+	} {
+		if _, err := DecodeDump([]byte(data)); err == nil {
+			t.Errorf("want error for %s", data)
+		}
+	}
+}
+
+func TestFDBSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := NewFDB(ctx)
+
+	changes := db.Subscribe(ctx)
+	db.UpdateCounter(ctx, "c", 2)
+	db.UpdateCounter(ctx, "c", 3)
+	db.UpdateGauge(ctx, "g", 1.5)
+	db.UpdateGauge(ctx, "g", 1.5) // значение не изменилось, события нет
+
+	want := []string{"counter c=2", "counter c=5", "gauge g=1.5"}
+	for _, w := range want {
+		select {
+		case c := <-changes:
+			got := fmt.Sprintf("%s %s=", c.Metric.MType, c.Metric.ID)
+			if c.Metric.Delta != nil {
+				got += fmt.Sprint(*c.Metric.Delta)
+			} else {
+				got += fmt.Sprint(*c.Metric.Value)
+			}
+			if got != w {
+				t.Errorf("want %q, got %q", w, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event for %q", w)
+		}
+	}
+	select {
+	case c := <-changes:
+		t.Errorf("unexpected event: %+v", c)
+	default:
+	}
+
+	cancel()
+	for range changes {
+	}
+}
+
+func TestFDBSubscribeSlowConsumer(t *testing.T) {
+	ctx := context.Background()
+	db := NewFDB(ctx)
+
+	subCtx, cancel := context.WithCancel(ctx)
+	changes := db.Subscribe(subCtx)
+
+	// Подписчик не читает события, запись не должна блокироваться.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10*subscriberBuffer; i++ {
+			db.UpdateCounter(ctx, "c", 1)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("writer blocked by slow subscriber")
+	}
+	if n := len(changes); n != subscriberBuffer {
+		t.Errorf("want %d buffered events, got %d", subscriberBuffer, n)
+	}
+
+	cancel()
+	for range changes {
+	}
+	db.Lock()
+	defer db.Unlock()
+	if len(db.subscribers) != 0 {
+		t.Error("subscriber must be removed after cancel")
+	}
+}
+
+func TestFDBGaugeTTL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := clock.NewFake(time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC))
+	db := NewFDB(ctx, WithClock(c), WithGaugeTTL(time.Minute))
+
+	db.UpdateCounter(ctx, "idle", 1)
+	db.UpdateCounter(ctx, "busy", 1)
+	db.UpdateGauge(ctx, "stale", 1)
+	db.UpdateGauge(ctx, "fresh", 1)
+
+	c.Advance(50 * time.Second)
+	db.UpdateGauge(ctx, "fresh", 2)
+	db.UpdateCounter(ctx, "busy", 1)
+	c.Advance(20 * time.Second)
+
+	if n := db.PruneGauges(ctx, c.Now().Add(-time.Minute)); n != 1 {
+		t.Errorf("want 1 pruned gauge, got %d", n)
+	}
+	if _, ok, _ := db.Get(ctx, models.Gauge, "stale"); ok {
+		t.Error("stale gauge must be pruned")
+	}
+	if m, ok, _ := db.Get(ctx, models.Gauge, "fresh"); !ok || *m.Value != 2 {
+		t.Errorf("fresh gauge must be kept, got %+v, %v", m, ok)
+	}
+
+	// Счетчики не удаляются, даже если давно не обновлялись.
+	c.Advance(time.Hour)
+	db.PruneGauges(ctx, c.Now().Add(-time.Minute))
+	if m, ok, _ := db.Get(ctx, models.Counter, "idle"); !ok || *m.Delta != 1 {
+		t.Errorf("idle counter must be kept, got %+v, %v", m, ok)
+	}
+	if m, ok, _ := db.Get(ctx, models.Counter, "busy"); !ok || *m.Delta != 2 {
+		t.Errorf("busy counter must be kept, got %+v, %v", m, ok)
+	}
+	if _, ok, _ := db.Get(ctx, models.Gauge, "fresh"); ok {
+		t.Error("fresh gauge must expire too")
+	}
+}
+
+func TestFDBDelete(t *testing.T) {
+	ctx := context.Background()
+	db := NewFDB(ctx)
+	db.UpdateCounter(ctx, "m", 3)
+	db.UpdateGauge(ctx, "m", 1.5)
+	count := db.UpdateCount(ctx)
+
+	if !db.DeleteCounter(ctx, "m") {
+		t.Error("existing counter must be deleted")
+	}
+	if db.DeleteCounter(ctx, "m") {
+		t.Error("missing counter must not be deleted")
+	}
+	if _, ok := db.Counter(ctx, "m"); ok {
+		t.Error("deleted counter is still readable")
+	}
+	if _, ok := db.LastUpdated(ctx, models.Counter, "m"); ok {
+		t.Error("update time of deleted counter is kept")
+	}
+	if v, ok := db.Gauge(ctx, "m"); !ok || v != 1.5 {
+		t.Errorf("gauge with the same name must be kept, got %v, %v", v, ok)
+	}
+	if n := db.UpdateCount(ctx); n != count+1 {
+		t.Errorf("deletion must be saved: want update count %d, got %d", count+1, n)
+	}
+	if !db.DeleteGauge(ctx, "m") || db.CountGauges(ctx) != 0 {
+		t.Error("existing gauge must be deleted")
+	}
+}
+
+func TestFDBCompact(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	filename := filepath.Join(t.TempDir(), "db.json")
+	db := NewFDB(ctx, WithInterval(-1), WithFile(filename))
+
+	db.UpdateCounter(ctx, "c", 1)
+	if _, err := db.save(); err != nil {
+		t.Fatal(err)
+	}
+	db.UpdateCounter(ctx, "c", 1)
+	if _, err := db.save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(backupName(filename, 0)); err != nil {
+		t.Fatalf("backup expected: %v", err)
+	}
+
+	db.UpdateGauge(ctx, "g", 1.5)
+	if err := db.Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(backupName(filename, 0)); !os.IsNotExist(err) {
+		t.Errorf("backup must be removed, got %v", err)
+	}
+	restored := NewFDB(ctx, WithInterval(-1), WithRestoreOnStart(true), WithFile(filename))
+	if v, ok := restored.Counter(ctx, "c"); !ok || v != 2 {
+		t.Errorf("want counter 2, got %d, %v", v, ok)
+	}
+	if v, ok := restored.Gauge(ctx, "g"); !ok || v != 1.5 {
+		t.Errorf("want gauge 1.5, got %f, %v", v, ok)
+	}
+}
+
+func TestFDBExists(t *testing.T) {
+	ctx := context.Background()
+	db := NewFDB(ctx)
+	db.UpdateCounter(ctx, "PollCount", 0)
+	db.UpdateGauge(ctx, "Alloc", 0)
+
+	tests := []struct {
+		mtype, id string
+		want      bool
+	}{
+		{models.Counter, "PollCount", true},
+		{models.Gauge, "Alloc", true},
+		{models.Counter, "Alloc", false},
+		{models.Gauge, "Missing", false},
+	}
+	for _, tt := range tests {
+		if ok, err := db.Exists(ctx, tt.mtype, tt.id); err != nil || ok != tt.want {
+			t.Errorf("%s %s: want %v, got %v, %v", tt.mtype, tt.id, tt.want, ok, err)
+		}
+	}
+	if _, err := db.Exists(ctx, "histogram", "Alloc"); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("want ErrUnknownType, got %v", err)
+	}
+}
+
+func TestFDBBackupRetention(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "db.json")
+	exists := func(name string) bool {
+		_, err := os.Stat(name)
+		return err == nil
+	}
+
+	db := NewFDB(ctx, WithInterval(-1), WithBackups(3, 0), WithFile(filename))
+	for i := 0; i < 5; i++ {
+		db.UpdateCounter(ctx, "c", 1)
+		if _, err := db.save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if !exists(backupName(filename, i)) {
+			t.Errorf("backup %d expected", i)
+		}
+	}
+	if exists(backupName(filename, 3)) {
+		t.Error("backup beyond retention must not exist")
+	}
+
+	// Копии сверх нового количества удаляются при сохранении.
+	db = NewFDB(ctx, WithInterval(-1), WithBackups(2, 0), WithFile(filename))
+	if _, err := db.save(); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(backupName(filename, 1)) || exists(backupName(filename, 2)) {
+		t.Error("want backups beyond count of 2 removed")
+	}
+
+	// Устаревшие копии удаляются, последняя хранится всегда.
+	old := time.Now().Add(-2 * time.Hour)
+	for i := 0; i < 2; i++ {
+		if err := os.Chtimes(backupName(filename, i), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db = NewFDB(ctx, WithInterval(-1), WithBackups(3, time.Hour), WithFile(filename))
+	if err := os.Chtimes(filename, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.save(); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(backupName(filename, 0)) {
+		t.Error("last backup must be kept regardless of age")
+	}
+	for i := 1; i < 3; i++ {
+		if exists(backupName(filename, i)) {
+			t.Errorf("stale backup %d must be removed", i)
+		}
+	}
+}
+
+func TestFDBBackupKeepsFile(t *testing.T) {
+	ctx := context.Background()
+	filename := filepath.Join(t.TempDir(), "db.json")
+	db := NewFDB(ctx, WithInterval(-1), WithBackups(2, 0), WithFile(filename))
+	db.UpdateCounter(ctx, "c", 1)
+	if _, err := db.save(); err != nil {
+		t.Fatal(err)
+	}
+	valid, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Между созданием копии и заменой файла он должен оставаться на месте.
+	db.rotateBackups()
+	for _, name := range []string{filename, backupName(filename, 0)} {
+		if got, err := os.ReadFile(name); err != nil || !bytes.Equal(got, valid) {
+			t.Errorf("%s: want saved data, got %q, %v", name, got, err)
+		}
+	}
+
+	// Новое сохранение не меняет копию, связанную с прежним файлом.
+	db.UpdateCounter(ctx, "c", 1)
+	if _, err := db.save(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(backupName(filename, 0)); !bytes.Equal(got, valid) {
+		t.Errorf("backup is changed by save:\n%s", got)
+	}
+}
+
+func TestFDBLoadOlderBackup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	filename := filepath.Join(t.TempDir(), "db.json")
+
+	db := NewFDB(ctx, WithInterval(-1), WithBackups(2, 0), WithFile(filename))
+	db.UpdateCounter(ctx, "c", 1)
+	if _, err := db.save(); err != nil {
+		t.Fatal(err)
+	}
+	db.UpdateCounter(ctx, "c", 1)
+	if _, err := db.save(); err != nil {
+		t.Fatal(err)
+	}
+	db.UpdateCounter(ctx, "c", 1)
+	if _, err := db.save(); err != nil {
+		t.Fatal(err)
+	}
+	// Повреждены файл и последняя копия, данные берутся из более старой.
+	for _, name := range []string{filename, backupName(filename, 0)} {
+		if err := os.WriteFile(name, []byte("{"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	restored := NewFDB(ctx, WithInterval(-1), WithRestoreOnStart(true), WithBackups(2, 0), WithFile(filename))
+	if v, ok := restored.Counter(ctx, "c"); !ok || v != 1 {
+		t.Errorf("want counter 1 from older backup, got %d, %v", v, ok)
+	}
+}
+
+func TestFDBWithTx(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	db := NewFDB(ctx)
+	db.UpdateCounter(ctx, "c", 1)
+	db.UpdateGauge(ctx, "g", 1)
+	changes := db.Subscribe(ctx)
+	errFail := errors.New("fail")
+
+	// Ошибка откатывает все изменения транзакции.
+	err := db.WithTx(ctx, func(tx Store) error {
+		tx.UpdateCounter(ctx, "c", 10)
+		tx.UpdateGauge(ctx, "g", 2)
+		tx.UpdateGauge(ctx, "new", 3)
+		return errFail
+	})
+	if !errors.Is(err, errFail) {
+		t.Fatalf("want errFail, got %v", err)
+	}
+	if v, _ := db.Counter(ctx, "c"); v != 1 {
+		t.Errorf("counter not rolled back: %d", v)
+	}
+	if v, _ := db.Gauge(ctx, "g"); v != 1 {
+		t.Errorf("gauge not rolled back: %v", v)
+	}
+	if ok, _ := db.Exists(ctx, models.Gauge, "new"); ok {
+		t.Error("new gauge not rolled back")
+	}
+	if n := db.PendingWrites(); n != 2 {
+		t.Errorf("want 2 pending writes, got %d", n)
+	}
+	select {
+	case c := <-changes:
+		t.Errorf("unexpected event after rollback: %+v", c)
+	default:
+	}
+
+	// Без ошибки изменения применяются, чтение внутри видит запись.
+	err = db.WithTx(ctx, func(tx Store) error {
+		v, _ := tx.Counter(ctx, "c")
+		tx.UpdateGauge(ctx, "g", float64(v*2))
+		_, err := tx.IncrAndGet(ctx, "c", 4)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := db.Counter(ctx, "c"); v != 5 {
+		t.Errorf("want counter 5, got %d", v)
+	}
+	if v, _ := db.Gauge(ctx, "g"); v != 2 {
+		t.Errorf("want gauge 2, got %v", v)
+	}
+	if n := db.PendingWrites(); n != 4 {
+		t.Errorf("want 4 pending writes, got %d", n)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-changes:
+		case <-time.After(time.Second):
+			t.Fatal("no event after commit")
+		}
+	}
+}
+
+func TestFDBStrictRestore(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	open := func(filename string) (*FDB, error) {
+		return OpenFDB(ctx, WithInterval(-1), WithRestoreOnStart(true), WithStrictRestore(true), WithFile(filename))
+	}
+
+	t.Run("first run", func(t *testing.T) {
+		db, err := open(filepath.Join(t.TempDir(), "db.json"))
+		if err != nil {
+			t.Fatalf("missing file must not fail: %v", err)
+		}
+		if n := db.CountCounters(ctx); n != 0 {
+			t.Errorf("want empty storage, got %d counters", n)
+		}
+	})
+
+	t.Run("killed before first save", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "db.json")
+		// Первый запуск создает пустой файл, процесс завершается без сохранения.
+		if _, err := open(filename); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := os.Stat(filename); err != nil || info.Size() != 0 {
+			t.Fatalf("empty file expected after start: %v", err)
+		}
+		if _, err := open(filename); err != nil {
+			t.Fatalf("empty file must not fail: %v", err)
+		}
+	})
+
+	t.Run("corrupt file", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "db.json")
+		if err := os.WriteFile(filename, []byte("{"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := open(filename); !errors.Is(err, ErrRestore) {
+			t.Fatalf("want ErrRestore, got %v", err)
+		}
+		// Без строгого режима запуск продолжается с пустым хранилищем.
+		db, err := OpenFDB(ctx, WithInterval(-1), WithRestoreOnStart(true), WithFile(filename))
+		if err != nil || db.CountCounters(ctx) != 0 {
+			t.Fatalf("want empty storage, got %v", err)
+		}
+	})
+
+	t.Run("good file", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "db.json")
+		db := NewFDB(ctx, WithInterval(-1), WithFile(filename))
+		db.UpdateCounter(ctx, "c", 3)
+		if _, err := db.save(); err != nil {
+			t.Fatal(err)
+		}
+		restored, err := open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v, ok := restored.Counter(ctx, "c"); !ok || v != 3 {
+			t.Errorf("want counter 3, got %d, %v", v, ok)
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrLocked файл хранилища используется другим процессом.
+var ErrLocked = errors.New("store file is locked by another process")
+
+// FileLock рекомендательная блокировка файла хранилища: пока она
+// удерживается, другой процесс не может открыть тот же файл через
+// AcquireLock. В файле блокировки записан PID владельца.
+type FileLock struct {
+	f *os.File
+}
+
+// AcquireLock захватывает блокировку filename.lock, не дожидаясь ее
+// освобождения. Если файл уже используется, возвращает ErrLocked.
+func AcquireLock(filename string) (*FileLock, error) {
+	name := filename + ".lock"
+	if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open lock file: %w", err)
+	}
+	locked, err := lockFile(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot lock %s: %w", name, err)
+	}
+	if !locked {
+		pid, _ := io.ReadAll(io.LimitReader(f, 32))
+		f.Close()
+		return nil, fmt.Errorf("%w: %s, pid: %s", ErrLocked, filename, strings.TrimSpace(string(pid)))
+	}
+
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &FileLock{f: f}, nil
+}
+
+// Release освобождает блокировку. Файл блокировки не удаляется, что бы
+// не разойтись с процессом, который уже открыл его и ждет захвата.
+func (l *FileLock) Release() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	_ = l.f.Truncate(0)
+	err := unlockFile(l.f)
+	if errClose := l.f.Close(); err == nil {
+		err = errClose
+	}
+	l.f = nil
+	return err
+}
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// TestLockHelperProcess захватывает блокировку в отдельном процессе
+// для TestAcquireLock, сам по себе ничего не проверяет.
+func TestLockHelperProcess(t *testing.T) {
+	filename := os.Getenv("STORE_LOCK_FILE")
+	if filename == "" {
+		return
+	}
+	if _, err := AcquireLock(filename); err != nil {
+		if errors.Is(err, ErrLocked) {
+			os.Exit(3)
+		}
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+func TestAcquireLock(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file lock is not implemented on windows")
+	}
+	filename := filepath.Join(t.TempDir(), "db.json")
+	lock, err := AcquireLock(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := func() int {
+		t.Helper()
+		cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelperProcess$")
+		cmd.Env = append(os.Environ(), "STORE_LOCK_FILE="+filename)
+		err := cmd.Run()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return 0
+	}
+
+	if code := second(); code != 3 {
+		t.Errorf("second process must be rejected with ErrLocked, exit code %d", code)
+	}
+	_, err = AcquireLock(filename)
+	if !errors.Is(err, ErrLocked) || !strings.Contains(err.Error(), "pid:") {
+		t.Errorf("want ErrLocked with owner pid, got %v", err)
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if code := second(); code != 0 {
+		t.Errorf("lock must be free after release, exit code %d", code)
+	}
+}
@@ -0,0 +1,12 @@
+package store
+
+import "os"
+
+// lockFile на Windows не реализован, блокировка всегда успешна.
+func lockFile(f *os.File) (bool, error) {
+	return true, nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -3,155 +3,834 @@ package store
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"go-musthave-devops-trainer/internal/logger"
+	"go-musthave-devops-trainer/models"
+
+	"github.com/jackc/pgx"
 )
 
 type RDB struct {
 	db *sql.DB
+	// conn выполняет запросы: база или транзакция, см. WithTx.
+	conn   querier
+	tx     *sql.Tx
+	health health
+	// Чтение снимка в транзакции REPEATABLE READ, см. WithConsistentReads.
+	consistentReads bool
+	// Ограничение времени одной операции, 0 - без ограничения.
+	opTimeout time.Duration
+}
+
+type rdbOption func(*RDB)
+
+// WithConsistentReads читает снимок метрик (Snapshot) в одной транзакции
+// REPEATABLE READ, что бы параллельное пакетное обновление не было видно
+// частично. Транзакция удерживает снимок базы на время чтения.
+func WithConsistentReads(consistent bool) rdbOption {
+	return func(r *RDB) {
+		r.consistentReads = consistent
+	}
+}
+
+// WithOpTimeout ограничивает время каждой операции хранилища, в том числе
+// вызванной с context.Background(). Операции в WithTx ограничиваются
+// по отдельности, Compact (VACUUM) и Bootstrap не ограничиваются.
+func WithOpTimeout(d time.Duration) rdbOption {
+	return func(r *RDB) {
+		r.opTimeout = d
+	}
+}
+
+// withTimeout контекст операции с учетом WithOpTimeout.
+func (r *RDB) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.opTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, r.opTimeout)
+}
+
+// retryIntervals паузы перед повторами операции после временной ошибки базы.
+var retryIntervals = []time.Duration{time.Second, 3 * time.Second, 5 * time.Second}
+
+// isRetriable временная ошибка базы: потеря соединения или ошибка
+// сериализации транзакции (40001). Разрыв соединения pgx сообщает
+// сетевой ошибкой, io.EOF/io.ErrUnexpectedEOF или driver.ErrBadConn,
+// а ошибку с кодом класса 08 возвращает сам сервер.
+//
+// Запрос, прерванный потерей соединения, мог быть выполнен базой до
+// разрыва, поэтому повтор увеличения счетчика может учесть его дважды.
+func isRetriable(err error) bool {
+	var pgErr pgx.PgError
+	if errors.As(err, &pgErr) {
+		return strings.HasPrefix(pgErr.Code, "08") || pgErr.Code == "40001"
+	}
+	var netErr *net.OpError
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, driver.ErrBadConn)
+}
+
+// withRetry выполняет fn, повторяя ее после пауз retryIntervals,
+// пока fn завершается временной ошибкой (см. isRetriable). Остальные
+// ошибки и отмена ctx возвращаются сразу.
+func withRetry(ctx context.Context, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !isRetriable(err) || attempt >= len(retryIntervals) || ctx.Err() != nil {
+			return err
+		}
+		logger.Warnf("rdb: %v, retry in %s", err, retryIntervals[attempt])
+		t := time.NewTimer(retryIntervals[attempt])
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+// retry выполняет fn через withRetry. В транзакции (см. WithTx) после
+// ошибки выполнять запросы бессмысленно, fn выполняется один раз.
+func (r *RDB) retry(ctx context.Context, fn func() error) error {
+	if r.tx != nil {
+		return fn()
+	}
+	return withRetry(ctx, fn)
+}
+
+// health отслеживает потерю соединения с базой. Пока соединение не
+// восстановлено, запросы не выполняются и завершаются ErrUnavailable.
+type health struct {
+	sync.Mutex
+	degraded bool
+	since    time.Time
 }
 
-func NewRDB(db *sql.DB) *RDB {
-	return &RDB{
-		db: db,
+// NewRDB хранилище в PostgreSQL. Время обновления метрик в таблице
+// не хранится, поэтому удаление устаревших датчиков (GaugePruner)
+// не поддерживается; счетчики, как и в FDB, не удаляются никогда.
+func NewRDB(db *sql.DB, opts ...rdbOption) *RDB {
+	r := &RDB{
+		db:   db,
+		conn: db,
+	}
+	for _, opt := range opts {
+		opt(r)
 	}
+	return r
 }
 
-// Bootstrap creates all necessary tables and their structures
+// schema таблицы хранилища, общие для RDB и SQLite: метрики
+// и единственная строка meta с поколением данных и временем обновления.
+const schema = `
+	CREATE TABLE IF NOT EXISTS metrics (
+		id varchar PRIMARY KEY,
+		type varchar,
+		delta bigint,
+		value double precision
+	);
+	CREATE TABLE IF NOT EXISTS meta (
+		id int PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+		generation bigint NOT NULL DEFAULT 0,
+		updated_at timestamptz
+	);
+	INSERT INTO meta (id) VALUES (1) ON CONFLICT (id) DO NOTHING;
+`
+
+// Bootstrap creates all necessary tables and their structures,
+// transient errors are retried (see withRetry)
 func (r *RDB) Bootstrap(ctx context.Context) error {
-	query := `
-		CREATE TABLE IF NOT EXISTS metrics (
-			id varchar PRIMARY KEY,
-			type varchar,
-			delta bigint,
-			value double precision
-		);
-	`
+	return withRetry(ctx, func() error {
+		tx, err := r.db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("cannot start transaction: %w", err)
+		}
+		defer tx.Rollback()
+
+		_, err = tx.ExecContext(ctx, schema)
+		if err != nil {
+			return fmt.Errorf("cannot create `urls` table: %w", err)
+		}
 
-	tx, err := r.db.BeginTx(ctx, nil)
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("cannot commit transaction: %w", err)
+		}
+		return nil
+	})
+}
+
+// Close для хранилища транзакции (см. WithTx) ничего не делает,
+// соединение закрывает исходное хранилище.
+func (r *RDB) Close() error {
+	if r.tx != nil {
+		return nil
+	}
+	return r.db.Close()
+}
+
+// WithTx выполняет fn в транзакции базы, ошибка fn или фиксации
+// откатывает все изменения. Вложенный вызов выполняется в той же
+// транзакции. Compact в транзакции не выполняется (VACUUM).
+func (r *RDB) WithTx(ctx context.Context, fn func(tx Store) error) error {
+	if r.tx != nil {
+		return fn(r)
+	}
+	if r.Degraded() {
+		return ErrUnavailable
+	}
+	return r.inTx(ctx, nil, func(tx *sql.Tx) error {
+		return fn(&RDB{db: r.db, conn: tx, tx: tx, consistentReads: r.consistentReads, opTimeout: r.opTimeout})
+	})
+}
+
+// inTx выполняет fn в новой транзакции или, для хранилища транзакции,
+// в текущей (opts при этом не применяются).
+func (r *RDB) inTx(ctx context.Context, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	if r.tx != nil {
+		return fn(r.tx)
+	}
+	tx, err := r.db.BeginTx(ctx, opts)
 	if err != nil {
 		return fmt.Errorf("cannot start transaction: %w", err)
 	}
 	defer tx.Rollback()
-
-	_, err = tx.ExecContext(ctx, query)
-	if err != nil {
-		return fmt.Errorf("cannot create `urls` table: %w", err)
+	if err := fn(tx); err != nil {
+		return err
 	}
-
 	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("cannot commit transaction: %w", err)
 	}
 	return nil
 }
 
-func (r *RDB) Close() error {
-	return r.db.Close()
+func (r *RDB) Ping(ctx context.Context) error {
+	return r.checkHealth(ctx)
 }
 
-func (r *RDB) Ping(ctx context.Context) error {
-	return r.db.PingContext(ctx)
+// Degraded сообщает, что соединение с базой потеряно.
+func (r *RDB) Degraded() bool {
+	r.health.Lock()
+	defer r.health.Unlock()
+	return r.health.degraded
+}
+
+// Subscribe для базы не поддерживается: изменения могут вносить другие
+// экземпляры сервера, поэтому события не рассылаются. Канал только
+// закрывается после отмены ctx, подписчикам нужно опрашивать хранилище.
+func (r *RDB) Subscribe(ctx context.Context) <-chan MetricChange {
+	ch := make(chan MetricChange)
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch
+}
+
+// Watch периодически проверяет соединение с базой до отмены контекста.
+func (r *RDB) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, interval)
+		_ = r.checkHealth(pingCtx)
+		cancel()
+	}
+}
+
+func (r *RDB) checkHealth(ctx context.Context) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	err := r.db.PingContext(ctx)
+
+	r.health.Lock()
+	defer r.health.Unlock()
+	switch {
+	case err != nil && !r.health.degraded:
+		r.health.degraded = true
+		r.health.since = time.Now()
+		logger.Warnf("RDB: connection lost, storage degraded: %v", err)
+	case err == nil && r.health.degraded:
+		r.health.degraded = false
+		logger.Infof("RDB: connection restored after %s", time.Since(r.health.since))
+	}
+	return err
 }
 
 func (r *RDB) Counter(ctx context.Context, id string) (int64, bool) {
-	log.Printf("RDB Counter: %s\n", id)
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	logger.Debugf("RDB Counter: %s\n", id)
+	if r.Degraded() {
+		return 0, false
+	}
 
 	var delta int64
 	query := `SELECT delta FROM metrics WHERE id = $1;`
-	err := r.db.QueryRowContext(ctx, query, id).Scan(&delta)
+	err := r.conn.QueryRowContext(ctx, query, id).Scan(&delta)
 	if err != nil {
-		log.Printf("RDB Counter: %s, error: %v\n", id, err)
-		if errors.Is(err, sql.ErrNoRows) {
-			return 0, true
+		if !errors.Is(err, sql.ErrNoRows) {
+			logger.Errorf("RDB Counter: %s, error: %v\n", id, err)
 		}
 		return 0, false
 	}
-	log.Printf("RDB Counter: %s, result: %d\n", id, delta)
+	logger.Debugf("RDB Counter: %s, result: %d\n", id, delta)
 	return delta, true
 }
 
 func (r *RDB) Gauge(ctx context.Context, id string) (float64, bool) {
-	log.Printf("RDB Gauge: %s\n", id)
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	logger.Debugf("RDB Gauge: %s\n", id)
+	if r.Degraded() {
+		return 0, false
+	}
 
 	var value float64
 	query := `SELECT value FROM metrics WHERE id = $1;`
-	err := r.db.QueryRowContext(ctx, query, id).Scan(&value)
+	err := r.conn.QueryRowContext(ctx, query, id).Scan(&value)
 	if err != nil {
-		log.Printf("RDB Gauge: %s, error: %v\n", id, err)
-		if errors.Is(err, sql.ErrNoRows) {
-			return 0, true
+		if !errors.Is(err, sql.ErrNoRows) {
+			logger.Errorf("RDB Gauge: %s, error: %v\n", id, err)
 		}
-		log.Printf("RDB Gauge: %s\n", id)
 		return 0, false
 	}
-	log.Printf("RDB Gauge: %s, result: %0.3f\n", id, value)
+	logger.Debugf("RDB Gauge: %s, result: %0.3f\n", id, value)
 	return value, true
 }
 
+func (r *RDB) Get(ctx context.Context, mtype, id string) (models.Metrics, bool, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	m := models.Metrics{ID: id, MType: mtype}
+
+	var query string
+	switch mtype {
+	case models.Counter:
+		query = `SELECT delta FROM metrics WHERE id = $1 AND type = $2;`
+		m.Delta = new(int64)
+	case models.Gauge:
+		query = `SELECT value FROM metrics WHERE id = $1 AND type = $2;`
+		m.Value = new(float64)
+	default:
+		return m, false, ErrUnknownType
+	}
+	if r.Degraded() {
+		return models.Metrics{ID: id, MType: mtype}, false, ErrUnavailable
+	}
+
+	row := r.conn.QueryRowContext(ctx, query, id, mtype)
+	var err error
+	if m.Delta != nil {
+		err = row.Scan(m.Delta)
+	} else {
+		err = row.Scan(m.Value)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Metrics{ID: id, MType: mtype}, false, nil
+	}
+	if err != nil {
+		return m, false, fmt.Errorf("cannot get %s %q: %w", mtype, id, err)
+	}
+	return m, true, nil
+}
+
+func (r *RDB) Exists(ctx context.Context, mtype, id string) (bool, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	if mtype != models.Counter && mtype != models.Gauge {
+		return false, ErrUnknownType
+	}
+	if r.Degraded() {
+		return false, ErrUnavailable
+	}
+
+	var one int
+	query := `SELECT 1 FROM metrics WHERE id = $1 AND type = $2;`
+	err := r.conn.QueryRowContext(ctx, query, id, mtype).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot check %s %q: %w", mtype, id, err)
+	}
+	return true, nil
+}
+
+func (r *RDB) CountCounters(ctx context.Context) int {
+	return r.count(ctx, models.Counter)
+}
+
+func (r *RDB) CountGauges(ctx context.Context) int {
+	return r.count(ctx, models.Gauge)
+}
+
+func (r *RDB) count(ctx context.Context, mtype string) int {
+	count, err := r.Count(ctx, mtype)
+	if err != nil {
+		logger.Errorf("RDB count %s, error: %v\n", mtype, err)
+	}
+	return count
+}
+
+// Count количество метрик типа mtype, см. CardinalityChecker.
+func (r *RDB) Count(ctx context.Context, mtype string) (int, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	if r.Degraded() {
+		return 0, ErrUnavailable
+	}
+	var count int
+	query := `SELECT count(*) FROM metrics WHERE type = $1;`
+	if err := r.conn.QueryRowContext(ctx, query, mtype).Scan(&count); err != nil {
+		return 0, fmt.Errorf("cannot count %s: %w", mtype, err)
+	}
+	return count, nil
+}
+
+// Snapshot читает все метрики: счетчики и датчики отдельными запросами,
+// при включенном WithConsistentReads - в одной транзакции только для чтения.
+func (r *RDB) Snapshot(ctx context.Context) (Dump, error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	if r.Degraded() {
+		return Dump{}, ErrUnavailable
+	}
+	if !r.consistentReads {
+		return readSnapshot(ctx, r.conn)
+	}
+
+	var d Dump
+	err := r.inTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true}, func(tx *sql.Tx) error {
+		var err error
+		d, err = readSnapshot(ctx, tx)
+		return err
+	})
+	if err != nil {
+		return Dump{}, err
+	}
+	return d, nil
+}
+
+// querier общие методы *sql.DB и *sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func readSnapshot(ctx context.Context, q querier) (Dump, error) {
+	d := Dump{Counters: make(map[string]int64), Gauges: make(map[string]float64)}
+
+	rows, err := q.QueryContext(ctx, `SELECT id, delta FROM metrics WHERE type = 'counter';`)
+	if err != nil {
+		return Dump{}, fmt.Errorf("cannot read counters: %w", err)
+	}
+	for rows.Next() {
+		var (
+			id    string
+			delta int64
+		)
+		if err := rows.Scan(&id, &delta); err != nil {
+			rows.Close()
+			return Dump{}, fmt.Errorf("cannot read counters: %w", err)
+		}
+		d.Counters[id] = delta
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return Dump{}, fmt.Errorf("cannot read counters: %w", err)
+	}
+
+	rows, err = q.QueryContext(ctx, `SELECT id, value FROM metrics WHERE type = 'gauge';`)
+	if err != nil {
+		return Dump{}, fmt.Errorf("cannot read gauges: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id    string
+			value float64
+		)
+		if err := rows.Scan(&id, &value); err != nil {
+			return Dump{}, fmt.Errorf("cannot read gauges: %w", err)
+		}
+		d.Gauges[id] = value
+	}
+	if err := rows.Err(); err != nil {
+		return Dump{}, fmt.Errorf("cannot read gauges: %w", err)
+	}
+	return d, nil
+}
+
+// MapOrderedCounter вызывает fun для каждого счетчика в порядке имен,
+// как и FDB. Ошибки чтения записываются в лог, обход прерывается.
 func (r *RDB) MapOrderedCounter(ctx context.Context, fun func(k string, v int64)) {
-	log.Println("RDB MapOrderedCounter not implemented")
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	if r.Degraded() {
+		logger.Errorf("RDB MapOrderedCounter: %v", ErrUnavailable)
+		return
+	}
+	rows, err := r.conn.QueryContext(ctx, `SELECT id, delta FROM metrics WHERE type = 'counter' ORDER BY id;`)
+	if err != nil {
+		logger.Errorf("RDB MapOrderedCounter: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id    string
+			delta int64
+		)
+		if err := rows.Scan(&id, &delta); err != nil {
+			logger.Errorf("RDB MapOrderedCounter: %v", err)
+			return
+		}
+		fun(id, delta)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Errorf("RDB MapOrderedCounter: %v", err)
+	}
 }
 
+// MapOrderedGauge вызывает fun для каждого датчика в порядке имен.
 func (r *RDB) MapOrderedGauge(ctx context.Context, fun func(k string, v float64)) {
-	log.Println("RDB MapOrderedGauge not implemented")
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	if r.Degraded() {
+		logger.Errorf("RDB MapOrderedGauge: %v", ErrUnavailable)
+		return
+	}
+	rows, err := r.conn.QueryContext(ctx, `SELECT id, value FROM metrics WHERE type = 'gauge' ORDER BY id;`)
+	if err != nil {
+		logger.Errorf("RDB MapOrderedGauge: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id    string
+			value float64
+		)
+		if err := rows.Scan(&id, &value); err != nil {
+			logger.Errorf("RDB MapOrderedGauge: %v", err)
+			return
+		}
+		fun(id, value)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Errorf("RDB MapOrderedGauge: %v", err)
+	}
 }
 
+// bumpMeta увеличивает поколение данных и время последнего обновления
+// в таблице meta. Выполняется в одном запросе с записью метрики (WITH),
+// строка meta блокируется до конца запроса, поэтому параллельные
+// обновления не теряют увеличений поколения.
+const bumpMeta = `UPDATE meta SET generation = generation + 1, updated_at = now() WHERE id = 1`
+
+// Timestamp время последнего обновления данных, для базы без обновлений -
+// нулевое время, как и у FDB.
 func (r *RDB) Timestamp(ctx context.Context, layout string) string {
-	log.Println("RDB Timestamp not implemented")
-	return ""
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	var t sql.NullTime
+	if !r.Degraded() {
+		err := r.conn.QueryRowContext(ctx, `SELECT updated_at FROM meta WHERE id = 1;`).Scan(&t)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			logger.Errorf("RDB Timestamp: %v", err)
+		}
+	}
+	return t.Time.Format(layout)
 }
 
+// UpdateCount поколение данных, увеличивается при каждом обновлении.
 func (r *RDB) UpdateCount(ctx context.Context) int {
-	log.Println("RDB UpdateCount not implemented")
-	return 0
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	if r.Degraded() {
+		return 0
+	}
+	var gen int64
+	err := r.conn.QueryRowContext(ctx, `SELECT generation FROM meta WHERE id = 1;`).Scan(&gen)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logger.Errorf("RDB UpdateCount: %v", err)
+	}
+	return int(gen)
 }
 
+// UpdateCounter увеличивает счетчик одним запросом, приращение
+// прибавляется на стороне базы, поэтому параллельные обновления
+// не теряются. Запрос повторяется при временной ошибке базы, каждая
+// попытка ограничена WithOpTimeout. Возвращает значение до обновления.
 func (r *RDB) UpdateCounter(ctx context.Context, id string, delta int64) int {
-	// DISCLAIMER: Код учебный !!!
-	log.Printf("RDB UpdateCounter: %s=%d\n", id, delta)
-	prevDelta, _ := r.Counter(ctx, id)
+	logger.Debugf("RDB UpdateCounter: %s=%d\n", id, delta)
+	if r.Degraded() {
+		logger.Errorf("RDB UpdateCounter: %s: %v\n", id, ErrUnavailable)
+		return 0
+	}
 
 	query := `
-		INSERT INTO metrics
-		    (id, type, delta)
-		VALUES
-		    ($1, 'counter', $2)
-		ON CONFLICT (id)
-		DO UPDATE SET delta = $2
-		RETURNING delta
+		WITH m AS (
+			INSERT INTO metrics
+			    (id, type, delta)
+			VALUES
+			    ($1, 'counter', $2)
+			ON CONFLICT (id)
+			DO UPDATE SET delta = metrics.delta + $2
+			RETURNING delta
+		), g AS (` + bumpMeta + `)
+		SELECT delta FROM m
 		`
 
-	var prevDelta2 int64
-	err := r.db.QueryRowContext(ctx, query, id, prevDelta+delta).Scan(&prevDelta2)
+	var total int64
+	err := r.retry(ctx, func() error {
+		ctx, cancel := r.withTimeout(ctx)
+		defer cancel()
+		return r.conn.QueryRowContext(ctx, query, id, delta).Scan(&total)
+	})
 	if err != nil {
-		log.Printf("rdb error: %v\n", err)
+		logger.Errorf("rdb error: %v\n", err)
+		return 0
+	}
+	logger.Debugf("RDB UpdateCounter: %s=%d|%d\n", id, total, delta)
+	return int(total - delta)
+}
+
+// IncrAndGet увеличивает счетчик одним запросом, новое значение
+// вычисляется на стороне базы и возвращается через RETURNING.
+// Запрос повторяется при временной ошибке базы, как в UpdateCounter.
+func (r *RDB) IncrAndGet(ctx context.Context, id string, delta int64) (int64, error) {
+	logger.Debugf("RDB IncrAndGet: %s=%d\n", id, delta)
+	if r.Degraded() {
+		return 0, ErrUnavailable
 	}
 
-	log.Printf("RDB UpdateCounter: %s=%d|%d|%d\n", id, prevDelta+delta, prevDelta, delta)
-	return int(prevDelta)
+	query := `
+		WITH m AS (
+			INSERT INTO metrics
+			    (id, type, delta)
+			VALUES
+			    ($1, 'counter', $2)
+			ON CONFLICT (id)
+			DO UPDATE SET delta = metrics.delta + $2
+			RETURNING delta
+		), g AS (` + bumpMeta + `)
+		SELECT delta FROM m
+		`
+
+	var total int64
+	err := r.retry(ctx, func() error {
+		ctx, cancel := r.withTimeout(ctx)
+		defer cancel()
+		return r.conn.QueryRowContext(ctx, query, id, delta).Scan(&total)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
 }
 
+// UpdateGauge записывает датчик, запрос повторяется при временной
+// ошибке базы, как в UpdateCounter.
 func (r *RDB) UpdateGauge(ctx context.Context, id string, value float64) int {
 	// DISCLAIMER: Код учебный !!!
-	log.Printf("RDB UpdateGauge: %s=%0.3f\n", id, value)
+	logger.Debugf("RDB UpdateGauge: %s=%0.3f\n", id, value)
+	if r.Degraded() {
+		logger.Errorf("RDB UpdateGauge: %s: %v\n", id, ErrUnavailable)
+		return 0
+	}
 	prevValue, _ := r.Gauge(ctx, id)
 
 	query := `
-		INSERT INTO metrics
-		    (id, type, value)
-		VALUES
-		    ($1, 'gauge', $2)
-		ON CONFLICT (id)
-		DO UPDATE SET value = $2
-		RETURNING value
+		WITH m AS (
+			INSERT INTO metrics
+			    (id, type, value)
+			VALUES
+			    ($1, 'gauge', $2)
+			ON CONFLICT (id)
+			DO UPDATE SET value = $2
+			RETURNING value
+		), g AS (` + bumpMeta + `)
+		SELECT value FROM m
 		`
 
 	var prevValue2 float64
-	err := r.db.QueryRowContext(ctx, query, id, value).Scan(&prevValue2)
+	err := r.retry(ctx, func() error {
+		ctx, cancel := r.withTimeout(ctx)
+		defer cancel()
+		return r.conn.QueryRowContext(ctx, query, id, value).Scan(&prevValue2)
+	})
 	if err != nil {
-		log.Printf("rdb error: %v\n", err)
+		logger.Errorf("rdb error: %v\n", err)
 	}
-	log.Printf("RDB UpdateGauge: %s=%0.3f|%0.3f\n", id, prevValue, value)
+	logger.Debugf("RDB UpdateGauge: %s=%0.3f|%0.3f\n", id, prevValue, value)
 	return int(prevValue)
 }
+
+func (r *RDB) DeleteCounter(ctx context.Context, id string) bool {
+	return r.delete(ctx, models.Counter, id)
+}
+
+func (r *RDB) DeleteGauge(ctx context.Context, id string) bool {
+	return r.delete(ctx, models.Gauge, id)
+}
+
+// delete удаляет метрику одним запросом, поколение данных в meta
+// увеличивается, только если метрика была.
+func (r *RDB) delete(ctx context.Context, mtype, id string) bool {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	if r.Degraded() {
+		logger.Errorf("RDB delete %s %s: %v", mtype, id, ErrUnavailable)
+		return false
+	}
+
+	query := `
+		WITH m AS (
+			DELETE FROM metrics WHERE id = $1 AND type = $2
+			RETURNING id
+		), g AS (` + bumpMeta + ` AND EXISTS (SELECT 1 FROM m))
+		SELECT count(*) FROM m
+		`
+	var deleted int
+	if err := r.conn.QueryRowContext(ctx, query, id, mtype).Scan(&deleted); err != nil {
+		logger.Errorf("RDB delete %s %s: %v", mtype, id, err)
+		return false
+	}
+	return deleted > 0
+}
+
+// Compact выполняет VACUUM (ANALYZE) таблицы метрик: освобождает место
+// после обновлений и обновляет статистику планировщика. VACUUM не может
+// выполняться в транзакции и на время работы нагружает базу, поэтому
+// вызывается явно, через административный метод.
+func (r *RDB) Compact(ctx context.Context) error {
+	if r.Degraded() {
+		return ErrUnavailable
+	}
+	if _, err := r.conn.ExecContext(ctx, `VACUUM (ANALYZE) metrics;`); err != nil {
+		return fmt.Errorf("cannot vacuum metrics: %w", err)
+	}
+	return nil
+}
+
+func (r *RDB) Import(ctx context.Context, d Dump, replace bool) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	if r.Degraded() {
+		return ErrUnavailable
+	}
+
+	return r.inTx(ctx, nil, func(tx *sql.Tx) error {
+		return importDump(ctx, tx, d, replace, bumpMeta)
+	})
+}
+
+// UpdateBatch записывает пачку в одной транзакции подготовленными запросами
+// INSERT ... ON CONFLICT, приращения счетчиков суммируются на стороне базы.
+// Транзакция повторяется целиком при временной ошибке базы; если соединение
+// потеряно при фиксации, уже примененная пачка может быть учтена дважды.
+func (r *RDB) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	for _, m := range metrics {
+		if !(m.MType == models.Counter && m.Delta != nil) && !(m.MType == models.Gauge && m.Value != nil) {
+			return fmt.Errorf("%w: %s %q", ErrUnknownType, m.MType, m.ID)
+		}
+	}
+	if r.Degraded() {
+		return ErrUnavailable
+	}
+
+	return r.retry(ctx, func() error {
+		ctx, cancel := r.withTimeout(ctx)
+		defer cancel()
+		return r.inTx(ctx, nil, func(tx *sql.Tx) error {
+			return updateBatch(ctx, tx, metrics, bumpMeta)
+		})
+	})
+}
+
+// updateBatch записывает пачку в транзакции tx, bump - запрос обновления
+// таблицы meta, зависящий от диалекта базы.
+func updateBatch(ctx context.Context, tx *sql.Tx, metrics []models.Metrics, bump string) error {
+	counterStmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO metrics (id, type, delta) VALUES ($1, 'counter', $2)
+		ON CONFLICT (id) DO UPDATE SET delta = metrics.delta + EXCLUDED.delta
+		`)
+	if err != nil {
+		return fmt.Errorf("cannot prepare counter update: %w", err)
+	}
+	defer counterStmt.Close()
+	gaugeStmt, err := tx.PrepareContext(ctx, `
+		INSERT INTO metrics (id, type, value) VALUES ($1, 'gauge', $2)
+		ON CONFLICT (id) DO UPDATE SET value = EXCLUDED.value
+		`)
+	if err != nil {
+		return fmt.Errorf("cannot prepare gauge update: %w", err)
+	}
+	defer gaugeStmt.Close()
+
+	for _, m := range metrics {
+		if m.MType == models.Counter {
+			_, err = counterStmt.ExecContext(ctx, m.ID, *m.Delta)
+		} else {
+			_, err = gaugeStmt.ExecContext(ctx, m.ID, *m.Value)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot update %s %q: %w", m.MType, m.ID, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, bump+";"); err != nil {
+		return fmt.Errorf("cannot update meta: %w", err)
+	}
+	return nil
+}
+
+// importDump загружает d в транзакции tx, bump как в updateBatch.
+func importDump(ctx context.Context, tx *sql.Tx, d Dump, replace bool, bump string) error {
+	if replace {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM metrics;`); err != nil {
+			return fmt.Errorf("cannot clear metrics: %w", err)
+		}
+	}
+
+	counterQuery := `
+		INSERT INTO metrics (id, type, delta) VALUES ($1, 'counter', $2)
+		ON CONFLICT (id) DO UPDATE SET type = 'counter', delta = $2, value = NULL
+		`
+	for id, v := range d.Counters {
+		if _, err := tx.ExecContext(ctx, counterQuery, id, v); err != nil {
+			return fmt.Errorf("cannot import counter %q: %w", id, err)
+		}
+	}
+	gaugeQuery := `
+		INSERT INTO metrics (id, type, value) VALUES ($1, 'gauge', $2)
+		ON CONFLICT (id) DO UPDATE SET type = 'gauge', value = $2, delta = NULL
+		`
+	for id, v := range d.Gauges {
+		if _, err := tx.ExecContext(ctx, gaugeQuery, id, v); err != nil {
+			return fmt.Errorf("cannot import gauge %q: %w", id, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, bump+";"); err != nil {
+		return fmt.Errorf("cannot update meta: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,569 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"go-musthave-devops-trainer/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgx"
+	_ "github.com/jackc/pgx/stdlib"
+)
+
+func newMockRDB(t *testing.T) (*RDB, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	return NewRDB(db), mock
+}
+
+func TestRDBGet(t *testing.T) {
+	ctx := context.Background()
+	r, mock := newMockRDB(t)
+
+	mock.ExpectQuery(`SELECT delta FROM metrics WHERE id = \$1 AND type = \$2`).
+		WithArgs("PollCount", models.Counter).
+		WillReturnRows(sqlmock.NewRows([]string{"delta"}).AddRow(int64(3)))
+	m, ok, err := r.Get(ctx, models.Counter, "PollCount")
+	if err != nil || !ok || m.Delta == nil || *m.Delta != 3 || m.Value != nil {
+		t.Errorf("unexpected counter: %+v, %v, %v", m, ok, err)
+	}
+
+	mock.ExpectQuery(`SELECT value FROM metrics WHERE id = \$1 AND type = \$2`).
+		WithArgs("Alloc", models.Gauge).
+		WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow(1.5))
+	m, ok, err = r.Get(ctx, models.Gauge, "Alloc")
+	if err != nil || !ok || m.Value == nil || *m.Value != 1.5 || m.Delta != nil {
+		t.Errorf("unexpected gauge: %+v, %v, %v", m, ok, err)
+	}
+
+	mock.ExpectQuery(`SELECT value FROM metrics`).
+		WithArgs("Missing", models.Gauge).
+		WillReturnRows(sqlmock.NewRows([]string{"value"}))
+	m, ok, err = r.Get(ctx, models.Gauge, "Missing")
+	if err != nil || ok || m.Value != nil {
+		t.Errorf("missing gauge found: %+v, %v, %v", m, ok, err)
+	}
+
+	if _, _, err = r.Get(ctx, "histogram", "Alloc"); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("want ErrUnknownType, got %v", err)
+	}
+}
+
+func TestRDBIncrAndGet(t *testing.T) {
+	ctx := context.Background()
+	r, mock := newMockRDB(t)
+
+	mock.ExpectQuery(`DO UPDATE SET delta = metrics.delta \+ \$2\s+RETURNING delta`).
+		WithArgs("PollCount", int64(2)).
+		WillReturnRows(sqlmock.NewRows([]string{"delta"}).AddRow(int64(5)))
+	total, err := r.IncrAndGet(ctx, "PollCount", 2)
+	if err != nil || total != 5 {
+		t.Errorf("want 5, got %d, %v", total, err)
+	}
+}
+
+func TestRDBHealth(t *testing.T) {
+	ctx := context.Background()
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	r := NewRDB(db)
+
+	mock.ExpectPing()
+	if err := r.Ping(ctx); err != nil || r.Degraded() {
+		t.Fatalf("want healthy, got %v", err)
+	}
+
+	mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+	if err := r.Ping(ctx); err == nil || !r.Degraded() {
+		t.Fatal("want degraded after failed ping")
+	}
+	// Пока соединения нет, запросы к базе не выполняются.
+	if _, _, err := r.Get(ctx, models.Counter, "PollCount"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("want ErrUnavailable, got %v", err)
+	}
+	if _, ok := r.Counter(ctx, "PollCount"); ok {
+		t.Error("no value expected while degraded")
+	}
+
+	mock.ExpectPing()
+	if err := r.Ping(ctx); err != nil || r.Degraded() {
+		t.Fatalf("want recovered, got %v", err)
+	}
+	mock.ExpectQuery(`SELECT delta FROM metrics WHERE id = \$1 AND type = \$2`).
+		WithArgs("PollCount", models.Counter).
+		WillReturnRows(sqlmock.NewRows([]string{"delta"}).AddRow(int64(1)))
+	if _, ok, err := r.Get(ctx, models.Counter, "PollCount"); err != nil || !ok {
+		t.Errorf("want value after recovery, got %v, %v", ok, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRDBCompact(t *testing.T) {
+	ctx := context.Background()
+	r, mock := newMockRDB(t)
+
+	mock.ExpectExec(`VACUUM \(ANALYZE\) metrics`).WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := r.Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectExec(`VACUUM \(ANALYZE\) metrics`).WillReturnError(errors.New("vacuum failed"))
+	if err := r.Compact(ctx); err == nil {
+		t.Error("error expected")
+	}
+}
+
+func TestRDBCount(t *testing.T) {
+	ctx := context.Background()
+	r, mock := newMockRDB(t)
+
+	mock.ExpectQuery(`SELECT count\(\*\) FROM metrics WHERE type = \$1`).
+		WithArgs(models.Counter).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	if n, err := r.Count(ctx, models.Counter); err != nil || n != 3 {
+		t.Errorf("want 3, got %d, %v", n, err)
+	}
+
+	// Ошибка возвращается Count, CountGauges только записывает ее в лог.
+	mock.ExpectQuery(`SELECT count\(\*\) FROM metrics`).WillReturnError(errors.New("connection reset"))
+	if _, err := r.Count(ctx, models.Gauge); err == nil {
+		t.Error("error expected")
+	}
+	mock.ExpectQuery(`SELECT count\(\*\) FROM metrics`).WillReturnError(errors.New("connection reset"))
+	if n := r.CountGauges(ctx); n != 0 {
+		t.Errorf("want 0 on error, got %d", n)
+	}
+}
+
+func TestRDBExists(t *testing.T) {
+	ctx := context.Background()
+	r, mock := newMockRDB(t)
+
+	mock.ExpectQuery(`SELECT 1 FROM metrics WHERE id = \$1 AND type = \$2`).
+		WithArgs("PollCount", models.Counter).
+		WillReturnRows(sqlmock.NewRows([]string{"?column?"}).AddRow(1))
+	if ok, err := r.Exists(ctx, models.Counter, "PollCount"); err != nil || !ok {
+		t.Errorf("want present, got %v, %v", ok, err)
+	}
+
+	mock.ExpectQuery(`SELECT 1 FROM metrics WHERE id = \$1 AND type = \$2`).
+		WithArgs("Missing", models.Gauge).
+		WillReturnRows(sqlmock.NewRows([]string{"?column?"}))
+	if ok, err := r.Exists(ctx, models.Gauge, "Missing"); err != nil || ok {
+		t.Errorf("want absent, got %v, %v", ok, err)
+	}
+
+	mock.ExpectQuery(`SELECT 1 FROM metrics`).WillReturnError(errors.New("connection reset"))
+	if _, err := r.Exists(ctx, models.Gauge, "Alloc"); err == nil {
+		t.Error("error expected")
+	}
+
+	if _, err := r.Exists(ctx, "histogram", "Alloc"); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("want ErrUnknownType, got %v", err)
+	}
+}
+
+func TestRDBDelete(t *testing.T) {
+	ctx := context.Background()
+	r, mock := newMockRDB(t)
+
+	expectDelete := func(id, mtype string, deleted int) {
+		mock.ExpectQuery(`DELETE FROM metrics WHERE id = \$1 AND type = \$2`).
+			WithArgs(id, mtype).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(deleted))
+	}
+	expectDelete("PollCount", models.Counter, 1)
+	if !r.DeleteCounter(ctx, "PollCount") {
+		t.Error("existing counter must be deleted")
+	}
+	expectDelete("Missing", models.Gauge, 0)
+	if r.DeleteGauge(ctx, "Missing") {
+		t.Error("missing gauge must not be deleted")
+	}
+	mock.ExpectQuery(`DELETE FROM metrics`).WillReturnError(errors.New("connection reset"))
+	if r.DeleteGauge(ctx, "Alloc") {
+		t.Error("failed deletion must not be reported as done")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRDBSnapshot(t *testing.T) {
+	ctx := context.Background()
+	expectReads := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery(`SELECT id, delta FROM metrics WHERE type = 'counter'`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "delta"}).AddRow("PollCount", int64(3)))
+		mock.ExpectQuery(`SELECT id, value FROM metrics WHERE type = 'gauge'`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "value"}).AddRow("Alloc", 1.5))
+	}
+	check := func(d Dump, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Counters["PollCount"] != 3 || d.Gauges["Alloc"] != 1.5 {
+			t.Errorf("unexpected snapshot: %+v", d)
+		}
+	}
+
+	// По умолчанию чтение без транзакции.
+	r, mock := newMockRDB(t)
+	expectReads(mock)
+	check(r.Snapshot(ctx))
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	r = NewRDB(db, WithConsistentReads(true))
+	mock.ExpectBegin()
+	expectReads(mock)
+	mock.ExpectCommit()
+	check(r.Snapshot(ctx))
+
+	// При ошибке чтения транзакция откатывается.
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT id, delta FROM metrics`).WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+	if _, err := r.Snapshot(ctx); err == nil {
+		t.Error("error expected")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRDBWithTx(t *testing.T) {
+	ctx := context.Background()
+	r, mock := newMockRDB(t)
+	errFail := errors.New("fail")
+
+	// Ошибка откатывает транзакцию.
+	mock.ExpectBegin()
+	mock.ExpectQuery(`DO UPDATE SET delta = metrics.delta \+ \$2`).
+		WithArgs("PollCount", int64(2)).
+		WillReturnRows(sqlmock.NewRows([]string{"delta"}).AddRow(int64(5)))
+	mock.ExpectRollback()
+	err := r.WithTx(ctx, func(tx Store) error {
+		if _, err := tx.IncrAndGet(ctx, "PollCount", 2); err != nil {
+			return err
+		}
+		return errFail
+	})
+	if !errors.Is(err, errFail) {
+		t.Errorf("want errFail, got %v", err)
+	}
+
+	// Запросы вложенного вызова идут в той же транзакции.
+	mock.ExpectBegin()
+	mock.ExpectQuery(`DO UPDATE SET delta = metrics.delta \+ \$2`).
+		WithArgs("PollCount", int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"delta"}).AddRow(int64(4)))
+	mock.ExpectQuery(`SELECT 1 FROM metrics`).
+		WithArgs("PollCount", models.Counter).
+		WillReturnRows(sqlmock.NewRows([]string{"one"}).AddRow(1))
+	mock.ExpectCommit()
+	err = r.WithTx(ctx, func(tx Store) error {
+		if _, err := tx.IncrAndGet(ctx, "PollCount", 1); err != nil {
+			return err
+		}
+		if err := tx.Close(); err != nil {
+			return err
+		}
+		return tx.WithTx(ctx, func(tx Store) error {
+			_, err := tx.Exists(ctx, models.Counter, "PollCount")
+			return err
+		})
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRDBMapOrdered(t *testing.T) {
+	ctx := context.Background()
+	r, mock := newMockRDB(t)
+
+	// Порядок задает база (ORDER BY id), он должен совпадать с FDB.
+	fdb := NewFDB(ctx)
+	for _, id := range []string{"b", "c", "a"} {
+		fdb.UpdateCounter(ctx, id, 1)
+		fdb.UpdateGauge(ctx, id, 1)
+	}
+	var want []string
+	fdb.MapOrderedCounter(ctx, func(k string, v int64) { want = append(want, k) })
+
+	mock.ExpectQuery(`SELECT id, delta FROM metrics WHERE type = 'counter' ORDER BY id`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "delta"}).
+			AddRow("a", int64(1)).AddRow("b", int64(1)).AddRow("c", int64(1))).
+		RowsWillBeClosed()
+	var got []string
+	r.MapOrderedCounter(ctx, func(k string, v int64) { got = append(got, k) })
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("want counters %v, got %v", want, got)
+	}
+
+	// Ошибка чтения строк прерывает обход.
+	mock.ExpectQuery(`SELECT id, value FROM metrics WHERE type = 'gauge' ORDER BY id`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "value"}).
+			AddRow("a", 1.0).AddRow("b", 2.0).RowError(1, errors.New("connection reset"))).
+		RowsWillBeClosed()
+	got = nil
+	r.MapOrderedGauge(ctx, func(k string, v float64) { got = append(got, k) })
+	if fmt.Sprint(got) != "[a]" {
+		t.Errorf("want gauges before error, got %v", got)
+	}
+}
+
+func TestRDBMeta(t *testing.T) {
+	ctx := context.Background()
+	r, mock := newMockRDB(t)
+
+	// Запись метрики и увеличение поколения - один запрос.
+	mock.ExpectQuery(`WITH m AS \(\s*INSERT INTO metrics.*UPDATE meta SET generation = generation \+ 1, updated_at = now\(\)`).
+		WithArgs("PollCount", int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"delta"}).AddRow(int64(1)))
+	if _, err := r.IncrAndGet(ctx, "PollCount", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery(`SELECT generation FROM meta`).
+		WillReturnRows(sqlmock.NewRows([]string{"generation"}).AddRow(int64(7)))
+	if gen := r.UpdateCount(ctx); gen != 7 {
+		t.Errorf("want generation 7, got %d", gen)
+	}
+
+	at := time.Date(2022, 5, 1, 12, 30, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT updated_at FROM meta`).
+		WillReturnRows(sqlmock.NewRows([]string{"updated_at"}).AddRow(at))
+	if got := r.Timestamp(ctx, time.RFC3339); got != "2022-05-01T12:30:00Z" {
+		t.Errorf("unexpected timestamp: %s", got)
+	}
+
+	// Без обновлений время нулевое, как у FDB.
+	mock.ExpectQuery(`SELECT updated_at FROM meta`).
+		WillReturnRows(sqlmock.NewRows([]string{"updated_at"}).AddRow(nil))
+	if got, want := r.Timestamp(ctx, time.RFC3339), (time.Time{}).Format(time.RFC3339); got != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+}
+
+func TestRDBOpTimeout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	r := NewRDB(db, WithOpTimeout(20*time.Millisecond))
+
+	mock.ExpectQuery(`SELECT value FROM metrics`).
+		WithArgs("Alloc", models.Gauge).
+		WillDelayFor(time.Second).
+		WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow(1.5))
+	start := time.Now()
+	_, _, err = r.Get(context.Background(), models.Gauge, "Alloc")
+	if err == nil {
+		t.Fatal("slow query must be cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("query cancelled after %s, want about 20ms", elapsed)
+	}
+}
+
+func TestRDBRetry(t *testing.T) {
+	saved := retryIntervals
+	retryIntervals = []time.Duration{time.Millisecond, time.Millisecond}
+	defer func() { retryIntervals = saved }()
+	ctx := context.Background()
+	r, mock := newMockRDB(t)
+	expectUpdate := func() *sqlmock.ExpectedQuery {
+		return mock.ExpectQuery(`INSERT INTO metrics`).WithArgs("PollCount", int64(1))
+	}
+
+	// Временные ошибки повторяются.
+	expectUpdate().WillReturnError(pgx.PgError{Code: "08006"})
+	expectUpdate().WillReturnError(pgx.PgError{Code: "40001"})
+	expectUpdate().WillReturnRows(sqlmock.NewRows([]string{"delta"}).AddRow(int64(3)))
+	if prev := r.UpdateCounter(ctx, "PollCount", 1); prev != 2 {
+		t.Errorf("want 2, got %d", prev)
+	}
+
+	// Повторов не больше, чем интервалов.
+	for i := 0; i < 3; i++ {
+		expectUpdate().WillReturnError(pgx.PgError{Code: "08003"})
+	}
+	if prev := r.UpdateCounter(ctx, "PollCount", 1); prev != 0 {
+		t.Errorf("want 0, got %d", prev)
+	}
+
+	// Остальные ошибки возвращаются сразу, лишний запрос провалил бы мок.
+	expectUpdate().WillReturnError(pgx.PgError{Code: "23505"})
+	r.UpdateCounter(ctx, "PollCount", 1)
+	expectUpdate().WillReturnError(errors.New("syntax error"))
+	r.UpdateCounter(ctx, "PollCount", 1)
+
+	// Разрыв соединения pgx сообщает сетевой ошибкой или неожиданным EOF.
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	expectUpdate().WillReturnError(reset)
+	expectUpdate().WillReturnError(io.ErrUnexpectedEOF)
+	expectUpdate().WillReturnRows(sqlmock.NewRows([]string{"delta"}).AddRow(int64(5)))
+	if total, err := r.IncrAndGet(ctx, "PollCount", 1); err != nil || total != 5 {
+		t.Errorf("want 5, got %d, %v", total, err)
+	}
+
+	// Пачка повторяется целиком в новой транзакции.
+	delta := int64(1)
+	mock.ExpectBegin()
+	counter := mock.ExpectPrepare(`INSERT INTO metrics \(id, type, delta\)`)
+	mock.ExpectPrepare(`INSERT INTO metrics \(id, type, value\)`)
+	counter.ExpectExec().WillReturnError(reset)
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	counter = mock.ExpectPrepare(`INSERT INTO metrics \(id, type, delta\)`)
+	mock.ExpectPrepare(`INSERT INTO metrics \(id, type, value\)`)
+	counter.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE meta`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if err := r.UpdateBatch(ctx, []models.Metrics{{ID: "PollCount", MType: models.Counter, Delta: &delta}}); err != nil {
+		t.Errorf("batch must be retried: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	for _, err := range []error{reset, io.EOF, io.ErrUnexpectedEOF, driver.ErrBadConn, fmt.Errorf("commit: %w", driver.ErrBadConn)} {
+		if !isRetriable(err) {
+			t.Errorf("%v must be retriable", err)
+		}
+	}
+	for _, err := range []error{sql.ErrNoRows, context.DeadlineExceeded, pgx.PgError{Code: "23505"}} {
+		if isRetriable(err) {
+			t.Errorf("%v must not be retriable", err)
+		}
+	}
+}
+
+func TestRDBUpdateBatch(t *testing.T) {
+	ctx := context.Background()
+	r, mock := newMockRDB(t)
+	delta, value := int64(2), 1.5
+	batch := []models.Metrics{
+		{ID: "PollCount", MType: models.Counter, Delta: &delta},
+		{ID: "Alloc", MType: models.Gauge, Value: &value},
+		{ID: "PollCount", MType: models.Counter, Delta: &delta},
+	}
+
+	mock.ExpectBegin()
+	counter := mock.ExpectPrepare(`INSERT INTO metrics \(id, type, delta\).*delta = metrics.delta \+ EXCLUDED.delta`)
+	gauge := mock.ExpectPrepare(`INSERT INTO metrics \(id, type, value\).*value = EXCLUDED.value`)
+	counter.ExpectExec().WithArgs("PollCount", int64(2)).WillReturnResult(sqlmock.NewResult(0, 1))
+	gauge.ExpectExec().WithArgs("Alloc", 1.5).WillReturnResult(sqlmock.NewResult(0, 1))
+	counter.ExpectExec().WithArgs("PollCount", int64(2)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE meta SET generation = generation \+ 1`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if err := r.UpdateBatch(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ошибка записи откатывает всю пачку.
+	mock.ExpectBegin()
+	counter = mock.ExpectPrepare(`INSERT INTO metrics \(id, type, delta\)`)
+	mock.ExpectPrepare(`INSERT INTO metrics \(id, type, value\)`)
+	counter.ExpectExec().WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+	if err := r.UpdateBatch(ctx, batch[:1]); err == nil {
+		t.Error("error expected")
+	}
+
+	// Метрика без значения отклоняется до обращения к базе.
+	if err := r.UpdateBatch(ctx, []models.Metrics{{ID: "Alloc", MType: models.Gauge}}); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("want ErrUnknownType, got %v", err)
+	}
+}
+
+func TestRDBUpdateCounterQuery(t *testing.T) {
+	ctx := context.Background()
+	r, mock := newMockRDB(t)
+
+	// Приращение прибавляется к значению в базе одним запросом, без
+	// чтения перед записью, поэтому параллельные обновления не теряются.
+	mock.ExpectQuery(`INSERT INTO metrics\s+\(id, type, delta\)\s+VALUES\s+\(\$1, 'counter', \$2\)\s+`+
+		`ON CONFLICT \(id\)\s+DO UPDATE SET delta = metrics.delta \+ \$2\s+RETURNING delta`).
+		WithArgs("PollCount", int64(2)).
+		WillReturnRows(sqlmock.NewRows([]string{"delta"}).AddRow(int64(7)))
+	if prev := r.UpdateCounter(ctx, "PollCount", 2); prev != 5 {
+		t.Errorf("want previous value 5, got %d", prev)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestRDBUpdateCounterConcurrent проверяет отсутствие потерянных
+// обновлений на настоящем PostgreSQL, DSN задается TEST_DATABASE_DSN.
+func TestRDBUpdateCounterConcurrent(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	ctx := context.Background()
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	r := NewRDB(db)
+	if err := r.Bootstrap(ctx); err != nil {
+		t.Fatal(err)
+	}
+	id := fmt.Sprintf("TestConcurrent%d", time.Now().UnixNano())
+	defer r.DeleteCounter(ctx, id)
+
+	const (
+		workers = 20
+		updates = 50
+	)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < updates; j++ {
+				r.UpdateCounter(ctx, id, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got, _ := r.Counter(ctx, id); got != workers*updates {
+		t.Errorf("want %s=%d, got %d", id, workers*updates, got)
+	}
+}
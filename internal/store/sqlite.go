@@ -0,0 +1,415 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"go-musthave-devops-trainer/internal/logger"
+	"go-musthave-devops-trainer/models"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteBumpMeta аналог bumpMeta: SQLite не поддерживает UPDATE в WITH,
+// поэтому meta обновляется отдельным запросом в той же транзакции.
+// Время хранится строкой RFC 3339 в UTC.
+const sqliteBumpMeta = `UPDATE meta SET generation = generation + 1, updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', 'now') WHERE id = 1`
+
+// SQLite хранилище в файле базы SQLite (modernc.org/sqlite, без cgo)
+// с той же схемой, что и RDB. В отличие от FDB, каждое обновление
+// записывается на диск сразу, в отличие от RDB - не требует сервера
+// базы. Запросы выполняются через одно соединение, поэтому записи
+// не конкурируют за блокировку файла.
+type SQLite struct {
+	db *sql.DB
+	// conn выполняет запросы: база или транзакция, см. WithTx.
+	conn querier
+	tx   *sql.Tx
+}
+
+var (
+	_ Store        = (*SQLite)(nil)
+	_ Snapshotter  = (*SQLite)(nil)
+	_ Compactor    = (*SQLite)(nil)
+	_ Importer     = (*SQLite)(nil)
+	_ BatchUpdater = (*SQLite)(nil)
+
+	_ CardinalityChecker = (*SQLite)(nil)
+)
+
+// OpenSQLite открывает или создает базу в файле path и создает таблицы.
+// Журнал ведется в режиме WAL, при блокировке файла другим процессом
+// запрос ждет ее освобождения до 5 секунд.
+func OpenSQLite(ctx context.Context, path string) (*SQLite, error) {
+	dsn := "file:" + path + "?" + url.Values{
+		"_pragma": {"busy_timeout(5000)", "journal_mode(WAL)"},
+	}.Encode()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %w", path, err)
+	}
+	db.SetMaxOpenConns(1)
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot open %s: %w", path, err)
+	}
+	if _, err := db.ExecContext(ctx, schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot create tables in %s: %w", path, err)
+	}
+	return &SQLite{db: db, conn: db}, nil
+}
+
+// Close для хранилища транзакции (см. WithTx) ничего не делает.
+func (s *SQLite) Close() error {
+	if s.tx != nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func (s *SQLite) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// WithTx выполняет fn в транзакции, вложенный вызов выполняется
+// в той же транзакции. Пока fn выполняется, остальные запросы
+// ждут единственное соединение.
+func (s *SQLite) WithTx(ctx context.Context, fn func(tx Store) error) error {
+	if s.tx != nil {
+		return fn(s)
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		return fn(&SQLite{db: s.db, conn: tx, tx: tx})
+	})
+}
+
+func (s *SQLite) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	if s.tx != nil {
+		return fn(s.tx)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLite) Counter(ctx context.Context, id string) (int64, bool) {
+	m, ok, err := s.Get(ctx, models.Counter, id)
+	if err != nil {
+		logger.Errorf("SQLite Counter: %v", err)
+	}
+	if !ok {
+		return 0, false
+	}
+	return *m.Delta, true
+}
+
+func (s *SQLite) Gauge(ctx context.Context, id string) (float64, bool) {
+	m, ok, err := s.Get(ctx, models.Gauge, id)
+	if err != nil {
+		logger.Errorf("SQLite Gauge: %v", err)
+	}
+	if !ok {
+		return 0, false
+	}
+	return *m.Value, true
+}
+
+func (s *SQLite) Get(ctx context.Context, mtype, id string) (models.Metrics, bool, error) {
+	m := models.Metrics{ID: id, MType: mtype}
+	var (
+		query string
+		dest  interface{}
+	)
+	switch mtype {
+	case models.Counter:
+		query = `SELECT delta FROM metrics WHERE id = $1 AND type = $2;`
+		m.Delta = new(int64)
+		dest = m.Delta
+	case models.Gauge:
+		query = `SELECT value FROM metrics WHERE id = $1 AND type = $2;`
+		m.Value = new(float64)
+		dest = m.Value
+	default:
+		return m, false, ErrUnknownType
+	}
+
+	err := s.conn.QueryRowContext(ctx, query, id, mtype).Scan(dest)
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Metrics{ID: id, MType: mtype}, false, nil
+	}
+	if err != nil {
+		return models.Metrics{ID: id, MType: mtype}, false, fmt.Errorf("cannot get %s %q: %w", mtype, id, err)
+	}
+	return m, true, nil
+}
+
+func (s *SQLite) Exists(ctx context.Context, mtype, id string) (bool, error) {
+	if mtype != models.Counter && mtype != models.Gauge {
+		return false, ErrUnknownType
+	}
+	var one int
+	err := s.conn.QueryRowContext(ctx, `SELECT 1 FROM metrics WHERE id = $1 AND type = $2;`, id, mtype).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot check %s %q: %w", mtype, id, err)
+	}
+	return true, nil
+}
+
+func (s *SQLite) CountCounters(ctx context.Context) int {
+	return s.count(ctx, models.Counter)
+}
+
+func (s *SQLite) CountGauges(ctx context.Context) int {
+	return s.count(ctx, models.Gauge)
+}
+
+func (s *SQLite) count(ctx context.Context, mtype string) int {
+	count, err := s.Count(ctx, mtype)
+	if err != nil {
+		logger.Errorf("SQLite count %s: %v", mtype, err)
+	}
+	return count
+}
+
+// Count количество метрик типа mtype, см. CardinalityChecker.
+func (s *SQLite) Count(ctx context.Context, mtype string) (int, error) {
+	var count int
+	if err := s.conn.QueryRowContext(ctx, `SELECT count(*) FROM metrics WHERE type = $1;`, mtype).Scan(&count); err != nil {
+		return 0, fmt.Errorf("cannot count %s: %w", mtype, err)
+	}
+	return count, nil
+}
+
+// Snapshot читает все метрики в одной транзакции, параллельные записи
+// ждут соединение, поэтому снимок согласован.
+func (s *SQLite) Snapshot(ctx context.Context) (Dump, error) {
+	var d Dump
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		var err error
+		d, err = readSnapshot(ctx, tx)
+		return err
+	})
+	if err != nil {
+		return Dump{}, err
+	}
+	return d, nil
+}
+
+// MapOrderedCounter вызывает fun для каждого счетчика в порядке имен.
+// Ошибки чтения записываются в лог, обход прерывается.
+func (s *SQLite) MapOrderedCounter(ctx context.Context, fun func(k string, v int64)) {
+	rows, err := s.conn.QueryContext(ctx, `SELECT id, delta FROM metrics WHERE type = 'counter' ORDER BY id;`)
+	if err != nil {
+		logger.Errorf("SQLite MapOrderedCounter: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id    string
+			delta int64
+		)
+		if err := rows.Scan(&id, &delta); err != nil {
+			logger.Errorf("SQLite MapOrderedCounter: %v", err)
+			return
+		}
+		fun(id, delta)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Errorf("SQLite MapOrderedCounter: %v", err)
+	}
+}
+
+// MapOrderedGauge вызывает fun для каждого датчика в порядке имен.
+func (s *SQLite) MapOrderedGauge(ctx context.Context, fun func(k string, v float64)) {
+	rows, err := s.conn.QueryContext(ctx, `SELECT id, value FROM metrics WHERE type = 'gauge' ORDER BY id;`)
+	if err != nil {
+		logger.Errorf("SQLite MapOrderedGauge: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id    string
+			value float64
+		)
+		if err := rows.Scan(&id, &value); err != nil {
+			logger.Errorf("SQLite MapOrderedGauge: %v", err)
+			return
+		}
+		fun(id, value)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Errorf("SQLite MapOrderedGauge: %v", err)
+	}
+}
+
+// Timestamp время последнего обновления данных, для базы без обновлений -
+// нулевое время, как и у RDB.
+func (s *SQLite) Timestamp(ctx context.Context, layout string) string {
+	var (
+		updated sql.NullString
+		t       time.Time
+	)
+	err := s.conn.QueryRowContext(ctx, `SELECT updated_at FROM meta WHERE id = 1;`).Scan(&updated)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logger.Errorf("SQLite Timestamp: %v", err)
+	}
+	if updated.Valid {
+		if t, err = time.Parse(time.RFC3339Nano, updated.String); err != nil {
+			logger.Errorf("SQLite Timestamp: %v", err)
+		}
+	}
+	return t.Format(layout)
+}
+
+// UpdateCount поколение данных, увеличивается при каждом обновлении.
+func (s *SQLite) UpdateCount(ctx context.Context) int {
+	var gen int64
+	err := s.conn.QueryRowContext(ctx, `SELECT generation FROM meta WHERE id = 1;`).Scan(&gen)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		logger.Errorf("SQLite UpdateCount: %v", err)
+	}
+	return int(gen)
+}
+
+// UpdateCounter увеличивает счетчик, возвращает значение до обновления.
+func (s *SQLite) UpdateCounter(ctx context.Context, id string, delta int64) int {
+	total, err := s.IncrAndGet(ctx, id, delta)
+	if err != nil {
+		logger.Errorf("SQLite UpdateCounter: %v", err)
+		return 0
+	}
+	return int(total - delta)
+}
+
+// IncrAndGet увеличивает счетчик и обновляет meta в одной транзакции,
+// новое значение возвращается через RETURNING.
+func (s *SQLite) IncrAndGet(ctx context.Context, id string, delta int64) (int64, error) {
+	query := `
+		INSERT INTO metrics (id, type, delta) VALUES ($1, 'counter', $2)
+		ON CONFLICT (id) DO UPDATE SET delta = metrics.delta + $2
+		RETURNING delta
+		`
+	var total int64
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		if err := tx.QueryRowContext(ctx, query, id, delta).Scan(&total); err != nil {
+			return fmt.Errorf("cannot update counter %q: %w", id, err)
+		}
+		if _, err := tx.ExecContext(ctx, sqliteBumpMeta+";"); err != nil {
+			return fmt.Errorf("cannot update meta: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// UpdateGauge записывает датчик, возвращает целую часть прежнего
+// значения, как и RDB.
+func (s *SQLite) UpdateGauge(ctx context.Context, id string, value float64) int {
+	var prev float64
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `SELECT value FROM metrics WHERE id = $1 AND type = 'gauge';`, id).Scan(&prev)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("cannot get gauge %q: %w", id, err)
+		}
+		query := `
+			INSERT INTO metrics (id, type, value) VALUES ($1, 'gauge', $2)
+			ON CONFLICT (id) DO UPDATE SET value = $2
+			`
+		if _, err := tx.ExecContext(ctx, query, id, value); err != nil {
+			return fmt.Errorf("cannot update gauge %q: %w", id, err)
+		}
+		if _, err := tx.ExecContext(ctx, sqliteBumpMeta+";"); err != nil {
+			return fmt.Errorf("cannot update meta: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("SQLite UpdateGauge: %v", err)
+	}
+	return int(prev)
+}
+
+func (s *SQLite) DeleteCounter(ctx context.Context, id string) bool {
+	return s.delete(ctx, models.Counter, id)
+}
+
+func (s *SQLite) DeleteGauge(ctx context.Context, id string) bool {
+	return s.delete(ctx, models.Gauge, id)
+}
+
+// delete удаляет метрику, поколение данных увеличивается, только если
+// метрика была.
+func (s *SQLite) delete(ctx context.Context, mtype, id string) bool {
+	var deleted int64
+	err := s.inTx(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `DELETE FROM metrics WHERE id = $1 AND type = $2;`, id, mtype)
+		if err != nil {
+			return fmt.Errorf("cannot delete %s %q: %w", mtype, id, err)
+		}
+		if deleted, err = res.RowsAffected(); err != nil || deleted == 0 {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, sqliteBumpMeta+";"); err != nil {
+			return fmt.Errorf("cannot update meta: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Errorf("SQLite delete: %v", err)
+		return false
+	}
+	return deleted > 0
+}
+
+// UpdateBatch записывает пачку в одной транзакции, как и RDB.
+func (s *SQLite) UpdateBatch(ctx context.Context, metrics []models.Metrics) error {
+	for _, m := range metrics {
+		if !(m.MType == models.Counter && m.Delta != nil) && !(m.MType == models.Gauge && m.Value != nil) {
+			return fmt.Errorf("%w: %s %q", ErrUnknownType, m.MType, m.ID)
+		}
+	}
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		return updateBatch(ctx, tx, metrics, sqliteBumpMeta)
+	})
+}
+
+func (s *SQLite) Import(ctx context.Context, d Dump, replace bool) error {
+	return s.inTx(ctx, func(tx *sql.Tx) error {
+		return importDump(ctx, tx, d, replace, sqliteBumpMeta)
+	})
+}
+
+// Compact перестраивает файл базы (VACUUM), освобождая место после
+// удалений. VACUUM не выполняется в транзакции.
+func (s *SQLite) Compact(ctx context.Context) error {
+	if s.tx != nil {
+		return errors.New("cannot vacuum in transaction")
+	}
+	if _, err := s.db.ExecContext(ctx, `VACUUM;`); err != nil {
+		return fmt.Errorf("cannot vacuum: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"go-musthave-devops-trainer/models"
+)
+
+func openTestSQLite(t *testing.T, path string) *SQLite {
+	t.Helper()
+	db, err := OpenSQLite(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestSQLite(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.db")
+	db := openTestSQLite(t, path)
+
+	if err := db.Ping(ctx); err != nil {
+		t.Fatalf("ping: %v", err)
+	}
+	if ts := db.Timestamp(ctx, time.RFC3339); ts != (time.Time{}).Format(time.RFC3339) {
+		t.Errorf("empty base must have zero timestamp, got %s", ts)
+	}
+
+	if prev := db.UpdateCounter(ctx, "PollCount", 2); prev != 0 {
+		t.Errorf("want previous 0, got %d", prev)
+	}
+	if total, err := db.IncrAndGet(ctx, "PollCount", 3); err != nil || total != 5 {
+		t.Errorf("want 5, got %d, %v", total, err)
+	}
+	db.UpdateGauge(ctx, "Alloc", 1.5)
+	if prev := db.UpdateGauge(ctx, "Alloc", 2.5); prev != 1 {
+		t.Errorf("want previous 1, got %d", prev)
+	}
+
+	if v, ok := db.Counter(ctx, "PollCount"); !ok || v != 5 {
+		t.Errorf("counter: want 5, got %d, %v", v, ok)
+	}
+	if _, ok, err := db.Get(ctx, models.Gauge, "PollCount"); ok || err != nil {
+		t.Errorf("counter must not be read as gauge: %v, %v", ok, err)
+	}
+	if ok, err := db.Exists(ctx, models.Gauge, "Alloc"); !ok || err != nil {
+		t.Errorf("gauge must exist: %v, %v", ok, err)
+	}
+	if _, _, err := db.Get(ctx, "unknown", "Alloc"); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("want ErrUnknownType, got %v", err)
+	}
+	if n := db.CountCounters(ctx) + db.CountGauges(ctx); n != 2 {
+		t.Errorf("want 2 metrics, got %d", n)
+	}
+	if n := db.UpdateCount(ctx); n != 4 {
+		t.Errorf("want 4 updates, got %d", n)
+	}
+	ts, err := time.Parse(time.RFC3339Nano, db.Timestamp(ctx, time.RFC3339Nano))
+	if err != nil || time.Since(ts) > time.Minute {
+		t.Errorf("unexpected timestamp: %v, %v", ts, err)
+	}
+
+	// Данные сохраняются между запусками.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db = openTestSQLite(t, path)
+	defer db.Close()
+	d, err := db.Snapshot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Counters["PollCount"] != 5 || d.Gauges["Alloc"] != 2.5 || len(d.Counters)+len(d.Gauges) != 2 {
+		t.Errorf("unexpected snapshot after reopen: %+v", d)
+	}
+	if err := db.Compact(ctx); err != nil {
+		t.Errorf("compact: %v", err)
+	}
+
+	if !db.DeleteGauge(ctx, "Alloc") || db.DeleteGauge(ctx, "Alloc") {
+		t.Error("gauge must be deleted once")
+	}
+	if db.DeleteGauge(ctx, "PollCount") {
+		t.Error("counter must not be deleted as gauge")
+	}
+	if n := db.UpdateCount(ctx); n != 5 {
+		t.Errorf("want 5 updates after deletion, got %d", n)
+	}
+}
+
+func TestSQLiteBatchAndTx(t *testing.T) {
+	ctx := context.Background()
+	db := openTestSQLite(t, filepath.Join(t.TempDir(), "metrics.db"))
+	defer db.Close()
+
+	delta, value := int64(1), 0.5
+	batch := []models.Metrics{
+		{ID: "c", MType: models.Counter, Delta: &delta},
+		{ID: "c", MType: models.Counter, Delta: &delta},
+		{ID: "g", MType: models.Gauge, Value: &value},
+	}
+	if err := db.UpdateBatch(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	bad := append(batch, models.Metrics{ID: "x", MType: models.Counter})
+	if err := db.UpdateBatch(ctx, bad); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("want ErrUnknownType, got %v", err)
+	}
+
+	errRollback := errors.New("rollback")
+	err := db.WithTx(ctx, func(tx Store) error {
+		tx.UpdateCounter(ctx, "c", 10)
+		tx.UpdateGauge(ctx, "new", 1)
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Errorf("want rollback error, got %v", err)
+	}
+
+	var keys []string
+	db.MapOrderedCounter(ctx, func(k string, v int64) {
+		keys = append(keys, k)
+		if v != 2 {
+			t.Errorf("counter %s: want 2, got %d", k, v)
+		}
+	})
+	db.MapOrderedGauge(ctx, func(k string, v float64) {
+		keys = append(keys, k)
+	})
+	if len(keys) != 2 || keys[0] != "c" || keys[1] != "g" {
+		t.Errorf("changes of rolled back transaction must not be visible: %v", keys)
+	}
+
+	if err := db.Import(ctx, Dump{Counters: map[string]int64{"imported": 7}}, true); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := db.Snapshot(ctx); len(d.Counters) != 1 || d.Counters["imported"] != 7 || len(d.Gauges) != 0 {
+		t.Errorf("unexpected snapshot after import: %+v", d)
+	}
+}
+
+func TestSQLiteConcurrentCounter(t *testing.T) {
+	ctx := context.Background()
+	db := openTestSQLite(t, filepath.Join(t.TempDir(), "metrics.db"))
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				db.UpdateCounter(ctx, "c", 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _ := db.Counter(ctx, "c"); v != 100 {
+		t.Errorf("want 100, got %d", v)
+	}
+}
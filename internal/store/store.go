@@ -2,17 +2,50 @@ package store
 
 import (
 	"context"
+	"errors"
 	"io"
+	"time"
+
+	"go-musthave-devops-trainer/models"
+)
+
+var (
+	ErrUnknownType = errors.New("unknown type of metrics")
+	// ErrUnavailable хранилище временно недоступно, запрос можно повторить.
+	ErrUnavailable = errors.New("storage is temporarily unavailable")
+	// ErrNotSupported хранилище, обернутое в Cache, не реализует операцию.
+	ErrNotSupported = errors.New("operation is not supported by storage")
 )
 
 type Gauge interface {
 	UpdateGauge(ctx context.Context, id string, value float64) int
 	Gauge(ctx context.Context, id string) (float64, bool)
+	// DeleteGauge удаляет датчик, false - датчика не было.
+	DeleteGauge(ctx context.Context, id string) bool
 }
 
 type Counter interface {
 	UpdateCounter(ctx context.Context, id string, delta int64) int
 	Counter(ctx context.Context, id string) (int64, bool)
+	// DeleteCounter удаляет счетчик, false - счетчика не было.
+	// Удаление явное, в отличие от GaugePruner: накопленная сумма теряется.
+	DeleteCounter(ctx context.Context, id string) bool
+	// IncrAndGet атомарно увеличивает счетчик и возвращает новое значение.
+	IncrAndGet(ctx context.Context, id string, delta int64) (int64, error)
+}
+
+// Cardinality количество уникальных метрик каждого типа.
+type Cardinality interface {
+	CountCounters(ctx context.Context) int
+	CountGauges(ctx context.Context) int
+}
+
+// CardinalityChecker количество уникальных метрик типа mtype или ошибка
+// его чтения. Реализуется хранилищами, чтение которых может не удаться
+// (RDB, SQLite): Cardinality при ошибке возвращает 0, а ограничение на
+// количество метрик не должно из-за этого пропускать запись.
+type CardinalityChecker interface {
+	Count(ctx context.Context, mtype string) (int, error)
 }
 
 type FileStore interface {
@@ -22,11 +55,103 @@ type FileStore interface {
 	MapOrderedGauge(ctx context.Context, f func(k string, v float64))
 }
 
+// SaveStats статистика сохранения данных на диск.
+// Реализуется хранилищами с отложенной записью (FDB).
+type SaveStats interface {
+	PendingWrites() int
+	LastSaveDuration() time.Duration
+	SaveCount() int
+}
+
+// Freshness время последнего обновления отдельных метрик.
+type Freshness interface {
+	LastUpdated(ctx context.Context, mtype, id string) (time.Time, bool)
+}
+
+// GaugePruner удаляет датчики, не обновлявшиеся с момента before.
+// Счетчики монотонны и не удаляются по времени ни одним хранилищем:
+// удаление обнулило бы накопленную сумму, поэтому метода для них нет.
+type GaugePruner interface {
+	PruneGauges(ctx context.Context, before time.Time) int
+}
+
+// Observations время измерения метрик, переданное агентом.
+type Observations interface {
+	SetObserved(ctx context.Context, mtype, id string, at time.Time)
+	Observed(ctx context.Context, mtype, id string) (time.Time, bool)
+}
+
+// MetricChange событие изменения метрики. Metric содержит новое
+// значение, для счетчика - итоговую сумму.
+type MetricChange struct {
+	Metric models.Metrics
+	At     time.Time
+}
+
+// Notifier рассылает события изменения метрик. Канал подписки
+// ограничен, события для не успевающего их читать подписчика
+// отбрасываются, что бы не задерживать запись. Канал закрывается
+// после отмены ctx.
+type Notifier interface {
+	Subscribe(ctx context.Context) <-chan MetricChange
+}
+
+// Compactor обслуживание хранилища, освобождающее место после обновлений
+// и удалений. Для RDB - VACUUM (ANALYZE) таблицы метрик, для FDB -
+// перезапись файла с текущими данными и удаление резервных копий.
+type Compactor interface {
+	Compact(ctx context.Context) error
+}
+
+// Snapshotter читает все метрики за один раз. Для хранилищ, которые
+// читают метрики запросами, это согласованная альтернатива обходу
+// MapOrderedCounter и MapOrderedGauge.
+type Snapshotter interface {
+	Snapshot(ctx context.Context) (Dump, error)
+}
+
+// Health состояние соединения с хранилищем.
+type Health interface {
+	Degraded() bool
+}
+
+// Dump значения всех метрик хранилища.
+type Dump struct {
+	Counters map[string]int64
+	Gauges   map[string]float64
+}
+
+// BatchUpdater записывает пачку обновлений за один раз: для счетчиков
+// Delta прибавляется к текущему значению, для датчиков Value заменяет его.
+// Метрики с другими типами или без значения приводят к ErrUnknownType,
+// при ошибке пачка не применяется.
+type BatchUpdater interface {
+	UpdateBatch(ctx context.Context, metrics []models.Metrics) error
+}
+
+// Importer загружает метрики из Dump. При replace текущие данные
+// заменяются целиком, иначе метрики из Dump добавляются к текущим,
+// а совпадающие по имени перезаписываются.
+type Importer interface {
+	Import(ctx context.Context, d Dump, replace bool) error
+}
+
 type Store interface {
 	io.Closer
 	Gauge
 	Counter
+	Cardinality
 	FileStore
 
+	// Get возвращает метрику указанного типа с заполненным значением.
+	Get(ctx context.Context, mtype, id string) (models.Metrics, bool, error)
+	// Exists проверяет наличие метрики, не читая ее значение.
+	Exists(ctx context.Context, mtype, id string) (bool, error)
+
 	Ping(ctx context.Context) error
+
+	// WithTx выполняет fn атомарно: если fn вернула ошибку, изменения,
+	// сделанные через tx, не применяются. Внутри fn хранилище доступно
+	// только через tx.
+	WithTx(ctx context.Context, fn func(tx Store) error) error
 }
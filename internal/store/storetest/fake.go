@@ -0,0 +1,294 @@
+// Package storetest хранилище для тестов обработчиков: данные в памяти,
+// ошибки методов и недоступность хранилища задаются тестом.
+package storetest
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go-musthave-devops-trainer/internal/store"
+	"go-musthave-devops-trainer/models"
+)
+
+// Методы, для которых можно задать ошибку через FailWith.
+const (
+	MethodGet        = "Get"
+	MethodExists     = "Exists"
+	MethodCount      = "Count"
+	MethodIncrAndGet = "IncrAndGet"
+	MethodPing       = "Ping"
+	MethodClose      = "Close"
+)
+
+// Fake реализует store.Store, store.Health и store.CardinalityChecker.
+type Fake struct {
+	mu          sync.Mutex
+	counters    map[string]int64
+	gauges      map[string]float64
+	errs        map[string]error
+	degraded    bool
+	updateCount int
+	tstamp      time.Time
+}
+
+var (
+	_ store.Store  = (*Fake)(nil)
+	_ store.Health = (*Fake)(nil)
+
+	_ store.CardinalityChecker = (*Fake)(nil)
+)
+
+func NewFake() *Fake {
+	return &Fake{
+		counters: make(map[string]int64),
+		gauges:   make(map[string]float64),
+		errs:     make(map[string]error),
+	}
+}
+
+// SetCounter задает значение счетчика, не считая его обновлением.
+func (f *Fake) SetCounter(id string, value int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.counters[id] = value
+}
+
+// SetGauge задает значение датчика, не считая его обновлением.
+func (f *Fake) SetGauge(id string, value float64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.gauges[id] = value
+}
+
+// FailWith заставляет метод (MethodGet, MethodPing...) возвращать err,
+// nil отменяет ошибку.
+func (f *Fake) FailWith(method string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.errs, method)
+		return
+	}
+	f.errs[method] = err
+}
+
+// SetDegraded переводит хранилище в состояние недоступности.
+func (f *Fake) SetDegraded(degraded bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.degraded = degraded
+}
+
+func (f *Fake) Degraded() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.degraded
+}
+
+func (f *Fake) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.errs[MethodClose]
+}
+
+func (f *Fake) Ping(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.errs[MethodPing]
+}
+
+func (f *Fake) UpdateGauge(ctx context.Context, id string, value float64) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.gauges[id] = value
+	f.updated()
+	return f.updateCount
+}
+
+func (f *Fake) Gauge(ctx context.Context, id string) (float64, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.gauges[id]
+	return v, ok
+}
+
+func (f *Fake) UpdateCounter(ctx context.Context, id string, delta int64) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.counters[id] += delta
+	f.updated()
+	return f.updateCount
+}
+
+func (f *Fake) Counter(ctx context.Context, id string) (int64, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.counters[id]
+	return v, ok
+}
+
+func (f *Fake) DeleteCounter(ctx context.Context, id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.counters[id]; !ok {
+		return false
+	}
+	delete(f.counters, id)
+	f.updated()
+	return true
+}
+
+func (f *Fake) DeleteGauge(ctx context.Context, id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.gauges[id]; !ok {
+		return false
+	}
+	delete(f.gauges, id)
+	f.updated()
+	return true
+}
+
+func (f *Fake) IncrAndGet(ctx context.Context, id string, delta int64) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.errs[MethodIncrAndGet]; err != nil {
+		return 0, err
+	}
+	f.counters[id] += delta
+	f.updated()
+	return f.counters[id], nil
+}
+
+func (f *Fake) Get(ctx context.Context, mtype, id string) (models.Metrics, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m := models.Metrics{ID: id, MType: mtype}
+	if err := f.errs[MethodGet]; err != nil {
+		return m, false, err
+	}
+	switch mtype {
+	case models.Counter:
+		v, ok := f.counters[id]
+		if ok {
+			m.Delta = &v
+		}
+		return m, ok, nil
+	case models.Gauge:
+		v, ok := f.gauges[id]
+		if ok {
+			m.Value = &v
+		}
+		return m, ok, nil
+	}
+	return m, false, store.ErrUnknownType
+}
+
+func (f *Fake) Exists(ctx context.Context, mtype, id string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.errs[MethodExists]; err != nil {
+		return false, err
+	}
+	switch mtype {
+	case models.Counter:
+		_, ok := f.counters[id]
+		return ok, nil
+	case models.Gauge:
+		_, ok := f.gauges[id]
+		return ok, nil
+	}
+	return false, store.ErrUnknownType
+}
+
+func (f *Fake) CountCounters(ctx context.Context) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.counters)
+}
+
+func (f *Fake) CountGauges(ctx context.Context) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.gauges)
+}
+
+func (f *Fake) Count(ctx context.Context, mtype string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.errs[MethodCount]; err != nil {
+		return 0, err
+	}
+	if mtype == models.Counter {
+		return len(f.counters), nil
+	}
+	return len(f.gauges), nil
+}
+
+func (f *Fake) Timestamp(ctx context.Context, layout string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tstamp.Format(layout)
+}
+
+func (f *Fake) UpdateCount(ctx context.Context) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.updateCount
+}
+
+func (f *Fake) MapOrderedCounter(ctx context.Context, fun func(k string, v int64)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := []string{}
+	for k := range f.counters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fun(k, f.counters[k])
+	}
+}
+
+func (f *Fake) MapOrderedGauge(ctx context.Context, fun func(k string, v float64)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := []string{}
+	for k := range f.gauges {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fun(k, f.gauges[k])
+	}
+}
+
+func (f *Fake) updated() {
+	f.updateCount++
+	f.tstamp = time.Now()
+}
+
+// WithTx выполняет fn над самим Fake без изоляции: при ошибке fn
+// значения метрик восстанавливаются такими, какими были до вызова.
+func (f *Fake) WithTx(ctx context.Context, fn func(tx store.Store) error) error {
+	f.mu.Lock()
+	counters := make(map[string]int64, len(f.counters))
+	for k, v := range f.counters {
+		counters[k] = v
+	}
+	gauges := make(map[string]float64, len(f.gauges))
+	for k, v := range f.gauges {
+		gauges[k] = v
+	}
+	f.mu.Unlock()
+
+	if err := fn(f); err != nil {
+		f.mu.Lock()
+		f.counters, f.gauges = counters, gauges
+		f.mu.Unlock()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+// Package wire компактный двоичный формат передачи []models.Metrics.
+//
+// Формат: количество метрик (uvarint), затем для каждой метрики
+// ID и тип (строки с длиной в uvarint), байт флагов заданных полей
+// и сами поля: delta (varint), value (8 байт, IEEE 754, big endian),
+// hash (строка), signed_at (varint), observed_at (varint),
+// sample_rate (8 байт, IEEE 754, big endian), tags (количество в uvarint,
+// затем пары имя-значение, отсортированные по имени).
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"go-musthave-devops-trainer/models"
+)
+
+// ContentType тип содержимого запроса в двоичном формате.
+const ContentType = "application/octet-stream"
+
+const (
+	flagDelta = 1 << iota
+	flagValue
+	flagHash
+	flagSignedAt
+	flagObservedAt
+	flagSampleRate
+	flagTags
+
+	knownFlags = flagDelta | flagValue | flagHash | flagSignedAt | flagObservedAt | flagSampleRate | flagTags
+)
+
+const (
+	// maxStringLen ограничение длины строки, что бы поврежденные данные
+	// не приводили к выделению большого объема памяти.
+	maxStringLen = 64 << 10
+	// maxPrealloc сколько метрик выделять заранее, независимо от заявленного количества.
+	maxPrealloc = 1024
+	// maxTags ограничение количества тегов одной метрики.
+	maxTags = 64
+)
+
+var ErrMalformed = errors.New("malformed binary metrics")
+
+// Encode записывает метрики в двоичном формате.
+func Encode(w io.Writer, metrics []models.Metrics) error {
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, binary.MaxVarintLen64)
+
+	putUvarint := func(v uint64) {
+		n := binary.PutUvarint(buf, v)
+		_, _ = bw.Write(buf[:n])
+	}
+	putString := func(s string) {
+		putUvarint(uint64(len(s)))
+		_, _ = bw.WriteString(s)
+	}
+
+	putUvarint(uint64(len(metrics)))
+	for _, m := range metrics {
+		putString(m.ID)
+		putString(m.MType)
+
+		var flags byte
+		if m.Delta != nil {
+			flags |= flagDelta
+		}
+		if m.Value != nil {
+			flags |= flagValue
+		}
+		if m.Hash != "" {
+			flags |= flagHash
+		}
+		if m.SignedAt != 0 {
+			flags |= flagSignedAt
+		}
+		if m.ObservedAt != 0 {
+			flags |= flagObservedAt
+		}
+		if m.SampleRate != 0 {
+			flags |= flagSampleRate
+		}
+		if len(m.Tags) > 0 {
+			flags |= flagTags
+		}
+		_ = bw.WriteByte(flags)
+
+		if m.Delta != nil {
+			n := binary.PutVarint(buf, *m.Delta)
+			_, _ = bw.Write(buf[:n])
+		}
+		if m.Value != nil {
+			binary.BigEndian.PutUint64(buf, math.Float64bits(*m.Value))
+			_, _ = bw.Write(buf[:8])
+		}
+		if m.Hash != "" {
+			putString(m.Hash)
+		}
+		if m.SignedAt != 0 {
+			n := binary.PutVarint(buf, m.SignedAt)
+			_, _ = bw.Write(buf[:n])
+		}
+		if m.ObservedAt != 0 {
+			n := binary.PutVarint(buf, m.ObservedAt)
+			_, _ = bw.Write(buf[:n])
+		}
+		if m.SampleRate != 0 {
+			binary.BigEndian.PutUint64(buf, math.Float64bits(m.SampleRate))
+			_, _ = bw.Write(buf[:8])
+		}
+		if len(m.Tags) > 0 {
+			keys := make([]string, 0, len(m.Tags))
+			for k := range m.Tags {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			putUvarint(uint64(len(keys)))
+			for _, k := range keys {
+				putString(k)
+				putString(m.Tags[k])
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// Decode читает метрики в двоичном формате. Данные после последней
+// метрики считаются ошибкой.
+func Decode(r io.Reader) ([]models.Metrics, error) {
+	br := bufio.NewReader(r)
+	metrics, err := decode(br)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, fmt.Errorf("%w: unexpected end of data", ErrMalformed)
+		}
+		return nil, err
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		return nil, fmt.Errorf("%w: trailing data", ErrMalformed)
+	}
+	return metrics, nil
+}
+
+func decode(br *bufio.Reader) ([]models.Metrics, error) {
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	prealloc := count
+	if prealloc > maxPrealloc {
+		prealloc = maxPrealloc
+	}
+	metrics := make([]models.Metrics, 0, prealloc)
+
+	for i := uint64(0); i < count; i++ {
+		var m models.Metrics
+		if m.ID, err = readString(br); err != nil {
+			return nil, err
+		}
+		if m.MType, err = readString(br); err != nil {
+			return nil, err
+		}
+		flags, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if flags&^knownFlags != 0 {
+			return nil, fmt.Errorf("%w: unknown flags %#x", ErrMalformed, flags)
+		}
+
+		if flags&flagDelta != 0 {
+			delta, err := binary.ReadVarint(br)
+			if err != nil {
+				return nil, err
+			}
+			m.Delta = &delta
+		}
+		if flags&flagValue != 0 {
+			value, err := readFloat(br)
+			if err != nil {
+				return nil, err
+			}
+			m.Value = &value
+		}
+		if flags&flagHash != 0 {
+			if m.Hash, err = readString(br); err != nil {
+				return nil, err
+			}
+		}
+		if flags&flagSignedAt != 0 {
+			if m.SignedAt, err = binary.ReadVarint(br); err != nil {
+				return nil, err
+			}
+		}
+		if flags&flagObservedAt != 0 {
+			if m.ObservedAt, err = binary.ReadVarint(br); err != nil {
+				return nil, err
+			}
+		}
+		if flags&flagSampleRate != 0 {
+			if m.SampleRate, err = readFloat(br); err != nil {
+				return nil, err
+			}
+		}
+		if flags&flagTags != 0 {
+			if m.Tags, err = readTags(br); err != nil {
+				return nil, err
+			}
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+func readString(br *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return "", err
+	}
+	if n > maxStringLen {
+		return "", fmt.Errorf("%w: string too long: %d", ErrMalformed, n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func readFloat(br *bufio.Reader) (float64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(br, b[:]); err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(b[:])), nil
+}
+
+func readTags(br *bufio.Reader) (map[string]string, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxTags {
+		return nil, fmt.Errorf("%w: too many tags: %d", ErrMalformed, n)
+	}
+	tags := make(map[string]string, n)
+	for i := uint64(0); i < n; i++ {
+		k, err := readString(br)
+		if err != nil {
+			return nil, err
+		}
+		if tags[k], err = readString(br); err != nil {
+			return nil, err
+		}
+	}
+	return tags, nil
+}
@@ -0,0 +1,133 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"go-musthave-devops-trainer/models"
+)
+
+func testMetrics(n int) []models.Metrics {
+	metrics := make([]models.Metrics, 0, n)
+	for i := 0; i < n; i++ {
+		delta := int64(i)
+		value := float64(i) * 1.5
+		metrics = append(metrics,
+			models.Metrics{ID: fmt.Sprintf("Counter%d", i), MType: models.Counter, Delta: &delta,
+				Hash: "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", SignedAt: 1651406400, ObservedAt: 1651406399123},
+			models.Metrics{ID: fmt.Sprintf("Gauge%d", i), MType: models.Gauge, Value: &value})
+	}
+	return metrics
+}
+
+func TestRoundTrip(t *testing.T) {
+	delta, value, nan := int64(-1<<53-1), math.Inf(-1), math.NaN()
+	tests := []struct {
+		name    string
+		metrics []models.Metrics
+	}{
+		{"empty", []models.Metrics{}},
+		{"batch", testMetrics(10)},
+		{"int gauge", []models.Metrics{{ID: "LastGC", MType: models.Gauge, Delta: &delta}}},
+		{"special values", []models.Metrics{{ID: "g", MType: models.Gauge, Value: &value}}},
+		{"no value", []models.Metrics{{ID: "h", MType: "histogram"}}},
+		{"tags", []models.Metrics{{ID: "c", MType: models.Counter, Delta: &delta, Tags: map[string]string{"host": "a", "instance": "b"}}}},
+		{"sampled counter", []models.Metrics{{ID: "c", MType: models.Counter, Delta: &delta, SampleRate: 0.01}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Encode(&buf, tt.metrics); err != nil {
+				t.Fatal(err)
+			}
+			got, err := Decode(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.metrics) {
+				t.Errorf("want %+v, got %+v", tt.metrics, got)
+			}
+		})
+	}
+
+	// NaN не равен сам себе, поэтому проверяется отдельно.
+	var buf bytes.Buffer
+	if err := Encode(&buf, []models.Metrics{{ID: "g", MType: models.Gauge, Value: &nan}}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Decode(&buf)
+	if err != nil || len(got) != 1 || !math.IsNaN(*got[0].Value) {
+		t.Errorf("NaN expected, got %+v, %v", got, err)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, testMetrics(2)); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.Bytes()
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated", valid[:len(valid)-3]},
+		{"trailing data", append(append([]byte{}, valid...), 0)},
+		{"huge string", []byte{1, 0xff, 0xff, 0xff, 0xff, 0x0f}},
+		{"unknown flags", []byte{1, 1, 'c', 1, 'g', 0x80}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Decode(bytes.NewReader(tt.data)); !errors.Is(err, ErrMalformed) {
+				t.Errorf("want ErrMalformed, got %v", err)
+			}
+		})
+	}
+}
+
+// Сравнение с JSON: go test -bench . -benchmem ./internal/wire
+func BenchmarkEncode(b *testing.B) {
+	metrics := testMetrics(100)
+	b.Run("binary", func(b *testing.B) {
+		var buf bytes.Buffer
+		for i := 0; i < b.N; i++ {
+			buf.Reset()
+			_ = Encode(&buf, metrics)
+		}
+		b.ReportMetric(float64(buf.Len()), "bytes/batch")
+	})
+	b.Run("json", func(b *testing.B) {
+		var data []byte
+		for i := 0; i < b.N; i++ {
+			data, _ = json.Marshal(metrics)
+		}
+		b.ReportMetric(float64(len(data)), "bytes/batch")
+	})
+}
+
+func BenchmarkDecode(b *testing.B) {
+	metrics := testMetrics(100)
+	var buf bytes.Buffer
+	_ = Encode(&buf, metrics)
+	binData := buf.Bytes()
+	jsonData, _ := json.Marshal(metrics)
+
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, _ = Decode(bytes.NewReader(binData))
+		}
+	})
+	b.Run("json", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var got []models.Metrics
+			_ = json.Unmarshal(jsonData, &got)
+		}
+	})
+}
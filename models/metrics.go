@@ -5,6 +5,22 @@ const (
 	Gauge   = "gauge"
 )
 
+// Заголовки нумерации пачек: идентификатор экземпляра агента и номер
+// пачки, по пропускам в номерах сервер обнаруживает потерянные пачки.
+const (
+	HeaderReporterID = "X-Reporter-Id"
+	HeaderSequence   = "X-Report-Sequence"
+)
+
+// Заголовки идемпотентности: запрос записи с ключом, уже обработанным
+// сервером, не применяется повторно, ответ на него помечается HeaderReportReplayed.
+// Стандартный Idempotency-Key не используется: с ним http.Transport сам
+// повторяет POST, в обход настроенных повторов агента.
+const (
+	HeaderReportKey      = "X-Report-Key"
+	HeaderReportReplayed = "X-Report-Replayed"
+)
+
 // NOTE: Не усложняем пример, вводя иерархическую вложенность структур.
 // Органичиваясь плоской моделью.
 // Delta и Value объявлены через указатели,
@@ -16,4 +32,15 @@ type Metrics struct {
 	Delta *int64   `json:"delta,omitempty"`
 	Value *float64 `json:"value,omitempty"`
 	Hash  string   `json:"hash,omitempty"`
+	// SignedAt время подписи метрики (unix, секунды), входит в подпись
+	// и позволяет серверу отклонять повторно отправленные старые метрики.
+	SignedAt int64 `json:"signed_at,omitempty"`
+	// ObservedAt время измерения значения агентом (unix, миллисекунды).
+	ObservedAt int64 `json:"observed_at,omitempty"`
+	// SampleRate доля увеличений счетчика, учтенных агентом (0 < rate <= 1),
+	// сервер делит на нее delta. Не задана (0) - учтены все увеличения.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+	// Tags теги метрики, сервер хранит метрики с разными тегами
+	// отдельно (см. SeriesID).
+	Tags map[string]string `json:"tags,omitempty"`
 }
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"sort"
+	"strings"
+)
+
+// tagSpecial символы, которые не могут входить в имена и значения тегов,
+// что бы имя ряда однозначно разбиралось.
+const tagSpecial = "{}=,"
+
+// ValidTags проверяет имена и значения тегов: имя не пустое, служебные
+// символы {}=, не используются.
+func ValidTags(tags map[string]string) bool {
+	for k, v := range tags {
+		if k == "" || strings.ContainsAny(k, tagSpecial) || strings.ContainsAny(v, tagSpecial) {
+			return false
+		}
+	}
+	return true
+}
+
+// SeriesID имя, под которым хранится метрика с тегами: имя метрики
+// и теги, отсортированные по имени, в фигурных скобках, например
+// PollCount{host=a,instance=b}. Без тегов совпадает с именем метрики.
+func SeriesID(id string, tags map[string]string) string {
+	if len(tags) == 0 {
+		return id
+	}
+	return id + "{" + JoinTags(tags) + "}"
+}
+
+// JoinTags теги в виде k1=v1,k2=v2, отсортированные по имени.
+func JoinTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(tags[k])
+	}
+	return b.String()
+}
+
+// ParseSeriesID разбирает имя ряда, полученное SeriesID. Строка без
+// тегов в фигурных скобках возвращается как имя метрики без тегов.
+func ParseSeriesID(series string) (string, map[string]string) {
+	open := strings.IndexByte(series, '{')
+	if open <= 0 || !strings.HasSuffix(series, "}") {
+		return series, nil
+	}
+	list := series[open+1 : len(series)-1]
+	if list == "" {
+		return series, nil
+	}
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(list, ",") {
+		k, v, found := strings.Cut(pair, "=")
+		if !found {
+			return series, nil
+		}
+		tags[k] = v
+	}
+	if !ValidTags(tags) {
+		return series, nil
+	}
+	return series[:open], tags
+}